@@ -5,12 +5,11 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
-	"math"
 	"os"
+	"play/quadrature"
 	"strconv"
 	"strings"
 	"time"
-	"unsafe"
 
 	"gonum.org/v1/gonum/mat"
 )
@@ -115,50 +114,9 @@ func gauss3D(nx, ny, nz int) (pos []Vec, w []float64) {
 	return pos, w
 }
 
+// gauss1D returns the n point Gauss-Legendre rule on [-1, 1].
 func gauss1D(n int) (x, w []float64) {
-	switch n {
-	case 1:
-		x = []float64{0}
-		w = []float64{2}
-	case 2:
-		a := math.Sqrt(3) / 3
-		x = []float64{-a, a}
-		w = []float64{1, 1}
-	case 3:
-		a := math.Sqrt(3.0 / 5.0)
-		x = []float64{-a, 0, a}
-		w = []float64{5 / 9, 8 / 9, 5 / 9}
-	case 4:
-		sqrt := 2 * math.Sqrt(6/5)
-		sqrt30 := math.Sqrt(30)
-		a := math.Sqrt((3 - sqrt) / 7)
-		b := math.Sqrt((3 + sqrt) / 7)
-		wa := (18 + sqrt30) / 36
-		wb := (18 - sqrt30) / 36
-		x = []float64{-b, -a, a, b}
-		w = []float64{wb, wa, wa, wb}
-	case 5:
-		sqrt107 := 2 * math.Sqrt(10.0/7.0)
-		sqrt70 := math.Sqrt(70)
-		a := 1.0 / 3 * math.Sqrt(5-2*sqrt107)
-		b := 1.0 / 3 * math.Sqrt(5+2*sqrt107)
-		wa := (322 + 13*sqrt70) / 900
-		wb := (322 - 13*sqrt70) / 900
-		x = []float64{-b, -a, 0, a, b}
-		w = []float64{wb, wa, 128 / 225, wa, wb}
-	case 6:
-		a := 0.932469514203152
-		b := 0.661209386466265
-		c := 0.238619186083197
-		wa := 0.171324492379170
-		wb := 0.360761573048139
-		wc := 0.467913934572691
-		x = []float64{-a, -b, -c, c, b, a}
-		w = []float64{wa, wb, wc, wc, wb, wa}
-	default:
-		panic("bad argument to Gauss1D")
-	}
-	return x, w
+	return quadrature.Legendre(n)
 }
 
 func h8FormFuncs(ksi, eta, dseta float64) []float64 {
@@ -196,15 +154,12 @@ func storeElemDofs(dst []int, elem []int, ndofPerNode int) {
 	if len(dst) != len(elem)*ndofPerNode {
 		panic("bad length")
 	}
-	if ndofPerNode != 3 {
-		panic("only works for 3 dimensions for now")
-	}
 	for i, node := range elem {
 		id := i * ndofPerNode
 		nodeDof := node * ndofPerNode
-		dst[id] = nodeDof
-		dst[id+1] = nodeDof + 1
-		dst[id+2] = nodeDof + 2
+		for d := 0; d < ndofPerNode; d++ {
+			dst[id+d] = nodeDof + d
+		}
 	}
 }
 
@@ -251,40 +206,46 @@ func findNodes(nodes []Vec, f func(n Vec) bool) (idxs []int) {
 	return idxs
 }
 
-func constrainRUCEdge(NN *mat.Dense, nodes []Vec, e1, e2 []int, rows, crossDim int, modelSize Vec) (proc int) {
-	if crossDim < 0 || crossDim > 2 {
-		panic("bad cross dimension (0,1,2 corresponds to X,Y,Z")
-	}
-	const (
-		VecSize   = unsafe.Sizeof(Vec{})
-		VecOffset = unsafe.Alignof(Vec{}.X)
-	)
-	rowsStart := rows
-	nodePtr := uintptr(unsafe.Pointer(&nodes[0]))
-	offset := uintptr(VecOffset * uintptr(crossDim))
-	modelPtr := uintptr(unsafe.Pointer(&modelSize))
-	modelDim := *(*float64)(unsafe.Pointer(modelPtr + offset))
-	for _, i1 := range e1 {
-		// very unsafe. very sharp.
-		pdim := *(*float64)(unsafe.Pointer(nodePtr + VecSize*uintptr(i1) + offset))
-		for _, i2 := range e2 {
-			Pdim := *(*float64)(unsafe.Pointer(nodePtr + VecSize*uintptr(i2) + offset))
-			if pdim == Pdim && 0 < pdim && pdim < modelDim {
-				constrainDisplacements(NN, rows, i1, i2)
-				rows++
-			}
+// findElems returns the indices of the elements for which f returns
+// true when called with the element's centroid.
+func findElems(nodes []Vec, elems [][]int, f func(centroid Vec) bool) (idxs []int) {
+	for i, elem := range elems {
+		var c Vec
+		for _, n := range elem {
+			c = Add(c, nodes[n])
+		}
+		if f(Scale(1.0/float64(len(elem)), c)) {
+			idxs = append(idxs, i)
 		}
 	}
-	return rows - rowsStart
+	return idxs
 }
 
-func constrainDisplacements(NN *mat.Dense, r, i1, i2 int) {
-	NN.Set(r*3, i1*3, -1)
-	NN.Set(r*3, i2*3, 1)
-	NN.Set(r*3+1, i1*3+1, -1)
-	NN.Set(r*3+1, i2*3+1, 1)
-	NN.Set(r*3+2, i1*3+2, -1)
-	NN.Set(r*3+2, i2*3+2, 1)
+// hexaGrid returns a structured mesh of div[0]×div[1]×div[2] Hex8 elements
+// filling box.
+func hexaGrid(box Box, div [3]int) (nodes []Vec, elems [][]int) {
+	sz := box.Size()
+	d := Vec{X: sz.X / float64(div[0]), Y: sz.Y / float64(div[1]), Z: sz.Z / float64(div[2])}
+	idx := func(i, j, k int) int { return (k*(div[1]+1)+j)*(div[0]+1) + i }
+	for k := 0; k <= div[2]; k++ {
+		for j := 0; j <= div[1]; j++ {
+			for i := 0; i <= div[0]; i++ {
+				nodes = append(nodes, Add(box.Min, Vec{X: float64(i) * d.X, Y: float64(j) * d.Y, Z: float64(k) * d.Z}))
+			}
+		}
+	}
+	for k := 0; k < div[2]; k++ {
+		for j := 0; j < div[1]; j++ {
+			for i := 0; i < div[0]; i++ {
+				// Same vertex ordering as Box.Vertices.
+				elems = append(elems, []int{
+					idx(i, j, k), idx(i+1, j, k), idx(i+1, j+1, k), idx(i, j+1, k),
+					idx(i, j, k+1), idx(i+1, j, k+1), idx(i+1, j+1, k+1), idx(i, j+1, k+1),
+				})
+			}
+		}
+	}
+	return nodes, elems
 }
 
 func booleanSetVec(dst *mat.VecDense, src mat.Vector, inv bool, br []bool) {
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// AssembleStiffness returns the global stiffness matrix of model. Degrees of
+// freedom are the X, Y and Z displacements of each node, node i owning
+// degrees of freedom 3*i to 3*i+2.
+func AssembleStiffness(model FEModel, materials []Material) (*CSR, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return nil, err
+	}
+	return assembleStiffness(model, elemC), nil
+}
+
+// assembleStiffness assembles the element stiffness matrices in parallel
+// into the sparsity pattern of model.
+func assembleStiffness(model FEModel, elemC []*mat.Dense) *CSR {
+	elem := model.element()
+	nn := elem.NumNodes()
+	ne := 3 * nn
+	a := newElemAssembly(model, 3, false)
+	K := a.matrix()
+	parallelColors(a.colors, func() func(int) {
+		integ := newElementIntegrator(elem)
+		Ke := mat.NewDense(ne, ne, nil)
+		enod := make([]Vec, nn)
+		edofs := make([]int, ne)
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			integ.stiffness(Ke, enod, elemC[iele])
+			storeElemDofs(edofs, enodes, 3)
+			K.addSub(edofs, Ke)
+		}
+	})
+	return K
+}
+
+// AssembleMass returns the global mass matrix of model with the degrees of
+// freedom of AssembleStiffness. The density of each element is taken from its
+// material. If lumped is true the diagonal mass matrix obtained by HRZ lumping
+// is returned: the diagonal of each consistent element mass matrix is scaled to
+// preserve the element mass. Unlike row sum lumping HRZ lumping keeps all nodal
+// masses positive for quadratic elements.
+func AssembleMass(model FEModel, materials []Material, lumped bool) (*CSR, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	density, err := model.elemProperty(materials, func(m Material) float64 { return m.Density })
+	if err != nil {
+		return nil, err
+	}
+	return assembleMass(model, density, 3, lumped), nil
+}
+
+// assembleMass returns the mass matrix of a field with ndof degrees of freedom
+// per node given the mass per unit volume of each element.
+func assembleMass(model FEModel, density []float64, ndof int, lumped bool) *CSR {
+	elem := model.element()
+	nn := elem.NumNodes()
+	upg, wpg := massQuadrature(elem)
+	ne := ndof * nn
+	a := newElemAssembly(model, ndof, lumped)
+	M := a.matrix()
+	parallelColors(a.colors, func() func(int) {
+		integ := newElementIntegratorRule(elem, upg, wpg)
+		Me := mat.NewDense(ne, ne, nil)
+		enod := make([]Vec, nn)
+		edofs := make([]int, ne)
+		diag := make([]float64, ne)
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			integ.mass(Me, enod, density[iele], ndof)
+			storeElemDofs(edofs, enodes, ndof)
+			if !lumped {
+				M.addSub(edofs, Me)
+				return
+			}
+			// The mass of the element is the sum of all entries of one direction.
+			var total, trace float64
+			for i := 0; i < nn; i++ {
+				trace += Me.At(ndof*i, ndof*i)
+				for j := 0; j < nn; j++ {
+					total += Me.At(ndof*i, ndof*j)
+				}
+			}
+			for i := range diag {
+				diag[i] = 0
+				if trace != 0 { // Massless elements add nothing.
+					diag[i] = Me.At(i, i) * total / trace
+				}
+			}
+			M.addDiag(edofs, diag)
+		}
+	})
+	return M
+}
+
+// elemAssembly assembles matrices of a field with ndof degrees of freedom per
+// node of a model directly in CSR format. The sparsity pattern is computed
+// once from the element connectivity and shared by every matrix of the
+// assembly. Elements are grouped in colors of elements without a common node
+// so that element matrices are added in parallel with parallelColors.
+type elemAssembly struct {
+	n      int
+	indptr []int
+	ind    []int
+	colors [][]int
+}
+
+// newElemAssembly returns the assembly of a field with ndof degrees of freedom
+// per node of model. If diagonal is true the matrices only hold the diagonal,
+// as lumped mass matrices do.
+func newElemAssembly(model FEModel, ndof int, diagonal bool) *elemAssembly {
+	nnodes := len(model.Nodes)
+	a := &elemAssembly{n: ndof * nnodes, indptr: make([]int, ndof*nnodes+1)}
+	// Elements of each node.
+	start := make([]int, nnodes+1)
+	for _, enodes := range model.Elems {
+		for _, n := range enodes {
+			start[n+1]++
+		}
+	}
+	for i := 0; i < nnodes; i++ {
+		start[i+1] += start[i]
+	}
+	nodeElems := make([]int, start[nnodes])
+	next := append([]int(nil), start[:nnodes]...)
+	for iele, enodes := range model.Elems {
+		for _, n := range enodes {
+			nodeElems[next[n]] = iele
+			next[n]++
+		}
+	}
+
+	// Greedy coloring in element order: each element takes the first color
+	// not taken by an element it shares a node with.
+	color := make([]int, len(model.Elems))
+	var taken []int // taken[c] == iele if color c is taken by a neighbor of iele.
+	for iele, enodes := range model.Elems {
+		for _, n := range enodes {
+			for _, other := range nodeElems[start[n]:start[n+1]] {
+				if other < iele {
+					taken[color[other]] = iele
+				}
+			}
+		}
+		c := 0
+		for c < len(taken) && taken[c] == iele {
+			c++
+		}
+		if c == len(taken) {
+			taken = append(taken, -1)
+			a.colors = append(a.colors, nil)
+		}
+		color[iele] = c
+		a.colors[c] = append(a.colors[c], iele)
+	}
+
+	if diagonal {
+		a.ind = make([]int, a.n)
+		for i := range a.ind {
+			a.ind[i] = i
+			a.indptr[i+1] = i + 1
+		}
+		return a
+	}
+	// Rows of a node hold the degrees of freedom of the nodes of its elements.
+	mark := make([]int, nnodes)
+	for i := range mark {
+		mark[i] = -1
+	}
+	var neighbors []int
+	storeNeighbors := func(node int) {
+		neighbors = neighbors[:0]
+		for _, iele := range nodeElems[start[node]:start[node+1]] {
+			for _, n := range model.Elems[iele] {
+				if mark[n] != node {
+					mark[n] = node
+					neighbors = append(neighbors, n)
+				}
+			}
+		}
+	}
+	for node := 0; node < nnodes; node++ {
+		storeNeighbors(node)
+		for d := 0; d < ndof; d++ {
+			row := ndof*node + d
+			a.indptr[row+1] = a.indptr[row] + ndof*len(neighbors)
+		}
+	}
+	for i := range mark {
+		mark[i] = -1
+	}
+	a.ind = make([]int, 0, a.indptr[a.n])
+	for node := 0; node < nnodes; node++ {
+		storeNeighbors(node)
+		sort.Ints(neighbors)
+		for d := 0; d < ndof; d++ {
+			for _, n := range neighbors {
+				for dd := 0; dd < ndof; dd++ {
+					a.ind = append(a.ind, ndof*n+dd)
+				}
+			}
+		}
+	}
+	return a
+}
+
+// matrix returns a zero matrix with the sparsity pattern of the assembly.
+func (a *elemAssembly) matrix() *CSR {
+	return &CSR{r: a.n, c: a.n, indptr: a.indptr, ind: a.ind, data: make([]float64, len(a.ind))}
+}
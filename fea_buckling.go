@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// BucklingSettings configures Buckling.
+type BucklingSettings struct {
+	// Modes is the number of buckling modes to compute. Defaults to 6.
+	Modes int
+	// Tolerance is the relative residual at which a mode is considered
+	// converged. Defaults to 1e-10.
+	Tolerance float64
+}
+
+// BucklingResult holds the buckling modes found by Buckling sorted by
+// ascending magnitude of their load factor.
+type BucklingResult struct {
+	// LoadFactors holds the factors λ by which the loads are multiplied to
+	// buckle the model. Negative factors buckle the model under reversed loads.
+	LoadFactors []float64
+	// Modes holds the mode shapes as columns, scaled to a largest displacement
+	// component of one. Rows are the degrees of freedom of the model.
+	Modes *mat.Dense
+	// Displacement holds the displacements of the linear static solution.
+	Displacement []float64
+}
+
+// AssembleGeometricStiffness returns the global geometric stiffness matrix of
+// model under the quadrature point stresses of stress, as returned by
+// RecoverStress, with the degrees of freedom of AssembleStiffness. It is the
+// change in stiffness due to the stress acting on the rotations of the
+// material, which softens compressed and stiffens tensioned parts.
+func AssembleGeometricStiffness(model FEModel, stress *StressResult) (*CSR, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	nq := len(newElementIntegrator(model.element()).upg)
+	if len(stress.GaussStress) != len(model.Elems) {
+		return nil, fmt.Errorf("got stresses of %d elements for %d elements: %w", len(stress.GaussStress), len(model.Elems), mat.ErrShape)
+	}
+	for iele, s := range stress.GaussStress {
+		if len(s) != nq {
+			return nil, fmt.Errorf("element %d has %d stresses for %d quadrature points: %w", iele, len(s), nq, mat.ErrShape)
+		}
+	}
+	return assembleGeometricStiffness(model, stress.GaussStress), nil
+}
+
+// assembleGeometricStiffness assembles the element geometric stiffness
+// matrices in parallel as assembleStiffness does.
+func assembleGeometricStiffness(model FEModel, stress [][][6]float64) *CSR {
+	elem := model.element()
+	nn := elem.NumNodes()
+	ne := 3 * nn
+	a := newElemAssembly(model, 3, false)
+	Kg := a.matrix()
+	parallelColors(a.colors, func() func(int) {
+		integ := newElementIntegrator(elem)
+		Ke := mat.NewDense(ne, ne, nil)
+		enod := make([]Vec, nn)
+		edofs := make([]int, ne)
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			integ.geometricStiffness(Ke, enod, stress[iele])
+			storeElemDofs(edofs, enodes, 3)
+			Kg.addSub(edofs, Ke)
+		}
+	})
+	return Kg
+}
+
+// Buckling solves the linear buckling problem of model under loads. The
+// stresses σ of the linear static solution give the geometric stiffness Kg
+// and the load factors λ and mode shapes φ solve
+//  (K + λ*Kg)*φ = 0
+// subject to the constraints of loads with zero values. Prescribed
+// displacements and thermal strains are part of the scaled loads. The
+// problem is solved as -Kg*φ = (1/λ)*K*φ with the Lanczos method in the K
+// inner product, K being factorized once, so the model must be supported
+// against rigid body motion. Constraints of loads are always enforced by
+// elimination.
+//
+// Linear buckling assumes the stresses grow in proportion to the loads and
+// ignores imperfections, so it overestimates the buckling load of structures
+// that are sensitive to them.
+func Buckling(model FEModel, materials []Material, loads StaticLoads, settings BucklingSettings) (BucklingResult, error) {
+	var result BucklingResult
+	u, err := SolveStatic(model, materials, loads)
+	if err != nil {
+		return result, err
+	}
+	stress, err := recoverStress(model, materials, u, loads.Temperature, loads.ReferenceTemperature)
+	if err != nil {
+		return result, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return result, err
+	}
+	K := assembleStiffness(model, elemC)
+	Kg := assembleGeometricStiffness(model, stress.GaussStress)
+	c, err := loads.constraints(len(model.Nodes))
+	if err != nil {
+		return result, err
+	}
+	c.Method = Elimination
+	sys, err := c.factorize(K)
+	if err != nil {
+		return result, err
+	}
+	nq := sys.nq()
+	nmodes := settings.Modes
+	if nmodes <= 0 {
+		nmodes = 6
+	}
+	if nmodes > nq {
+		nmodes = nq
+	}
+	tol := settings.Tolerance
+	if tol <= 0 {
+		tol = 1e-10
+	}
+	if nmodes == 0 {
+		return result, errors.New("model has no free degrees of freedom")
+	}
+	Kq, Gq := sys.reduceMatrix(K), sys.reduceMatrix(Kg)
+	Gx := make([]float64, nq)
+	mu, ritz, err := lanczos(Kq, func(dst, x, _ []float64) error {
+		Gq.MulVecTo(Gx, x)
+		floats.Scale(-1, Gx)
+		return sys.ldl.SolveVecTo(dst, Gx)
+	}, nmodes, tol)
+	if err != nil {
+		return result, err
+	}
+	result.LoadFactors = make([]float64, nmodes)
+	result.Modes = mat.NewDense(3*len(model.Nodes), nmodes, nil)
+	result.Displacement = u
+	for k := range mu {
+		result.LoadFactors[k] = 1 / mu[k]
+		phi := sys.expand(mat.Col(nil, k, ritz))
+		// Sign chosen so the largest component is positive.
+		scale := phi[floats.MaxIdx(phi)]
+		if min := phi[floats.MinIdx(phi)]; -min > scale {
+			scale = min
+		}
+		if scale != 0 && !math.IsNaN(scale) {
+			floats.Scale(1/scale, phi)
+		}
+		result.Modes.SetCol(k, phi)
+	}
+	return result, nil
+}
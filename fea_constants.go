@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// ElasticConstants holds the engineering constants of an orthotropic material
+// along its axes 1, 2 and 3, the x, y and z axes of its Voigt matrix.
+type ElasticConstants struct {
+	// E1, E2 and E3 are the Young's moduli along each axis.
+	E1, E2, E3 float64
+	// Nu12 to Nu32 are the Poisson ratios νᵢⱼ = -εⱼ/εᵢ under uniaxial stress
+	// along axis i. They satisfy νᵢⱼ/Eᵢ = νⱼᵢ/Eⱼ.
+	Nu12, Nu13, Nu23, Nu21, Nu31, Nu32 float64
+	// G12, G13 and G23 are the shear moduli of each plane.
+	G12, G13, G23 float64
+}
+
+// EngineeringConstants returns the engineering constants of the stiffness C
+// in Voigt notation, such as the effective stiffness returned by Homogenize.
+// It is the inverse of orthotropicCompliance, which builds C from them. The
+// constants are read off the compliance C⁻¹, so couplings between normal
+// and shear strains are ignored and the constants describe C exactly only
+// if it is orthotropic in its axes, which MaterialSymmetry measures. An error
+// is returned if C is not symmetric or not positive definite.
+func EngineeringConstants(C mat.Matrix) (ElasticConstants, error) {
+	var ec ElasticConstants
+	if r, c := C.Dims(); r != 6 || c != 6 {
+		return ec, fmt.Errorf("got %d×%d stiffness, want 6×6: %w", r, c, mat.ErrShape)
+	}
+	if asym := asymmetry(mandel(C)); asym > 1e-6 {
+		return ec, fmt.Errorf("stiffness not symmetric: relative asymmetry %g", asym)
+	}
+	sym := mat.NewSymDense(6, nil)
+	for i := 0; i < 6; i++ {
+		for j := i; j < 6; j++ {
+			sym.SetSym(i, j, (C.At(i, j)+C.At(j, i))/2)
+		}
+	}
+	var chol mat.Cholesky
+	if !chol.Factorize(sym) {
+		return ec, errors.New("stiffness not positive definite")
+	}
+	var S mat.SymDense
+	if err := chol.InverseTo(&S); err != nil {
+		return ec, err
+	}
+	// Under uniaxial stress σᵢ the strains are εⱼ = Sⱼᵢ*σᵢ.
+	nu := func(i, j int) float64 { return -S.At(j, i) / S.At(i, i) }
+	ec = ElasticConstants{
+		E1: 1 / S.At(0, 0), E2: 1 / S.At(1, 1), E3: 1 / S.At(2, 2),
+		Nu12: nu(0, 1), Nu13: nu(0, 2), Nu23: nu(1, 2),
+		Nu21: nu(1, 0), Nu31: nu(2, 0), Nu32: nu(2, 1),
+		G12: 1 / S.At(3, 3), G23: 1 / S.At(4, 4), G13: 1 / S.At(5, 5),
+	}
+	return ec, nil
+}
+
+// SymmetryDistance measures how far a stiffness is from the symmetry classes
+// of elastic materials in its axes. Distances are relative to the norm of the
+// stiffness tensor: zero if it belongs to the class and at most one. They are
+// Frobenius norms in Mandel notation, which are those of the tensors, of the
+// difference to the closest stiffness of the class.
+type SymmetryDistance struct {
+	// Asymmetry is the distance to the symmetric part of the stiffness, which
+	// should be round-off for stiffnesses derived from a strain energy. The
+	// other distances are those of the symmetric part.
+	Asymmetry float64
+	// Orthotropic is the distance to orthotropic stiffnesses whose planes of
+	// symmetry are normal to the axes.
+	Orthotropic float64
+	// TransverselyIsotropic is the distance to transversely isotropic
+	// stiffnesses whose axis of symmetry is Axis, the closest of x, y and z
+	// numbered from zero.
+	TransverselyIsotropic float64
+	Axis                  int
+	// Isotropic is the distance to isotropic stiffnesses.
+	Isotropic float64
+}
+
+// MaterialSymmetry returns the distances of the 6×6 Voigt stiffness C to the
+// orthotropic, transversely isotropic and isotropic symmetry classes. Axes
+// are not searched for, so a stiffness rotated off its axes of symmetry is
+// at a distance from its class.
+func MaterialSymmetry(C mat.Matrix) SymmetryDistance {
+	M := mandel(C)
+	var d SymmetryDistance
+	d.Asymmetry = asymmetry(M)
+	sym := mat.NewDense(6, 6, nil)
+	sym.Add(M, M.T())
+	sym.Scale(0.5, sym)
+
+	var ortho [][6][6]float64
+	for i := 0; i < 3; i++ {
+		for j := i; j < 3; j++ {
+			var b [6][6]float64
+			b[i][j], b[j][i] = 1, 1
+			ortho = append(ortho, b)
+		}
+		var b [6][6]float64
+		b[3+i][3+i] = 1
+		ortho = append(ortho, b)
+	}
+	d.Orthotropic = symmetryDistance(sym, ortho)
+
+	d.TransverselyIsotropic = math.Inf(1)
+	for axis := 0; axis < 3; axis++ {
+		// Isotropy in the plane of axes j and l makes its shear stiffness
+		// Cⱼⱼ - Cⱼₗ in Mandel notation.
+		j, l := (axis+1)%3, (axis+2)%3
+		s := shearIndex(j, l)
+		var a, b, c, e, g [6][6]float64
+		a[axis][axis] = 1
+		b[j][j], b[l][l], b[s][s] = 1, 1, 1
+		c[j][l], c[l][j], c[s][s] = 1, 1, -1
+		e[axis][j], e[j][axis], e[axis][l], e[l][axis] = 1, 1, 1, 1
+		g[shearIndex(axis, j)][shearIndex(axis, j)] = 1
+		g[shearIndex(axis, l)][shearIndex(axis, l)] = 1
+		if dist := symmetryDistance(sym, [][6][6]float64{a, b, c, e, g}); dist < d.TransverselyIsotropic {
+			d.TransverselyIsotropic, d.Axis = dist, axis
+		}
+	}
+
+	var volumetric, identity [6][6]float64
+	for i := 0; i < 6; i++ {
+		identity[i][i] = 1
+		for j := 0; j < 3 && i < 3; j++ {
+			volumetric[i][j] = 1
+		}
+	}
+	d.Isotropic = symmetryDistance(sym, [][6][6]float64{volumetric, identity})
+	return d
+}
+
+// symmetryDistance returns the relative distance of M to the closest linear
+// combination of basis, its orthogonal projection found by least squares.
+func symmetryDistance(M *mat.Dense, basis [][6][6]float64) float64 {
+	A := mat.NewDense(36, len(basis), nil)
+	for k, b := range basis {
+		for i := range b {
+			for j := range b[i] {
+				A.Set(6*i+j, k, b[i][j])
+			}
+		}
+	}
+	m := mat.NewVecDense(36, append([]float64(nil), M.RawMatrix().Data...))
+	norm := mat.Norm(m, 2)
+	if norm == 0 {
+		return 0
+	}
+	var x, r mat.VecDense
+	if err := x.SolveVec(A, m); err != nil {
+		panic(err)
+	}
+	r.MulVec(A, &x)
+	r.SubVec(m, &r)
+	return mat.Norm(&r, 2) / norm
+}
+
+// mandel returns the 6×6 Voigt stiffness C in Mandel notation, whose shear
+// rows and columns are scaled by √2 so that it has the norm of the tensor.
+func mandel(C mat.Matrix) *mat.Dense {
+	s := [6]float64{1, 1, 1, math.Sqrt2, math.Sqrt2, math.Sqrt2}
+	M := mat.NewDense(6, 6, nil)
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			M.Set(i, j, s[i]*s[j]*C.At(i, j))
+		}
+	}
+	return M
+}
+
+// asymmetry returns the norm of the antisymmetric part of the square matrix
+// A relative to the norm of A.
+func asymmetry(A mat.Matrix) float64 {
+	var sum, anti float64
+	n, _ := A.Dims()
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			sum += A.At(i, j) * A.At(i, j)
+			d := (A.At(i, j) - A.At(j, i)) / 2
+			anti += d * d
+		}
+	}
+	if sum == 0 {
+		return 0
+	}
+	return math.Sqrt(anti / sum)
+}
+
+// shearIndex returns the Voigt index of the shear component of the distinct
+// axes i and j.
+func shearIndex(i, j int) int {
+	for k := 3; k < 6; k++ {
+		if p := voigtPairs[k]; (p[0] == i && p[1] == j) || (p[0] == j && p[1] == i) {
+			return k
+		}
+	}
+	panic("no shear component of equal axes")
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ConstraintMethod selects how Constraints are enforced on a system of equations.
+type ConstraintMethod int
+
+const (
+	// Elimination expresses constrained degrees of freedom in terms of the
+	// remaining ones and removes them from the system. Constraints are
+	// satisfied exactly and a positive definite system stays positive definite.
+	Elimination ConstraintMethod = iota
+	// Penalty adds stiff springs that resist violation of the constraints.
+	// Constraints are satisfied approximately, the violation decreasing with
+	// the penalty factor, and the system keeps its size.
+	Penalty
+	// Lagrange adds a Lagrange multiplier per constraint. Constraints are
+	// satisfied exactly but the system is indefinite.
+	Lagrange
+)
+
+// Constraint is the linear multi-point constraint
+//  Σ Coefs[i]*u[Dofs[i]] = Value
+// When constraints are eliminated the first degree of freedom is preferred
+// as the dependent one.
+type Constraint struct {
+	Dofs  []int
+	Coefs []float64
+	Value float64
+}
+
+// Constraints holds the essential boundary conditions and multi-point
+// constraints of a model with a fixed number of degrees of freedom per node,
+// node i owning degrees of freedom ndof*i to ndof*i+ndof-1.
+type Constraints struct {
+	// Method is the enforcement method.
+	Method ConstraintMethod
+	// PenaltyFactor is the ratio of the penalty stiffness to the largest
+	// diagonal entry of the system matrix. Defaults to 1e8.
+	PenaltyFactor float64
+
+	nnodes, ndof int
+	// naux is the number of auxiliary degrees of freedom, numbered after
+	// the nodal ones, used to build constraints such as rigid links. They are
+	// eliminated from the constraints before solving.
+	naux int
+	eqs  []Constraint
+}
+
+// ConstraintError reports constraints that are linear combinations of the
+// constraints that precede them. Redundant constraints agree with the
+// preceding constraints and are dropped when solving. Conflicting constraints
+// contradict them and prevent solving.
+type ConstraintError struct {
+	Redundant   []int
+	Conflicting []int
+}
+
+func (e *ConstraintError) Error() string {
+	if len(e.Conflicting) > 0 {
+		return fmt.Sprintf("%d conflicting and %d redundant constraints, first conflict is constraint %d", len(e.Conflicting), len(e.Redundant), e.Conflicting[0])
+	}
+	return fmt.Sprintf("%d redundant constraints, first is constraint %d", len(e.Redundant), e.Redundant[0])
+}
+
+// NewConstraints returns an empty set of constraints for a model with nnodes
+// nodes and ndof degrees of freedom per node.
+func NewConstraints(nnodes, ndof int) *Constraints {
+	return &Constraints{nnodes: nnodes, ndof: ndof}
+}
+
+// Len returns the number of constraint equations.
+func (c *Constraints) Len() int { return len(c.eqs) }
+
+// Add adds the multi-point constraint con.
+func (c *Constraints) Add(con Constraint) {
+	c.eqs = append(c.eqs, con)
+}
+
+// Prescribe constrains degree of freedom dof to value.
+func (c *Constraints) Prescribe(dof int, value float64) {
+	c.Add(Constraint{Dofs: []int{dof}, Coefs: []float64{1}, Value: value})
+}
+
+// Fix constrains all degrees of freedom of nodes to zero.
+func (c *Constraints) Fix(nodes []int) {
+	for _, n := range nodes {
+		for d := 0; d < c.ndof; d++ {
+			c.Prescribe(c.ndof*n+d, 0)
+		}
+	}
+}
+
+// Symmetry constrains the displacement of nodes lying on a symmetry plane
+// with the given normal to the plane: u⋅normal = 0. Normals aligned with an
+// axis constrain a single degree of freedom per node.
+func (c *Constraints) Symmetry(nodes []int, normal Vec) {
+	c.mustDisplacement()
+	normal = Unit(normal)
+	for _, n := range nodes {
+		var con Constraint
+		// The largest component is listed first to be the dependent one.
+		order := [3]int{0, 1, 2}
+		sort.SliceStable(order[:], func(i, j int) bool {
+			return math.Abs(normal.component(order[i])) > math.Abs(normal.component(order[j]))
+		})
+		for _, d := range order {
+			if normal.component(d) != 0 {
+				con.Dofs = append(con.Dofs, 3*n+d)
+				con.Coefs = append(con.Coefs, normal.component(d))
+			}
+		}
+		c.Add(con)
+	}
+}
+
+// RigidLink constrains the slave nodes to move rigidly with the master node
+// under small rotations:
+//  u_slave = u_master + θ × (x_slave - x_master)
+// where θ is the unknown rotation of the link and positions are taken from nodes.
+// Solid elements have no rotational degrees of freedom so θ is determined
+// by the slaves alone.
+func (c *Constraints) RigidLink(nodes []Vec, master int, slaves []int) {
+	c.mustDisplacement()
+	theta := c.ndof*c.nnodes + c.naux
+	c.naux += 3
+	for _, s := range slaves {
+		r := Sub(nodes[s], nodes[master])
+		// Rows of the cross product matrix [θ×]r = -[r×]θ.
+		cross := [3]Vec{{Y: r.Z, Z: -r.Y}, {X: -r.Z, Z: r.X}, {X: r.Y, Y: -r.X}}
+		for d := 0; d < 3; d++ {
+			c.Add(Constraint{
+				Dofs:  []int{3*s + d, 3*master + d, theta, theta + 1, theta + 2},
+				Coefs: []float64{1, -1, cross[d].X, cross[d].Y, cross[d].Z},
+			})
+		}
+	}
+}
+
+func (c *Constraints) mustDisplacement() {
+	if c.ndof != 3 {
+		panic(fmt.Sprintf("displacement constraint on model with %d degrees of freedom per node", c.ndof))
+	}
+}
+
+// Validate checks constraint degrees of freedom are in range and returns a
+// *ConstraintError if there are redundant or conflicting constraints.
+func (c *Constraints) Validate() error {
+	red, err := c.reduce(nil)
+	if err != nil {
+		return err
+	}
+	if len(red.redundant) > 0 {
+		return &ConstraintError{Redundant: red.redundant}
+	}
+	return nil
+}
+
+// reducedConstraint is a constraint solved for its pivot degree of freedom,
+// whose coefficient in row is 1. The value of the constraint is the
+// combination comb of the values of the original constraints.
+type reducedConstraint struct {
+	pivot int
+	row   sparseRow
+	comb  sparseRow
+}
+
+// reduction is the reduced row echelon form of a set of constraints. Each
+// pivot appears in a single constraint and no auxiliary degree of freedom
+// appears in the constraints.
+type reduction struct {
+	rows      []reducedConstraint
+	redundant []int
+}
+
+// reduce brings the constraints to reduced row echelon form with Gaussian
+// elimination, eliminating auxiliary degrees of freedom first. Constraints
+// that reduce to zero are redundant if their reduced value is zero and are
+// conflicting otherwise. values overrides the constraint values if not nil.
+func (c *Constraints) reduce(values []float64) (*reduction, error) {
+	if values == nil {
+		values = c.values()
+	}
+	nfield := c.ndof * c.nnodes
+	ndofs := nfield + c.naux
+	var (
+		rows        []reducedConstraint
+		pivotRow    = make(map[int]int)
+		colRows     = make(map[int][]int) // Rows in which each degree of freedom may appear.
+		redundant   []int
+		conflicting []int
+	)
+	for k, con := range c.eqs {
+		if len(con.Dofs) != len(con.Coefs) {
+			return nil, fmt.Errorf("constraint %d has %d degrees of freedom and %d coefficients", k, len(con.Dofs), len(con.Coefs))
+		}
+		for _, dof := range con.Dofs {
+			if dof < 0 || dof >= ndofs {
+				return nil, fmt.Errorf("constraint %d degree of freedom %d out of range [0,%d) of %d nodal and %d auxiliary degrees of freedom", k, dof, ndofs, nfield, c.naux)
+			}
+		}
+		row := newSparseRow(con.Dofs, con.Coefs)
+		comb := sparseRow{idx: []int{k}, val: []float64{1}}
+		scale := row.maxAbs()
+		for _, dof := range append([]int(nil), row.idx...) {
+			if r, ok := pivotRow[dof]; ok {
+				a := row.at(dof)
+				row = row.axpy(-a, rows[r].row)
+				comb = comb.axpy(-a, rows[r].comb)
+			}
+		}
+		row = row.drop(1e-10 * scale)
+		if len(row.idx) == 0 {
+			var v, mag float64
+			for i, ci := range comb.idx {
+				v += comb.val[i] * values[ci]
+				mag += math.Abs(comb.val[i] * values[ci])
+			}
+			if math.Abs(v) <= 1e-10*mag || mag == 0 {
+				redundant = append(redundant, k)
+			} else {
+				conflicting = append(conflicting, k)
+			}
+			continue
+		}
+		// Choose the pivot: auxiliary degrees of freedom first, then the first
+		// degree of freedom of the constraint unless its coefficient is small.
+		pivot, best := -1, 0.0
+		for i, dof := range row.idx {
+			if dof >= nfield && math.Abs(row.val[i]) > best {
+				pivot, best = dof, math.Abs(row.val[i])
+			}
+		}
+		if pivot < 0 {
+			max := row.maxAbs()
+			if a := math.Abs(row.at(con.Dofs[0])); a >= 0.1*max {
+				pivot = con.Dofs[0]
+			} else {
+				for i, dof := range row.idx {
+					if math.Abs(row.val[i]) > best {
+						pivot, best = dof, math.Abs(row.val[i])
+					}
+				}
+			}
+		}
+		a := 1 / row.at(pivot)
+		row.scale(a)
+		comb.scale(a)
+		row.set(pivot, 1)
+		// Eliminate the new pivot from the preceding rows.
+		for _, r := range colRows[pivot] {
+			prev := &rows[r]
+			b := prev.row.at(pivot)
+			if b == 0 {
+				continue
+			}
+			prev.row = prev.row.axpy(-b, row)
+			prev.comb = prev.comb.axpy(-b, comb)
+			for _, dof := range row.idx {
+				colRows[dof] = append(colRows[dof], r)
+			}
+		}
+		pivotRow[pivot] = len(rows)
+		for _, dof := range row.idx {
+			colRows[dof] = append(colRows[dof], len(rows))
+		}
+		rows = append(rows, reducedConstraint{pivot: pivot, row: row, comb: comb})
+	}
+	if len(conflicting) > 0 {
+		return nil, &ConstraintError{Redundant: redundant, Conflicting: conflicting}
+	}
+	red := &reduction{redundant: redundant}
+	for _, r := range rows {
+		if r.pivot < nfield {
+			red.rows = append(red.rows, r)
+		}
+	}
+	return red, nil
+}
+
+// constrainedSystem is a factorized symmetric system of equations
+//  K*u = f
+// subject to constraints. Only the constraint values and loads may change
+// between solves.
+type constrainedSystem struct {
+	method  ConstraintMethod
+	n       int
+	values  []float64 // Values of the original constraints.
+	rows    []reducedConstraint
+	K       *CSR
+	penalty float64
+	// q maps degrees of freedom to the reduced system of the Elimination
+	// method, -1 for eliminated degrees of freedom.
+	q   []int
+	ldl LDL
+}
+
+// factorize returns the factorized system K*u = f subject to c. Redundant
+// constraints are dropped and conflicting constraints return a *ConstraintError.
+func (c *Constraints) factorize(K *CSR) (*constrainedSystem, error) {
+	n, cols := K.Dims()
+	if n != cols || n != c.ndof*c.nnodes {
+		return nil, fmt.Errorf("system is %d×%d for %d constrained degrees of freedom", n, cols, c.ndof*c.nnodes)
+	}
+	red, err := c.reduce(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &constrainedSystem{method: c.Method, n: n, values: c.values(), rows: red.rows, K: K}
+	switch c.Method {
+	case Elimination:
+		s.q = make([]int, n)
+		for _, r := range s.rows {
+			s.q[r.pivot] = -1
+		}
+		nq := 0
+		for i := range s.q {
+			if s.q[i] == 0 {
+				s.q[i] = nq
+				nq++
+			} else {
+				s.q[i] = -1
+			}
+		}
+		if nq == 0 {
+			return s, nil
+		}
+		if err := s.ldl.Factorize(s.reduceMatrix(K), nil); err != nil {
+			return nil, s.mechanismError(err)
+		}
+	case Penalty:
+		factor := c.PenaltyFactor
+		if factor == 0 {
+			factor = 1e8
+		}
+		for _, d := range K.Diag() {
+			s.penalty = math.Max(s.penalty, math.Abs(d))
+		}
+		s.penalty *= factor
+		A := NewCOO(n, n, K.NNZ())
+		A.AddBlock(0, 0, K)
+		for _, r := range s.rows {
+			for i, di := range r.row.idx {
+				for j, dj := range r.row.idx {
+					A.AddAt(di, dj, s.penalty*r.row.val[i]*r.row.val[j])
+				}
+			}
+		}
+		if err := s.ldl.Factorize(A.ToCSR(), nil); err != nil {
+			return nil, s.mechanismError(err)
+		}
+	case Lagrange:
+		m := len(s.rows)
+		A := NewCOO(n+m, n+m, K.NNZ()+2*m)
+		A.AddBlock(0, 0, K)
+		delayed := make([]bool, n+m)
+		for k, r := range s.rows {
+			delayed[n+k] = true
+			for i, dof := range r.row.idx {
+				A.AddAt(n+k, dof, r.row.val[i])
+				A.AddAt(dof, n+k, r.row.val[i])
+			}
+		}
+		if err := s.ldl.Factorize(A.ToCSR(), delayed); err != nil {
+			return nil, s.mechanismError(err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown constraint method %d", c.Method)
+	}
+	return s, nil
+}
+
+// mechanismError returns err with the degree of freedom left free to move
+// by the constraints if err is a singular factorization of the system.
+func (s *constrainedSystem) mechanismError(err error) error {
+	var serr *singularError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	dof := serr.index
+	if s.q != nil {
+		for i, q := range s.q {
+			if q == serr.index {
+				dof = i
+				break
+			}
+		}
+	}
+	if dof >= s.n {
+		return err // Singular constraint rows.
+	}
+	return fmt.Errorf("constraints do not prevent motion of degree of freedom %d: %w", dof, err)
+}
+
+// transformEntry is an entry of the Elimination transformation u = T*q + g.
+type transformEntry struct {
+	q int
+	v float64
+}
+
+// transformation returns the rows of T.
+func (s *constrainedSystem) transformation() [][]transformEntry {
+	T := make([][]transformEntry, s.n)
+	for i, q := range s.q {
+		if q >= 0 {
+			T[i] = []transformEntry{{q: q, v: 1}}
+		}
+	}
+	for _, r := range s.rows {
+		for i, dof := range r.row.idx {
+			if dof != r.pivot {
+				T[r.pivot] = append(T[r.pivot], transformEntry{q: s.q[dof], v: -r.row.val[i]})
+			}
+		}
+	}
+	return T
+}
+
+// reduceMatrix returns Tᵀ*A*T, the matrix A of the degrees of freedom left
+// free by the constraints, where u = T*q + g is the transformation of the
+// Elimination method.
+func (s *constrainedSystem) reduceMatrix(A *CSR) *CSR {
+	nq := s.nq()
+	T := s.transformation()
+	Aq := NewCOO(nq, nq, A.NNZ())
+	A.DoNonZero(func(i, j int, v float64) {
+		for _, ti := range T[i] {
+			for _, tj := range T[j] {
+				Aq.AddAt(ti.q, tj.q, ti.v*v*tj.v)
+			}
+		}
+	})
+	return Aq.ToCSR()
+}
+
+// expand returns T*q, the solution for the reduced degrees of freedom q of the
+// Elimination method when all constraint values are zero.
+func (s *constrainedSystem) expand(q []float64) []float64 {
+	u := make([]float64, s.n)
+	for i, row := range s.transformation() {
+		for _, t := range row {
+			u[i] += t.v * q[t.q]
+		}
+	}
+	return u
+}
+
+// solve returns the solution for loads f and the constraint values, which
+// replace the values of the constraints if not nil. Values must keep
+// redundant constraints consistent.
+func (s *constrainedSystem) solve(f []float64, values []float64) ([]float64, error) {
+	return s.solveReduced(f, s.reducedValues(values))
+}
+
+// solveCorrection returns the solution du of K*du = f for which u + du
+// satisfies the constraints with the given values.
+func (s *constrainedSystem) solveCorrection(f, values, u []float64) ([]float64, error) {
+	g := s.reducedValues(values)
+	for k, r := range s.rows {
+		for i, dof := range r.row.idx {
+			g[k] -= r.row.val[i] * u[dof]
+		}
+	}
+	return s.solveReduced(f, g)
+}
+
+// reducedValues returns the values of the reduced constraints given the
+// values of the constraints, or their own values if nil.
+func (s *constrainedSystem) reducedValues(values []float64) []float64 {
+	if values == nil {
+		values = s.values
+	}
+	g := make([]float64, len(s.rows))
+	for k, r := range s.rows {
+		for i, ci := range r.comb.idx {
+			g[k] += r.comb.val[i] * values[ci]
+		}
+	}
+	return g
+}
+
+// solveReduced returns the solution for loads f and reduced constraint values g.
+func (s *constrainedSystem) solveReduced(f, g []float64) ([]float64, error) {
+	if f == nil {
+		f = make([]float64, s.n)
+	}
+	u := make([]float64, s.n)
+	switch s.method {
+	case Elimination:
+		for k, r := range s.rows {
+			u[r.pivot] = g[k]
+		}
+		Kg := make([]float64, s.n)
+		s.K.MulVecTo(Kg, u)
+		nq := s.nq()
+		if nq == 0 {
+			return u, nil
+		}
+		T := s.transformation()
+		fq := make([]float64, nq)
+		for i, row := range T {
+			for _, t := range row {
+				fq[t.q] += t.v * (f[i] - Kg[i])
+			}
+		}
+		q := make([]float64, nq)
+		if err := s.ldl.SolveVecTo(q, fq); err != nil {
+			return nil, err
+		}
+		for i, row := range T {
+			for _, t := range row {
+				u[i] += t.v * q[t.q]
+			}
+		}
+	case Penalty:
+		rhs := append([]float64(nil), f...)
+		for k, r := range s.rows {
+			for i, dof := range r.row.idx {
+				rhs[dof] += s.penalty * r.row.val[i] * g[k]
+			}
+		}
+		if err := s.ldl.SolveVecTo(u, rhs); err != nil {
+			return nil, err
+		}
+	case Lagrange:
+		rhs := append(append([]float64(nil), f...), g...)
+		sol := make([]float64, len(rhs))
+		if err := s.ldl.SolveVecTo(sol, rhs); err != nil {
+			return nil, fmt.Errorf("constraints do not prevent a mechanism: %w", err)
+		}
+		copy(u, sol)
+	}
+	return u, nil
+}
+
+// project returns Tᵀ*r, the components of r along the degrees of freedom
+// left free by the constraints, where u = T*q + g is the transformation of the
+// Elimination method. It is the out of balance force of a residual r.
+func (s *constrainedSystem) project(r []float64) []float64 {
+	if s.q == nil {
+		panic("constraint projection requires elimination")
+	}
+	rq := make([]float64, s.nq())
+	for i, row := range s.transformation() {
+		for _, t := range row {
+			rq[t.q] += t.v * r[i]
+		}
+	}
+	return rq
+}
+
+// nq returns the number of degrees of freedom of the reduced system of the
+// Elimination method.
+func (s *constrainedSystem) nq() int {
+	nq := 0
+	for _, q := range s.q {
+		if q >= 0 {
+			nq++
+		}
+	}
+	return nq
+}
+
+// solve returns the solution of the symmetric system K*u = f subject to c.
+func (c *Constraints) solve(K *CSR, f []float64) ([]float64, error) {
+	if r, _ := K.Dims(); len(f) != r {
+		return nil, fmt.Errorf("system has %d rows and %d right hand side entries", r, len(f))
+	}
+	s, err := c.factorize(K)
+	if err != nil {
+		return nil, err
+	}
+	return s.solve(f, nil)
+}
+
+// values returns the value of each constraint.
+func (c *Constraints) values() []float64 {
+	v := make([]float64, len(c.eqs))
+	for i, con := range c.eqs {
+		v[i] = con.Value
+	}
+	return v
+}
+
+// sparseRow is a sparse vector with sorted indices.
+type sparseRow struct {
+	idx []int
+	val []float64
+}
+
+// newSparseRow returns the sparse vector with values val at indices idx.
+// Values at repeated indices are summed.
+func newSparseRow(idx []int, val []float64) sparseRow {
+	var r sparseRow
+	for i := range idx {
+		r = r.axpy(val[i], sparseRow{idx: idx[i : i+1], val: []float64{1}})
+	}
+	return r
+}
+
+// at returns the value at index i.
+func (r sparseRow) at(i int) float64 {
+	k := sort.SearchInts(r.idx, i)
+	if k < len(r.idx) && r.idx[k] == i {
+		return r.val[k]
+	}
+	return 0
+}
+
+// set sets the value at index i, which must be stored.
+func (r sparseRow) set(i int, v float64) {
+	r.val[sort.SearchInts(r.idx, i)] = v
+}
+
+// scale multiplies the entries of r by a.
+func (r sparseRow) scale(a float64) {
+	for i := range r.val {
+		r.val[i] *= a
+	}
+}
+
+// axpy returns r + a*x. Entries that cancel exactly are not stored.
+func (r sparseRow) axpy(a float64, x sparseRow) sparseRow {
+	var res sparseRow
+	add := func(i int, v float64) {
+		if v != 0 {
+			res.idx = append(res.idx, i)
+			res.val = append(res.val, v)
+		}
+	}
+	i, j := 0, 0
+	for i < len(r.idx) || j < len(x.idx) {
+		switch {
+		case j == len(x.idx) || (i < len(r.idx) && r.idx[i] < x.idx[j]):
+			add(r.idx[i], r.val[i])
+			i++
+		case i == len(r.idx) || x.idx[j] < r.idx[i]:
+			add(x.idx[j], a*x.val[j])
+			j++
+		default:
+			add(r.idx[i], r.val[i]+a*x.val[j])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// drop returns r without the entries of magnitude below tol.
+func (r sparseRow) drop(tol float64) sparseRow {
+	var res sparseRow
+	for i, v := range r.val {
+		if math.Abs(v) > tol {
+			res.idx = append(res.idx, r.idx[i])
+			res.val = append(res.val, v)
+		}
+	}
+	return res
+}
+
+// maxAbs returns the largest magnitude of the entries of r.
+func (r sparseRow) maxAbs() float64 {
+	var max float64
+	for _, v := range r.val {
+		max = math.Max(max, math.Abs(v))
+	}
+	return max
+}
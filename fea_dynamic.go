@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// DynamicSettings configures SolveDynamic.
+type DynamicSettings struct {
+	// TimeStep is the time step Δt. The last step is shortened to end at Duration.
+	TimeStep float64
+	// Duration is the simulated time.
+	Duration float64
+	// Alpha is the HHT-α parameter in [-1/3, 0]. Negative values damp the
+	// high frequency modes the time step cannot resolve while keeping second
+	// order accuracy. Zero is the average acceleration method, which does not
+	// damp any mode.
+	Alpha float64
+	// Beta and Gamma are the Newmark parameters β and γ. If both are zero
+	// they are (1-α)²/4 and 1/2-α, which is unconditionally stable.
+	Beta, Gamma float64
+	// MassDamping a and StiffnessDamping b define the Rayleigh damping
+	// matrix a*M + b*K, which damps mode i with the damping ratio
+	// a/(2*ωᵢ) + b*ωᵢ/2.
+	MassDamping, StiffnessDamping float64
+	// Lumped selects a lumped mass matrix.
+	Lumped bool
+	// InitialDisplacement and InitialVelocity hold the nodal displacements and
+	// velocities at time zero. If nil they are zero.
+	InitialDisplacement, InitialVelocity []float64
+	// Loads returns the loads at time t, which is called once per time step.
+	// Prescribed displacements and constraint values may change in time but
+	// the constrained degrees of freedom and coefficients may not. If nil
+	// there are no loads.
+	Loads func(t float64) StaticLoads
+	// Snapshots holds the times at which the displacements, velocities and
+	// accelerations are recorded. Times that fall between steps are
+	// interpolated linearly.
+	Snapshots []float64
+}
+
+// DynamicResult holds the time history recorded by SolveDynamic.
+type DynamicResult struct {
+	// Times holds the snapshot times in ascending order.
+	Times []float64
+	// Displacements, Velocities and Accelerations hold the nodal values at
+	// each snapshot time.
+	Displacements, Velocities, Accelerations [][]float64
+}
+
+// SolveDynamic integrates the equations of motion
+//  M*a + C*v + K*u = f
+// of model in time with the HHT-α method, where C = a*M + b*K is the
+// Rayleigh damping matrix. Equilibrium is weighted between the start and
+// end of each step
+//  M*aₙ₊₁ + (1+α)*(C*vₙ₊₁ + K*uₙ₊₁) - α*(C*vₙ + K*uₙ) = (1+α)*fₙ₊₁ - α*fₙ
+// and the Newmark relations
+//  uₙ₊₁ = uₙ + Δt*vₙ + Δt²*((1/2-β)*aₙ + β*aₙ₊₁)
+//  vₙ₊₁ = vₙ + Δt*((1-γ)*aₙ + γ*aₙ₊₁)
+// give a linear system in uₙ₊₁ whose matrix is factorized once. The method
+// is implicit and unconditionally stable, so the time step is chosen for
+// accuracy of the modes of interest, which suits vibration and other long
+// duration events. The initial accelerations satisfy equilibrium, those of
+// prescribed degrees of freedom being zero. Constraints of loads are always
+// enforced by elimination.
+func SolveDynamic(model FEModel, materials []Material, settings DynamicSettings) (DynamicResult, error) {
+	var result DynamicResult
+	if err := model.validate(); err != nil {
+		return result, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return result, err
+	}
+	density, err := model.elemProperty(materials, func(m Material) float64 { return m.Density })
+	if err != nil {
+		return result, err
+	}
+	if !(settings.TimeStep > 0) || !(settings.Duration >= 0) {
+		return result, fmt.Errorf("invalid time step %g or duration %g", settings.TimeStep, settings.Duration)
+	}
+	alpha, beta, gamma := settings.Alpha, settings.Beta, settings.Gamma
+	if alpha < -1./3 || alpha > 0 {
+		return result, fmt.Errorf("HHT alpha %g out of range [-1/3,0]", alpha)
+	}
+	if beta == 0 && gamma == 0 {
+		beta, gamma = (1-alpha)*(1-alpha)/4, 0.5-alpha
+	}
+	if !(beta > 0) || !(gamma >= 0.5) {
+		return result, fmt.Errorf("invalid Newmark parameters β=%g and γ=%g", beta, gamma)
+	}
+	aM, bK := settings.MassDamping, settings.StiffnessDamping
+	if aM < 0 || bK < 0 {
+		return result, fmt.Errorf("negative damping coefficients %g and %g", aM, bK)
+	}
+	snapshots := append([]float64(nil), settings.Snapshots...)
+	sort.Float64s(snapshots)
+	if len(snapshots) > 0 && (snapshots[0] < 0 || snapshots[len(snapshots)-1] > settings.Duration) {
+		return result, errors.New("snapshot times must be within the simulated time")
+	}
+	n := 3 * len(model.Nodes)
+	u := make([]float64, n)
+	v := make([]float64, n)
+	for _, init := range []struct {
+		dst, src []float64
+		name     string
+	}{{u, settings.InitialDisplacement, "displacements"}, {v, settings.InitialVelocity, "velocities"}} {
+		if init.src == nil {
+			continue
+		}
+		if len(init.src) != n {
+			return result, fmt.Errorf("got %d initial %s for %d degrees of freedom: %w", len(init.src), init.name, n, mat.ErrShape)
+		}
+		copy(init.dst, init.src)
+	}
+	K := assembleStiffness(model, elemC)
+	M := assembleMass(model, density, 3, settings.Lumped)
+	// external returns the external forces and constraints at t.
+	external := func(t float64) ([]float64, *Constraints, error) {
+		f := make([]float64, n)
+		if settings.Loads == nil {
+			return f, NewConstraints(len(model.Nodes), 3), nil
+		}
+		loads := settings.Loads(t)
+		c := NewConstraints(len(model.Nodes), 3)
+		if len(loads.Displacement) > 0 || (loads.Constraints != nil && loads.Constraints.Len() > 0) {
+			var err error
+			if c, err = loads.constraints(len(model.Nodes)); err != nil {
+				return nil, nil, err
+			}
+		}
+		c.Method = Elimination
+		if err := loads.assemble(model, materials, elemC, f); err != nil {
+			return nil, nil, err
+		}
+		return f, c, nil
+	}
+	f, c, err := external(0)
+	if err != nil {
+		return result, err
+	}
+	// Initial displacements are corrected to satisfy the constraints with
+	// the correction of least mass weighted norm and initial accelerations
+	// solve M*a₀ = f₀ - C*v₀ - K*u₀.
+	msys, err := c.factorize(M)
+	if err != nil {
+		return result, err
+	}
+	du, err := msys.solveCorrection(make([]float64, n), c.values(), u)
+	if err != nil {
+		return result, err
+	}
+	floats.Add(u, du)
+	var (
+		Mx = make([]float64, n)
+		Kx = make([]float64, n)
+		y  = make([]float64, n)
+		z  = make([]float64, n)
+		a  = make([]float64, n)
+	)
+	for i := range z {
+		z[i] = bK*v[i] + u[i]
+	}
+	M.MulVecTo(Mx, v)
+	K.MulVecTo(Kx, z)
+	for i := range a {
+		a[i] = f[i] - aM*Mx[i] - Kx[i]
+	}
+	a0, err := msys.solve(a, make([]float64, c.Len()))
+	if err != nil {
+		return result, err
+	}
+	copy(a, a0)
+
+	record := func(t float64, u, v, a []float64) {
+		result.Times = append(result.Times, t)
+		result.Displacements = append(result.Displacements, append([]float64(nil), u...))
+		result.Velocities = append(result.Velocities, append([]float64(nil), v...))
+		result.Accelerations = append(result.Accelerations, append([]float64(nil), a...))
+	}
+	for len(snapshots) > 0 && snapshots[0] == 0 {
+		record(0, u, v, a)
+		snapshots = snapshots[1:]
+	}
+
+	var (
+		system   *constrainedSystem
+		systemDt float64
+		rhs      = make([]float64, n)
+		v1       = make([]float64, n)
+		a1       = make([]float64, n)
+		interp   = make([]float64, 3*n)
+	)
+	t := 0.0
+	for step := 1; t < settings.Duration; step++ {
+		// Step times are computed from the step count to avoid accumulating round-off.
+		t1 := math.Min(float64(step)*settings.TimeStep, settings.Duration)
+		h := t1 - t
+		f1, c1, err := external(t1)
+		if err != nil {
+			return result, err
+		}
+		if !sameConstraints(c, c1) {
+			return result, fmt.Errorf("constraints change at time %g", t1)
+		}
+		// aₙ₊₁ = cu*(uₙ₊₁ - uₙ - Δt*vₙ) - (1/(2β) - 1)*aₙ
+		// vₙ₊₁ = cv*(uₙ₊₁ - uₙ) + (1 - γ/β)*vₙ + Δt*(1 - γ/(2β))*aₙ
+		cu, cv := 1/(beta*h*h), gamma/(beta*h)
+		if system == nil || h != systemDt {
+			// Effective stiffness (cu + (1+α)*cv*a)*M + (1+α)*(1 + cv*b)*K.
+			A := NewCOO(n, n, K.NNZ()+M.NNZ())
+			M.DoNonZero(func(i, j int, v float64) { A.AddAt(i, j, (cu+(1+alpha)*cv*aM)*v) })
+			K.DoNonZero(func(i, j int, v float64) { A.AddAt(i, j, (1+alpha)*(1+cv*bK)*v) })
+			if system, err = c.factorize(A.ToCSR()); err != nil {
+				return result, err
+			}
+			systemDt = h
+		}
+		// Right hand side M*y + K*z of the known terms, where the parts of
+		// the damping forces C = α*M + β*K are gathered in y and z.
+		for i := range y {
+			p := cu*(u[i]+h*v[i]) + (1/(2*beta)-1)*a[i]
+			q := cv*u[i] - (1-gamma/beta)*v[i] - h*(1-gamma/(2*beta))*a[i]
+			y[i] = p + aM*((1+alpha)*q+alpha*v[i])
+			z[i] = bK*((1+alpha)*q+alpha*v[i]) + alpha*u[i]
+		}
+		M.MulVecTo(Mx, y)
+		K.MulVecTo(Kx, z)
+		for i := range rhs {
+			rhs[i] = (1+alpha)*f1[i] - alpha*f[i] + Mx[i] + Kx[i]
+		}
+		u1, err := system.solve(rhs, c1.values())
+		if err != nil {
+			return result, fmt.Errorf("time %g: %w", t1, err)
+		}
+		for i := range u1 {
+			a1[i] = cu*(u1[i]-u[i]-h*v[i]) - (1/(2*beta)-1)*a[i]
+			v1[i] = v[i] + h*((1-gamma)*a[i]+gamma*a1[i])
+		}
+		for len(snapshots) > 0 && snapshots[0] <= t1 {
+			w := (snapshots[0] - t) / h
+			ui, vi, ai := interp[:n], interp[n:2*n], interp[2*n:]
+			for i := range ui {
+				ui[i] = (1-w)*u[i] + w*u1[i]
+				vi[i] = (1-w)*v[i] + w*v1[i]
+				ai[i] = (1-w)*a[i] + w*a1[i]
+			}
+			record(snapshots[0], ui, vi, ai)
+			snapshots = snapshots[1:]
+		}
+		u, f, t = u1, f1, t1
+		v, v1 = v1, v
+		a, a1 = a1, a
+	}
+	return result, nil
+}
+
+// sameConstraints reports whether a and b constrain the same degrees of
+// freedom with the same coefficients, in which case they only differ in
+// their values.
+func sameConstraints(a, b *Constraints) bool {
+	if a.Method != b.Method || a.PenaltyFactor != b.PenaltyFactor || a.naux != b.naux || len(a.eqs) != len(b.eqs) {
+		return false
+	}
+	for k, ea := range a.eqs {
+		eb := b.eqs[k]
+		if len(ea.Dofs) != len(eb.Dofs) || len(ea.Coefs) != len(eb.Coefs) {
+			return false
+		}
+		for i := range ea.Dofs {
+			if ea.Dofs[i] != eb.Dofs[i] {
+				return false
+			}
+		}
+		for i := range ea.Coefs {
+			if ea.Coefs[i] != eb.Coefs[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FrequencySettings configures FrequencyResponse.
+type FrequencySettings struct {
+	// Frequencies holds the excitation frequencies in cycles per unit time.
+	Frequencies []float64
+	// MassDamping a and StiffnessDamping b define the Rayleigh damping
+	// matrix a*M + b*K as in DynamicSettings.
+	MassDamping, StiffnessDamping float64
+	// LossFactor η adds structural damping, which makes the stiffness
+	// (1 + i*η)*K and damps every mode with the damping ratio η/2 at resonance.
+	LossFactor float64
+	// Lumped selects a lumped mass matrix.
+	Lumped bool
+	// Probes holds the nodes whose displacement amplitudes are returned.
+	// If nil all nodes are returned.
+	Probes []int
+}
+
+// FrequencyResult holds the harmonic response found by FrequencyResponse.
+type FrequencyResult struct {
+	// Frequencies holds the excitation frequencies.
+	Frequencies []float64
+	// Amplitudes holds for each frequency the complex displacement amplitudes
+	// of the probe nodes, probe i owning indices 3*i to 3*i+2. The displacement
+	// over time is the real part of Amplitude*exp(i*ω*t).
+	Amplitudes [][]complex128
+}
+
+// FrequencyResponse solves the steady state response of model to loads that
+// vary harmonically in time with angular frequency ω = 2π*f:
+//  (K - ω²*M + i*ω*C + i*η*K)*U = F
+// The point loads, tractions, pressures, body forces, prescribed displacements
+// and constraint values of loads are the amplitudes of the excitation, all in
+// phase. The complex system is solved as the equivalent real symmetric system
+//  | A  -B | |Re U|   | F |
+//  |-B  -A | |Im U| = | 0 |
+// where A = K - ω²*M and B = ω*C + η*K, which is indefinite and factorized
+// once per frequency. Constraints of loads are always enforced by elimination.
+func FrequencyResponse(model FEModel, materials []Material, loads StaticLoads, settings FrequencySettings) (FrequencyResult, error) {
+	var result FrequencyResult
+	if err := model.validate(); err != nil {
+		return result, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return result, err
+	}
+	density, err := model.elemProperty(materials, func(m Material) float64 { return m.Density })
+	if err != nil {
+		return result, err
+	}
+	aM, bK, eta := settings.MassDamping, settings.StiffnessDamping, settings.LossFactor
+	if aM < 0 || bK < 0 || eta < 0 {
+		return result, fmt.Errorf("negative damping coefficients %g, %g and %g", aM, bK, eta)
+	}
+	probes := settings.Probes
+	if probes == nil {
+		probes = make([]int, len(model.Nodes))
+		for i := range probes {
+			probes[i] = i
+		}
+	}
+	for _, node := range probes {
+		if node < 0 || node >= len(model.Nodes) {
+			return result, fmt.Errorf("probe node %d out of range [0,%d)", node, len(model.Nodes))
+		}
+	}
+	n := 3 * len(model.Nodes)
+	c := NewConstraints(len(model.Nodes), 3)
+	if len(loads.Displacement) > 0 || (loads.Constraints != nil && loads.Constraints.Len() > 0) {
+		if c, err = loads.constraints(len(model.Nodes)); err != nil {
+			return result, err
+		}
+	}
+	c = c.complex()
+	f := make([]float64, 2*n)
+	if err := loads.assemble(model, materials, elemC, f[:n]); err != nil {
+		return result, err
+	}
+	K := assembleStiffness(model, elemC)
+	M := assembleMass(model, density, 3, settings.Lumped)
+	for _, freq := range settings.Frequencies {
+		if !(freq >= 0) || math.IsInf(freq, 0) {
+			return result, fmt.Errorf("invalid frequency %g", freq)
+		}
+		omega := 2 * math.Pi * freq
+		A := NewCOO(2*n, 2*n, 4*K.NNZ()+4*M.NNZ())
+		add := func(i, j int, a, b float64) {
+			A.AddAt(i, j, a)
+			A.AddAt(i, n+j, -b)
+			A.AddAt(n+i, j, -b)
+			A.AddAt(n+i, n+j, -a)
+		}
+		K.DoNonZero(func(i, j int, v float64) { add(i, j, v, (omega*bK+eta)*v) })
+		M.DoNonZero(func(i, j int, v float64) { add(i, j, -omega*omega*v, omega*aM*v) })
+		system, err := c.factorize(A.ToCSR())
+		if err != nil {
+			return result, fmt.Errorf("frequency %g: %w", freq, err)
+		}
+		U, err := system.solve(f, nil)
+		if err != nil {
+			return result, fmt.Errorf("frequency %g: %w", freq, err)
+		}
+		amplitudes := make([]complex128, 3*len(probes))
+		for i, node := range probes {
+			for d := 0; d < 3; d++ {
+				amplitudes[3*i+d] = complex(U[3*node+d], U[n+3*node+d])
+			}
+		}
+		result.Frequencies = append(result.Frequencies, freq)
+		result.Amplitudes = append(result.Amplitudes, amplitudes)
+	}
+	return result, nil
+}
+
+// complex returns the constraints of the real and imaginary parts of the
+// complex degrees of freedom constrained by c, numbered as nodal degrees of
+// freedom of twice the nodes, the imaginary parts following the real ones.
+// The imaginary parts of the constraint values are zero. The result uses the
+// Elimination method.
+func (c *Constraints) complex() *Constraints {
+	n := c.ndof * c.nnodes
+	d := &Constraints{nnodes: 2 * c.nnodes, ndof: c.ndof, naux: 2 * c.naux}
+	for part := 0; part < 2; part++ {
+		for _, eq := range c.eqs {
+			con := Constraint{Dofs: make([]int, len(eq.Dofs)), Coefs: eq.Coefs}
+			for i, dof := range eq.Dofs {
+				if dof < n {
+					con.Dofs[i] = dof + part*n
+				} else {
+					// Auxiliary degrees of freedom follow the nodal ones.
+					con.Dofs[i] = dof + n + part*c.naux
+				}
+			}
+			if part == 0 {
+				con.Value = eq.Value
+			}
+			d.Add(con)
+		}
+	}
+	return d
+}
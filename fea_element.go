@@ -0,0 +1,1022 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"play/quadrature"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+var (
+	_ Element = Tet4{}
+	_ Element = Tet10{}
+	_ Element = Hex8{}
+	_ Element = Hex20{}
+)
+
+// Element is a finite element type defined on a reference domain. Reference
+// coordinates ξ, η and ζ are stored in the X, Y and Z fields of a Vec.
+type Element interface {
+	// NumNodes returns the number of nodes of the element.
+	NumNodes() int
+	// Basis stores the shape functions evaluated at reference coordinates u in dst.
+	Basis(dst []float64, u Vec)
+	// BasisDiff stores the derivatives of the shape functions at u in the
+	// rows of dst, a 3×NumNodes matrix: ∂N/∂ξ, ∂N/∂η and ∂N/∂ζ.
+	BasisDiff(dst *mat.Dense, u Vec)
+	// Quadrature returns the integration points and weights of a rule that
+	// integrates the stiffness matrix of an undistorted element exactly.
+	Quadrature() (points []Vec, weights []float64)
+	// Faces returns the local nodes of each face. Corner nodes come first,
+	// ordered counter-clockwise as seen from outside the element, followed by
+	// the midside nodes of the face edges in the same order.
+	Faces() [][]int
+}
+
+// Tet4 is the 4 node linear tetrahedron. Its reference domain is
+// ξ, η, ζ ≥ 0 and ξ+η+ζ ≤ 1 with node 0 at the origin and nodes 1, 2
+// and 3 on the ξ, η and ζ axes.
+type Tet4 struct{}
+
+func (Tet4) NumNodes() int { return 4 }
+
+func (Tet4) Basis(dst []float64, u Vec) {
+	dst[0] = 1 - u.X - u.Y - u.Z
+	dst[1] = u.X
+	dst[2] = u.Y
+	dst[3] = u.Z
+}
+
+func (Tet4) BasisDiff(dst *mat.Dense, u Vec) {
+	for d := 0; d < 3; d++ {
+		for n := 0; n < 4; n++ {
+			dst.Set(d, n, tetBarycentricDiff[n][d])
+		}
+	}
+}
+
+func (Tet4) Quadrature() ([]Vec, []float64) {
+	return []Vec{{X: 0.25, Y: 0.25, Z: 0.25}}, []float64{1.0 / 6}
+}
+
+func (Tet4) Faces() [][]int {
+	return [][]int{{0, 2, 1}, {0, 1, 3}, {0, 3, 2}, {1, 2, 3}}
+}
+
+// Tet10 is the 10 node quadratic tetrahedron. Corner nodes follow Tet4
+// and nodes 4 to 9 lie at the midpoints of edges 0-1, 1-2, 2-0, 0-3, 1-3 and 2-3.
+type Tet10 struct{}
+
+// tet10Edges are the corner nodes of each Tet10 midside node.
+var tet10Edges = [6][2]int{{0, 1}, {1, 2}, {2, 0}, {0, 3}, {1, 3}, {2, 3}}
+
+// tetBarycentricDiff holds the derivatives of the barycentric
+// coordinates of a tetrahedron with respect to ξ, η and ζ.
+var tetBarycentricDiff = [4][3]float64{{-1, -1, -1}, {1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+func (Tet10) NumNodes() int { return 10 }
+
+func (Tet10) Basis(dst []float64, u Vec) {
+	L := [4]float64{1 - u.X - u.Y - u.Z, u.X, u.Y, u.Z}
+	for i := 0; i < 4; i++ {
+		dst[i] = L[i] * (2*L[i] - 1)
+	}
+	for k, e := range tet10Edges {
+		dst[4+k] = 4 * L[e[0]] * L[e[1]]
+	}
+}
+
+func (Tet10) BasisDiff(dst *mat.Dense, u Vec) {
+	L := [4]float64{1 - u.X - u.Y - u.Z, u.X, u.Y, u.Z}
+	dL := tetBarycentricDiff
+	for d := 0; d < 3; d++ {
+		for i := 0; i < 4; i++ {
+			dst.Set(d, i, (4*L[i]-1)*dL[i][d])
+		}
+		for k, e := range tet10Edges {
+			i, j := e[0], e[1]
+			dst.Set(d, 4+k, 4*(L[j]*dL[i][d]+L[i]*dL[j][d]))
+		}
+	}
+}
+
+func (Tet10) Quadrature() ([]Vec, []float64) {
+	// Degree 2 rule with 4 points.
+	a := (5 + 3*math.Sqrt(5)) / 20
+	b := (5 - math.Sqrt(5)) / 20
+	w := 1.0 / 24
+	return []Vec{{X: b, Y: b, Z: b}, {X: a, Y: b, Z: b}, {X: b, Y: a, Z: b}, {X: b, Y: b, Z: a}},
+		[]float64{w, w, w, w}
+}
+
+func (Tet10) Faces() [][]int {
+	return [][]int{{0, 2, 1, 6, 5, 4}, {0, 1, 3, 4, 8, 7}, {0, 3, 2, 7, 9, 6}, {1, 2, 3, 5, 9, 8}}
+}
+
+// Hex8 is the 8 node trilinear hexahedron. Its reference domain is the cube
+// [-1,1]³ and its node ordering follows h8FormFuncs and Box.Vertices.
+type Hex8 struct {
+	// Formulation selects how the stiffness is integrated. Defaults to
+	// FullIntegration.
+	Formulation Hex8Formulation
+	// Hourglass is the stiffness of the hourglass modes of ReducedIntegration
+	// relative to the shear stiffness of the element. Defaults to 0.1.
+	Hourglass float64
+}
+
+// Hex8Formulation selects the stiffness formulation of Hex8 elements.
+// Formulations other than FullIntegration apply to linear elastic analyses
+// and are rejected by solvers that do not support them.
+type Hex8Formulation int
+
+const (
+	// FullIntegration integrates the stiffness with 2×2×2 Gauss points. The
+	// element is too stiff in bending and locks when the material is nearly
+	// incompressible.
+	FullIntegration Hex8Formulation = iota
+	// BBar replaces the volumetric strain at each Gauss point by its mean
+	// over the element, which prevents volumetric locking. For isotropic
+	// materials it is selective reduced integration of the volumetric
+	// stiffness.
+	BBar
+	// IncompatibleModes adds Wilson's internal modes 1-ξ², 1-η² and 1-ζ² to
+	// each displacement component and condenses them out of the element,
+	// which makes bending of parallelepipeds exact. Their gradients are
+	// evaluated with the Jacobian at the element center, Taylor's correction
+	// for passing the patch test. Thermal strains load the modes too, so
+	// temperature fields quadratic within the element are reproduced.
+	IncompatibleModes
+	// ReducedIntegration integrates the stiffness at a single point with the
+	// volume averaged strain-displacement matrix, which does not lock but
+	// leaves four zero energy hourglass modes per direction. They are
+	// stabilized with the stiffness of Flanagan and Belytschko, orthogonal
+	// to linear displacement fields, scaled by Hourglass. Stresses are
+	// constant within elements.
+	ReducedIntegration
+)
+
+// String returns the name of the formulation.
+func (f Hex8Formulation) String() string {
+	switch f {
+	case FullIntegration:
+		return "FullIntegration"
+	case BBar:
+		return "BBar"
+	case IncompatibleModes:
+		return "IncompatibleModes"
+	case ReducedIntegration:
+		return "ReducedIntegration"
+	}
+	return fmt.Sprintf("Hex8Formulation(%d)", int(f))
+}
+
+// hexCorners holds the reference coordinates of hexahedron corner nodes.
+var hexCorners = [8]Vec{
+	{X: -1, Y: -1, Z: -1}, {X: 1, Y: -1, Z: -1}, {X: 1, Y: 1, Z: -1}, {X: -1, Y: 1, Z: -1},
+	{X: -1, Y: -1, Z: 1}, {X: 1, Y: -1, Z: 1}, {X: 1, Y: 1, Z: 1}, {X: -1, Y: 1, Z: 1},
+}
+
+func (Hex8) NumNodes() int { return 8 }
+
+func (Hex8) Basis(dst []float64, u Vec) {
+	copy(dst, h8FormFuncs(u.X, u.Y, u.Z))
+}
+
+func (Hex8) BasisDiff(dst *mat.Dense, u Vec) {
+	dst.Copy(mat.NewDense(3, 8, h8FormFuncsDiff(u.X, u.Y, u.Z)))
+}
+
+func (Hex8) Quadrature() ([]Vec, []float64) { return gauss3D(2, 2, 2) }
+
+func (Hex8) Faces() [][]int {
+	return [][]int{{0, 3, 2, 1}, {4, 5, 6, 7}, {0, 1, 5, 4}, {3, 7, 6, 2}, {0, 4, 7, 3}, {1, 2, 6, 5}}
+}
+
+// Hex20 is the 20 node serendipity hexahedron. Corner nodes follow Hex8 and
+// nodes 8 to 19 lie at the midpoints of edges 0-1, 1-2, 2-3, 3-0, 4-5, 5-6,
+// 6-7, 7-4, 0-4, 1-5, 2-6 and 3-7.
+type Hex20 struct{}
+
+// hex20Edges are the corner nodes of each Hex20 midside node.
+var hex20Edges = [12][2]int{
+	{0, 1}, {1, 2}, {2, 3}, {3, 0},
+	{4, 5}, {5, 6}, {6, 7}, {7, 4},
+	{0, 4}, {1, 5}, {2, 6}, {3, 7},
+}
+
+func (Hex20) NumNodes() int { return 20 }
+
+func (h Hex20) Basis(dst []float64, u Vec) {
+	a := [3]float64{u.X, u.Y, u.Z}
+	for i, c := range hexCorners {
+		ai := [3]float64{c.X, c.Y, c.Z}
+		dst[i] = (1 + a[0]*ai[0]) * (1 + a[1]*ai[1]) * (1 + a[2]*ai[2]) *
+			(a[0]*ai[0] + a[1]*ai[1] + a[2]*ai[2] - 2) / 8
+	}
+	for k := range hex20Edges {
+		ai, zd := h.midside(k)
+		N := (1 - a[zd]*a[zd]) / 4
+		for d := 0; d < 3; d++ {
+			if d != zd {
+				N *= 1 + a[d]*ai[d]
+			}
+		}
+		dst[8+k] = N
+	}
+}
+
+func (h Hex20) BasisDiff(dst *mat.Dense, u Vec) {
+	a := [3]float64{u.X, u.Y, u.Z}
+	for i, c := range hexCorners {
+		ai := [3]float64{c.X, c.Y, c.Z}
+		var f [3]float64 // Linear factors 1 + aᵢ*a.
+		for d := range f {
+			f[d] = 1 + a[d]*ai[d]
+		}
+		s := a[0]*ai[0] + a[1]*ai[1] + a[2]*ai[2] - 2
+		for d := 0; d < 3; d++ {
+			others := f[(d+1)%3] * f[(d+2)%3]
+			dst.Set(d, i, ai[d]*others*(s+f[d])/8)
+		}
+	}
+	for k := range hex20Edges {
+		ai, zd := h.midside(k)
+		for d := 0; d < 3; d++ {
+			v := 0.25
+			for e := 0; e < 3; e++ {
+				switch {
+				case e == zd && d == zd:
+					v *= -2 * a[e]
+				case e == zd:
+					v *= 1 - a[e]*a[e]
+				case e == d:
+					v *= ai[e]
+				default:
+					v *= 1 + a[e]*ai[e]
+				}
+			}
+			dst.Set(d, 8+k, v)
+		}
+	}
+}
+
+// midside returns the reference coordinates of midside node k
+// and the dimension along which the node's edge runs.
+func (Hex20) midside(k int) (ai [3]float64, zeroDim int) {
+	e := hex20Edges[k]
+	c := Scale(0.5, Add(hexCorners[e[0]], hexCorners[e[1]]))
+	ai = [3]float64{c.X, c.Y, c.Z}
+	for d := range ai {
+		if ai[d] == 0 {
+			zeroDim = d
+		}
+	}
+	return ai, zeroDim
+}
+
+func (Hex20) Quadrature() ([]Vec, []float64) { return gauss3D(3, 3, 3) }
+
+func (Hex20) Faces() [][]int {
+	return [][]int{
+		{0, 3, 2, 1, 11, 10, 9, 8},
+		{4, 5, 6, 7, 12, 13, 14, 15},
+		{0, 1, 5, 4, 8, 17, 12, 16},
+		{3, 7, 6, 2, 19, 14, 18, 10},
+		{0, 4, 7, 3, 16, 15, 19, 11},
+		{1, 2, 6, 5, 9, 18, 13, 17},
+	}
+}
+
+// elementIntegrator evaluates element quantities at the quadrature points
+// of an Element. It holds scratch space so it must not be used concurrently.
+type elementIntegrator struct {
+	elem  Element
+	upg   []Vec
+	wpg   []float64
+	N     [][]float64  // Form functions at Gauss points.
+	dN    []*mat.Dense // Form function derivatives at Gauss points.
+	jac   *Mat
+	enod  *mat.Dense // Element node positions as rows.
+	dNxyz *mat.Dense // Form function derivatives in global coordinates.
+	B     *mat.Dense // Strain-displacement matrix.
+	aux1  *mat.Dense
+	aux2  *mat.Dense
+
+	// Hex8 formulation and the element data set by setElement.
+	formulation Hex8Formulation
+	hourglass   float64
+	mean        *mat.Dense // Volume averaged dNxyz.
+	volume      float64
+	jac0        *Mat       // Jacobian at the element center.
+	G           *mat.Dense // Strain-displacement matrix of incompatible modes.
+}
+
+func newElementIntegrator(elem Element) *elementIntegrator {
+	upg, wpg := elem.Quadrature()
+	return newElementIntegratorRule(elem, upg, wpg)
+}
+
+// newElementIntegratorRule returns an integrator that uses the quadrature rule
+// upg, wpg instead of the element's own.
+func newElementIntegratorRule(elem Element, upg []Vec, wpg []float64) *elementIntegrator {
+	n := elem.NumNodes()
+	h := &elementIntegrator{
+		elem:  elem,
+		upg:   upg,
+		wpg:   wpg,
+		N:     make([][]float64, len(upg)),
+		dN:    make([]*mat.Dense, len(upg)),
+		jac:   NewMat(nil),
+		enod:  mat.NewDense(n, 3, nil),
+		dNxyz: mat.NewDense(3, n, nil),
+		B:     mat.NewDense(6, 3*n, nil),
+		aux1:  mat.NewDense(3*n, 6, nil),
+		aux2:  mat.NewDense(3*n, 3*n, nil),
+	}
+	for ipg, pg := range upg {
+		h.N[ipg] = make([]float64, n)
+		elem.Basis(h.N[ipg], pg)
+		h.dN[ipg] = mat.NewDense(3, n, nil)
+		elem.BasisDiff(h.dN[ipg], pg)
+	}
+	if hex, ok := elem.(Hex8); ok && hex.Formulation != FullIntegration {
+		h.formulation = hex.Formulation
+		h.hourglass = hex.Hourglass
+		if h.hourglass == 0 {
+			h.hourglass = 0.1
+		}
+		h.mean = mat.NewDense(3, n, nil)
+		h.jac0 = NewMat(nil)
+		h.G = mat.NewDense(6, 9, nil)
+	}
+	return h
+}
+
+// setElement prepares the integrator for the element with node positions
+// enod. Formulations that depend on the whole element require it before
+// calls to bmatrix.
+func (h *elementIntegrator) setElement(enod []Vec) {
+	switch h.formulation {
+	case BBar, ReducedIntegration:
+		h.mean.Zero()
+		h.volume = 0
+		for ipg := range h.upg {
+			dV := h.gradient(enod, ipg)
+			h.volume += dV
+			h.aux2.Slice(0, 3, 0, len(enod)).(*mat.Dense).Scale(dV, h.dNxyz)
+			h.mean.Add(h.mean, h.aux2.Slice(0, 3, 0, len(enod)))
+		}
+		h.mean.Scale(1/h.volume, h.mean)
+	case IncompatibleModes:
+		dN0 := mat.NewDense(3, len(enod), nil)
+		h.elem.BasisDiff(dN0, Vec{})
+		for i := range enod {
+			h.enod.Set(i, 0, enod[i].X)
+			h.enod.Set(i, 1, enod[i].Y)
+			h.enod.Set(i, 2, enod[i].Z)
+		}
+		h.jac0.Mul(dN0, h.enod)
+	}
+}
+
+// setB stores in B the strain-displacement matrix of the shape functions
+// whose derivatives in global coordinates are the columns of grad.
+func setB(B, grad *mat.Dense) {
+	_, n := grad.Dims()
+	for i := 0; i < n; i++ {
+		// First three rows.
+		B.Set(0, i*3, grad.At(0, i))
+		B.Set(1, i*3+1, grad.At(1, i))
+		B.Set(2, i*3+2, grad.At(2, i))
+		// Fourth row.
+		B.Set(3, i*3, grad.At(1, i))
+		B.Set(3, i*3+1, grad.At(0, i))
+		// Fifth row.
+		B.Set(4, i*3+1, grad.At(2, i))
+		B.Set(4, i*3+2, grad.At(1, i))
+		// Sixth row.
+		B.Set(5, i*3, grad.At(2, i))
+		B.Set(5, i*3+2, grad.At(0, i))
+	}
+}
+
+// gradient sets the shape function derivatives in global coordinates dNxyz of
+// the element with node positions enod at Gauss point ipg. It returns the
+// integration weight times |det(J)|, the volume represented by the Gauss point.
+func (h *elementIntegrator) gradient(enod []Vec, ipg int) (dV float64) {
+	for i := range enod {
+		h.enod.Set(i, 0, enod[i].X)
+		h.enod.Set(i, 1, enod[i].Y)
+		h.enod.Set(i, 2, enod[i].Z)
+	}
+	h.jac.Mul(h.dN[ipg], h.enod)
+	h.dNxyz.Solve(h.jac, h.dN[ipg])
+	// Absolute value so elements with mirrored node ordering integrate correctly.
+	return math.Abs(h.jac.Det()) * h.wpg[ipg]
+}
+
+// bmatrix sets the strain-displacement matrix B of the element with node
+// positions enod at Gauss point ipg. It returns the volume represented by the
+// Gauss point as gradient does. B is that of the element's formulation: the
+// volume averaged one of ReducedIntegration, with the mean volumetric strain
+// for BBar and without incompatible modes for IncompatibleModes.
+func (h *elementIntegrator) bmatrix(enod []Vec, ipg int) (dV float64) {
+	dV = h.gradient(enod, ipg)
+	switch h.formulation {
+	case ReducedIntegration:
+		setB(h.B, h.mean)
+	case BBar:
+		setB(h.B, h.dNxyz)
+		// B̄ = B + m*(b̄ - b)ᵀ/3 where b holds the volumetric strain row.
+		for i := range enod {
+			for k := 0; k < 3; k++ {
+				d := (h.mean.At(k, i) - h.dNxyz.At(k, i)) / 3
+				for r := 0; r < 3; r++ {
+					if r == k {
+						h.B.Set(r, 3*i+k, h.dNxyz.At(k, i)+d)
+					} else {
+						h.B.Set(r, 3*i+k, d)
+					}
+				}
+			}
+		}
+	default:
+		setB(h.B, h.dNxyz)
+	}
+	return dV
+}
+
+// incompatible sets the strain-displacement matrix G of the incompatible
+// modes at Gauss point ipg after a call to gradient at that point. The mode
+// gradients use the Jacobian at the element center scaled by the ratio of its
+// determinant to that of the point, so that ∫ G dV vanishes.
+func (h *elementIntegrator) incompatible(ipg int) {
+	pg := h.upg[ipg]
+	var dP Mat
+	for k, x := range [3]float64{pg.X, pg.Y, pg.Z} {
+		dP.Set(k, k, -2*x)
+	}
+	var grad mat.Dense
+	grad.Solve(h.jac0, &dP)
+	grad.Scale(h.jac0.Det()/h.jac.Det(), &grad)
+	setB(h.G, &grad)
+}
+
+// stiffness stores the element stiffness matrix in Ke.
+//  Ke = ∫ Bᵀ*C*B dV
+func (h *elementIntegrator) stiffness(Ke *mat.Dense, enod []Vec, C mat.Matrix) {
+	h.setElement(enod)
+	switch h.formulation {
+	case ReducedIntegration:
+		h.reducedStiffness(Ke, enod, C)
+		return
+	case IncompatibleModes:
+		Kci, Kii := h.incompatibleStiffness(Ke, enod, C)
+		if Kii == nil {
+			return
+		}
+		// Static condensation Ke - Kci*Kii⁻¹*Kciᵀ.
+		var X, KX mat.Dense
+		if err := Kii.SolveTo(&X, Kci.T()); err != nil {
+			panic(err)
+		}
+		KX.Mul(Kci, &X)
+		Ke.Sub(Ke, &KX)
+		return
+	}
+	Ke.Zero()
+	for ipg := range h.upg {
+		dV := h.bmatrix(enod, ipg)
+		h.aux1.Mul(h.B.T(), C)
+		h.aux2.Mul(h.aux1, h.B)
+		h.aux2.Scale(dV, h.aux2)
+		Ke.Add(Ke, h.aux2)
+	}
+}
+
+// reducedStiffness stores in Ke the one point stiffness matrix of the
+// element with node positions enod and its hourglass stiffness:
+//  Ke = V*B̄ᵀ*C*B̄ + c*Σ γₐ*γₐᵀ
+// The hourglass vectors γₐ = hₐ - Σᵢ (hₐ⋅xᵢ)*b̄ᵢ are the hourglass modes hₐ
+// of the reference element made orthogonal to linear fields, b̄ᵢ being the
+// averaged shape function derivatives along axis i and xᵢ the node
+// coordinates. c = Hourglass*μ*V*Σ |b̄|²/8 where μ is the mean shear stiffness
+// of C.
+func (h *elementIntegrator) reducedStiffness(Ke *mat.Dense, enod []Vec, C mat.Matrix) {
+	setB(h.B, h.mean)
+	h.aux1.Mul(h.B.T(), C)
+	Ke.Mul(h.aux1, h.B)
+	Ke.Scale(h.volume, Ke)
+	n := len(enod)
+	var bb float64
+	for i := 0; i < 3; i++ {
+		for a := 0; a < n; a++ {
+			bb += h.mean.At(i, a) * h.mean.At(i, a)
+		}
+	}
+	mu := (C.At(3, 3) + C.At(4, 4) + C.At(5, 5)) / 3
+	c := h.hourglass * mu * h.volume * bb / 8
+	var gammas [4][8]float64
+	for alpha := range gammas {
+		var hg [8]float64
+		for a, x := range hexCorners {
+			hg[a] = [4]float64{x.X * x.Y, x.Y * x.Z, x.Z * x.X, x.X * x.Y * x.Z}[alpha]
+		}
+		var hx [3]float64
+		for a := range hg {
+			hx[0] += hg[a] * enod[a].X
+			hx[1] += hg[a] * enod[a].Y
+			hx[2] += hg[a] * enod[a].Z
+		}
+		for a := range hg {
+			gammas[alpha][a] = hg[a]
+			for i := 0; i < 3; i++ {
+				gammas[alpha][a] -= hx[i] * h.mean.At(i, a)
+			}
+		}
+	}
+	for a := 0; a < n; a++ {
+		for b := 0; b < n; b++ {
+			var g float64
+			for _, gamma := range gammas {
+				g += gamma[a] * gamma[b]
+			}
+			for k := 0; k < 3; k++ {
+				Ke.Set(3*a+k, 3*b+k, Ke.At(3*a+k, 3*b+k)+c*g)
+			}
+		}
+	}
+}
+
+// incompatibleStiffness stores in Ke, if not nil, the stiffness matrix of the
+// element with node positions enod without incompatible modes and returns the coupling
+// Kci of the nodal and internal degrees of freedom and the factorized
+// stiffness of the internal ones. Kii is nil if it is not positive definite,
+// as for a void material, in which case the internal modes carry no energy
+// and are taken as zero.
+//  Kci = ∫ Bᵀ*C*G dV
+//  Kii = ∫ Gᵀ*C*G dV
+func (h *elementIntegrator) incompatibleStiffness(Ke *mat.Dense, enod []Vec, C mat.Matrix) (Kci *mat.Dense, Kii *mat.Cholesky) {
+	ne := 3 * len(enod)
+	if Ke != nil {
+		Ke.Zero()
+	}
+	Kci = mat.NewDense(ne, 9, nil)
+	kii := mat.NewDense(9, 9, nil)
+	var CG, aux mat.Dense
+	for ipg := range h.upg {
+		dV := h.bmatrix(enod, ipg)
+		h.incompatible(ipg)
+		if Ke != nil {
+			h.aux1.Mul(h.B.T(), C)
+			h.aux2.Mul(h.aux1, h.B)
+			h.aux2.Scale(dV, h.aux2)
+			Ke.Add(Ke, h.aux2)
+		}
+		CG.Mul(C, h.G)
+		CG.Scale(dV, &CG)
+		aux.Mul(h.B.T(), &CG)
+		Kci.Add(Kci, &aux)
+		aux.Reset()
+		aux.Mul(h.G.T(), &CG)
+		kii.Add(kii, &aux)
+		aux.Reset()
+	}
+	sym := mat.NewSymDense(9, nil)
+	for i := 0; i < 9; i++ {
+		for j := i; j < 9; j++ {
+			sym.SetSym(i, j, (kii.At(i, j)+kii.At(j, i))/2)
+		}
+	}
+	Kii = &mat.Cholesky{}
+	if !Kii.Factorize(sym) {
+		return Kci, nil
+	}
+	return Kci, Kii
+}
+
+// incompatibleThermalLoad returns the load on the incompatible modes of the
+// element with node positions enod of the thermal strain cte*ΔT, where the
+// temperature change ΔT is interpolated from the element nodal values dT.
+//  fₐ = ∫ Gᵀ*C*cte*ΔT dV
+func (h *elementIntegrator) incompatibleThermalLoad(enod []Vec, C mat.Matrix, cte [6]float64, dT []float64) *mat.VecDense {
+	var Ccte mat.VecDense
+	Ccte.MulVec(C, mat.NewVecDense(6, cte[:]))
+	fa := mat.NewVecDense(9, nil)
+	for ipg := range h.upg {
+		dV := h.gradient(enod, ipg)
+		h.incompatible(ipg)
+		var t float64
+		for i, N := range h.N[ipg] {
+			t += N * dT[i]
+		}
+		for j := 0; j < 9; j++ {
+			var v float64
+			for k := 0; k < 6; k++ {
+				v += h.G.At(k, j) * Ccte.AtVec(k)
+			}
+			fa.SetVec(j, fa.AtVec(j)+v*t*dV)
+		}
+	}
+	return fa
+}
+
+// strains stores in eps the strain at each quadrature point of the element
+// with node positions enod and nodal displacements ue, and in dV the volume
+// represented by each point. C is the constitutive matrix, which determines
+// the internal modes of IncompatibleModes together with the thermal strain
+// cte*ΔT of the element nodal temperature changes dT. dT may be nil if there
+// is no thermal strain.
+func (h *elementIntegrator) strains(eps [][6]float64, dV []float64, enod []Vec, ue []float64, C mat.Matrix, cte [6]float64, dT []float64) {
+	h.setElement(enod)
+	var alpha []float64
+	if h.formulation == IncompatibleModes {
+		// Internal modes α = Kii⁻¹*(fₐ - Kciᵀ*ue), zero if Kii is singular.
+		alpha = make([]float64, 9)
+		if Kci, Kii := h.incompatibleStiffness(nil, enod, C); Kii != nil {
+			var f, a mat.VecDense
+			f.MulVec(Kci.T(), mat.NewVecDense(len(ue), ue))
+			if dT != nil {
+				f.SubVec(&f, h.incompatibleThermalLoad(enod, C, cte, dT))
+			}
+			if err := Kii.SolveVecTo(&a, &f); err != nil {
+				panic(err)
+			}
+			for i := range alpha {
+				alpha[i] = -a.AtVec(i)
+			}
+		}
+	}
+	for ipg := range h.upg {
+		dV[ipg] = h.bmatrix(enod, ipg)
+		for k := range eps[ipg] {
+			eps[ipg][k] = 0
+			for j, u := range ue {
+				eps[ipg][k] += h.B.At(k, j) * u
+			}
+		}
+		if alpha != nil {
+			h.incompatible(ipg)
+			for k := range eps[ipg] {
+				for j, a := range alpha {
+					eps[ipg][k] += h.G.At(k, j) * a
+				}
+			}
+		}
+	}
+}
+
+// nonlinear stores in fe the internal forces and, if Ke is not nil, the
+// tangent stiffness matrix in Ke of the element with reference node positions
+// enod and nodal displacements ue in the total Lagrangian formulation:
+//  fe = ∫ Bᵀ*S dV₀
+//  Ke = ∫ Bᵀ*D*B + G dV₀
+// where B is the strain-displacement matrix of the Green-Lagrange strain E at
+// the deformation gradient F and G the geometric stiffness of the second
+// Piola-Kirchhoff stress S. law stores S and D = ∂S/∂E at quadrature point ipg.
+func (h *elementIntegrator) nonlinear(Ke *mat.Dense, fe []float64, enod []Vec, ue []float64, law func(ipg int, F *Mat, S *[6]float64, D *mat.Dense)) {
+	for i := range fe {
+		fe[i] = 0
+	}
+	var D *mat.Dense
+	if Ke != nil {
+		Ke.Zero()
+		D = mat.NewDense(6, 6, nil)
+	}
+	n := len(enod)
+	B, dN := h.B, h.dNxyz
+	var F Mat
+	var S [6]float64
+	for ipg := range h.upg {
+		dV := h.gradient(enod, ipg)
+		// F = I + ∂u/∂X
+		F.CloneFrom(Eye())
+		for a := 0; a < n; a++ {
+			for i := 0; i < 3; i++ {
+				for j := 0; j < 3; j++ {
+					F.Set(i, j, F.At(i, j)+ue[3*a+i]*dN.At(j, a))
+				}
+			}
+		}
+		law(ipg, &F, &S, D)
+		for a := 0; a < n; a++ {
+			for k := 0; k < 3; k++ {
+				col := 3*a + k
+				B.Set(0, col, F.At(k, 0)*dN.At(0, a))
+				B.Set(1, col, F.At(k, 1)*dN.At(1, a))
+				B.Set(2, col, F.At(k, 2)*dN.At(2, a))
+				B.Set(3, col, F.At(k, 0)*dN.At(1, a)+F.At(k, 1)*dN.At(0, a))
+				B.Set(4, col, F.At(k, 1)*dN.At(2, a)+F.At(k, 2)*dN.At(1, a))
+				B.Set(5, col, F.At(k, 0)*dN.At(2, a)+F.At(k, 2)*dN.At(0, a))
+			}
+		}
+		for j := range fe {
+			var v float64
+			for k := 0; k < 6; k++ {
+				v += B.At(k, j) * S[k]
+			}
+			fe[j] += v * dV
+		}
+		if Ke == nil {
+			continue
+		}
+		h.aux1.Mul(B.T(), D)
+		h.aux2.Mul(h.aux1, B)
+		h.aux2.Scale(dV, h.aux2)
+		Ke.Add(Ke, h.aux2)
+		h.addGeometric(Ke, S, dV)
+	}
+}
+
+// addGeometric adds to Ke the geometric stiffness ∇Naᵀ*S*∇Nb*dV of the
+// stress S on the diagonal of each node block, using the shape function
+// derivatives of the last call to gradient.
+func (h *elementIntegrator) addGeometric(Ke *mat.Dense, S [6]float64, dV float64) {
+	St := voigtTensor(S)
+	dN := h.dNxyz
+	n := h.elem.NumNodes()
+	for a := 0; a < n; a++ {
+		for b := 0; b < n; b++ {
+			var g float64
+			for i := 0; i < 3; i++ {
+				for j := 0; j < 3; j++ {
+					g += dN.At(i, a) * St.At(i, j) * dN.At(j, b)
+				}
+			}
+			for k := 0; k < 3; k++ {
+				Ke.Set(3*a+k, 3*b+k, Ke.At(3*a+k, 3*b+k)+g*dV)
+			}
+		}
+	}
+}
+
+// geometricStiffness stores in Kg the geometric stiffness matrix of the
+// element with node positions enod under the stress at each quadrature point.
+//  Kg = ∫ Gᵀ*σ*G dV
+// where G holds the shape function gradients, so that uᵀ*Kg*u is the work of
+// the stress on the quadratic part of the Green-Lagrange strain.
+func (h *elementIntegrator) geometricStiffness(Kg *mat.Dense, enod []Vec, stress [][6]float64) {
+	Kg.Zero()
+	for ipg := range h.upg {
+		dV := h.gradient(enod, ipg)
+		h.addGeometric(Kg, stress[ipg], dV)
+	}
+}
+
+// smallStrain stores in fe the internal forces and, if Ke is not nil, the
+// tangent stiffness matrix in Ke of the element with node positions enod and
+// nodal displacements ue under small strains:
+//  fe = ∫ Bᵀ*σ dV
+//  Ke = ∫ Bᵀ*D*B dV
+// law stores the stress σ and the tangent D = ∂σ/∂ε of the strain ε at
+// quadrature point ipg.
+func (h *elementIntegrator) smallStrain(Ke *mat.Dense, fe []float64, enod []Vec, ue []float64, law func(ipg int, strain, S *[6]float64, D *mat.Dense)) {
+	for i := range fe {
+		fe[i] = 0
+	}
+	var D *mat.Dense
+	if Ke != nil {
+		Ke.Zero()
+		D = mat.NewDense(6, 6, nil)
+	}
+	h.setElement(enod)
+	var strain, S [6]float64
+	for ipg := range h.upg {
+		dV := h.bmatrix(enod, ipg)
+		for k := range strain {
+			strain[k] = 0
+			for j, u := range ue {
+				strain[k] += h.B.At(k, j) * u
+			}
+		}
+		law(ipg, &strain, &S, D)
+		for j := range fe {
+			var v float64
+			for k := 0; k < 6; k++ {
+				v += h.B.At(k, j) * S[k]
+			}
+			fe[j] += v * dV
+		}
+		if Ke == nil {
+			continue
+		}
+		h.aux1.Mul(h.B.T(), D)
+		h.aux2.Mul(h.aux1, h.B)
+		h.aux2.Scale(dV, h.aux2)
+		Ke.Add(Ke, h.aux2)
+	}
+}
+
+// thermalLoad stores in fe the element nodal forces equivalent to the thermal
+// strain α*ΔT, where the temperature change ΔT is interpolated from the
+// element nodal values dT.
+//  fe = ∫ Bᵀ*C*α*ΔT dV
+// For IncompatibleModes the load fₐ on the internal modes is condensed as
+// the stiffness is, fe - Kci*Kii⁻¹*fₐ.
+func (h *elementIntegrator) thermalLoad(fe []float64, enod []Vec, C mat.Matrix, alpha [6]float64, dT []float64) {
+	for i := range fe {
+		fe[i] = 0
+	}
+	var Calpha mat.VecDense
+	Calpha.MulVec(C, mat.NewVecDense(6, alpha[:]))
+	h.setElement(enod)
+	for ipg := range h.upg {
+		dV := h.bmatrix(enod, ipg)
+		var t float64
+		for i, N := range h.N[ipg] {
+			t += N * dT[i]
+		}
+		for j := range fe {
+			var v float64
+			for k := 0; k < 6; k++ {
+				v += h.B.At(k, j) * Calpha.AtVec(k)
+			}
+			fe[j] += v * t * dV
+		}
+	}
+	if h.formulation != IncompatibleModes {
+		return
+	}
+	Kci, Kii := h.incompatibleStiffness(nil, enod, C)
+	if Kii == nil {
+		return
+	}
+	var x, Kx mat.VecDense
+	if err := Kii.SolveVecTo(&x, h.incompatibleThermalLoad(enod, C, alpha, dT)); err != nil {
+		panic(err)
+	}
+	Kx.MulVec(Kci, &x)
+	for j := range fe {
+		fe[j] -= Kx.AtVec(j)
+	}
+}
+
+// conduction stores the element conductivity matrix in Ke of a scalar field
+// with one degree of freedom per node and conductivity tensor k.
+//  Ke = ∫ ∇Nᵀ*k*∇N dV
+func (h *elementIntegrator) conduction(Ke *mat.Dense, enod []Vec, k mat.Matrix) {
+	Ke.Zero()
+	n := len(enod)
+	// Scratch space from disjoint blocks of aux2.
+	kdN := h.aux2.Slice(0, 3, 0, n).(*mat.Dense)
+	aux := h.aux2.Slice(n, 2*n, 0, n).(*mat.Dense)
+	for ipg := range h.upg {
+		dV := h.gradient(enod, ipg)
+		kdN.Mul(k, h.dNxyz)
+		aux.Mul(h.dNxyz.T(), kdN)
+		aux.Scale(dV, aux)
+		Ke.Add(Ke, aux)
+	}
+}
+
+// mass stores the consistent element mass matrix in Me of a field with
+// ndof degrees of freedom per node.
+//  Me = ∫ ρ*Nᵀ*N dV
+// The integrator's quadrature rule must integrate N² exactly, see massQuadrature.
+func (h *elementIntegrator) mass(Me *mat.Dense, enod []Vec, rho float64, ndof int) {
+	Me.Zero()
+	for ipg := range h.upg {
+		dV := h.gradient(enod, ipg)
+		N := h.N[ipg]
+		for i := range N {
+			for j := range N {
+				m := rho * N[i] * N[j] * dV
+				for d := 0; d < ndof; d++ {
+					Me.Set(ndof*i+d, ndof*j+d, Me.At(ndof*i+d, ndof*j+d)+m)
+				}
+			}
+		}
+	}
+}
+
+// massQuadrature returns a quadrature rule that integrates the product of
+// two shape functions of elem exactly on undistorted elements.
+func massQuadrature(elem Element) (upg []Vec, wpg []float64) {
+	var degree int
+	switch elem.(type) {
+	case Tet4:
+		degree = 2
+	case Tet10:
+		degree = 4
+	default:
+		// Tensor product rules of hexahedra already integrate N² exactly.
+		return elem.Quadrature()
+	}
+	points, w := quadrature.Tetrahedron(degree)
+	for _, p := range points {
+		upg = append(upg, Vec{X: p[0], Y: p[1], Z: p[2]})
+	}
+	return upg, w
+}
+
+// element returns the model's element type.
+func (m *FEModel) element() Element {
+	if m.Element == nil {
+		return Hex8{}
+	}
+	return m.Element
+}
+
+// checkFormulation returns an error if the model's elements are Hex8 with a
+// formulation other than FullIntegration and those allowed by analysis.
+func (m *FEModel) checkFormulation(analysis string, allowed ...Hex8Formulation) error {
+	hex, ok := m.element().(Hex8)
+	if !ok || hex.Formulation == FullIntegration {
+		return nil
+	}
+	for _, f := range allowed {
+		if f == hex.Formulation {
+			return nil
+		}
+	}
+	return fmt.Errorf("Hex8 formulation %v not supported in %s analysis", hex.Formulation, analysis)
+}
+
+// validate checks element connectivity is consistent with the model's nodes and element type.
+func (m *FEModel) validate() error {
+	if len(m.Nodes) == 0 || len(m.Elems) == 0 {
+		return errors.New("empty model")
+	}
+	nn := m.element().NumNodes()
+	for i, elem := range m.Elems {
+		if len(elem) != nn {
+			return fmt.Errorf("element %d has %d nodes, expected %d", i, len(elem), nn)
+		}
+		for _, n := range elem {
+			if n < 0 || n >= len(m.Nodes) {
+				return fmt.Errorf("element %d references node %d out of range [0,%d)", i, n, len(m.Nodes))
+			}
+		}
+	}
+	return nil
+}
+
+// Quadratic returns a copy of the model with linear elements converted to
+// their quadratic counterpart: Tet4 to Tet10 and Hex8 to Hex20. Midside nodes
+// shared by neighbouring elements are created once and appended to the nodes.
+func (m FEModel) Quadratic() (FEModel, error) {
+	var edges [][2]int
+	var quad Element
+	switch m.element().(type) {
+	case Tet4:
+		edges, quad = tet10Edges[:], Tet10{}
+	case Hex8:
+		edges, quad = hex20Edges[:], Hex20{}
+	default:
+		return m, fmt.Errorf("no quadratic counterpart for %T", m.element())
+	}
+	if err := m.validate(); err != nil {
+		return m, err
+	}
+	q := m
+	q.Element = quad
+	q.Nodes = append([]Vec(nil), m.Nodes...)
+	q.Elems = make([][]int, len(m.Elems))
+	midside := make(map[[2]int]int)
+	for iele, elem := range m.Elems {
+		qe := append(make([]int, 0, len(elem)+len(edges)), elem...)
+		for _, e := range edges {
+			key := [2]int{elem[e[0]], elem[e[1]]}
+			if key[0] > key[1] {
+				key[0], key[1] = key[1], key[0]
+			}
+			n, ok := midside[key]
+			if !ok {
+				n = len(q.Nodes)
+				midside[key] = n
+				q.Nodes = append(q.Nodes, Scale(0.5, Add(m.Nodes[key[0]], m.Nodes[key[1]])))
+			}
+			qe = append(qe, n)
+		}
+		q.Elems[iele] = qe
+	}
+	return q, nil
+}
+
+// meshElems converts fixed size element connectivity to the
+// slice form used by FEModel.
+func meshElems[E [4]int | [8]int | [10]int | [20]int](elems []E) [][]int {
+	s := make([][]int, len(elems))
+	for i := range elems {
+		s[i] = make([]int, len(elems[i]))
+		for j := range s[i] {
+			s[i][j] = elems[i][j]
+		}
+	}
+	return s
+}
+
+// tetraModel returns a Tet4 model of the tetrahedra produced by
+// tmesh.meshTetraBCC. Degenerate tetrahedra are discarded.
+func tetraModel(nodes []Vec, tetras [][4]int) FEModel {
+	model := FEModel{Nodes: nodes, Element: Tet4{}}
+	for _, t := range tetras {
+		if t[0] == t[1] || t[0] == t[2] || t[0] == t[3] || t[1] == t[2] || t[1] == t[3] || t[2] == t[3] {
+			continue
+		}
+		model.Elems = append(model.Elems, []int{t[0], t[1], t[2], t[3]})
+	}
+	return model
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// ExplicitSettings configures SolveExplicit.
+type ExplicitSettings struct {
+	// TimeStep is the time step Δt. If zero the critical time step of the
+	// model scaled by Safety is used. The last step is shortened to end at Duration.
+	TimeStep float64
+	// Safety scales the critical time step when TimeStep is zero. Defaults to 0.8.
+	Safety float64
+	// Duration is the simulated time.
+	Duration float64
+	// MassDamping α and StiffnessDamping β define the Rayleigh damping
+	// matrix α*M + β*K, which damps mode i with the damping ratio
+	// α/(2*ωᵢ) + β*ωᵢ/2. Stiffness damping reduces the critical time step.
+	MassDamping, StiffnessDamping float64
+	// InitialDisplacement and InitialVelocity hold the nodal displacements and
+	// velocities at time zero. If nil they are zero.
+	InitialDisplacement, InitialVelocity []float64
+	// Loads returns the loads at time t, which is called once per time step.
+	// Prescribed displacements may change in time. Multi-point constraints are
+	// not supported. If nil there are no loads.
+	Loads func(t float64) StaticLoads
+	// Snapshots holds the times at which displacements, velocities and energies
+	// are recorded. Times that fall between steps are interpolated linearly.
+	Snapshots []float64
+}
+
+// ExplicitResult holds the time history recorded by SolveExplicit.
+type ExplicitResult struct {
+	// TimeStep is the time step used.
+	TimeStep float64
+	// Times holds the snapshot times in ascending order.
+	Times []float64
+	// Displacements and Velocities hold the nodal displacements and velocities
+	// at each snapshot time.
+	Displacements, Velocities [][]float64
+	// Energies holds the energy balance at each snapshot time.
+	Energies []EnergyBalance
+}
+
+// EnergyBalance holds the energies of a dynamic analysis at a point in time.
+// The total energy Kinetic + Strain + Damping - External is conserved, so its
+// drift measures the error of the time integration.
+type EnergyBalance struct {
+	// Kinetic is the kinetic energy of the degrees of freedom that are not
+	// prescribed and Strain the elastic strain energy.
+	Kinetic, Strain float64
+	// External is the work done by the loads and supports since time zero.
+	External float64
+	// Damping is the energy dissipated by damping since time zero.
+	Damping float64
+}
+
+// Total returns Kinetic + Strain + Damping - External.
+func (e EnergyBalance) Total() float64 {
+	return e.Kinetic + e.Strain + e.Damping - e.External
+}
+
+// CriticalTimeStep estimates the largest stable time step of the central
+// difference method on model with lumped masses as the smallest ratio of
+// element size to wave speed. The element size is the volume over the largest
+// face area, times three for tetrahedra, and a quarter of that for quadratic
+// elements. The wave speed is √(λmax/ρ), where λmax is the largest eigenvalue
+// of the element's constitutive tensor, which bounds the speed of plane waves
+// in any direction. The estimate is exact for a bar of linear hexahedra
+// without lateral contraction and slightly optimistic for some meshes, so
+// time steps should include a safety factor.
+func CriticalTimeStep(model FEModel, materials []Material) (float64, error) {
+	if err := model.validate(); err != nil {
+		return 0, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return 0, err
+	}
+	density, err := model.elemProperty(materials, func(m Material) float64 { return m.Density })
+	if err != nil {
+		return 0, err
+	}
+	return criticalTimeStep(model, elemC, density)
+}
+
+func criticalTimeStep(model FEModel, elemC []*mat.Dense, density []float64) (float64, error) {
+	elem := model.element()
+	integ := newElementIntegrator(elem)
+	faces := elem.Faces()
+	corners := faceCorners(faces[0])
+	scale := 1.0
+	if corners == 3 {
+		scale = 3 // Tetrahedron altitude.
+	}
+	if len(faces[0]) > corners {
+		scale /= 4 // Midside nodes.
+	}
+	enod := make([]Vec, elem.NumNodes())
+	// Largest eigenvalue of each distinct constitutive matrix.
+	lmax := make(map[*mat.Dense]float64)
+	dt := math.Inf(1)
+	for iele, enodes := range model.Elems {
+		if density[iele] <= 0 {
+			return 0, fmt.Errorf("element %d has no mass", iele)
+		}
+		C := elemC[iele]
+		l, ok := lmax[C]
+		if !ok {
+			l = maxStiffness(C)
+			lmax[C] = l
+		}
+		storeElemNode(enod, model.Nodes, enodes)
+		var vol, area float64
+		for ipg := range integ.upg {
+			vol += integ.gradient(enod, ipg)
+		}
+		for _, lf := range faces {
+			a, b, c := enod[lf[0]], enod[lf[1]], enod[lf[2]]
+			var n Vec
+			if faceCorners(lf) == 3 {
+				n = Cross(Sub(b, a), Sub(c, a))
+			} else {
+				n = Cross(Sub(c, a), Sub(enod[lf[3]], b))
+			}
+			area = math.Max(area, Norm(n)/2)
+		}
+		if l > 0 {
+			dt = math.Min(dt, scale*vol/area/math.Sqrt(l/density[iele]))
+		}
+	}
+	return dt, nil
+}
+
+// maxStiffness returns the largest eigenvalue of the constitutive tensor of
+// the Voigt matrix C, which is that of C in Mandel notation.
+func maxStiffness(C mat.Matrix) float64 {
+	s := [6]float64{1, 1, 1, math.Sqrt2, math.Sqrt2, math.Sqrt2}
+	mandel := mat.NewSymDense(6, nil)
+	for i := 0; i < 6; i++ {
+		for j := i; j < 6; j++ {
+			mandel.SetSym(i, j, s[i]*s[j]*(C.At(i, j)+C.At(j, i))/2)
+		}
+	}
+	var eig mat.EigenSym
+	if !eig.Factorize(mandel, false) {
+		return math.NaN()
+	}
+	return floats.Max(eig.Values(nil))
+}
+
+// SolveExplicit integrates the equations of motion
+//  M*a + (α*M + β*K)*v + K*u = f
+// of model in time with the central difference method and a lumped mass
+// matrix M:
+//  vₙ₊½ = vₙ₋½ + Δt*M⁻¹*(fₙ - K*uₙ - (α*M + β*K)*vₙ₋½)
+//  uₙ₊₁ = uₙ + Δt*vₙ₊½
+// The method is explicit: internal forces are computed element by element and
+// no global matrix is assembled or factorized, so memory grows linearly with
+// the model size. It is stable for time steps below the critical time step,
+// which suits short duration events such as impacts.
+func SolveExplicit(model FEModel, materials []Material, settings ExplicitSettings) (ExplicitResult, error) {
+	var result ExplicitResult
+	if err := model.validate(); err != nil {
+		return result, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return result, err
+	}
+	density, err := model.elemProperty(materials, func(m Material) float64 { return m.Density })
+	if err != nil {
+		return result, err
+	}
+	if err := model.checkFormulation("explicit"); err != nil {
+		return result, err
+	}
+	alpha, beta := settings.MassDamping, settings.StiffnessDamping
+	if alpha < 0 || beta < 0 {
+		return result, fmt.Errorf("negative damping coefficients %g and %g", alpha, beta)
+	}
+	dt := settings.TimeStep
+	if dt == 0 {
+		safety := settings.Safety
+		if safety == 0 {
+			safety = 0.8
+		}
+		if !(safety > 0 && safety <= 1) {
+			return result, fmt.Errorf("safety factor %g out of range (0,1]", safety)
+		}
+		dtc, err := criticalTimeStep(model, elemC, density)
+		if err != nil {
+			return result, err
+		}
+		// Stiffness damping of the highest frequency 2/Δtc reduces the
+		// stability limit to Δtc*(√(1+ξ²) - ξ).
+		xi := beta / dtc
+		dt = safety * dtc * (math.Sqrt(1+xi*xi) - xi)
+	}
+	if !(dt > 0) || math.IsInf(dt, 0) || !(settings.Duration >= 0) {
+		return result, fmt.Errorf("invalid time step %g or duration %g", dt, settings.Duration)
+	}
+	result.TimeStep = dt
+	snapshots := append([]float64(nil), settings.Snapshots...)
+	sort.Float64s(snapshots)
+	if len(snapshots) > 0 && (snapshots[0] < 0 || snapshots[len(snapshots)-1] > settings.Duration) {
+		return result, errors.New("snapshot times must be within the simulated time")
+	}
+	n := 3 * len(model.Nodes)
+	u := make([]float64, n)
+	v := make([]float64, n)
+	for _, init := range []struct {
+		dst, src []float64
+		name     string
+	}{{u, settings.InitialDisplacement, "displacements"}, {v, settings.InitialVelocity, "velocities"}} {
+		if init.src == nil {
+			continue
+		}
+		if len(init.src) != n {
+			return result, fmt.Errorf("got %d initial %s for %d degrees of freedom: %w", len(init.src), init.name, n, mat.ErrShape)
+		}
+		copy(init.dst, init.src)
+	}
+	mass := assembleMass(model, density, 3, true).Diag()
+	sys := newExplicitSystem(model, elemC, beta)
+	// external returns the external forces and prescribed displacements at t.
+	external := func(t float64) ([]float64, map[int]float64, error) {
+		f := make([]float64, n)
+		if settings.Loads == nil {
+			return f, nil, nil
+		}
+		loads := settings.Loads(t)
+		if loads.Constraints != nil {
+			return nil, nil, errors.New("multi-point constraints not supported in explicit analysis")
+		}
+		for dof := range loads.Displacement {
+			if dof < 0 || dof >= n {
+				return nil, nil, fmt.Errorf("prescribed displacement of degree of freedom %d out of range [0,%d)", dof, n)
+			}
+		}
+		if err := loads.assemble(model, materials, elemC, f); err != nil {
+			return nil, nil, err
+		}
+		return f, loads.Displacement, nil
+	}
+	fext, prescribed, err := external(0)
+	if err != nil {
+		return result, err
+	}
+	for dof, value := range prescribed {
+		u[dof] = value
+	}
+	for i, m := range mass {
+		if _, ok := prescribed[i]; !ok && m <= 0 {
+			return result, fmt.Errorf("degree of freedom %d has no mass", i)
+		}
+	}
+
+	var (
+		fint   = make([]float64, n)
+		fdamp  = make([]float64, n)
+		a      = make([]float64, n)
+		vm     = make([]float64, n) // Velocity half a step back.
+		vp     = make([]float64, n) // Velocity half a step ahead.
+		u1     = make([]float64, n)
+		v1     = make([]float64, n)
+		energy EnergyBalance
+	)
+	// accelerate stores in a the accelerations of the free degrees of freedom
+	// under the forces of the current state, with damping forces evaluated at
+	// the velocity vd. It returns the strain energy.
+	accelerate := func(u, vd, fext []float64, prescribed map[int]float64) float64 {
+		strain := sys.forces(u, vd, fint, fdamp)
+		for i := range a {
+			fdamp[i] += alpha * mass[i] * vd[i]
+			a[i] = 0
+			if _, ok := prescribed[i]; !ok {
+				a[i] = (fext[i] - fint[i] - fdamp[i]) / mass[i]
+			}
+		}
+		return strain
+	}
+	energy.Strain = accelerate(u, v, fext, prescribed)
+	for i := range v {
+		vm[i] = v[i] - dt/2*a[i]
+		vp[i] = v[i] + dt/2*a[i]
+	}
+	energy.Kinetic = kineticEnergy(mass, vm, vp, prescribed)
+	interpolated := make([]float64, 2*n)
+	record := func(t float64, u, v []float64, e EnergyBalance) {
+		result.Times = append(result.Times, t)
+		result.Displacements = append(result.Displacements, append([]float64(nil), u...))
+		result.Velocities = append(result.Velocities, append([]float64(nil), v...))
+		result.Energies = append(result.Energies, e)
+	}
+	for len(snapshots) > 0 && snapshots[0] == 0 {
+		record(0, u, v, energy)
+		snapshots = snapshots[1:]
+	}
+	// Forces acting on the degrees of freedom at the start of the step and
+	// the damping forces. Prescribed degrees of freedom are acted on by the
+	// supports, their inertia being excluded along with their kinetic energy.
+	support := make([]float64, n)
+	storeSupport := func(fext []float64, prescribed map[int]float64) {
+		copy(support, fext)
+		for dof := range prescribed {
+			support[dof] = fint[dof] + fdamp[dof]
+		}
+	}
+	storeSupport(fext, prescribed)
+	dissipation := append([]float64(nil), fdamp...)
+	t := 0.0
+	for step := 1; t < settings.Duration; step++ {
+		// Step times are computed from the step count to avoid accumulating round-off.
+		t1 := math.Min(float64(step)*dt, settings.Duration)
+		h := t1 - t
+		fext1, prescribed1, err := external(t1)
+		if err != nil {
+			return result, err
+		}
+		for i := range u1 {
+			u1[i] = u[i] + h*vp[i]
+		}
+		for dof, value := range prescribed1 {
+			u1[dof] = value
+			vp[dof] = (value - u[dof]) / h
+		}
+		strain := accelerate(u1, vp, fext1, prescribed1)
+		// Work over the step with the trapezoidal rule, for which the energy
+		// balance of the central difference method is exact.
+		var work, dissipated float64
+		for i := range u1 {
+			du := u1[i] - u[i]
+			f := fext1[i]
+			if _, ok := prescribed1[i]; ok {
+				f = fint[i] + fdamp[i]
+			}
+			work += du * (support[i] + f) / 2
+			dissipated += du * (dissipation[i] + fdamp[i]) / 2
+		}
+		storeSupport(fext1, prescribed1)
+		copy(dissipation, fdamp)
+		// Velocities at t1 and half a step ahead. The next step may be shorter.
+		next := math.Min(dt, settings.Duration-t1)
+		if next == 0 {
+			next = h
+		}
+		copy(vm, vp)
+		for i := range v1 {
+			v1[i] = vm[i] + h/2*a[i]
+			vp[i] = v1[i] + next/2*a[i]
+		}
+		e0 := energy
+		energy = EnergyBalance{
+			Kinetic:  kineticEnergy(mass, vm, vp, prescribed1),
+			Strain:   strain,
+			External: energy.External + work,
+			Damping:  energy.Damping + dissipated,
+		}
+		for len(snapshots) > 0 && snapshots[0] <= t1 {
+			w := (snapshots[0] - t) / h
+			ui, vi := interpolated[:n], interpolated[n:]
+			for i := range ui {
+				ui[i] = (1-w)*u[i] + w*u1[i]
+				vi[i] = (1-w)*v[i] + w*v1[i]
+			}
+			record(snapshots[0], ui, vi, EnergyBalance{
+				Kinetic:  (1-w)*e0.Kinetic + w*energy.Kinetic,
+				Strain:   (1-w)*e0.Strain + w*energy.Strain,
+				External: (1-w)*e0.External + w*energy.External,
+				Damping:  (1-w)*e0.Damping + w*energy.Damping,
+			})
+			snapshots = snapshots[1:]
+		}
+		u, u1 = u1, u
+		v, v1 = v1, v
+		t = t1
+	}
+	return result, nil
+}
+
+// kineticEnergy returns vmᵀ*M*vp/2 over the degrees of freedom that are not
+// prescribed for the diagonal mass matrix with diagonal mass. With the
+// velocities half a step before and after a time the central difference
+// method conserves energy exactly.
+func kineticEnergy(mass, vm, vp []float64, prescribed map[int]float64) float64 {
+	var e float64
+	for i, m := range mass {
+		if _, ok := prescribed[i]; !ok {
+			e += m * vm[i] * vp[i] / 2
+		}
+	}
+	return e
+}
+
+// explicitSystem evaluates the internal forces of a linear elastic model
+// element by element. Shape function gradients are computed once for each
+// distinct element shape, so voxel meshes of identical elements need little
+// memory. It holds per element results so elements are processed in
+// parallel and summed in element order.
+type explicitSystem struct {
+	model        FEModel
+	elemC        []*mat.Dense
+	beta         float64
+	shapes       []elemGradients
+	elemShape    []int
+	elemF, elemD []float64
+	elemU        []float64
+}
+
+// elemGradients holds the shape function derivatives in global coordinates
+// at each quadrature point of an element, ∂Nₐ/∂xᵢ at dN[ipg][i*n+a] for n
+// nodes, and the volume represented by each point.
+type elemGradients struct {
+	dN [][]float64
+	dV []float64
+}
+
+func newExplicitSystem(model FEModel, elemC []*mat.Dense, beta float64) *explicitSystem {
+	elem := model.element()
+	nn := elem.NumNodes()
+	ne := 3 * nn
+	s := &explicitSystem{
+		model:     model,
+		elemC:     elemC,
+		beta:      beta,
+		elemShape: make([]int, len(model.Elems)),
+		elemF:     make([]float64, len(model.Elems)*ne),
+		elemD:     make([]float64, len(model.Elems)*ne),
+		elemU:     make([]float64, len(model.Elems)),
+	}
+	integ := newElementIntegrator(elem)
+	enod := make([]Vec, nn)
+	// Elements are of the same shape if their nodes are equal relative to
+	// their first node.
+	shapes := make(map[string]int)
+	key := make([]byte, 0, 24*nn)
+	for iele, enodes := range model.Elems {
+		storeElemNode(enod, model.Nodes, enodes)
+		key = key[:0]
+		for _, n := range enod {
+			d := Sub(n, enod[0])
+			for _, x := range [3]float64{d.X, d.Y, d.Z} {
+				var b [8]byte
+				binary.LittleEndian.PutUint64(b[:], math.Float64bits(x))
+				key = append(key, b[:]...)
+			}
+		}
+		k, ok := shapes[string(key)]
+		if !ok {
+			k = len(s.shapes)
+			shapes[string(key)] = k
+			var g elemGradients
+			for ipg := range integ.upg {
+				g.dV = append(g.dV, integ.gradient(enod, ipg))
+				g.dN = append(g.dN, mat.DenseCopyOf(integ.dNxyz).RawMatrix().Data)
+			}
+			s.shapes = append(s.shapes, g)
+		}
+		s.elemShape[iele] = k
+	}
+	return s
+}
+
+// forces stores the elastic forces K*u in fint and the stiffness
+// proportional damping forces β*K*v in fdamp. It returns the strain energy
+// uᵀ*K*u/2.
+func (s *explicitSystem) forces(u, v, fint, fdamp []float64) float64 {
+	model := s.model
+	nn := model.element().NumNodes()
+	ne := 3 * nn
+	parallelElems(len(model.Elems), func() func(int) {
+		edofs := make([]int, ne)
+		ue := make([]float64, ne)
+		ve := make([]float64, ne)
+		return func(iele int) {
+			storeElemDofs(edofs, model.Elems[iele], 3)
+			for i, dof := range edofs {
+				ue[i], ve[i] = u[dof], v[dof]
+			}
+			fe, fd := s.elemF[iele*ne:(iele+1)*ne], s.elemD[iele*ne:(iele+1)*ne]
+			for i := range fe {
+				fe[i], fd[i] = 0, 0
+			}
+			var C [6][6]float64
+			for i := range C {
+				for j := range C[i] {
+					C[i][j] = s.elemC[iele].At(i, j)
+				}
+			}
+			g := s.shapes[s.elemShape[iele]]
+			var strain float64
+			for ipg, dN := range g.dN {
+				dV := g.dV[ipg]
+				var e, edot, S, Sd [6]float64
+				for a := 0; a < nn; a++ {
+					grad := Vec{X: dN[a], Y: dN[nn+a], Z: dN[2*nn+a]}
+					addStrain(&e, ue[3*a:3*a+3], grad)
+					addStrain(&edot, ve[3*a:3*a+3], grad)
+				}
+				for i := range S {
+					for j := range e {
+						S[i] += C[i][j] * e[j]
+						Sd[i] += s.beta * C[i][j] * edot[j]
+					}
+					strain += e[i] * S[i] * dV / 2
+				}
+				for a := 0; a < nn; a++ {
+					gx, gy, gz := dN[a]*dV, dN[nn+a]*dV, dN[2*nn+a]*dV
+					fe[3*a] += S[0]*gx + S[3]*gy + S[5]*gz
+					fe[3*a+1] += S[3]*gx + S[1]*gy + S[4]*gz
+					fe[3*a+2] += S[5]*gx + S[4]*gy + S[2]*gz
+					fd[3*a] += Sd[0]*gx + Sd[3]*gy + Sd[5]*gz
+					fd[3*a+1] += Sd[3]*gx + Sd[1]*gy + Sd[4]*gz
+					fd[3*a+2] += Sd[5]*gx + Sd[4]*gy + Sd[2]*gz
+				}
+			}
+			s.elemU[iele] = strain
+		}
+	})
+	for i := range fint {
+		fint[i], fdamp[i] = 0, 0
+	}
+	edofs := make([]int, ne)
+	var strain float64
+	for iele, enodes := range model.Elems {
+		storeElemDofs(edofs, enodes, 3)
+		for i, dof := range edofs {
+			fint[dof] += s.elemF[iele*ne+i]
+			fdamp[dof] += s.elemD[iele*ne+i]
+		}
+		strain += s.elemU[iele]
+	}
+	return strain
+}
+
+// addStrain adds to e the strain in Voigt notation of the displacement w of
+// a node whose shape function has gradient grad.
+func addStrain(e *[6]float64, w []float64, grad Vec) {
+	e[0] += w[0] * grad.X
+	e[1] += w[1] * grad.Y
+	e[2] += w[2] * grad.Z
+	e[3] += w[0]*grad.Y + w[1]*grad.X
+	e[4] += w[1]*grad.Z + w[2]*grad.Y
+	e[5] += w[0]*grad.Z + w[2]*grad.X
+}
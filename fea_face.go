@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"play/quadrature"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/spatial/r3"
+)
+
+// ElemFace is the face Face of element Elem, faces being numbered
+// as returned by the element type's Faces method.
+type ElemFace struct {
+	Elem, Face int
+}
+
+// BoundaryFaces returns the element faces on the boundary of the model, that is
+// faces not shared by two elements, for which f returns true when called with the
+// face centroid and outward unit normal. If f is nil all boundary faces are returned.
+// The normal is that of the plane through the face's first three corners.
+func (m *FEModel) BoundaryFaces(f func(centroid, normal Vec) bool) []ElemFace {
+	elem := m.element()
+	lfaces := elem.Faces()
+	// Faces are identified by their sorted corner nodes.
+	count := make(map[[4]int]int)
+	key := func(enodes []int, lf []int) [4]int {
+		k := [4]int{-1, -1, -1, -1}
+		nc := faceCorners(lf)
+		for i := 0; i < nc; i++ {
+			k[i] = enodes[lf[i]]
+		}
+		sort.Ints(k[:nc])
+		return k
+	}
+	for _, enodes := range m.Elems {
+		for _, lf := range lfaces {
+			count[key(enodes, lf)]++
+		}
+	}
+	var faces []ElemFace
+	for iele, enodes := range m.Elems {
+		for iface, lf := range lfaces {
+			if count[key(enodes, lf)] != 1 {
+				continue
+			}
+			if f != nil {
+				centroid, normal := m.faceGeometry(enodes, lf)
+				if !f(centroid, normal) {
+					continue
+				}
+			}
+			faces = append(faces, ElemFace{Elem: iele, Face: iface})
+		}
+	}
+	return faces
+}
+
+// checkFaces checks faces reference existing elements and faces.
+func (m *FEModel) checkFaces(faces []ElemFace) error {
+	nfaces := len(m.element().Faces())
+	for _, face := range faces {
+		if face.Elem < 0 || face.Elem >= len(m.Elems) || face.Face < 0 || face.Face >= nfaces {
+			return fmt.Errorf("invalid element face %+v", face)
+		}
+	}
+	return nil
+}
+
+// DistanceField is a signed distance function, negative inside the surface
+// it describes. It is implemented by sdf.SDF3.
+type DistanceField interface {
+	Evaluate(p r3.Vec) float64
+}
+
+// SDFFaces returns a face predicate for BoundaryFaces that selects faces
+// whose centroid lies within tol of the surface of s, such as
+//  faces := model.BoundaryFaces(SDFFaces(s, 1e-3))
+// where s may be the SDF the model was meshed from or a part of it.
+func SDFFaces(s DistanceField, tol float64) func(centroid, normal Vec) bool {
+	return func(centroid, _ Vec) bool {
+		return math.Abs(s.Evaluate(r3.Vec(centroid))) <= tol
+	}
+}
+
+// faceGeometry returns the centroid of the corners of face lf of the element
+// with nodes enodes and its outward unit normal.
+func (m *FEModel) faceGeometry(enodes []int, lf []int) (centroid, normal Vec) {
+	nc := faceCorners(lf)
+	for i := 0; i < nc; i++ {
+		centroid = Add(centroid, m.Nodes[enodes[lf[i]]])
+	}
+	centroid = Scale(1/float64(nc), centroid)
+	a, b, c := m.Nodes[enodes[lf[0]]], m.Nodes[enodes[lf[1]]], m.Nodes[enodes[lf[2]]]
+	normal = Unit(Cross(Sub(b, a), Sub(c, a)))
+	// Elements with mirrored node ordering have inward counter-clockwise faces.
+	var elemCentroid Vec
+	for _, n := range enodes {
+		elemCentroid = Add(elemCentroid, m.Nodes[n])
+	}
+	elemCentroid = Scale(1/float64(len(enodes)), elemCentroid)
+	if Dot(normal, Sub(centroid, elemCentroid)) < 0 {
+		normal = Scale(-1, normal)
+	}
+	return centroid, normal
+}
+
+// faceCorners returns the number of corner nodes of the face with local nodes lf.
+func faceCorners(lf []int) int {
+	if len(lf) == 3 || len(lf) == 6 {
+		return 3
+	}
+	return 4
+}
+
+// tetCorners holds the reference coordinates of tetrahedron corner nodes.
+var tetCorners = [4]Vec{{}, {X: 1}, {Y: 1}, {Z: 1}}
+
+// faceIntegrator evaluates element quantities at quadrature points on the faces
+// of an Element. Faces are mapped into the element's reference domain so the
+// element's own shape functions are used. It holds scratch space so it must not
+// be used concurrently.
+type faceIntegrator struct {
+	wpg [][]float64 // Weights of each face.
+	N   [][][]float64
+	dN  [][]*mat.Dense
+	// Derivatives of reference coordinates with respect to the face
+	// coordinates s and t at each point of each face.
+	duds, dudt [][]Vec
+	jac        *Mat
+	enod       *mat.Dense
+}
+
+func newFaceIntegrator(elem Element) *faceIntegrator {
+	var corners []Vec
+	switch elem.(type) {
+	case Tet4, Tet10:
+		corners = tetCorners[:]
+	case Hex8, Hex20:
+		corners = hexCorners[:]
+	default:
+		panic(fmt.Sprintf("no face integration for %T", elem))
+	}
+	// Shape functions are of order 2 when there are midside nodes. The rules
+	// integrate products of two shape functions exactly on flat faces.
+	order := 1
+	if elem.NumNodes() > len(corners) {
+		order = 2
+	}
+	n := elem.NumNodes()
+	faces := elem.Faces()
+	h := &faceIntegrator{
+		wpg:  make([][]float64, len(faces)),
+		N:    make([][][]float64, len(faces)),
+		dN:   make([][]*mat.Dense, len(faces)),
+		duds: make([][]Vec, len(faces)),
+		dudt: make([][]Vec, len(faces)),
+		jac:  NewMat(nil),
+		enod: mat.NewDense(n, 3, nil),
+	}
+	for iface, lf := range faces {
+		var c [4]Vec
+		for i := 0; i < faceCorners(lf); i++ {
+			c[i] = corners[lf[i]]
+		}
+		var upg, duds, dudt []Vec
+		if faceCorners(lf) == 3 {
+			// Affine map from the reference triangle.
+			pts, w := quadrature.Triangle(2 * order)
+			for _, p := range pts {
+				upg = append(upg, Add(c[0], Add(Scale(p[0], Sub(c[1], c[0])), Scale(p[1], Sub(c[2], c[0])))))
+				duds = append(duds, Sub(c[1], c[0]))
+				dudt = append(dudt, Sub(c[2], c[0]))
+			}
+			h.wpg[iface] = w
+		} else {
+			// Bilinear map from [-1,1]².
+			x, wx := gauss1D(order + 1)
+			xi := [4]float64{-1, 1, 1, -1}
+			eta := [4]float64{-1, -1, 1, 1}
+			for i := range x {
+				for j := range x {
+					s, t := x[i], x[j]
+					var u, us, ut Vec
+					for k := range xi {
+						u = Add(u, Scale((1+xi[k]*s)*(1+eta[k]*t)/4, c[k]))
+						us = Add(us, Scale(xi[k]*(1+eta[k]*t)/4, c[k]))
+						ut = Add(ut, Scale(eta[k]*(1+xi[k]*s)/4, c[k]))
+					}
+					upg = append(upg, u)
+					duds = append(duds, us)
+					dudt = append(dudt, ut)
+					h.wpg[iface] = append(h.wpg[iface], wx[i]*wx[j])
+				}
+			}
+		}
+		h.duds[iface], h.dudt[iface] = duds, dudt
+		for _, u := range upg {
+			N := make([]float64, n)
+			elem.Basis(N, u)
+			dN := mat.NewDense(3, n, nil)
+			elem.BasisDiff(dN, u)
+			h.N[iface] = append(h.N[iface], N)
+			h.dN[iface] = append(h.dN[iface], dN)
+		}
+	}
+	return h
+}
+
+// point returns the element shape functions at quadrature point ipg of face of
+// the element with node positions enod, the outward unit normal at the point
+// and the area represented by the point.
+func (h *faceIntegrator) point(enod []Vec, face, ipg int) (N []float64, normal Vec, dA float64) {
+	for i := range enod {
+		h.enod.Set(i, 0, enod[i].X)
+		h.enod.Set(i, 1, enod[i].Y)
+		h.enod.Set(i, 2, enod[i].Z)
+	}
+	h.jac.Mul(h.dN[face][ipg], h.enod)
+	// Rows of the jacobian are the derivatives of position with respect
+	// to the reference coordinates.
+	ts := h.jac.MulVecTrans(h.duds[face][ipg])
+	tt := h.jac.MulVecTrans(h.dudt[face][ipg])
+	normal = Cross(ts, tt)
+	area := Norm(normal)
+	normal = Scale(1/area, normal)
+	if h.jac.Det() < 0 {
+		// Mirrored node ordering flips the orientation of faces.
+		normal = Scale(-1, normal)
+	}
+	return h.N[face][ipg], normal, area * h.wpg[face][ipg]
+}
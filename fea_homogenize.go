@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// FEModel is a finite element mesh made up of a single element type.
+type FEModel struct {
+	Nodes []Vec
+	// Element is the type of all elements in the model. If nil Hex8 is used.
+	Element Element
+	// Elems holds the node indices of each element. Local node
+	// ordering follows the documentation of the element type.
+	Elems [][]int
+	// ElemMaterial is the region tag of each element: an index into the
+	// materials used for analysis. If nil every element is assigned the first material.
+	ElemMaterial []int
+	// ElemOrientation is the rotation from material axes to global axes of each
+	// element. If nil, or for nil entries, material axes are the global axes.
+	ElemOrientation []*Mat
+}
+
+// Material holds the properties of a material.
+type Material struct {
+	// C is the 6×6 constitutive matrix in Voigt notation in material axes.
+	// Strains are ordered xx, yy, zz, xy, yz, xz with engineering shear strains.
+	C *mat.Dense
+	// Density is the mass per unit volume, used for mass matrices.
+	Density float64
+	// SpecificHeat is the heat capacity per unit mass, used with
+	// Density for capacity matrices of transient thermal analyses.
+	SpecificHeat float64
+	// Conductivity is the 3×3 thermal conductivity tensor in material axes,
+	// used for scalar field analyses.
+	Conductivity *mat.Dense
+	// CTE holds the coefficients of thermal expansion in Voigt notation in
+	// material axes, the thermal strain per unit temperature change. Shear
+	// terms are engineering strains and are zero for orthotropic materials.
+	CTE [6]float64
+	// Hyperelastic is the finite strain model of the material used by
+	// SolveNonlinear. If nil the St. Venant-Kirchhoff model of C is used.
+	// Hyperelastic models are isotropic so element orientations do not apply.
+	Hyperelastic Hyperelastic
+	// Plasticity is the yield and hardening model of the material used by
+	// SolvePlastic, which requires an isotropic C. If nil the material is
+	// linear elastic.
+	Plasticity *J2Plasticity
+}
+
+// SetMaterial assigns material to the elements in elems.
+func (m *FEModel) SetMaterial(elems []int, material int) {
+	if m.ElemMaterial == nil {
+		m.ElemMaterial = make([]int, len(m.Elems))
+	}
+	for _, e := range elems {
+		m.ElemMaterial[e] = material
+	}
+}
+
+// SetOrientation assigns the material axes rotation R to the elements in elems.
+func (m *FEModel) SetOrientation(elems []int, R *Mat) {
+	if m.ElemOrientation == nil {
+		m.ElemOrientation = make([]*Mat, len(m.Elems))
+	}
+	for _, e := range elems {
+		m.ElemOrientation[e] = R
+	}
+}
+
+// elemConstitutive returns the constitutive matrix of every element
+// in global axes. Elements that share material and orientation share
+// the returned matrix.
+func (m *FEModel) elemConstitutive(materials []Material) ([]*mat.Dense, error) {
+	return m.elemTensors(materials, func(material Material, R *Mat) (*mat.Dense, error) {
+		if R == nil {
+			return material.C, nil
+		}
+		return rotateStiffness(material.C, R), nil
+	})
+}
+
+// elemConductivity returns the conductivity tensor of every element in global
+// axes. Elements that share material and orientation share the returned matrix.
+func (m *FEModel) elemConductivity(materials []Material) ([]*mat.Dense, error) {
+	return m.elemTensors(materials, func(material Material, R *Mat) (*mat.Dense, error) {
+		k := material.Conductivity
+		if k == nil {
+			return nil, errors.New("material has no conductivity")
+		}
+		if r, c := k.Dims(); r != 3 || c != 3 {
+			return nil, fmt.Errorf("conductivity is %d×%d: %w", r, c, mat.ErrShape)
+		}
+		if R == nil {
+			return k, nil
+		}
+		// k' = R*k*Rᵀ
+		var rk mat.Dense
+		rk.Mul(R, k)
+		rk.Mul(&rk, R.T())
+		return &rk, nil
+	})
+}
+
+// elemCTE returns the thermal expansion coefficients of every element in
+// global axes.
+func (m *FEModel) elemCTE(materials []Material) ([][6]float64, error) {
+	alphas, err := m.elemTensors(materials, func(material Material, R *Mat) (*mat.Dense, error) {
+		alpha := material.CTE
+		if R != nil {
+			alpha = rotateStrain(alpha, R)
+		}
+		return mat.NewDense(6, 1, alpha[:]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cte := make([][6]float64, len(alphas))
+	for iele, alpha := range alphas {
+		copy(cte[iele][:], alpha.RawMatrix().Data)
+	}
+	return cte, nil
+}
+
+// elemTensors returns the material tensor of every element in global axes as
+// returned by tensor for the element's material and orientation R, which may be nil.
+// tensor is called once per distinct material and orientation.
+func (m *FEModel) elemTensors(materials []Material, tensor func(material Material, R *Mat) (*mat.Dense, error)) ([]*mat.Dense, error) {
+	if err := m.checkMaterials(materials); err != nil {
+		return nil, err
+	}
+	type key struct {
+		material int
+		R        *Mat
+	}
+	cache := make(map[key]*mat.Dense)
+	Ts := make([]*mat.Dense, len(m.Elems))
+	for iele := range m.Elems {
+		k := key{material: m.material(iele)}
+		if m.ElemOrientation != nil {
+			k.R = m.ElemOrientation[iele]
+		}
+		T, ok := cache[k]
+		if !ok {
+			var err error
+			T, err = tensor(materials[k.material], k.R)
+			if err != nil {
+				return nil, fmt.Errorf("material %d: %w", k.material, err)
+			}
+			cache[k] = T
+		}
+		Ts[iele] = T
+	}
+	return Ts, nil
+}
+
+// elemProperty returns the scalar material property of every element.
+func (m *FEModel) elemProperty(materials []Material, property func(Material) float64) ([]float64, error) {
+	if err := m.checkMaterials(materials); err != nil {
+		return nil, err
+	}
+	p := make([]float64, len(m.Elems))
+	for iele := range p {
+		p[iele] = property(materials[m.material(iele)])
+	}
+	return p, nil
+}
+
+// material returns the material index of element iele.
+func (m *FEModel) material(iele int) int {
+	if m.ElemMaterial == nil {
+		return 0
+	}
+	return m.ElemMaterial[iele]
+}
+
+// checkMaterials checks the element materials and orientations are
+// consistent with the model's elements and materials.
+func (m *FEModel) checkMaterials(materials []Material) error {
+	if len(materials) == 0 {
+		return errors.New("no materials")
+	}
+	if m.ElemMaterial != nil && len(m.ElemMaterial) != len(m.Elems) {
+		return fmt.Errorf("%d element materials for %d elements", len(m.ElemMaterial), len(m.Elems))
+	}
+	if m.ElemOrientation != nil && len(m.ElemOrientation) != len(m.Elems) {
+		return fmt.Errorf("%d element orientations for %d elements", len(m.ElemOrientation), len(m.Elems))
+	}
+	for iele, material := range m.ElemMaterial {
+		if material < 0 || material >= len(materials) {
+			return fmt.Errorf("element %d has material %d out of range [0,%d)", iele, material, len(materials))
+		}
+	}
+	return nil
+}
+
+// HomogenizeSettings configures Homogenize.
+type HomogenizeSettings struct {
+	// Box is the representative unit cell (RUC). Nodes on the faces of Box are
+	// constrained periodically to their image on the opposite face.
+	Box Box
+	// Strain is the magnitude of the macroscopic strain imposed in each
+	// load case. Since the analysis is linear it only affects round-off. Defaults to 0.1.
+	Strain float64
+	// Tolerance is the distance within which nodes are considered to lie on a
+	// RUC face or to coincide with a periodic image. Defaults to 1e-6 times the
+	// length of the diagonal of Box.
+	Tolerance float64
+	// NonMatching allows meshes whose opposite faces do not match node for node.
+	// Nodes without a coincident image are constrained to the interpolated
+	// displacement of the opposite face. If false such nodes are reported
+	// with an *UnpairedNodesError.
+	NonMatching bool
+	// ThermalExpansion enables the load case from which the effective thermal
+	// expansion coefficients of HomogenizeReport are computed.
+	ThermalExpansion bool
+}
+
+// HomogenizeReport holds the results of the individual load cases of Homogenize.
+// Load cases are ordered xx, yy, zz, xy, xz, yz as in imposedDisplacementForRUC.
+type HomogenizeReport struct {
+	// Strain holds the strain of each load case averaged over the RUC volume.
+	Strain [6][6]float64
+	// Stress holds the stress of each load case averaged over the RUC volume.
+	Stress [6][6]float64
+	// Volume is the volume of the mesh. It is less than the volume of the RUC box
+	// for porous cells.
+	Volume float64
+	// Constraints is the number of periodic node pairs.
+	Constraints int
+	// Displacements holds the nodal displacements of each load case for use
+	// with RecoverStress. Displacements of node i are at indices 3*i to 3*i+2.
+	Displacements [6][]float64
+	// CTE holds the effective thermal expansion coefficients of the RUC in
+	// Voigt notation with engineering shear strains. It is only computed if
+	// enabled by HomogenizeSettings.ThermalExpansion.
+	CTE [6]float64
+}
+
+// Homogenize computes the effective stiffness C of a periodic representative unit cell
+// in Voigt notation. Six macroscopic strain states are imposed on the cell through
+// periodic boundary conditions enforced with Lagrange multipliers and C is obtained
+// from the volume averaged stresses. If settings.ThermalExpansion is set, the
+// effective thermal expansion coefficients are obtained from a seventh load
+// case, a unit temperature rise at zero macroscopic strain, and returned in the
+// report. The load case is skipped if no material expands. An error of the
+// thermal load case is returned along with C.
+//
+// Elements are assigned materials through the model's ElemMaterial and ElemOrientation.
+func Homogenize(model FEModel, materials []Material, settings HomogenizeSettings) (C [6][6]float64, report HomogenizeReport, err error) {
+	if err := model.validate(); err != nil {
+		return C, report, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return C, report, err
+	}
+	size := settings.Box.Size()
+	boxVolume := size.X * size.Y * size.Z
+	if !(boxVolume > 0) {
+		return C, report, fmt.Errorf("invalid RUC box %+v", settings.Box)
+	}
+	strain := settings.Strain
+	if strain == 0 {
+		strain = 0.1
+	}
+	nodes := model.Nodes
+	tol := settings.Tolerance
+	if tol == 0 {
+		tol = 1e-6 * Norm(size)
+	}
+	constraints, err := rucPeriodicConstraints(nodes, model.Elems, model.element(), settings.Box, tol, settings.NonMatching)
+	if err != nil {
+		return C, report, err
+	}
+	if len(constraints) == 0 {
+		return C, report, errors.New("no periodic node pairs found on RUC faces")
+	}
+	report.Constraints = len(constraints)
+
+	K := assembleStiffness(model, elemC)
+	// Factorize once, only the imposed displacements change between load cases.
+	system, err := newPeriodicSystem(K, nodes, constraints, 3, settings.Box)
+	if err != nil {
+		return C, report, err
+	}
+
+	var macroStrain, avgStress mat.Dense
+	macroStrain.ReuseAs(6, 6)
+	avgStress.ReuseAs(6, 6)
+	for rucCase := 0; rucCase < 6; rucCase++ {
+		eps := imposedDisplacementForRUC(rucCase, strain)
+		macroStrain.SetCol(rucCase, voigtStrain(eps))
+		report.Displacements[rucCase], err = system.solve(func(dx Vec, d int) float64 {
+			return eps.At(d, 0)*dx.X + eps.At(d, 1)*dx.Y + eps.At(d, 2)*dx.Z
+		}, nil)
+		if err != nil {
+			return C, report, err
+		}
+		res, err := RecoverStress(model, materials, report.Displacements[rucCase])
+		if err != nil {
+			return C, report, err
+		}
+		// Volume average of strain and stress.
+		var strainSum, stressSum [6]float64
+		volume := 0.0
+		for iele := range res.GaussVolume {
+			for ipg, dV := range res.GaussVolume[iele] {
+				volume += dV
+				for i := 0; i < 6; i++ {
+					strainSum[i] += dV * res.GaussStrain[iele][ipg][i]
+					stressSum[i] += dV * res.GaussStress[iele][ipg][i]
+				}
+			}
+		}
+		report.Volume = volume
+		for i := 0; i < 6; i++ {
+			report.Strain[rucCase][i] = strainSum[i] / boxVolume
+			report.Stress[rucCase][i] = stressSum[i] / boxVolume
+			avgStress.Set(i, rucCase, report.Stress[rucCase][i])
+		}
+	}
+	// Columns of macroStrain and avgStress are the load cases: S = C*E.
+	var Ceff mat.Dense
+	err = Ceff.Solve(macroStrain.T(), avgStress.T())
+	if err != nil {
+		return C, report, err
+	}
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			C[i][j] = Ceff.At(j, i)
+		}
+	}
+
+	if !settings.ThermalExpansion {
+		return C, report, nil
+	}
+	// A unit temperature rise at zero macroscopic strain produces the average
+	// stress -C*α from which the effective thermal expansion α is obtained.
+	elemCTE, err := model.elemCTE(materials)
+	if err != nil {
+		return C, report, err
+	}
+	expands := false
+	for _, cte := range elemCTE {
+		expands = expands || cte != [6]float64{}
+	}
+	if !expands {
+		return C, report, nil
+	}
+	T := make([]float64, len(nodes))
+	for i := range T {
+		T[i] = 1
+	}
+	f := make([]float64, 3*len(nodes))
+	assembleThermalLoad(model, elemC, elemCTE, T, 0, f)
+	u, err := system.solve(func(Vec, int) float64 { return 0 }, f)
+	if err != nil {
+		return C, report, err
+	}
+	res, err := RecoverThermalStress(model, materials, u, T, 0)
+	if err != nil {
+		return C, report, err
+	}
+	thermalStress := mat.NewVecDense(6, nil)
+	for iele := range res.GaussVolume {
+		for ipg, dV := range res.GaussVolume[iele] {
+			for i := 0; i < 6; i++ {
+				thermalStress.SetVec(i, thermalStress.AtVec(i)-dV*res.GaussStress[iele][ipg][i]/boxVolume)
+			}
+		}
+	}
+	var alpha mat.VecDense
+	err = alpha.SolveVec(voigtDense(C), thermalStress)
+	if err != nil {
+		return C, report, fmt.Errorf("effective thermal expansion: %w", err)
+	}
+	for i := range report.CTE {
+		report.CTE[i] = alpha.AtVec(i)
+	}
+	return C, report, nil
+}
+
+// voigtPairs maps Voigt indices to tensor indices.
+var voigtPairs = [6][2]int{{0, 0}, {1, 1}, {2, 2}, {0, 1}, {1, 2}, {0, 2}}
+
+// rotateStiffness returns the Voigt constitutive matrix C expressed in
+// the axes rotated by R, that is
+//  C'ᵢⱼₖₗ = Rᵢₚ Rⱼq Rₖᵣ Rₗₛ Cₚqᵣₛ
+// where C is in material axes and R rotates material axes to global axes.
+func rotateStiffness(C mat.Matrix, R *Mat) *mat.Dense {
+	var voigt [3][3]int
+	for I, p := range voigtPairs {
+		voigt[p[0]][p[1]] = I
+		voigt[p[1]][p[0]] = I
+	}
+	// Rotate one index at a time to keep the operation count low.
+	var t, u [3][3][3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				for l := 0; l < 3; l++ {
+					t[i][j][k][l] = C.At(voigt[i][j], voigt[k][l])
+				}
+			}
+		}
+	}
+	for dim := 0; dim < 4; dim++ {
+		u = [3][3][3][3]float64{}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				for k := 0; k < 3; k++ {
+					for l := 0; l < 3; l++ {
+						idx := [4]int{i, j, k, l}
+						for p := 0; p < 3; p++ {
+							src := idx
+							src[dim] = p
+							u[i][j][k][l] += R.At(idx[dim], p) * t[src[0]][src[1]][src[2]][src[3]]
+						}
+					}
+				}
+			}
+		}
+		t = u
+	}
+	Crot := mat.NewDense(6, 6, nil)
+	for I, p := range voigtPairs {
+		for J, q := range voigtPairs {
+			Crot.Set(I, J, t[p[0]][p[1]][q[0]][q[1]])
+		}
+	}
+	return Crot
+}
+
+// rotateStrain returns the Voigt strain e with engineering shear strains
+// expressed in the axes rotated by R, that is ε' = R*ε*Rᵀ.
+func rotateStrain(e [6]float64, R *Mat) [6]float64 {
+	eps := voigtTensor([6]float64{e[0], e[1], e[2], e[3] / 2, e[4] / 2, e[5] / 2})
+	var rot mat.Dense
+	rot.Mul(R, eps)
+	rot.Mul(&rot, R.T())
+	var r [6]float64
+	copy(r[:], voigtStrain(&rot))
+	return r
+}
+
+// voigtStrain returns the Voigt vector of the symmetric strain tensor eps
+// with engineering shear strains.
+func voigtStrain(eps mat.Matrix) []float64 {
+	return []float64{
+		eps.At(0, 0), eps.At(1, 1), eps.At(2, 2),
+		2 * eps.At(0, 1), 2 * eps.At(1, 2), 2 * eps.At(0, 2),
+	}
+}
+
+// voigtDense returns the 6×6 Voigt matrix as a *mat.Dense.
+func voigtDense(C [6][6]float64) *mat.Dense {
+	m := mat.NewDense(6, 6, nil)
+	for i := range C {
+		m.SetRow(i, C[i][:])
+	}
+	return m
+}
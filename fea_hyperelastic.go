@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Hyperelastic is a finite strain material defined by a strain energy density.
+// Models must be safe for concurrent use.
+type Hyperelastic interface {
+	// Energy returns the strain energy per unit reference volume at the
+	// deformation gradient F.
+	Energy(F *Mat) float64
+	// Stress stores in S the second Piola-Kirchhoff stress in Voigt notation
+	// and, if D is not nil, the material tangent ∂S/∂E in D at the deformation
+	// gradient F. The Green-Lagrange strain E uses engineering shear strains so
+	// D is the linear constitutive matrix at the undeformed state.
+	Stress(F *Mat, S *[6]float64, D *mat.Dense)
+}
+
+var (
+	_ Hyperelastic = StVenantKirchhoff{}
+	_ Hyperelastic = NeoHookean{}
+	_ Hyperelastic = MooneyRivlin{}
+)
+
+// StVenantKirchhoff is the linear relation S = C*E between the second
+// Piola-Kirchhoff stress and the Green-Lagrange strain. It is suited to large
+// rotations with small strains and softens unrealistically in compression.
+type StVenantKirchhoff struct {
+	// C is the 6×6 constitutive matrix in Voigt notation.
+	C mat.Matrix
+}
+
+// Energy returns Eᵀ*C*E/2.
+func (m StVenantKirchhoff) Energy(F *Mat) float64 {
+	E := greenLagrange(F)
+	var w float64
+	for i := range E {
+		for j := range E {
+			w += E[i] * m.C.At(i, j) * E[j] / 2
+		}
+	}
+	return w
+}
+
+// Stress stores S = C*E in S and C in D.
+func (m StVenantKirchhoff) Stress(F *Mat, S *[6]float64, D *mat.Dense) {
+	E := greenLagrange(F)
+	for i := range S {
+		S[i] = 0
+		for j := range E {
+			S[i] += m.C.At(i, j) * E[j]
+		}
+	}
+	if D != nil {
+		D.Copy(m.C)
+	}
+}
+
+// NeoHookean is the compressible Neo-Hookean material with strain energy
+//  ψ = μ/2*(I₁ - 3) - μ*ln(J) + λ/2*ln(J)²
+// where I₁ is the trace of the right Cauchy-Green tensor C = FᵀF and J = det(F).
+// At small strains it is the isotropic linear material of Lamé constants μ and λ.
+type NeoHookean struct {
+	// Mu is the shear modulus μ and Lambda the first Lamé constant λ.
+	Mu, Lambda float64
+}
+
+// Energy returns the strain energy ψ.
+func (m NeoHookean) Energy(F *Mat) float64 {
+	I1, _, J := invariants(F)
+	lnJ := math.Log(J)
+	return m.Mu/2*(I1-3) - m.Mu*lnJ + m.Lambda/2*lnJ*lnJ
+}
+
+// Stress stores the second Piola-Kirchhoff stress in S and the tangent in D.
+func (m NeoHookean) Stress(F *Mat, S *[6]float64, D *mat.Dense) {
+	invariantStress(F, func(I1, I2, J float64) energyDerivatives {
+		lnJ := math.Log(J)
+		return energyDerivatives{
+			d1:  m.Mu / 2,
+			dJ:  (m.Lambda*lnJ - m.Mu) / J,
+			dJJ: (m.Mu + m.Lambda*(1-lnJ)) / (J * J),
+		}
+	}, S, D)
+}
+
+// MooneyRivlin is the compressible Mooney-Rivlin material with strain energy
+//  ψ = C10*(Ī₁ - 3) + C01*(Ī₂ - 3) + Bulk/2*(J - 1)²
+// where Ī₁ = J^(-2/3)*I₁ and Ī₂ = J^(-4/3)*I₂ are the isochoric invariants of
+// the right Cauchy-Green tensor C = FᵀF and J = det(F). At small strains its
+// shear modulus is 2*(C10 + C01) and its bulk modulus Bulk. C01 = 0 gives
+// the Neo-Hookean material with a volumetric-isochoric split.
+type MooneyRivlin struct {
+	C10, C01, Bulk float64
+}
+
+// Energy returns the strain energy ψ.
+func (m MooneyRivlin) Energy(F *Mat) float64 {
+	I1, I2, J := invariants(F)
+	return m.C10*(math.Pow(J, -2./3)*I1-3) + m.C01*(math.Pow(J, -4./3)*I2-3) + m.Bulk/2*(J-1)*(J-1)
+}
+
+// Stress stores the second Piola-Kirchhoff stress in S and the tangent in D.
+func (m MooneyRivlin) Stress(F *Mat, S *[6]float64, D *mat.Dense) {
+	invariantStress(F, func(I1, I2, J float64) energyDerivatives {
+		return energyDerivatives{
+			d1:  m.C10 * math.Pow(J, -2./3),
+			d2:  m.C01 * math.Pow(J, -4./3),
+			dJ:  -2./3*m.C10*math.Pow(J, -5./3)*I1 - 4./3*m.C01*math.Pow(J, -7./3)*I2 + m.Bulk*(J-1),
+			d1J: -2. / 3 * m.C10 * math.Pow(J, -5./3),
+			d2J: -4. / 3 * m.C01 * math.Pow(J, -7./3),
+			dJJ: 10./9*m.C10*math.Pow(J, -8./3)*I1 + 28./9*m.C01*math.Pow(J, -10./3)*I2 + m.Bulk,
+		}
+	}, S, D)
+}
+
+// energyDerivatives holds the first and second derivatives of a strain energy
+// ψ(I₁, I₂, J) with respect to its arguments, d12 being ∂²ψ/∂I₁∂I₂.
+type energyDerivatives struct {
+	d1, d2, dJ    float64
+	d11, d12, d22 float64
+	d1J, d2J, dJJ float64
+}
+
+// invariants returns the invariants I₁ and I₂ of the right Cauchy-Green tensor
+// C = FᵀF and the volume ratio J = det(F).
+func invariants(F *Mat) (I1, I2, J float64) {
+	var C Mat
+	C.Mul(F.T(), F)
+	var trC2 float64
+	for i := 0; i < 3; i++ {
+		I1 += C.At(i, i)
+		for j := 0; j < 3; j++ {
+			trC2 += C.At(i, j) * C.At(j, i)
+		}
+	}
+	return I1, (I1*I1 - trC2) / 2, F.Det()
+}
+
+// invariantStress stores in S the second Piola-Kirchhoff stress S = 2*∂ψ/∂C
+// and, if D is not nil, the tangent ∂S/∂E = 4*∂²ψ/∂C∂C in D of the strain
+// energy ψ(I₁, I₂, J) with derivatives psi at the deformation gradient F.
+// With A = I, B = I₁*I - C and G = J/2*C⁻¹ the derivatives of I₁, I₂ and J
+// with respect to C:
+//  S = 2*(ψ₁*A + ψ₂*B + ψⱼ*G)
+//  D = 4*(Σ ψₐₑ a⊗e + ψ₂*(A⊗A - 𝕀) + ψⱼ*(J/4*C⁻¹⊗C⁻¹ - J/2*𝕀(C⁻¹)))
+// where the sum runs over the pairs of A, B and G and 𝕀(C⁻¹)ᵢⱼₖₗ is
+// (C⁻¹ᵢₖ*C⁻¹ⱼₗ + C⁻¹ᵢₗ*C⁻¹ⱼₖ)/2, 𝕀 being 𝕀(I).
+func invariantStress(F *Mat, psi func(I1, I2, J float64) energyDerivatives, S *[6]float64, D *mat.Dense) {
+	I1, I2, J := invariants(F)
+	d := psi(I1, I2, J)
+	var C Mat
+	var Cinv mat.Dense
+	C.Mul(F.T(), F)
+	if err := Cinv.Inverse(&C); err != nil {
+		// Singular deformation, propagate NaN so solvers cut back.
+		Cinv.Scale(math.NaN(), Eye())
+	}
+	var A, B, G [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			B[i][j] = -C.At(i, j)
+			G[i][j] = J / 2 * Cinv.At(i, j)
+		}
+		A[i][i] = 1
+		B[i][i] += I1
+	}
+	for I, p := range voigtPairs {
+		i, j := p[0], p[1]
+		S[I] = 2 * (d.d1*A[i][j] + d.d2*B[i][j] + d.dJ*G[i][j])
+	}
+	if D == nil {
+		return
+	}
+	for I, p := range voigtPairs {
+		i, j := p[0], p[1]
+		for K, q := range voigtPairs {
+			k, l := q[0], q[1]
+			a, b, g := [2]float64{A[i][j], A[k][l]}, [2]float64{B[i][j], B[k][l]}, [2]float64{G[i][j], G[k][l]}
+			v := d.d11*a[0]*a[1] + d.d22*b[0]*b[1] + d.dJJ*g[0]*g[1] +
+				d.d12*(a[0]*b[1]+b[0]*a[1]) + d.d1J*(a[0]*g[1]+g[0]*a[1]) + d.d2J*(b[0]*g[1]+g[0]*b[1])
+			sym := (A[i][k]*A[j][l] + A[i][l]*A[j][k]) / 2
+			symInv := (Cinv.At(i, k)*Cinv.At(j, l) + Cinv.At(i, l)*Cinv.At(j, k)) / 2
+			v += d.d2 * (a[0]*a[1] - sym)
+			v += d.dJ * (J/4*Cinv.At(i, j)*Cinv.At(k, l) - J/2*symInv)
+			D.Set(I, K, 4*v)
+		}
+	}
+}
+
+// greenLagrange returns the Green-Lagrange strain E = (FᵀF - I)/2 of the
+// deformation gradient F in Voigt notation with engineering shear strains.
+func greenLagrange(F *Mat) [6]float64 {
+	var C Mat
+	C.Mul(F.T(), F)
+	var E [6]float64
+	for I, p := range voigtPairs {
+		E[I] = C.At(p[0], p[1])
+		if p[0] == p[1] {
+			E[I] = (E[I] - 1) / 2
+		}
+	}
+	return E
+}
+
+// elemHyperelastic returns the finite strain model of every element: the
+// material's Hyperelastic model or the St. Venant-Kirchhoff model of its
+// constitutive matrix in global axes.
+func (m *FEModel) elemHyperelastic(materials []Material) ([]Hyperelastic, error) {
+	elemC, err := m.elemTensors(materials, func(material Material, R *Mat) (*mat.Dense, error) {
+		switch {
+		case material.Plasticity != nil:
+			return nil, errors.New("plastic materials require SolvePlastic")
+		case material.Hyperelastic != nil:
+			return nil, nil
+		case material.C == nil:
+			return nil, errors.New("material has no constitutive matrix")
+		case R == nil:
+			return material.C, nil
+		}
+		return rotateStiffness(material.C, R), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	laws := make([]Hyperelastic, len(elemC))
+	for iele, C := range elemC {
+		laws[iele] = materials[m.material(iele)].Hyperelastic
+		if laws[iele] == nil {
+			laws[iele] = StVenantKirchhoff{C: C}
+		}
+	}
+	return laws, nil
+}
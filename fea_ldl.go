@@ -0,0 +1,479 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// LDL is a sparse LDLᵀ factorization of a symmetric, possibly indefinite, matrix
+//  P*A*Pᵀ = L*D*Lᵀ
+// where P is a fill-reducing permutation, L is unit lower triangular and D is diagonal.
+// Once factorized the same LDL can solve for any number of right hand sides.
+//
+// No dynamic pivoting is done. Saddle point systems such as those formed by
+// Lagrange multiplier constraints are handled by delaying the elimination of
+// the multipliers (see Factorize). Pivots that are still numerically zero are
+// perturbed if they belong to a delayed variable or to a variable coupled to a
+// delayed variable eliminated later, whose pivot completes the 2×2 pivot the
+// pair forms. The solution is then recovered by iterative refinement. Any other
+// zero pivot means the matrix is singular.
+type LDL struct {
+	a    *CSR
+	n    int
+	perm []int // perm[k] is the original index of the k-th pivot.
+	pinv []int // pinv[perm[k]] = k.
+	// L is stored column-wise excluding the unit diagonal.
+	lp []int
+	li []int
+	lx []float64
+	d  []float64
+	// etree is the elimination tree, only kept between symbolic and numeric factorization.
+	etree []int
+	// perturbed holds the pivots replaced during factorization.
+	perturbed []int
+}
+
+// Factorize computes the LDLᵀ factorization of the symmetric matrix A. Only the
+// sparsity pattern and values of A are used, A is not modified and must not
+// be modified while the factorization is in use.
+//
+// Variables where delayed is true are eliminated only after all of their
+// neighbors that are not delayed. Lagrange multipliers should be marked delayed
+// so that no zero diagonal is used as a pivot. delayed may be nil.
+// An error is returned if the matrix is found to be singular.
+func (f *LDL) Factorize(A *CSR, delayed []bool) error {
+	n, c := A.Dims()
+	if n != c {
+		return mat.ErrSquare
+	}
+	if delayed != nil && len(delayed) != n {
+		return fmt.Errorf("delayed length %d does not match matrix size %d: %w", len(delayed), n, mat.ErrShape)
+	}
+	*f = LDL{a: A, n: n}
+	f.perm = minimumDegree(A, delayed)
+	f.pinv = make([]int, n)
+	for k, p := range f.perm {
+		f.pinv[p] = k
+	}
+	f.symbolic()
+	return f.numeric(delayed)
+}
+
+// symbolic computes the elimination tree and the column pointers of L.
+func (f *LDL) symbolic() {
+	n, A := f.n, f.a
+	parent := make([]int, n)
+	flag := make([]int, n)
+	lnz := make([]int, n)
+	for k := 0; k < n; k++ {
+		parent[k] = -1
+		flag[k] = k
+		kk := f.perm[k]
+		for p := A.indptr[kk]; p < A.indptr[kk+1]; p++ {
+			i := f.pinv[A.ind[p]]
+			if i >= k {
+				continue
+			}
+			// Follow path from i to root of etree, stop at flagged node.
+			for ; flag[i] != k; i = parent[i] {
+				if parent[i] == -1 {
+					parent[i] = k
+				}
+				lnz[i]++
+				flag[i] = k
+			}
+		}
+	}
+	f.lp = make([]int, n+1)
+	for k := 0; k < n; k++ {
+		f.lp[k+1] = f.lp[k] + lnz[k]
+	}
+	f.li = make([]int, f.lp[n])
+	f.lx = make([]float64, f.lp[n])
+	f.d = make([]float64, n)
+	f.etree = parent
+}
+
+// numeric computes L and D with an up-looking algorithm.
+func (f *LDL) numeric(delayed []bool) error {
+	n, A := f.n, f.a
+	var anorm float64
+	for _, v := range A.data {
+		anorm = math.Max(anorm, math.Abs(v))
+	}
+	if anorm == 0 {
+		return errors.New("ldl: zero matrix")
+	}
+	tiny := anorm * 1e-13
+	// delayedAncestor[k] is true if a delayed variable is an ancestor of pivot
+	// k in the elimination tree, which holds the nonzero rows of column k of L.
+	delayedAncestor := make([]bool, n)
+	if delayed != nil {
+		for k := n - 1; k >= 0; k-- {
+			if p := f.etree[k]; p != -1 {
+				delayedAncestor[k] = delayed[f.perm[p]] || delayedAncestor[p]
+			}
+		}
+	}
+	y := make([]float64, n)
+	pattern := make([]int, n)
+	flag := make([]int, n)
+	lnz := make([]int, n)
+	parent := f.etree
+	for k := 0; k < n; k++ {
+		top := n
+		flag[k] = k
+		kk := f.perm[k]
+		for p := A.indptr[kk]; p < A.indptr[kk+1]; p++ {
+			i := f.pinv[A.ind[p]]
+			if i > k {
+				continue
+			}
+			y[i] += A.data[p]
+			length := 0
+			for ; flag[i] != k; i = parent[i] {
+				pattern[length] = i
+				length++
+				flag[i] = k
+			}
+			for length > 0 {
+				top--
+				length--
+				pattern[top] = pattern[length]
+			}
+		}
+		// Sparse triangular solve for row k of L.
+		dk := y[k]
+		y[k] = 0
+		for ; top < n; top++ {
+			i := pattern[top]
+			yi := y[i]
+			y[i] = 0
+			p2 := f.lp[i] + lnz[i]
+			for p := f.lp[i]; p < p2; p++ {
+				y[f.li[p]] -= f.lx[p] * yi
+			}
+			lki := yi / f.d[i]
+			dk -= lki * yi
+			f.li[p2] = k
+			f.lx[p2] = lki
+			lnz[i]++
+		}
+		if math.IsNaN(dk) || math.IsInf(dk, 0) {
+			return fmt.Errorf("ldl: invalid pivot %g at step %d", dk, k)
+		}
+		if math.Abs(dk) < tiny {
+			if delayed == nil || !delayed[kk] && !delayedAncestor[k] {
+				return &singularError{pivot: k, index: kk}
+			}
+			// Static pivot perturbation. Sign is kept so inertia is preserved
+			// as best as possible.
+			f.perturbed = append(f.perturbed, k)
+			if dk < 0 {
+				dk = -tiny
+			} else {
+				dk = tiny
+			}
+		}
+		f.d[k] = dk
+	}
+	f.etree = nil
+	return nil
+}
+
+// singularError is returned by Factorize for a zero pivot that cannot be perturbed.
+type singularError struct {
+	pivot int // Elimination step.
+	index int // Original index of the pivot variable.
+}
+
+func (e *singularError) Error() string {
+	return fmt.Sprintf("ldl: matrix singular at pivot %d (original index %d)", e.pivot, e.index)
+}
+
+// NNZ returns the number of stored off-diagonal entries of L.
+func (f *LDL) NNZ() int { return len(f.lx) }
+
+// Inertia returns the number of positive, negative and zero pivots of D, which
+// by Sylvester's law of inertia are the number of positive, negative and zero
+// eigenvalues of A. Pivots perturbed during factorization count as zero.
+func (f *LDL) Inertia() (pos, neg, zero int) {
+	for _, d := range f.d {
+		switch {
+		case d > 0:
+			pos++
+		case d < 0:
+			neg++
+		default:
+			zero++
+		}
+	}
+	for _, k := range f.perturbed {
+		if f.d[k] > 0 {
+			pos--
+		} else {
+			neg--
+		}
+		zero++
+	}
+	return pos, neg, zero
+}
+
+// SolveVecTo solves A*dst = b. If pivots were perturbed during factorization
+// the solution is improved with a few steps of iterative refinement and an
+// error is returned if the refinement does not converge, which happens when
+// the matrix is singular.
+func (f *LDL) SolveVecTo(dst, b []float64) error {
+	if len(dst) != f.n || len(b) != f.n {
+		panic(mat.ErrShape)
+	}
+	x := make([]float64, f.n)
+	f.solve(dst, b, x)
+	if len(f.perturbed) == 0 {
+		return nil
+	}
+	r := make([]float64, f.n)
+	dx := make([]float64, f.n)
+	const maxIter = 10
+	bnorm := floats.Norm(b, math.Inf(1))
+	var rnorm float64
+	for iter := 0; iter <= maxIter; iter++ {
+		f.a.MulVecTo(r, dst)
+		floats.SubTo(r, b, r)
+		rnorm = floats.Norm(r, math.Inf(1))
+		if rnorm <= 1e-14*bnorm {
+			return nil
+		}
+		if iter == maxIter {
+			break
+		}
+		f.solve(dx, r, x)
+		floats.Add(dst, dx)
+	}
+	return fmt.Errorf("ldl: iterative refinement reached %d iterations with residual %g for %d perturbed pivots: %w", maxIter, rnorm, len(f.perturbed), errNotConverged)
+}
+
+// SolveTo solves A*dst = b for every column of b. See SolveVecTo for the
+// errors returned.
+func (f *LDL) SolveTo(dst *mat.Dense, b mat.Matrix) error {
+	r, c := b.Dims()
+	if r != f.n {
+		panic(mat.ErrShape)
+	}
+	dst.ReuseAs(r, c)
+	col := make([]float64, r)
+	sol := make([]float64, r)
+	for j := 0; j < c; j++ {
+		mat.Col(col, j, b)
+		if err := f.SolveVecTo(sol, col); err != nil {
+			return err
+		}
+		dst.SetCol(j, sol)
+	}
+	return nil
+}
+
+// solve applies the factorization once. work must be of length n.
+func (f *LDL) solve(dst, b, work []float64) {
+	for k, p := range f.perm {
+		work[k] = b[p]
+	}
+	// L*y = Pb
+	for j := 0; j < f.n; j++ {
+		xj := work[j]
+		for p := f.lp[j]; p < f.lp[j+1]; p++ {
+			work[f.li[p]] -= f.lx[p] * xj
+		}
+	}
+	// D*z = y
+	for j := range work {
+		work[j] /= f.d[j]
+	}
+	// Lᵀ*x = z
+	for j := f.n - 1; j >= 0; j-- {
+		xj := work[j]
+		for p := f.lp[j]; p < f.lp[j+1]; p++ {
+			xj -= f.lx[p] * work[f.li[p]]
+		}
+		work[j] = xj
+	}
+	for k, p := range f.perm {
+		dst[p] = work[k]
+	}
+}
+
+// minimumDegree returns a fill-reducing elimination order for the symmetric
+// sparsity pattern of A. It is a minimum degree algorithm on the quotient graph
+// with element absorption and an approximate (upper bound) external degree,
+// in the spirit of AMD without supervariable detection.
+//
+// Variables where delayed is true become eligible for elimination only after
+// all of their non-delayed neighbors have been eliminated.
+func minimumDegree(A *CSR, delayed []bool) (perm []int) {
+	n := A.r
+	adj := make([][]int, n)
+	A.DoNonZero(func(i, j int, _ float64) {
+		if i != j {
+			adj[i] = append(adj[i], j)
+			adj[j] = append(adj[j], i)
+		}
+	})
+	isDelayed := func(i int) bool { return delayed != nil && delayed[i] }
+	var (
+		vars       = make([][]int, n) // Variable-variable adjacency.
+		elems      = make([][]int, n) // Variable-element adjacency.
+		elemVars   = make([][]int, n) // Element i's variables. Element i is variable i once eliminated.
+		eliminated = make([]bool, n)
+		absorbed   = make([]bool, n)
+		pending    = make([]int, n) // Non-delayed neighbors left before a delayed variable is eligible.
+		stamp      = make([]int, n) // Heap entry version.
+		mark       = make([]int, n)
+		tag        int
+		h          = make(degreeHeap, 0, n)
+	)
+	for i := range mark {
+		mark[i] = -1
+	}
+	for i := 0; i < n; i++ {
+		// Remove duplicates produced by symmetrization.
+		tag++
+		for _, j := range adj[i] {
+			if mark[j] != tag {
+				mark[j] = tag
+				vars[i] = append(vars[i], j)
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		if isDelayed(i) {
+			for _, j := range vars[i] {
+				if !isDelayed(j) {
+					pending[i]++
+				}
+			}
+		}
+		if pending[i] == 0 {
+			h = append(h, degreeItem{deg: len(vars[i]), idx: i})
+		}
+	}
+	// adj is the original graph, needed to update pending counts.
+	adj = make([][]int, n)
+	for i := range vars {
+		adj[i] = append([]int(nil), vars[i]...)
+	}
+	heap.Init(&h)
+	perm = make([]int, 0, n)
+	for len(perm) < n {
+		if h.Len() == 0 {
+			panic("minimum degree: no eligible variable left")
+		}
+		item := heap.Pop(&h).(degreeItem)
+		p := item.idx
+		if eliminated[p] || item.stamp != stamp[p] {
+			continue // Stale entry.
+		}
+		perm = append(perm, p)
+		eliminated[p] = true
+		// Build element p: union of adjacent variables and variables of adjacent elements.
+		tag++
+		mark[p] = tag
+		var Lp []int
+		for _, v := range vars[p] {
+			if !eliminated[v] && mark[v] != tag {
+				mark[v] = tag
+				Lp = append(Lp, v)
+			}
+		}
+		for _, e := range elems[p] {
+			if absorbed[e] {
+				continue
+			}
+			for _, v := range elemVars[e] {
+				if !eliminated[v] && mark[v] != tag {
+					mark[v] = tag
+					Lp = append(Lp, v)
+				}
+			}
+			absorbed[e] = true
+			elemVars[e] = nil
+		}
+		elemVars[p] = Lp
+		vars[p], elems[p] = nil, nil
+		for _, j := range adj[p] {
+			if isDelayed(j) && !isDelayed(p) {
+				pending[j]--
+			}
+		}
+		// Update the variables of the new element.
+		for _, i := range Lp {
+			vi := vars[i][:0]
+			for _, v := range vars[i] {
+				// Variables in Lp are now reached through element p.
+				if !eliminated[v] && mark[v] != tag {
+					vi = append(vi, v)
+				}
+			}
+			vars[i] = vi
+			ei := elems[i][:0]
+			for _, e := range elems[i] {
+				if !absorbed[e] {
+					ei = append(ei, e)
+				}
+			}
+			elems[i] = append(ei, p)
+			if pending[i] > 0 {
+				continue
+			}
+			deg := len(vars[i])
+			for _, e := range elems[i] {
+				deg += len(elemVars[e]) - 1
+			}
+			if deg > n {
+				deg = n
+			}
+			stamp[i]++
+			heap.Push(&h, degreeItem{deg: deg, idx: i, stamp: stamp[i]})
+		}
+		// Delayed neighbors may have just become eligible without being in Lp.
+		for _, j := range adj[p] {
+			if isDelayed(j) && !eliminated[j] && pending[j] == 0 && mark[j] != tag {
+				deg := len(vars[j])
+				for _, e := range elems[j] {
+					deg += len(elemVars[e]) - 1
+				}
+				stamp[j]++
+				heap.Push(&h, degreeItem{deg: deg, idx: j, stamp: stamp[j]})
+			}
+		}
+	}
+	return perm
+}
+
+type degreeItem struct {
+	deg, idx, stamp int
+}
+
+// degreeHeap is a min heap on degree with ties broken by index
+// so orderings are deterministic.
+type degreeHeap []degreeItem
+
+func (h degreeHeap) Len() int { return len(h) }
+func (h degreeHeap) Less(i, j int) bool {
+	if h[i].deg != h[j].deg {
+		return h[i].deg < h[j].deg
+	}
+	return h[i].idx < h[j].idx
+}
+func (h degreeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *degreeHeap) Push(x interface{}) { *h = append(*h, x.(degreeItem)) }
+func (h *degreeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Micromechanics holds analytical estimates of the effective stiffness of a
+// unidirectional fiber composite, computed by FiberComposite. Stiffnesses are
+// 6×6 Voigt matrices with the fibers along x.
+type Micromechanics struct {
+	// VolumeFraction is the fiber volume fraction.
+	VolumeFraction float64
+	// Voigt and Reuss are the volume averages of the stiffnesses and of the
+	// compliances of the phases, which bound the stiffness of any
+	// microstructure from above and below.
+	Voigt, Reuss *mat.Dense
+	// HalpinTsai is the transversely isotropic stiffness of the rule of
+	// mixtures for E1 and ν12 and of the Halpin-Tsai equations for E2, G12 and
+	// G23.
+	HalpinTsai *mat.Dense
+	// MoriTanaka is the Mori-Tanaka estimate for aligned circular fibers,
+	// which is exact to first order in the volume fraction.
+	MoriTanaka *mat.Dense
+	// HashinShtrikmanLower and HashinShtrikmanUpper bound the stiffness of
+	// composites whose fibers are distributed with transversely isotropic
+	// statistics. They are tighter than the Voigt and Reuss bounds but need
+	// not hold for periodic arrays, whose transverse stiffness is not isotropic.
+	HashinShtrikmanLower, HashinShtrikmanUpper *mat.Dense
+}
+
+// FiberComposite returns analytical estimates of the effective stiffness of
+// unidirectional fibers of stiffness fiber along x embedded in matrix with
+// volume fraction vf, such as those of orthotropicCompliance and
+// isotropicCompliance. The matrix must be isotropic and both stiffnesses
+// positive definite. Fiber stiffnesses that are not transversely isotropic
+// about x only apply to the Voigt, Reuss and Hashin-Shtrikman estimates;
+// Halpin-Tsai uses their E1, E2, ν12, G12 and G23.
+//
+// The Mori-Tanaka and Hashin-Shtrikman estimates share the form
+//  C = (Σ vᵣ*Cᵣ*Aᵣ)*(Σ vᵣ*Aᵣ)⁻¹,  Aᵣ = (I + P₀*(Cᵣ - C₀))⁻¹
+// where P₀ = S₀*C₀⁻¹ is the Hill tensor of a cylinder along x in an
+// isotropic reference medium C₀ and S₀ its Eshelby tensor. Mori-Tanaka
+// takes the matrix as reference. The Hashin-Shtrikman bounds take isotropic
+// references softer and stiffer than both phases, so the lower bound equals
+// Mori-Tanaka when the fiber is stiffer than the matrix.
+func FiberComposite(fiber, matrix mat.Matrix, vf float64) (Micromechanics, error) {
+	m := Micromechanics{VolumeFraction: vf}
+	if !(vf >= 0 && vf <= 1) {
+		return m, fmt.Errorf("volume fraction %g out of range [0,1]", vf)
+	}
+	cf, err := EngineeringConstants(fiber)
+	if err != nil {
+		return m, fmt.Errorf("fiber: %w", err)
+	}
+	cm, err := EngineeringConstants(matrix)
+	if err != nil {
+		return m, fmt.Errorf("matrix: %w", err)
+	}
+	Gm, Km, ok := isotropicModuli(matrix)
+	if !ok {
+		return m, errors.New("matrix stiffness not isotropic")
+	}
+	vm := 1 - vf
+	phases := []*mat.Dense{mandel(fiber), mandel(matrix)}
+	fractions := []float64{vf, vm}
+
+	m.Voigt = mat.NewDense(6, 6, nil)
+	for r, C := range phases {
+		m.Voigt.Add(m.Voigt, scaled(fractions[r], C))
+	}
+	m.Voigt = voigtFromMandel(m.Voigt)
+	var S, Sr mat.Dense
+	S.ReuseAs(6, 6)
+	for r, C := range phases {
+		if err := Sr.Inverse(C); err != nil {
+			return m, err
+		}
+		S.Add(&S, scaled(fractions[r], &Sr))
+	}
+	var Creuss mat.Dense
+	if err := Creuss.Inverse(&S); err != nil {
+		return m, err
+	}
+	m.Reuss = voigtFromMandel(&Creuss)
+
+	// Halpin-Tsai: M/Mm = (1 + ξ*η*vf)/(1 - η*vf), η = (Mf/Mm - 1)/(Mf/Mm + ξ).
+	// ξ = 2 for E2 is empirical for circular fibers, while ξ = 1 for G12 and
+	// ξ = 1/(3-4νm) for G23 match the exact dilute limit.
+	halpinTsai := func(Mf, Mm, xi float64) float64 {
+		eta := (Mf/Mm - 1) / (Mf/Mm + xi)
+		return Mm * (1 + xi*eta*vf) / (1 - eta*vf)
+	}
+	nuM := cm.Nu12
+	E1 := vf*cf.E1 + vm*cm.E1
+	nu12 := vf*cf.Nu12 + vm*nuM
+	E2 := halpinTsai(cf.E2, cm.E2, 2)
+	G12 := halpinTsai(cf.G12, Gm, 1)
+	G23 := halpinTsai(cf.G23, Gm, 1/(3-4*nuM))
+	m.HalpinTsai = orthotropicCompliance(E1, E2, nu12, E2/(2*G23)-1, G12)
+
+	if m.MoriTanaka, err = hashinShtrikman(phases, fractions, Km, Gm); err != nil {
+		return m, err
+	}
+	// Reference media are the extreme isotropic projections of the phases
+	// scaled until they are softer or stiffer than every phase.
+	kmin, kmax := math.Inf(1), math.Inf(-1)
+	gmin, gmax := math.Inf(1), math.Inf(-1)
+	for _, C := range phases {
+		k, g := isotropicProjection(C)
+		kmin, kmax = math.Min(kmin, k), math.Max(kmax, k)
+		gmin, gmax = math.Min(gmin, g), math.Max(gmax, g)
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, C := range phases {
+		l, _ := relativeEigenRange(C, kmin, gmin)
+		_, h := relativeEigenRange(C, kmax, gmax)
+		lo, hi = math.Min(lo, l), math.Max(hi, h)
+	}
+	lo, hi = math.Min(lo, 1), math.Max(hi, 1)
+	if m.HashinShtrikmanLower, err = hashinShtrikman(phases, fractions, lo*kmin, lo*gmin); err != nil {
+		return m, err
+	}
+	if m.HashinShtrikmanUpper, err = hashinShtrikman(phases, fractions, hi*kmax, hi*gmax); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// hashinShtrikman returns the Voigt stiffness of the Hashin-Shtrikman-Willis
+// estimate of aligned cylindrical phases along x with Mandel stiffnesses
+// phases and volume fractions fractions in the isotropic reference medium of
+// bulk modulus k0 and shear modulus g0.
+func hashinShtrikman(phases []*mat.Dense, fractions []float64, k0, g0 float64) (*mat.Dense, error) {
+	// Eshelby tensor of a cylinder along x in Mandel notation.
+	nu := (3*k0 - 2*g0) / (2 * (3*k0 + g0))
+	a := 1 / (8 * (1 - nu))
+	S0 := mat.NewDense(6, 6, nil)
+	S0.Set(1, 1, (5-4*nu)*a)
+	S0.Set(2, 2, (5-4*nu)*a)
+	S0.Set(1, 2, (4*nu-1)*a)
+	S0.Set(2, 1, (4*nu-1)*a)
+	S0.Set(1, 0, 4*nu*a)
+	S0.Set(2, 0, 4*nu*a)
+	S0.Set(3, 3, 0.5)
+	S0.Set(4, 4, 2*(3-4*nu)*a)
+	S0.Set(5, 5, 0.5)
+	var P mat.Dense
+	P.Mul(S0, isotropicMandel(1/(3*k0), 1/(2*g0)))
+	C0 := isotropicMandel(3*k0, 2*g0)
+	num := mat.NewDense(6, 6, nil)
+	den := mat.NewDense(6, 6, nil)
+	var A, CA mat.Dense
+	for r, C := range phases {
+		// Aᵣ = (I + P₀*(Cᵣ - C₀))⁻¹.
+		A.Sub(C, C0)
+		A.Mul(&P, &A)
+		for i := 0; i < 6; i++ {
+			A.Set(i, i, A.At(i, i)+1)
+		}
+		if err := A.Inverse(&A); err != nil {
+			return nil, err
+		}
+		CA.Mul(C, &A)
+		num.Add(num, scaled(fractions[r], &CA))
+		den.Add(den, scaled(fractions[r], &A))
+	}
+	var C mat.Dense
+	if err := C.Solve(den.T(), num.T()); err != nil {
+		return nil, err
+	}
+	// Symmetrize the round-off of the solve.
+	Ceff := mat.NewDense(6, 6, nil)
+	Ceff.Add(&C, C.T())
+	Ceff.Scale(0.5, Ceff)
+	return voigtFromMandel(Ceff), nil
+}
+
+// isotropicMandel returns the isotropic Mandel matrix with eigenvalue a for
+// volumetric strains and b for deviatoric strains, 3*K and 2*G for a
+// stiffness of bulk modulus K and shear modulus G.
+func isotropicMandel(a, b float64) *mat.Dense {
+	M := mat.NewDense(6, 6, nil)
+	for i := 0; i < 6; i++ {
+		M.Set(i, i, b)
+		for j := 0; j < 3 && i < 3; j++ {
+			M.Set(i, j, M.At(i, j)+(a-b)/3)
+		}
+	}
+	return M
+}
+
+// isotropicProjection returns the bulk and shear moduli of the isotropic
+// part of the Mandel stiffness M, its Voigt average.
+func isotropicProjection(M *mat.Dense) (k, g float64) {
+	var normal, shear float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			k += M.At(i, j) / 9
+		}
+		normal += M.At(i, i)
+		shear += M.At(3+i, 3+i)
+	}
+	// The trace of M is 3*K + 10*G for isotropic stiffnesses.
+	g = (normal + shear - 3*k) / 10
+	return k, g
+}
+
+// relativeEigenRange returns the smallest and largest eigenvalues of M
+// relative to the isotropic stiffness of bulk modulus k and shear modulus g,
+// those of C₀^(-1/2)*M*C₀^(-1/2). M is stiffer than C₀ if the smallest is at
+// least one and softer if the largest is at most one.
+func relativeEigenRange(M *mat.Dense, k, g float64) (min, max float64) {
+	R := isotropicMandel(1/math.Sqrt(3*k), 1/math.Sqrt(2*g))
+	var X mat.Dense
+	X.Mul(R, M)
+	X.Mul(&X, R)
+	sym := mat.NewSymDense(6, nil)
+	for i := 0; i < 6; i++ {
+		for j := i; j < 6; j++ {
+			sym.SetSym(i, j, (X.At(i, j)+X.At(j, i))/2)
+		}
+	}
+	var eig mat.EigenSym
+	if !eig.Factorize(sym, false) {
+		return math.NaN(), math.NaN()
+	}
+	values := eig.Values(nil)
+	return floats.Min(values), floats.Max(values)
+}
+
+// scaled returns a*M.
+func scaled(a float64, M mat.Matrix) *mat.Dense {
+	var d mat.Dense
+	d.Scale(a, M)
+	return &d
+}
+
+// voigtFromMandel returns the Voigt stiffness of the Mandel matrix M, the
+// inverse of mandel.
+func voigtFromMandel(M mat.Matrix) *mat.Dense {
+	s := [6]float64{1, 1, 1, math.Sqrt2, math.Sqrt2, math.Sqrt2}
+	C := mat.NewDense(6, 6, nil)
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			C.Set(i, j, M.At(i, j)/(s[i]*s[j]))
+		}
+	}
+	return C
+}
+
+// MicromechanicsEstimate compares an analytical estimate to the FEA stiffness.
+type MicromechanicsEstimate struct {
+	// Model names the estimate.
+	Model string
+	// Constants holds the engineering constants of the estimate.
+	Constants ElasticConstants
+	// Deviation is the norm of the difference of the estimate to the FEA
+	// stiffness relative to the norm of the FEA stiffness, in Mandel notation.
+	Deviation float64
+}
+
+// MicromechanicsReport compares the analytical estimates of Micromechanics
+// to the stiffness of a finite element analysis of the same composite.
+type MicromechanicsReport struct {
+	// FEA holds the engineering constants of the FEA stiffness.
+	FEA ElasticConstants
+	// Estimates holds the comparison to each estimate in the order Voigt,
+	// Reuss, Halpin-Tsai, Mori-Tanaka and the lower and upper
+	// Hashin-Shtrikman bounds.
+	Estimates []MicromechanicsEstimate
+	// WithinVoigtReuss and WithinHashinShtrikman report whether the FEA
+	// stiffness lies between each pair of bounds, that is whether its
+	// differences to them are positive semidefinite.
+	WithinVoigtReuss, WithinHashinShtrikman bool
+}
+
+// CompareMicromechanics returns the comparison of the FEA stiffness fea, such
+// as that returned by Homogenize, to the analytical estimates of m. Bounds
+// are checked to a tolerance of 1e-9 relative to the norm of fea.
+func CompareMicromechanics(fea mat.Matrix, m Micromechanics) (MicromechanicsReport, error) {
+	var report MicromechanicsReport
+	var err error
+	if report.FEA, err = EngineeringConstants(fea); err != nil {
+		return report, err
+	}
+	F := mandel(fea)
+	norm := mat.Norm(F, 2)
+	for _, est := range []struct {
+		name string
+		C    *mat.Dense
+	}{
+		{"Voigt", m.Voigt},
+		{"Reuss", m.Reuss},
+		{"Halpin-Tsai", m.HalpinTsai},
+		{"Mori-Tanaka", m.MoriTanaka},
+		{"Hashin-Shtrikman lower", m.HashinShtrikmanLower},
+		{"Hashin-Shtrikman upper", m.HashinShtrikmanUpper},
+	} {
+		constants, err := EngineeringConstants(est.C)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", est.name, err)
+		}
+		var D mat.Dense
+		D.Sub(mandel(est.C), F)
+		report.Estimates = append(report.Estimates, MicromechanicsEstimate{
+			Model:     est.name,
+			Constants: constants,
+			Deviation: mat.Norm(&D, 2) / norm,
+		})
+	}
+	// between reports whether lower ⪯ F ⪯ upper.
+	between := func(lower, upper *mat.Dense) bool {
+		var D mat.Dense
+		D.Sub(F, mandel(lower))
+		lo := minEigenvalue(&D)
+		D.Sub(mandel(upper), F)
+		return lo >= -1e-9*norm && minEigenvalue(&D) >= -1e-9*norm
+	}
+	report.WithinVoigtReuss = between(m.Reuss, m.Voigt)
+	report.WithinHashinShtrikman = between(m.HashinShtrikmanLower, m.HashinShtrikmanUpper)
+	return report, nil
+}
+
+// minEigenvalue returns the smallest eigenvalue of the symmetric part of A.
+func minEigenvalue(A mat.Matrix) float64 {
+	n, _ := A.Dims()
+	sym := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			sym.SetSym(i, j, (A.At(i, j)+A.At(j, i))/2)
+		}
+	}
+	var eig mat.EigenSym
+	if !eig.Factorize(sym, false) {
+		return math.NaN()
+	}
+	return floats.Min(eig.Values(nil))
+}
+
+// String formats the report as a table of engineering constants with the
+// deviation of each estimate.
+func (r MicromechanicsReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-24s %10s %10s %10s %10s %10s %7s %7s %9s\n", "model", "E1", "E2", "E3", "G12", "G23", "ν12", "ν23", "deviation")
+	row := func(name string, c ElasticConstants, dev string) {
+		fmt.Fprintf(&b, "%-24s %10.4g %10.4g %10.4g %10.4g %10.4g %7.4f %7.4f %9s\n", name, c.E1, c.E2, c.E3, c.G12, c.G23, c.Nu12, c.Nu23, dev)
+	}
+	row("FEA", r.FEA, "")
+	for _, e := range r.Estimates {
+		row(e.Model, e.Constants, fmt.Sprintf("%.2f%%", 100*e.Deviation))
+	}
+	fmt.Fprintf(&b, "within Voigt-Reuss bounds: %t, within Hashin-Shtrikman bounds: %t\n", r.WithinVoigtReuss, r.WithinHashinShtrikman)
+	return b.String()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// ModalSettings configures Modal.
+type ModalSettings struct {
+	// Modes is the number of modes to compute. Defaults to 6.
+	Modes int
+	// Shift is the spectral shift σ. The eigenvalues ω² closest to σ are found.
+	// If zero a small negative shift is used so that structures without
+	// supports, which have rigid body modes at ω² = 0, can be solved.
+	Shift float64
+	// Tolerance is the relative residual at which a mode is considered
+	// converged. Defaults to 1e-10.
+	Tolerance float64
+}
+
+// ModalResult holds the natural vibration modes found by Modal sorted by
+// distance to the shift, which for the default shift is ascending frequency.
+type ModalResult struct {
+	// Eigenvalues holds the squared angular frequencies ω².
+	Eigenvalues []float64
+	// Frequencies holds the natural frequencies in cycles per unit time.
+	Frequencies []float64
+	// Modes holds the mass normalized mode shapes as columns, φᵀ*M*φ = 1.
+	// Rows are the degrees of freedom of K and M, fixed ones being zero.
+	Modes *mat.Dense
+}
+
+// Modal solves the generalized symmetric eigenproblem
+//  K*φ = ω²*M*φ
+// for the natural vibration modes of a structure with stiffness K and mass M,
+// as returned by AssembleStiffness and AssembleMass. Degrees of freedom where
+// fixed is true are held at zero, fixed may be nil.
+//
+// Modal uses the shift-invert Lanczos method with full reorthogonalization in the M
+// inner product. (K-σ*M) is factorized once with a sparse LDLᵀ factorization.
+func Modal(K, M *CSR, fixed []bool, settings ModalSettings) (ModalResult, error) {
+	n, _ := K.Dims()
+	if r, c := M.Dims(); r != n || c != n {
+		return ModalResult{}, fmt.Errorf("mass matrix is %d×%d, stiffness is %d×%d: %w", r, c, n, n, mat.ErrShape)
+	}
+	if fixed != nil && len(fixed) != n {
+		return ModalResult{}, fmt.Errorf("fixed length %d does not match %d degrees of freedom: %w", len(fixed), n, mat.ErrShape)
+	}
+	keep := make([]bool, n)
+	for i := range keep {
+		keep[i] = fixed == nil || !fixed[i]
+	}
+	Kf, Mf := K.Sub(keep), M.Sub(keep)
+	nf, _ := Kf.Dims()
+	if nf == 0 {
+		return ModalResult{}, errors.New("model has no free degrees of freedom")
+	}
+	nmodes := settings.Modes
+	if nmodes <= 0 {
+		nmodes = 6
+	}
+	if nmodes > nf {
+		nmodes = nf
+	}
+	tol := settings.Tolerance
+	if tol <= 0 {
+		tol = 1e-10
+	}
+	sigma := settings.Shift
+	if sigma == 0 {
+		sigma = -1e-6 * floats.Max(Kf.Diag()) / floats.Max(Mf.Diag())
+	}
+	if math.IsNaN(sigma) || math.IsInf(sigma, 0) {
+		return ModalResult{}, errors.New("mass matrix has no positive diagonal")
+	}
+	// Shifted operator (K - σM)⁻¹.
+	shifted := NewCOO(nf, nf, Kf.NNZ()+Mf.NNZ())
+	shifted.AddBlock(0, 0, Kf)
+	Mf.DoNonZero(func(i, j int, v float64) { shifted.AddAt(i, j, -sigma*v) })
+	var ldl LDL
+	if err := ldl.Factorize(shifted.ToCSR(), nil); err != nil {
+		return ModalResult{}, err
+	}
+	theta, ritz, err := lanczosShiftInvert(&ldl, Mf, nmodes, tol)
+	if err != nil {
+		return ModalResult{}, err
+	}
+	res := ModalResult{
+		Eigenvalues: make([]float64, nmodes),
+		Frequencies: make([]float64, nmodes),
+		Modes:       mat.NewDense(n, nmodes, nil),
+	}
+	for k := 0; k < nmodes; k++ {
+		lambda := sigma + 1/theta[k]
+		res.Eigenvalues[k] = lambda
+		res.Frequencies[k] = math.Sqrt(math.Max(lambda, 0)) / (2 * math.Pi)
+		row := 0
+		for i, kept := range keep {
+			if kept {
+				res.Modes.Set(i, k, ritz.At(row, k))
+				row++
+			}
+		}
+	}
+	return res, nil
+}
+
+// lanczosShiftInvert returns the nev eigenvalues θ of largest magnitude of
+// the operator (K-σM)⁻¹*M, which is self-adjoint in the M inner product, and
+// their M-orthonormal eigenvectors as columns of ritz. inv holds the factorization
+// of K-σM.
+func lanczosShiftInvert(inv *LDL, M *CSR, nev int, tol float64) (theta []float64, ritz *mat.Dense, err error) {
+	return lanczos(M, func(dst, _, Mx []float64) error { return inv.SolveVecTo(dst, Mx) }, nev, tol)
+}
+
+// lanczos returns the nev eigenvalues θ of largest magnitude of an operator
+// that is self-adjoint in the M inner product and their M-orthonormal
+// eigenvectors as columns of ritz. apply stores the operator applied to x in
+// dst, Mx holding M*x, and its error is returned.
+func lanczos(M *CSR, apply func(dst, x, Mx []float64) error, nev int, tol float64) (theta []float64, ritz *mat.Dense, err error) {
+	n, _ := M.Dims()
+	rnd := rand.New(rand.NewSource(1))
+	var (
+		Q     [][]float64 // Lanczos vectors.
+		MQ    [][]float64 // M times Lanczos vectors.
+		alpha []float64
+		beta  []float64
+	)
+	w := make([]float64, n)
+	Mw := make([]float64, n)
+	// orthogonalize M-orthogonalizes w against all Lanczos vectors twice and
+	// returns its M-norm. Mw is updated to M*w.
+	orthogonalize := func() float64 {
+		for pass := 0; pass < 2; pass++ {
+			for i := range Q {
+				floats.AddScaled(w, -floats.Dot(MQ[i], w), Q[i])
+			}
+		}
+		M.MulVecTo(Mw, w)
+		return math.Sqrt(math.Max(floats.Dot(w, Mw), 0))
+	}
+	// appendVector normalizes w and adds it to the Lanczos basis.
+	appendVector := func(norm float64) {
+		q := make([]float64, n)
+		floats.ScaleTo(q, 1/norm, w)
+		mq := make([]float64, n)
+		floats.ScaleTo(mq, 1/norm, Mw)
+		Q = append(Q, q)
+		MQ = append(MQ, mq)
+	}
+	randomStart := func() (bool, error) {
+		for try := 0; try < 10; try++ {
+			for i := range w {
+				w[i] = rnd.Float64() - 0.5
+			}
+			// Apply the operator once to filter out the null space of M.
+			M.MulVecTo(Mw, w)
+			if err := apply(w, append([]float64(nil), w...), Mw); err != nil {
+				return false, err
+			}
+			if norm := orthogonalize(); norm > 1e-10*floats.Norm(w, 2) && norm > 0 {
+				appendVector(norm)
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	ok, err := randomStart()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, errors.New("mass matrix is zero")
+	}
+	var eig mat.EigenSym
+	var S mat.Dense
+	for j := 0; j < n; j++ {
+		if err := apply(w, Q[j], MQ[j]); err != nil {
+			return nil, nil, err
+		}
+		a := floats.Dot(MQ[j], w)
+		alpha = append(alpha, a)
+		bnorm := orthogonalize()
+		// Check convergence once the basis can hold the wanted modes.
+		m := len(alpha)
+		if m >= nev && (m%5 == 0 || m == n || bnorm == 0) {
+			T := mat.NewSymDense(m, nil)
+			for i := 0; i < m; i++ {
+				T.SetSym(i, i, alpha[i])
+				if i+1 < m {
+					T.SetSym(i, i+1, beta[i])
+				}
+			}
+			if !eig.Factorize(T, true) {
+				return nil, nil, errors.New("tridiagonal eigendecomposition failed")
+			}
+			vals := eig.Values(nil)
+			S.Reset()
+			eig.VectorsTo(&S)
+			order := make([]int, m)
+			for i := range order {
+				order[i] = i
+			}
+			sort.Slice(order, func(a, b int) bool { return math.Abs(vals[order[a]]) > math.Abs(vals[order[b]]) })
+			converged := true
+			for _, k := range order[:nev] {
+				// Residual of Ritz pair is |β_m * s_mk|.
+				if math.Abs(bnorm*S.At(m-1, k)) > tol*math.Abs(vals[k]) {
+					converged = false
+					break
+				}
+			}
+			if converged || m == n {
+				theta = make([]float64, nev)
+				ritz = mat.NewDense(n, nev, nil)
+				x := make([]float64, n)
+				for c, k := range order[:nev] {
+					theta[c] = vals[k]
+					// Ritz vector x = Q*s.
+					for i := range x {
+						x[i] = 0
+					}
+					for i := 0; i < m; i++ {
+						floats.AddScaled(x, S.At(i, k), Q[i])
+					}
+					ritz.SetCol(c, x)
+				}
+				return theta, ritz, nil
+			}
+		}
+		if j == n-1 {
+			break
+		}
+		if bnorm <= 1e-12*math.Abs(a) {
+			// Invariant subspace found, restart with a new orthogonal vector.
+			beta = append(beta, 0)
+			ok, err := randomStart()
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				break
+			}
+			continue
+		}
+		beta = append(beta, bnorm)
+		appendVector(bnorm)
+	}
+	return nil, nil, fmt.Errorf("Lanczos iteration did not converge: %w", errNotConverged)
+}
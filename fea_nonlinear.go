@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// NonlinearSettings configures SolveNonlinear.
+type NonlinearSettings struct {
+	// Steps is the number of equal load increments. Defaults to 10.
+	Steps int
+	// MaxIterations is the number of Newton-Raphson iterations after which an
+	// increment is considered not to converge. Defaults to 20.
+	MaxIterations int
+	// Tolerance is the convergence tolerance of the out of balance force
+	// relative to the applied loads and reactions. Defaults to 1e-8.
+	Tolerance float64
+	// LineSearch scales Newton-Raphson corrections to minimize the out of
+	// balance force along them, which helps convergence when the tangent
+	// stiffness changes quickly.
+	LineSearch bool
+	// MaxCutbacks is the number of times an increment that does not converge
+	// is halved before giving up. Defaults to 4.
+	MaxCutbacks int
+	// LoadPath holds the load factors reached at the end of successive stages,
+	// each applied in Steps increments. Defaults to {1}. Paths such as {1, 0}
+	// load and unload the model, which matters for path dependent materials.
+	LoadPath []float64
+}
+
+// NonlinearStep holds the converged state at the end of a load increment.
+type NonlinearStep struct {
+	// LoadFactor is the fraction of the loads and prescribed displacements applied.
+	LoadFactor float64
+	// Residuals holds the relative out of balance force at the start of each
+	// iteration, the last being the converged one.
+	Residuals []float64
+	// Displacement holds the nodal displacements, node i owning indices 3*i to 3*i+2.
+	Displacement []float64
+	// Force holds the internal nodal forces, which balance the applied loads
+	// and support reactions.
+	Force []float64
+	// Plastic holds the state of every quadrature point of every element in
+	// results of SolvePlastic. Elements of elastic materials have no state.
+	Plastic [][]PlasticState
+}
+
+// NonlinearResult holds the load increments of SolveNonlinear.
+type NonlinearResult struct {
+	Steps []NonlinearStep
+}
+
+// ForceDisplacement returns the force-displacement curve of the degrees of
+// freedom dofs: for every step the sum of the forces and the mean
+// displacement of dofs. The curve starts at the unloaded state.
+func (r *NonlinearResult) ForceDisplacement(dofs []int) (force, displacement []float64) {
+	force = make([]float64, len(r.Steps)+1)
+	displacement = make([]float64, len(r.Steps)+1)
+	for i, step := range r.Steps {
+		for _, dof := range dofs {
+			force[i+1] += step.Force[dof]
+			displacement[i+1] += step.Displacement[dof] / float64(len(dofs))
+		}
+	}
+	return force, displacement
+}
+
+// SolveNonlinear solves the geometrically nonlinear static problem of model
+// with a total Lagrangian formulation. The second Piola-Kirchhoff stress is
+// obtained from the deformation gradient by the Hyperelastic model of each
+// element's material or, if nil, from the Green-Lagrange strain E as
+//  S = C*E
+// which is the St. Venant-Kirchhoff material, valid for large rotations and
+// small strains. Loads and prescribed displacements are applied in increments,
+// each solved with the Newton-Raphson method. Loads act on the undeformed
+// configuration and keep their direction, so pressure is not a follower load.
+// Constraints of loads are always enforced by elimination.
+//
+// An error is returned along with the converged increments if an increment
+// does not converge or its tangent stiffness is singular.
+func SolveNonlinear(model FEModel, materials []Material, loads StaticLoads, settings NonlinearSettings) (*NonlinearResult, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	if err := model.checkFormulation("nonlinear"); err != nil {
+		return nil, err
+	}
+	laws, err := model.elemHyperelastic(materials)
+	if err != nil {
+		return nil, err
+	}
+	if loads.Temperature != nil {
+		return nil, errors.New("thermal strain not supported in nonlinear analysis")
+	}
+	c, err := loads.constraints(len(model.Nodes))
+	if err != nil {
+		return nil, err
+	}
+	c.Method = Elimination
+	fext := make([]float64, 3*len(model.Nodes))
+	if err := loads.assemble(model, materials, nil, fext); err != nil {
+		return nil, err
+	}
+	sys := hyperelasticSystem{model: model, laws: laws, assembly: newElemAssembly(model, 3, false)}
+	return solveNewton(sys, c, fext, settings)
+}
+
+// nonlinearSystem is a model whose internal forces depend nonlinearly on
+// the displacements and possibly on the converged state of its materials.
+type nonlinearSystem interface {
+	// assemble returns the tangent stiffness matrix, if withK is true, and
+	// the internal forces at the displacements u, starting from the state
+	// at the end of the last committed increment.
+	assemble(u []float64, withK bool) (*CSR, []float64)
+	// commit accepts the state of the last call to assemble as converged
+	// and stores it in step.
+	commit(step *NonlinearStep)
+}
+
+// solveNewton applies the external forces fext and the constraint values of c
+// scaled by the load factors of the load path in increments and finds the
+// equilibrium of each with the Newton-Raphson method.
+func solveNewton(sys nonlinearSystem, c *Constraints, fext []float64, settings NonlinearSettings) (*NonlinearResult, error) {
+	steps := settings.Steps
+	if steps == 0 {
+		steps = 10
+	}
+	maxIter := settings.MaxIterations
+	if maxIter == 0 {
+		maxIter = 20
+	}
+	tol := settings.Tolerance
+	if tol == 0 {
+		tol = 1e-8
+	}
+	maxCutbacks := settings.MaxCutbacks
+	if maxCutbacks == 0 {
+		maxCutbacks = 4
+	}
+	path := settings.LoadPath
+	if path == nil {
+		path = []float64{1}
+	}
+	if steps < 0 || maxIter < 0 || tol < 0 || maxCutbacks < 0 || len(path) == 0 {
+		return nil, fmt.Errorf("invalid nonlinear settings %+v", settings)
+	}
+	n := len(fext)
+	target := c.values()
+	values := make([]float64, len(target))
+	R := make([]float64, n)
+	trial := make([]float64, n)
+	u := make([]float64, n)
+	result := &NonlinearResult{}
+
+	// increment attempts to find the equilibrium at load factor lambda starting
+	// from u. It returns the residual history and whether it converged, or an
+	// error if a linearized system could not be solved.
+	increment := func(lambda float64) (residuals []float64, converged bool, err error) {
+		for iter := 0; iter <= maxIter; iter++ {
+			K, fint := sys.assemble(u, true)
+			for i := range R {
+				R[i] = lambda*fext[i] - fint[i]
+			}
+			system, err := c.factorize(K)
+			if err != nil {
+				return residuals, false, err
+			}
+			ref := math.Max(math.Abs(lambda)*floats.Norm(fext, 2), floats.Norm(fint, 2))
+			res := floats.Norm(system.project(R), 2)
+			if ref > 0 {
+				res /= ref
+			}
+			residuals = append(residuals, res)
+			if math.IsNaN(res) || math.IsInf(res, 0) {
+				return residuals, false, nil
+			}
+			if iter > 0 && res <= tol {
+				return residuals, true, nil
+			}
+			if iter == maxIter {
+				break
+			}
+			// Constraints are only violated on the first iteration of an increment.
+			for k := range values {
+				values[k] = lambda * target[k]
+			}
+			du, err := system.solveCorrection(R, values, u)
+			if err != nil {
+				return residuals, false, err
+			}
+			s := 1.0
+			if settings.LineSearch && iter > 0 {
+				s = lineSearch(du, R, func(s float64) []float64 {
+					for i := range trial {
+						trial[i] = u[i] + s*du[i]
+					}
+					_, fint := sys.assemble(trial, false)
+					for i := range trial {
+						trial[i] = lambda*fext[i] - fint[i]
+					}
+					return trial
+				})
+			}
+			floats.AddScaled(u, s, du)
+			// Loads that vanish at equilibrium, such as under prescribed rigid
+			// body motion, are converged by the size of the correction.
+			if iter > 0 && s*floats.Norm(du, 2) <= tol*floats.Norm(u, 2) {
+				return residuals, true, nil
+			}
+		}
+		return residuals, false, nil
+	}
+
+	lambda := 0.0
+	cutbacks := 0
+	converged := append([]float64(nil), u...)
+	for _, end := range path {
+		nominal := (end - lambda) / float64(steps)
+		dlambda := nominal
+		for lambda != end {
+			next := lambda + dlambda
+			if math.Abs(end-next) < 1e-12*math.Abs(end-lambda) || (end-next)*nominal < 0 {
+				next = end
+			}
+			residuals, ok, err := increment(next)
+			if err != nil {
+				return result, fmt.Errorf("load increment to factor %g: %w", next, err)
+			}
+			if !ok {
+				copy(u, converged)
+				if cutbacks == maxCutbacks {
+					return result, fmt.Errorf("load increment to factor %g did not converge after %d cutbacks", next, cutbacks)
+				}
+				cutbacks++
+				dlambda /= 2
+				continue
+			}
+			lambda = next
+			cutbacks = 0
+			copy(converged, u)
+			_, fint := sys.assemble(u, false)
+			result.Steps = append(result.Steps, NonlinearStep{
+				LoadFactor:   lambda,
+				Residuals:    residuals,
+				Displacement: append([]float64(nil), u...),
+				Force:        fint,
+			})
+			sys.commit(&result.Steps[len(result.Steps)-1])
+			if math.Abs(2*dlambda) < math.Abs(nominal) {
+				dlambda *= 2
+			} else {
+				dlambda = nominal
+			}
+		}
+	}
+	return result, nil
+}
+
+// lineSearch returns the step length s along du that approximately zeroes
+// the projection of the residual R(s) on du, where residual returns R(s)
+// and R is R(0).
+func lineSearch(du, R []float64, residual func(s float64) []float64) float64 {
+	g0 := floats.Dot(du, R)
+	if g0 <= 0 {
+		return 1 // Not a descent direction, take the Newton step.
+	}
+	s, g := 1.0, floats.Dot(du, residual(1))
+	best, gbest := s, math.Abs(g)
+	for i := 0; i < 5 && math.Abs(g) > 0.5*g0; i++ {
+		// Secant on g(s) through (0, g0) and (s, g), kept within sensible bounds.
+		s = math.Min(math.Max(s*g0/(g0-g), 0.1), 2)
+		g = floats.Dot(du, residual(s))
+		if math.Abs(g) < gbest {
+			best, gbest = s, math.Abs(g)
+		}
+	}
+	return best
+}
+
+// hyperelasticSystem is the nonlinearSystem of a model of hyperelastic
+// materials in the total Lagrangian formulation. It has no state.
+type hyperelasticSystem struct {
+	model    FEModel
+	laws     []Hyperelastic
+	assembly *elemAssembly
+}
+
+func (s hyperelasticSystem) assemble(u []float64, withK bool) (*CSR, []float64) {
+	return assembleTangent(s.assembly, s.model, u, withK, func() elemTangent {
+		integ := newElementIntegrator(s.model.element())
+		return func(iele int, Ke *mat.Dense, fe []float64, enod []Vec, ue []float64) {
+			integ.nonlinear(Ke, fe, enod, ue, func(_ int, F *Mat, S *[6]float64, D *mat.Dense) {
+				s.laws[iele].Stress(F, S, D)
+			})
+		}
+	})
+}
+
+func (hyperelasticSystem) commit(*NonlinearStep) {}
+
+// elemTangent stores in fe the internal forces and, if Ke is not nil, the
+// tangent stiffness matrix in Ke of element iele with node positions enod
+// and nodal displacements ue.
+type elemTangent func(iele int, Ke *mat.Dense, fe []float64, enod []Vec, ue []float64)
+
+// assembleTangent returns the tangent stiffness matrix, if withK is true, and
+// the internal forces of model at the displacements u. Elements are processed
+// in parallel as in assembleStiffness, each worker evaluating elements with
+// its own elemTangent returned by newElem. The tangent stiffness matrix has
+// the sparsity pattern of a, which is computed once for all iterations.
+func assembleTangent(a *elemAssembly, model FEModel, u []float64, withK bool, newElem func() elemTangent) (*CSR, []float64) {
+	elem := model.element()
+	nn := elem.NumNodes()
+	ne := 3 * nn
+	ndofs := 3 * len(model.Nodes)
+	var K *CSR
+	if withK {
+		K = a.matrix()
+	}
+	elemF := make([]float64, len(model.Elems)*ne)
+	parallelColors(a.colors, func() func(int) {
+		tangent := newElem()
+		var Ke *mat.Dense
+		if withK {
+			Ke = mat.NewDense(ne, ne, nil)
+		}
+		enod := make([]Vec, nn)
+		edofs := make([]int, ne)
+		ue := make([]float64, ne)
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			storeElemDofs(edofs, enodes, 3)
+			for i, dof := range edofs {
+				ue[i] = u[dof]
+			}
+			tangent(iele, Ke, elemF[iele*ne:(iele+1)*ne], enod, ue)
+			if withK {
+				K.addSub(edofs, Ke)
+			}
+		}
+	})
+	// Element forces are summed in element order to be deterministic.
+	f := make([]float64, ndofs)
+	edofs := make([]int, ne)
+	for iele, enodes := range model.Elems {
+		storeElemDofs(edofs, enodes, 3)
+		for i, dof := range edofs {
+			f[dof] += elemF[iele*ne+i]
+		}
+	}
+	return K, f
+}
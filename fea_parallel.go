@@ -0,0 +1,93 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// elemChunk is the number of consecutive elements a worker of parallelElems
+// processes at a time. Chunks keep workers on nearby elements and make
+// scheduling overhead negligible.
+const elemChunk = 64
+
+// parallelElems calls the function returned by newWorker for every element
+// index in [0,nel). Chunks of elements are handed out to up to
+// runtime.GOMAXPROCS(0) goroutines, each of which calls newWorker once, so
+// scratch space allocated by newWorker is never shared between goroutines.
+//
+// Elements are processed in no particular order. Workers must write results
+// to storage owned by the element for the outcome to be deterministic.
+func parallelElems(nel int, newWorker func() func(iele int)) {
+	do := newWorkers(nel, newWorker)
+	if len(do) == 1 {
+		for iele := 0; iele < nel; iele++ {
+			do[0](iele)
+		}
+		return
+	}
+	runChunks(nel, do, func(i int) int { return i })
+}
+
+// parallelColors calls the function returned by newWorker for every element
+// of colors as parallelElems does, one color after the other. Elements of a
+// color must not share storage they write to, such as the entries of a
+// matrix owned by their nodes. Storage shared by elements of different colors
+// is then written in color order, so the outcome is deterministic.
+func parallelColors(colors [][]int, newWorker func() func(iele int)) {
+	largest := 0
+	for _, color := range colors {
+		largest = max(largest, len(color))
+	}
+	do := newWorkers(largest, newWorker)
+	for _, color := range colors {
+		if len(do) == 1 {
+			for _, iele := range color {
+				do[0](iele)
+			}
+			continue
+		}
+		runChunks(len(color), do, func(i int) int { return color[i] })
+	}
+}
+
+// newWorkers returns the workers of newWorker that process n elements, at
+// most one per chunk of elements and at least one.
+func newWorkers(n int, newWorker func() func(iele int)) []func(iele int) {
+	workers := runtime.GOMAXPROCS(0)
+	if nchunks := (n + elemChunk - 1) / elemChunk; workers > nchunks {
+		workers = nchunks
+	}
+	do := make([]func(int), max(workers, 1))
+	for w := range do {
+		do[w] = newWorker()
+	}
+	return do
+}
+
+// runChunks calls the workers in do, each in its own goroutine, for the
+// elements elem(i) with i in [0,n) and returns once all have been processed.
+func runChunks(n int, do []func(iele int), elem func(i int) int) {
+	var next int64
+	var wg sync.WaitGroup
+	wg.Add(len(do))
+	for _, do := range do {
+		go func(do func(int)) {
+			defer wg.Done()
+			for {
+				end := int(atomic.AddInt64(&next, elemChunk))
+				start := end - elemChunk
+				if start >= n {
+					return
+				}
+				if end > n {
+					end = n
+				}
+				for i := start; i < end; i++ {
+					do(elem(i))
+				}
+			}
+		}(do)
+	}
+	wg.Wait()
+}
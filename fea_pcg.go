@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/floats"
+)
+
+var (
+	_ Operator = (*CSR)(nil)
+	_ Operator = OperatorFunc(nil)
+
+	_ Preconditioner = jacobi(nil)
+	_ Preconditioner = (*ic0)(nil)
+	_ Preconditioner = (*ssor)(nil)
+)
+
+// errNotConverged is returned by iterative solvers that reach their iteration limit.
+var errNotConverged = errors.New("iterative solver did not converge")
+
+// Operator is a linear operator that can be applied to a vector. Solvers
+// that only need matrix-vector products accept an Operator so large models
+// can be solved without ever assembling an explicit matrix.
+type Operator interface {
+	// MulVecTo computes dst = A*x. dst and x do not overlap.
+	MulVecTo(dst, x []float64)
+}
+
+// OperatorFunc adapts an ordinary function to the Operator interface.
+type OperatorFunc func(dst, x []float64)
+
+// MulVecTo calls f(dst, x).
+func (f OperatorFunc) MulVecTo(dst, x []float64) { f(dst, x) }
+
+// Preconditioner approximates the inverse of a linear operator.
+type Preconditioner interface {
+	// Precondition solves M*dst = r for dst, where M approximates A.
+	// dst and r do not overlap.
+	Precondition(dst, r []float64)
+}
+
+// PCGSettings configures the preconditioned conjugate gradient solver.
+type PCGSettings struct {
+	// Tolerance is the relative residual norm ‖b-A*x‖/‖b‖ at which
+	// iteration stops. Defaults to 1e-8.
+	Tolerance float64
+	// MaxIterations is the iteration limit. Defaults to the size of the system.
+	MaxIterations int
+	// Preconditioner is applied to the residual every iteration.
+	// If nil no preconditioning is done.
+	Preconditioner Preconditioner
+}
+
+// PCGResult reports how a PCG solve went.
+type PCGResult struct {
+	// Iterations is the number of iterations performed.
+	Iterations int
+	// Residuals holds the relative residual norm history. The first
+	// element corresponds to the initial guess.
+	Residuals []float64
+}
+
+// PCG solves A*x = b for symmetric positive definite A using the preconditioned
+// conjugate gradient method. x holds the initial guess on entry and the solution
+// on return. If the tolerance is not met within the iteration limit PCG returns the
+// last iterate along with an error.
+func PCG(A Operator, x, b []float64, settings PCGSettings) (PCGResult, error) {
+	n := len(b)
+	if len(x) != n {
+		panic("x and b must be the same length")
+	}
+	tol := settings.Tolerance
+	if tol <= 0 {
+		tol = 1e-8
+	}
+	maxIter := settings.MaxIterations
+	if maxIter <= 0 {
+		maxIter = n
+	}
+	var res PCGResult
+	bnorm := floats.Norm(b, 2)
+	if bnorm == 0 {
+		for i := range x {
+			x[i] = 0
+		}
+		res.Residuals = []float64{0}
+		return res, nil
+	}
+	r := make([]float64, n)
+	z := make([]float64, n)
+	p := make([]float64, n)
+	Ap := make([]float64, n)
+	// r = b - A*x
+	A.MulVecTo(r, x)
+	floats.SubTo(r, b, r)
+	rnorm := floats.Norm(r, 2) / bnorm
+	res.Residuals = append(res.Residuals, rnorm)
+	if rnorm <= tol {
+		return res, nil
+	}
+	precondition := func(dst, r []float64) {
+		if settings.Preconditioner == nil {
+			copy(dst, r)
+			return
+		}
+		settings.Preconditioner.Precondition(dst, r)
+	}
+	precondition(z, r)
+	copy(p, z)
+	rz := floats.Dot(r, z)
+	for res.Iterations < maxIter {
+		res.Iterations++
+		A.MulVecTo(Ap, p)
+		pAp := floats.Dot(p, Ap)
+		if pAp <= 0 || math.IsNaN(pAp) {
+			return res, fmt.Errorf("PCG breakdown at iteration %d: operator not positive definite (pᵀAp=%g)", res.Iterations, pAp)
+		}
+		alpha := rz / pAp
+		floats.AddScaled(x, alpha, p)
+		floats.AddScaled(r, -alpha, Ap)
+		rnorm = floats.Norm(r, 2) / bnorm
+		res.Residuals = append(res.Residuals, rnorm)
+		if rnorm <= tol {
+			return res, nil
+		}
+		precondition(z, r)
+		rzNew := floats.Dot(r, z)
+		beta := rzNew / rz
+		rz = rzNew
+		// p = z + beta*p
+		floats.AddScaledTo(p, z, beta, p)
+	}
+	return res, fmt.Errorf("PCG reached %d iterations with relative residual %g: %w", res.Iterations, rnorm, errNotConverged)
+}
+
+// jacobi is the diagonal preconditioner. It stores the inverse of the diagonal.
+type jacobi []float64
+
+// NewJacobi returns a Jacobi (diagonal) preconditioner for an operator with
+// diagonal diag. Taking the diagonal as argument allows its use with
+// matrix-free operators.
+func NewJacobi(diag []float64) (Preconditioner, error) {
+	inv := make(jacobi, len(diag))
+	for i, d := range diag {
+		if d == 0 {
+			return nil, fmt.Errorf("zero diagonal at row %d", i)
+		}
+		inv[i] = 1 / d
+	}
+	return inv, nil
+}
+
+func (j jacobi) Precondition(dst, r []float64) {
+	floats.MulTo(dst, j, r)
+}
+
+// ic0 is the zero fill-in incomplete Cholesky preconditioner M = L*Lᵀ.
+// L is stored by rows with the diagonal as the last entry of each row.
+type ic0 struct {
+	L *CSR
+}
+
+// NewIC0 returns an incomplete Cholesky preconditioner with the sparsity pattern
+// of the lower triangle of A. If the factorization breaks down on a non-positive
+// pivot the diagonal is shifted and the factorization retried.
+func NewIC0(A *CSR) (Preconditioner, error) {
+	n, c := A.Dims()
+	if n != c {
+		return nil, errors.New("IC0 requires a square matrix")
+	}
+	for _, shift := range []float64{0, 1e-3, 1e-2, 1e-1, 1} {
+		L, ok := incompleteCholesky(A, shift)
+		if ok {
+			return &ic0{L: L}, nil
+		}
+	}
+	return nil, errors.New("incomplete Cholesky factorization broke down")
+}
+
+// incompleteCholesky computes the IC(0) factor of A+shift*diag(A).
+func incompleteCholesky(A *CSR, shift float64) (L *CSR, ok bool) {
+	n := A.r
+	L = &CSR{r: n, c: n, indptr: make([]int, n+1)}
+	for i := 0; i < n; i++ {
+		for k := A.indptr[i]; k < A.indptr[i+1]; k++ {
+			if j := A.ind[k]; j <= i {
+				L.ind = append(L.ind, j)
+				L.data = append(L.data, A.data[k])
+			}
+		}
+		L.indptr[i+1] = len(L.ind)
+		if L.indptr[i+1] == L.indptr[i] || L.ind[L.indptr[i+1]-1] != i {
+			return nil, false // Missing diagonal entry.
+		}
+	}
+	for i := 0; i < n; i++ {
+		start, diag := L.indptr[i], L.indptr[i+1]-1
+		for k := start; k < diag; k++ {
+			j := L.ind[k]
+			// L[i,j] = (A[i,j] - Σ L[i,m]*L[j,m]) / L[j,j] for m < j.
+			L.data[k] = (L.data[k] - sparseRowDot(L, i, j, j)) / L.data[L.indptr[j+1]-1]
+		}
+		d := L.data[diag] * (1 + shift)
+		for k := start; k < diag; k++ {
+			d -= L.data[k] * L.data[k]
+		}
+		if d <= 0 || math.IsNaN(d) {
+			return nil, false
+		}
+		L.data[diag] = math.Sqrt(d)
+	}
+	return L, true
+}
+
+// sparseRowDot returns the dot product of rows a and b of m
+// considering only columns less than end.
+func sparseRowDot(m *CSR, a, b, end int) float64 {
+	ka, kb := m.indptr[a], m.indptr[b]
+	aEnd, bEnd := m.indptr[a+1], m.indptr[b+1]
+	var sum float64
+	for ka < aEnd && kb < bEnd {
+		ja, jb := m.ind[ka], m.ind[kb]
+		if ja >= end || jb >= end {
+			break
+		}
+		switch {
+		case ja == jb:
+			sum += m.data[ka] * m.data[kb]
+			ka++
+			kb++
+		case ja < jb:
+			ka++
+		default:
+			kb++
+		}
+	}
+	return sum
+}
+
+func (ic *ic0) Precondition(dst, r []float64) {
+	L := ic.L
+	// Forward substitution L*y = r.
+	for i := 0; i < L.r; i++ {
+		sum := r[i]
+		diag := L.indptr[i+1] - 1
+		for k := L.indptr[i]; k < diag; k++ {
+			sum -= L.data[k] * dst[L.ind[k]]
+		}
+		dst[i] = sum / L.data[diag]
+	}
+	// Backward substitution Lᵀ*dst = y, done in place column by column.
+	for i := L.r - 1; i >= 0; i-- {
+		diag := L.indptr[i+1] - 1
+		dst[i] /= L.data[diag]
+		for k := L.indptr[i]; k < diag; k++ {
+			dst[L.ind[k]] -= L.data[k] * dst[i]
+		}
+	}
+}
+
+// ssor is the symmetric successive over-relaxation preconditioner of NewSSOR.
+type ssor struct {
+	A     *CSR
+	diag  []float64
+	omega float64
+}
+
+// NewSSOR returns the symmetric successive over-relaxation preconditioner
+//  M = (D/ω + L)*(D/ω)⁻¹*(D/ω + U)*ω/(2-ω)
+// for the symmetric matrix A = L + D + U, with L and U strictly triangular and
+// D diagonal. M is ω times the textbook (D + ωL)*D⁻¹*(D + ωU)/(ω*(2-ω)), a
+// scaling that does not change the PCG iterates. omega must be in the open
+// interval (0, 2).
+func NewSSOR(A *CSR, omega float64) (Preconditioner, error) {
+	if omega <= 0 || omega >= 2 {
+		return nil, fmt.Errorf("SSOR relaxation factor %g outside (0,2)", omega)
+	}
+	diag := A.Diag()
+	for i, d := range diag {
+		if d == 0 {
+			return nil, fmt.Errorf("zero diagonal at row %d", i)
+		}
+	}
+	return &ssor{A: A, diag: diag, omega: omega}, nil
+}
+
+func (s *ssor) Precondition(dst, r []float64) {
+	A, w := s.A, s.omega
+	// Forward sweep: (D/ω + L)*y = r.
+	for i := 0; i < A.r; i++ {
+		sum := r[i]
+		for k := A.indptr[i]; k < A.indptr[i+1]; k++ {
+			if j := A.ind[k]; j < i {
+				sum -= A.data[k] * dst[j]
+			}
+		}
+		dst[i] = sum * w / s.diag[i]
+	}
+	// Scale: y = (2-ω)/ω * (D/ω)*y.
+	for i := range dst {
+		dst[i] *= (2 - w) / w * s.diag[i] / w
+	}
+	// Backward sweep: (D/ω + U)*dst = y.
+	for i := A.r - 1; i >= 0; i-- {
+		sum := dst[i]
+		for k := A.indptr[i]; k < A.indptr[i+1]; k++ {
+			if j := A.ind[k]; j > i {
+				sum -= A.data[k] * dst[j]
+			}
+		}
+		dst[i] = sum * w / s.diag[i]
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"play/kdtree"
+)
+
+var (
+	_ kdtree.Interface[kdPoint, *kdNode] = kdNodes{}
+	_ kdtree.Comparable[kdPoint]         = &kdNode{}
+)
+
+// periodicConstraint ties the displacement of a node on a maximum face of a RUC
+// to its periodic image on the minimum faces:
+//  u_slave - Σ wᵢ u_mastersᵢ = ε⋅(x_slave - Σ wᵢ x_mastersᵢ)
+// When meshes match node for node there is a single master with unit weight.
+// Otherwise the image is interpolated from the nodes of the opposite face.
+type periodicConstraint struct {
+	slave   int
+	masters []int
+	weights []float64
+}
+
+// UnpairedNodesError is returned when nodes on the maximum faces of a RUC
+// have no periodic image on the opposite faces.
+type UnpairedNodesError struct {
+	// Nodes holds the indices of the unpaired nodes.
+	Nodes []int
+	// Images holds the expected position of each unpaired node's image.
+	Images []Vec
+}
+
+func (e *UnpairedNodesError) Error() string {
+	return fmt.Sprintf("%d nodes without periodic image, first is node %d with image at %+v", len(e.Nodes), e.Nodes[0], e.Images[0])
+}
+
+// rucPeriodicConstraints pairs every node on the maximum faces of box with its
+// periodic image on the minimum faces. Edge and corner nodes on the maximum
+// faces are all paired with the same image. Nodes are considered to lie on a face
+// or to coincide with an image when they are within tol of one another.
+//
+// If nonMatching is true images that do not coincide with a node are interpolated
+// from the element face on which they lie. Otherwise an *UnpairedNodesError is returned.
+// Interpolation uses the corner nodes of the face so it is linear on triangular
+// faces and bilinear on quadrilateral faces regardless of the element order.
+func rucPeriodicConstraints(nodes []Vec, elems [][]int, elem Element, box Box, tol float64, nonMatching bool) ([]periodicConstraint, error) {
+	tree := kdtree.New[kdPoint, *kdNode](newKDNodes(nodes), false)
+	var faces *rucFaces
+	var unpaired UnpairedNodesError
+	var constraints []periodicConstraint
+	for i, n := range nodes {
+		image, onMax := n, false
+		for d := 0; d < 3; d++ {
+			if math.Abs(n.component(d)-box.Max.component(d)) <= tol {
+				image.setComponent(d, box.Min.component(d))
+				onMax = true
+			}
+		}
+		if !onMax {
+			continue
+		}
+		nearest, dist2 := tree.Nearest(kdPoint{image})
+		if dist2 <= tol*tol {
+			constraints = append(constraints, periodicConstraint{slave: i, masters: []int{nearest.idx}, weights: []float64{1}})
+			continue
+		}
+		if nonMatching {
+			if faces == nil {
+				faces = newRUCFaces(nodes, elems, elem, box, tol)
+			}
+			masters, weights, ok := faces.interpolate(image, nearest.idx)
+			if ok {
+				constraints = append(constraints, periodicConstraint{slave: i, masters: masters, weights: weights})
+				continue
+			}
+		}
+		unpaired.Nodes = append(unpaired.Nodes, i)
+		unpaired.Images = append(unpaired.Images, image)
+	}
+	if len(unpaired.Nodes) > 0 {
+		return nil, &unpaired
+	}
+	return constraints, nil
+}
+
+// periodicSystem is the factorized system of equations of a RUC field whose
+// periodic constraints are enforced with Lagrange multipliers:
+//  [K Nᵀ; N 0] [u; λ] = [0; g]
+// where each row of N constrains u_slave - Σ wᵢ u_mastersᵢ to the jump g
+// imposed by the macroscopic strain or gradient.
+type periodicSystem struct {
+	ndof   int   // Degrees of freedom per node.
+	dx     []Vec // x_slave - Σ wᵢ x_mastersᵢ of each constraint.
+	values []float64
+	system *constrainedSystem
+}
+
+// newPeriodicSystem factorizes the system of a field with ndof degrees of freedom
+// per node, stiffness K and the given periodic constraints. The node closest to
+// box.Min is fixed to remove rigid body translation. Rotations are prevented by
+// the periodic constraints.
+func newPeriodicSystem(K *CSR, nodes []Vec, constraints []periodicConstraint, ndof int, box Box) (*periodicSystem, error) {
+	s := &periodicSystem{
+		ndof: ndof,
+		dx:   make([]Vec, len(constraints)),
+	}
+	c := NewConstraints(len(nodes), ndof)
+	c.Method = Lagrange
+	for r, pc := range constraints {
+		s.dx[r] = nodes[pc.slave]
+		for i, master := range pc.masters {
+			s.dx[r] = Sub(s.dx[r], Scale(pc.weights[i], nodes[master]))
+		}
+		for d := 0; d < ndof; d++ {
+			con := Constraint{Dofs: []int{ndof*pc.slave + d}, Coefs: []float64{1}}
+			for i, master := range pc.masters {
+				con.Dofs = append(con.Dofs, ndof*master+d)
+				con.Coefs = append(con.Coefs, -pc.weights[i])
+			}
+			c.Add(con)
+		}
+	}
+	fixedNode := 0
+	for i := range nodes {
+		if Norm2(Sub(nodes[i], box.Min)) < Norm2(Sub(nodes[fixedNode], box.Min)) {
+			fixedNode = i
+		}
+	}
+	c.Fix([]int{fixedNode})
+	s.values = make([]float64, c.Len())
+	var err error
+	s.system, err = c.factorize(K)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// solve returns the nodal field for which the jump of degree of freedom d
+// between every constrained node and its periodic image is jump(dx, d), where
+// dx is the position of the node relative to its image. f holds loads on the
+// field degrees of freedom and may be nil.
+func (s *periodicSystem) solve(jump func(dx Vec, d int) float64, f []float64) ([]float64, error) {
+	for r, dx := range s.dx {
+		for d := 0; d < s.ndof; d++ {
+			s.values[s.ndof*r+d] = jump(dx, d)
+		}
+	}
+	return s.system.solve(f, s.values)
+}
+
+// rucFaces holds the element faces lying on the minimum faces of a RUC.
+type rucFaces struct {
+	nodes []Vec
+	tol   float64
+	box   Box
+	// faces[d] holds the corner nodes of the faces on the plane normal to dimension d.
+	faces [3][][]int
+	// nodeFaces[d] maps a node to the faces in faces[d] it belongs to.
+	nodeFaces [3]map[int][]int
+}
+
+func newRUCFaces(nodes []Vec, elems [][]int, elem Element, box Box, tol float64) *rucFaces {
+	f := &rucFaces{nodes: nodes, tol: tol, box: box}
+	for d := 0; d < 3; d++ {
+		f.nodeFaces[d] = make(map[int][]int)
+	}
+	for _, enodes := range elems {
+		for _, lf := range elem.Faces() {
+			// Only corner nodes are used for interpolation.
+			face := make([]int, faceCorners(lf))
+			for i := range face {
+				face[i] = enodes[lf[i]]
+			}
+			for d := 0; d < 3; d++ {
+				onPlane := true
+				for _, n := range face {
+					onPlane = onPlane && math.Abs(nodes[n].component(d)-box.Min.component(d)) <= tol
+				}
+				if !onPlane {
+					continue
+				}
+				for _, n := range face {
+					f.nodeFaces[d][n] = append(f.nodeFaces[d][n], len(f.faces[d]))
+				}
+				f.faces[d] = append(f.faces[d], face)
+			}
+		}
+	}
+	return f
+}
+
+// interpolate returns the nodes and bilinear interpolation weights of the face
+// containing p. Faces adjacent to hint, usually the node nearest to p, are tried first.
+func (f *rucFaces) interpolate(p Vec, hint int) (masters []int, weights []float64, ok bool) {
+	for d := 0; d < 3; d++ {
+		if math.Abs(p.component(d)-f.box.Min.component(d)) > f.tol {
+			continue
+		}
+		for _, iface := range f.nodeFaces[d][hint] {
+			if masters, weights, ok = f.faceWeights(d, f.faces[d][iface], p); ok {
+				return masters, weights, true
+			}
+		}
+		for _, face := range f.faces[d] {
+			if masters, weights, ok = f.faceWeights(d, face, p); ok {
+				return masters, weights, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// faceWeights returns the linear or bilinear shape function values of the
+// triangle or quadrilateral face at p in the plane normal to dimension d.
+// ok is false if p lies outside the face.
+func (f *rucFaces) faceWeights(d int, face []int, p Vec) (masters []int, weights []float64, ok bool) {
+	u, v := (d+1)%3, (d+2)%3
+	var x, y [4]float64
+	for i, n := range face {
+		x[i] = f.nodes[n].component(u)
+		y[i] = f.nodes[n].component(v)
+	}
+	px, py := p.component(u), p.component(v)
+	const eps = 1e-8
+	if len(face) == 3 {
+		// Barycentric coordinates of p.
+		det := (x[1]-x[0])*(y[2]-y[0]) - (x[2]-x[0])*(y[1]-y[0])
+		if det == 0 {
+			return nil, nil, false
+		}
+		l1 := ((px-x[0])*(y[2]-y[0]) - (x[2]-x[0])*(py-y[0])) / det
+		l2 := ((x[1]-x[0])*(py-y[0]) - (px-x[0])*(y[1]-y[0])) / det
+		L := [3]float64{1 - l1 - l2, l1, l2}
+		for i := range L {
+			if L[i] < -eps {
+				return nil, nil, false
+			}
+		}
+		for i := range L {
+			if L[i] > eps {
+				masters = append(masters, face[i])
+				weights = append(weights, L[i])
+			}
+		}
+		return masters, weights, true
+	}
+	xi := [4]float64{-1, 1, 1, -1}
+	eta := [4]float64{-1, -1, 1, 1}
+	var s, t float64
+	var N [4]float64
+	// Newton iteration on the inverse of the bilinear map.
+	for iter := 0; iter < 20; iter++ {
+		var rx, ry, dxds, dxdt, dyds, dydt float64
+		for i := range face {
+			N[i] = (1 + xi[i]*s) * (1 + eta[i]*t) / 4
+			dNds := xi[i] * (1 + eta[i]*t) / 4
+			dNdt := eta[i] * (1 + xi[i]*s) / 4
+			rx += N[i] * x[i]
+			ry += N[i] * y[i]
+			dxds += dNds * x[i]
+			dxdt += dNdt * x[i]
+			dyds += dNds * y[i]
+			dydt += dNdt * y[i]
+		}
+		rx -= px
+		ry -= py
+		if math.Hypot(rx, ry) <= f.tol*1e-6 {
+			break
+		}
+		det := dxds*dydt - dxdt*dyds
+		if det == 0 {
+			return nil, nil, false
+		}
+		s -= (dydt*rx - dxdt*ry) / det
+		t -= (-dyds*rx + dxds*ry) / det
+	}
+	if math.Abs(s) > 1+eps || math.Abs(t) > 1+eps {
+		return nil, nil, false
+	}
+	for i := range face {
+		N[i] = (1 + xi[i]*s) * (1 + eta[i]*t) / 4
+		if math.Abs(N[i]) > eps {
+			masters = append(masters, face[i])
+			weights = append(weights, N[i])
+		}
+	}
+	return masters, weights, true
+}
+
+// kdNode is a mesh node stored in a k-d tree.
+type kdNode struct {
+	kdPoint
+	idx int
+}
+
+func (n *kdNode) ComparePoint(p kdPoint, d kdtree.Dim) float64 {
+	return n.Component(d) - p.Component(d)
+}
+func (n *kdNode) Point() kdPoint             { return n.kdPoint }
+func (n *kdNode) Distance(p kdPoint) float64 { return Norm2(Sub(n.Vec, p.Vec)) }
+
+type kdNodes []kdNode
+
+func newKDNodes(nodes []Vec) kdNodes {
+	kn := make(kdNodes, len(nodes))
+	for i, n := range nodes {
+		kn[i] = kdNode{kdPoint: kdPoint{n}, idx: i}
+	}
+	return kn
+}
+
+func (k kdNodes) Index(i int) *kdNode { return &k[i] }
+func (k kdNodes) Len() int            { return len(k) }
+func (k kdNodes) Pivot(d kdtree.Dim) int {
+	p := kdNodePlane{dim: d, nodes: k}
+	return kdtree.Partition(p, kdtree.MedianOfMedians(p))
+}
+func (k kdNodes) Slice(start, end int) kdtree.Interface[kdPoint, *kdNode] {
+	return k[start:end]
+}
+
+type kdNodePlane struct {
+	dim   kdtree.Dim
+	nodes kdNodes
+}
+
+func (p kdNodePlane) Less(i, j int) bool {
+	return p.nodes[i].Component(p.dim) < p.nodes[j].Component(p.dim)
+}
+func (p kdNodePlane) Swap(i, j int) { p.nodes[i], p.nodes[j] = p.nodes[j], p.nodes[i] }
+func (p kdNodePlane) Len() int      { return len(p.nodes) }
+func (p kdNodePlane) Slice(start, end int) kdtree.SortSlicer {
+	return kdNodePlane{dim: p.dim, nodes: p.nodes[start:end]}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// J2Plasticity is von Mises plasticity with linear isotropic and kinematic
+// hardening under small strains. The material yields when
+//  √(3/2)*|dev(σ) - β| = Yield + IsotropicHardening*α
+// where β is the back stress and α the equivalent plastic strain. The back
+// stress follows Prager's rule dβ = 2/3*KinematicHardening*dεᵖ. In uniaxial
+// tension the stress grows with the plastic strain at a rate of
+// IsotropicHardening + KinematicHardening.
+type J2Plasticity struct {
+	// Yield is the initial yield stress in uniaxial tension.
+	Yield float64
+	// IsotropicHardening is the growth of the yield stress per unit
+	// equivalent plastic strain.
+	IsotropicHardening float64
+	// KinematicHardening is the linear kinematic hardening modulus.
+	KinematicHardening float64
+}
+
+// PlasticState holds the internal variables of J2Plasticity at a point.
+type PlasticState struct {
+	// Strain is the plastic strain in Voigt notation with engineering shear strains.
+	Strain [6]float64
+	// BackStress is the center of the yield surface in Voigt notation.
+	BackStress [6]float64
+	// Equivalent is the accumulated equivalent plastic strain α.
+	Equivalent float64
+}
+
+// returnMap integrates the material from state to the total strain with the
+// radial return method of an isotropic elastic material of shear modulus G
+// and bulk modulus K. It updates state, stores the stress in S and, if D is
+// not nil, the algorithmic tangent ∂σ/∂ε consistent with the return in D:
+//  D = K*1⊗1 + 2*G*θ*𝕀dev - 2*G*θ̄*n⊗n
+// where n is the direction of the return and θ and θ̄ reduce to 1 and 0 when
+// the step is elastic.
+func (p J2Plasticity) returnMap(G, K float64, strain *[6]float64, state *PlasticState, S *[6]float64, D *mat.Dense) {
+	// Elastic trial strain with tensor shear components.
+	var e [6]float64
+	for I := range e {
+		e[I] = strain[I] - state.Strain[I]
+		if I >= 3 {
+			e[I] /= 2
+		}
+	}
+	tr := e[0] + e[1] + e[2]
+	// Trial relative stress η = dev(σ) - β.
+	var eta [6]float64
+	var norm float64
+	for I := range eta {
+		eta[I] = 2*G*e[I] - state.BackStress[I]
+		if I < 3 {
+			eta[I] -= 2 * G * tr / 3
+			norm += eta[I] * eta[I]
+		} else {
+			norm += 2 * eta[I] * eta[I]
+		}
+	}
+	norm = math.Sqrt(norm)
+	q := math.Sqrt(1.5) * norm
+	H := p.IsotropicHardening + p.KinematicHardening
+	radius := p.Yield + p.IsotropicHardening*state.Equivalent
+	f := q - radius
+	var n [6]float64
+	dalpha, theta, thetaBar := 0.0, 1.0, 0.0
+	// Points left on the yield surface by the previous increment are elastic
+	// so that unloading starts with the elastic tangent.
+	if f > 1e-10*radius {
+		dalpha = f / (3*G + H)
+		theta = 1 - 3*G*dalpha/q
+		thetaBar = 3*G/(3*G+H) - (1 - theta)
+		for I := range n {
+			n[I] = eta[I] / norm
+			dep := math.Sqrt(1.5) * dalpha * n[I]
+			state.BackStress[I] += math.Sqrt(2./3) * p.KinematicHardening * dalpha * n[I]
+			if I >= 3 {
+				dep *= 2
+			}
+			state.Strain[I] += dep
+		}
+		state.Equivalent += dalpha
+	}
+	for I := range S {
+		S[I] = 2 * G * (e[I] - math.Sqrt(1.5)*dalpha*n[I])
+		if I < 3 {
+			S[I] += (K - 2*G/3) * tr
+		}
+	}
+	if D == nil {
+		return
+	}
+	for I := 0; I < 6; I++ {
+		for J := 0; J < 6; J++ {
+			var dev, vol float64
+			switch {
+			case I < 3 && J < 3:
+				vol = 1
+				dev = -1. / 3
+				if I == J {
+					dev += 1
+				}
+			case I == J:
+				dev = 0.5
+			}
+			D.Set(I, J, K*vol+2*G*theta*dev-2*G*thetaBar*n[I]*n[J])
+		}
+	}
+}
+
+// isotropicModuli returns the shear and bulk moduli of the isotropic
+// constitutive matrix C. ok is false if C is not isotropic.
+func isotropicModuli(C mat.Matrix) (G, K float64, ok bool) {
+	G, lambda := C.At(3, 3), C.At(0, 1)
+	tol := 1e-10 * math.Abs(C.At(0, 0))
+	for I := 0; I < 6; I++ {
+		for J := 0; J < 6; J++ {
+			var want float64
+			switch {
+			case I < 3 && J < 3:
+				want = lambda
+				if I == J {
+					want += 2 * G
+				}
+			case I == J:
+				want = G
+			}
+			if math.Abs(C.At(I, J)-want) > tol {
+				return 0, 0, false
+			}
+		}
+	}
+	return G, lambda + 2*G/3, true
+}
+
+// SolvePlastic solves the static problem of model with materials that may
+// yield under small strains and displacements. Materials with a Plasticity
+// model follow J2Plasticity with the elastic moduli of their isotropic
+// constitutive matrix C and the rest remain linear elastic. Loads are applied
+// along the load path of settings in increments, each solved with the
+// Newton-Raphson method using the algorithmic tangent. The plastic state of
+// every quadrature point is carried from one increment to the next so
+// unloading leaves the permanent deformation of the model. Constraints of
+// loads are always enforced by elimination.
+//
+// An error is returned along with the converged increments if an increment
+// does not converge or its tangent stiffness is singular.
+func SolvePlastic(model FEModel, materials []Material, loads StaticLoads, settings NonlinearSettings) (*NonlinearResult, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	if err := model.checkFormulation("plastic", BBar); err != nil {
+		return nil, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return nil, err
+	}
+	if loads.Temperature != nil {
+		return nil, errors.New("thermal strain not supported in plastic analysis")
+	}
+	sys := &plasticSystem{
+		model:    model,
+		elemC:    elemC,
+		laws:     make([]*plasticLaw, len(model.Elems)),
+		assembly: newElemAssembly(model, 3, false),
+	}
+	nq := len(newElementIntegrator(model.element()).upg)
+	laws := make(map[int]*plasticLaw)
+	for iele := range model.Elems {
+		imat := model.material(iele)
+		material := materials[imat]
+		if material.Plasticity == nil {
+			continue
+		}
+		law, ok := laws[imat]
+		if !ok {
+			if material.C == nil {
+				return nil, fmt.Errorf("plastic material %d has no constitutive matrix", imat)
+			}
+			G, K, ok := isotropicModuli(material.C)
+			if !ok {
+				return nil, errors.New("plastic material has an anisotropic constitutive matrix")
+			}
+			law = &plasticLaw{J2Plasticity: *material.Plasticity, shear: G, bulk: K}
+			laws[imat] = law
+		}
+		sys.laws[iele] = law
+	}
+	sys.state = make([][]PlasticState, len(model.Elems))
+	sys.trial = make([][]PlasticState, len(model.Elems))
+	for iele, law := range sys.laws {
+		if law != nil {
+			sys.state[iele] = make([]PlasticState, nq)
+			sys.trial[iele] = make([]PlasticState, nq)
+		}
+	}
+	c, err := loads.constraints(len(model.Nodes))
+	if err != nil {
+		return nil, err
+	}
+	c.Method = Elimination
+	fext := make([]float64, 3*len(model.Nodes))
+	if err := loads.assemble(model, materials, elemC, fext); err != nil {
+		return nil, err
+	}
+	return solveNewton(sys, c, fext, settings)
+}
+
+// plasticLaw is a J2Plasticity model with its elastic moduli.
+type plasticLaw struct {
+	J2Plasticity
+	shear, bulk float64
+}
+
+// plasticSystem is the nonlinearSystem of a model of elastic and plastic
+// materials under small strains. Elements without a plastic law use their
+// constitutive matrix.
+type plasticSystem struct {
+	model    FEModel
+	elemC    []*mat.Dense
+	laws     []*plasticLaw
+	assembly *elemAssembly
+	// Converged and trial states of the quadrature points of each element.
+	state, trial [][]PlasticState
+}
+
+func (s *plasticSystem) assemble(u []float64, withK bool) (*CSR, []float64) {
+	return assembleTangent(s.assembly, s.model, u, withK, func() elemTangent {
+		integ := newElementIntegrator(s.model.element())
+		return func(iele int, Ke *mat.Dense, fe []float64, enod []Vec, ue []float64) {
+			law := s.laws[iele]
+			integ.smallStrain(Ke, fe, enod, ue, func(ipg int, strain, S *[6]float64, D *mat.Dense) {
+				if law != nil {
+					trial := &s.trial[iele][ipg]
+					*trial = s.state[iele][ipg]
+					law.returnMap(law.shear, law.bulk, strain, trial, S, D)
+					return
+				}
+				C := s.elemC[iele]
+				for i := range S {
+					S[i] = 0
+					for j := range strain {
+						S[i] += C.At(i, j) * strain[j]
+					}
+				}
+				if D != nil {
+					D.Copy(C)
+				}
+			})
+		}
+	})
+}
+
+func (s *plasticSystem) commit(step *NonlinearStep) {
+	step.Plastic = make([][]PlasticState, len(s.state))
+	for iele, trial := range s.trial {
+		if trial != nil {
+			copy(s.state[iele], trial)
+			step.Plastic[iele] = append([]PlasticState(nil), trial...)
+		}
+	}
+}
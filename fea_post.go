@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// StressResult holds the strain and stress recovered from a displacement
+// solution. Strains and stresses are Voigt vectors ordered xx, yy, zz, xy,
+// yz, xz with engineering shear strains.
+type StressResult struct {
+	// GaussPoints holds the global position of the quadrature points of
+	// each element: GaussPoints[iele][ipg].
+	GaussPoints [][]Vec
+	// GaussVolume holds the volume represented by each quadrature point.
+	GaussVolume [][]float64
+	// GaussStrain and GaussStress hold strain and stress at each quadrature point.
+	GaussStrain, GaussStress [][][6]float64
+	// NodalStrain and NodalStress hold strain and stress at each node. Element values
+	// are extrapolated from quadrature points to the nodes and averaged over the
+	// elements sharing the node. Averaging smears the stress jump at material
+	// interfaces so prefer quadrature point values there.
+	NodalStrain, NodalStress [][6]float64
+}
+
+// RecoverStress computes strain and stress of model for the nodal displacements u
+// which hold the X, Y and Z displacement of each node in order.
+func RecoverStress(model FEModel, materials []Material, u []float64) (*StressResult, error) {
+	return recoverStress(model, materials, u, nil, 0)
+}
+
+// RecoverThermalStress is like RecoverStress for a model at nodal temperatures T.
+// Stress is C*(ε - α*(T - Tref)) where α holds the thermal expansion coefficients
+// and Tref is the stress free temperature. Strains are total strains, including
+// the thermal strain.
+func RecoverThermalStress(model FEModel, materials []Material, u, T []float64, Tref float64) (*StressResult, error) {
+	if len(T) != len(model.Nodes) {
+		return nil, fmt.Errorf("got %d temperatures for %d nodes: %w", len(T), len(model.Nodes), mat.ErrShape)
+	}
+	return recoverStress(model, materials, u, T, Tref)
+}
+
+// recoverStress computes strain and stress for the displacements u and, if T is
+// not nil, the thermal strain of the nodal temperatures T relative to Tref.
+func recoverStress(model FEModel, materials []Material, u, T []float64, Tref float64) (*StressResult, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	if len(u) != 3*len(model.Nodes) {
+		return nil, fmt.Errorf("got %d displacements for %d nodes: %w", len(u), len(model.Nodes), mat.ErrShape)
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return nil, err
+	}
+	var elemCTE [][6]float64
+	if T != nil {
+		elemCTE, err = model.elemCTE(materials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	elem := model.element()
+	nn := elem.NumNodes()
+	integ := newElementIntegrator(elem)
+	npg := len(integ.upg)
+	extrap, edges := gaussExtrapolation(elem, integ)
+	nel := len(model.Elems)
+	res := &StressResult{
+		GaussPoints: make([][]Vec, nel),
+		GaussVolume: make([][]float64, nel),
+		GaussStrain: make([][][6]float64, nel),
+		GaussStress: make([][][6]float64, nel),
+		NodalStrain: make([][6]float64, len(model.Nodes)),
+		NodalStress: make([][6]float64, len(model.Nodes)),
+	}
+	// Quadrature point values are computed in parallel.
+	parallelElems(nel, func() func(int) {
+		integ := newElementIntegrator(elem)
+		enod := make([]Vec, nn)
+		eleDisp := make([]float64, 3*nn)
+		var eleDT []float64
+		if T != nil {
+			eleDT = make([]float64, nn)
+		}
+		var stressVec mat.VecDense
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			for i, n := range enodes {
+				for d := 0; d < 3; d++ {
+					eleDisp[3*i+d] = u[3*n+d]
+				}
+			}
+			res.GaussPoints[iele] = make([]Vec, npg)
+			res.GaussVolume[iele] = make([]float64, npg)
+			res.GaussStrain[iele] = make([][6]float64, npg)
+			res.GaussStress[iele] = make([][6]float64, npg)
+			var cte [6]float64
+			if T != nil {
+				cte = elemCTE[iele]
+				for i, n := range enodes {
+					eleDT[i] = T[n] - Tref
+				}
+			}
+			integ.strains(res.GaussStrain[iele], res.GaussVolume[iele], enod, eleDisp, elemC[iele], cte, eleDT)
+			for ipg := 0; ipg < npg; ipg++ {
+				var x Vec
+				for i, N := range integ.N[ipg] {
+					x = Add(x, Scale(N, enod[i]))
+				}
+				res.GaussPoints[iele][ipg] = x
+				strain := res.GaussStrain[iele][ipg]
+				if T != nil {
+					// Only the mechanical strain produces stress.
+					var dT float64
+					for i, N := range integ.N[ipg] {
+						dT += N * eleDT[i]
+					}
+					for i := 0; i < 6; i++ {
+						strain[i] -= cte[i] * dT
+					}
+				}
+				stressVec.MulVec(elemC[iele], mat.NewVecDense(6, strain[:]))
+				for i := 0; i < 6; i++ {
+					res.GaussStress[iele][ipg][i] = stressVec.AtVec(i)
+				}
+			}
+		}
+	})
+	// Nodal averages are accumulated in element order to be deterministic.
+	count := make([]int, len(model.Nodes))
+	nodalStrain := make([][6]float64, nn)
+	nodalStress := make([][6]float64, nn)
+	for iele, enodes := range model.Elems {
+		// Extrapolate to corner nodes and interpolate linearly to midside nodes.
+		ncorner, _ := extrap.Dims()
+		for i := 0; i < ncorner; i++ {
+			nodalStrain[i], nodalStress[i] = [6]float64{}, [6]float64{}
+			for ipg := 0; ipg < npg; ipg++ {
+				e := extrap.At(i, ipg)
+				for k := 0; k < 6; k++ {
+					nodalStrain[i][k] += e * res.GaussStrain[iele][ipg][k]
+					nodalStress[i][k] += e * res.GaussStress[iele][ipg][k]
+				}
+			}
+		}
+		for j, edge := range edges {
+			for k := 0; k < 6; k++ {
+				nodalStrain[ncorner+j][k] = (nodalStrain[edge[0]][k] + nodalStrain[edge[1]][k]) / 2
+				nodalStress[ncorner+j][k] = (nodalStress[edge[0]][k] + nodalStress[edge[1]][k]) / 2
+			}
+		}
+		for i, n := range enodes {
+			count[n]++
+			for k := 0; k < 6; k++ {
+				res.NodalStrain[n][k] += nodalStrain[i][k]
+				res.NodalStress[n][k] += nodalStress[i][k]
+			}
+		}
+	}
+	for n, c := range count {
+		if c == 0 {
+			continue
+		}
+		for k := 0; k < 6; k++ {
+			res.NodalStrain[n][k] /= float64(c)
+			res.NodalStress[n][k] /= float64(c)
+		}
+	}
+	return res, nil
+}
+
+// gaussExtrapolation returns the matrix that maps values at the quadrature
+// points of elem to its corner nodes. Values are fit in the least squares
+// sense with the linear element sharing elem's corners. Midside nodes of
+// quadratic elements lie on the returned edges.
+func gaussExtrapolation(elem Element, integ *elementIntegrator) (extrap *mat.Dense, edges [][2]int) {
+	var linear Element
+	switch elem.(type) {
+	case Tet4:
+		linear = Tet4{}
+	case Tet10:
+		linear, edges = Tet4{}, tet10Edges[:]
+	case Hex8:
+		linear = Hex8{}
+	case Hex20:
+		linear, edges = Hex8{}, hex20Edges[:]
+	default:
+		panic(fmt.Sprintf("no Gauss point extrapolation for %T", elem))
+	}
+	npg := len(integ.upg)
+	ncorner := linear.NumNodes()
+	// N holds the linear shape functions at each quadrature point so
+	// that gauss = N*corner. The extrapolation is its pseudo-inverse.
+	N := mat.NewDense(npg, ncorner, nil)
+	row := make([]float64, ncorner)
+	for ipg, pg := range integ.upg {
+		linear.Basis(row, pg)
+		N.SetRow(ipg, row)
+	}
+	extrap = mat.NewDense(ncorner, npg, nil)
+	err := extrap.Solve(N, eye(npg))
+	if err != nil {
+		panic(err)
+	}
+	return extrap, edges
+}
+
+// voigtTensor returns the symmetric 3×3 tensor of the Voigt stress s.
+func voigtTensor(s [6]float64) *Mat {
+	return NewMat([]float64{
+		s[0], s[3], s[5],
+		s[3], s[1], s[4],
+		s[5], s[4], s[2],
+	})
+}
+
+// VonMises returns the von Mises equivalent stress of the Voigt stress s.
+func VonMises(s [6]float64) float64 {
+	dxy, dyz, dzx := s[0]-s[1], s[1]-s[2], s[2]-s[0]
+	return math.Sqrt((dxy*dxy+dyz*dyz+dzx*dzx)/2 + 3*(s[3]*s[3]+s[4]*s[4]+s[5]*s[5]))
+}
+
+// PrincipalStresses returns the principal stresses of the Voigt stress s
+// sorted in descending order.
+func PrincipalStresses(s [6]float64) [3]float64 {
+	eigs, _ := voigtTensor(s).Eigs()
+	sort.Sort(sort.Reverse(sort.Float64Slice(eigs)))
+	return [3]float64{eigs[0], eigs[1], eigs[2]}
+}
+
+// Pressure returns the hydrostatic pressure of the Voigt stress s,
+// positive in compression.
+func Pressure(s [6]float64) float64 {
+	return -(s[0] + s[1] + s[2]) / 3
+}
+
+// StrainEnergyDensity returns the strain energy per unit volume ½σ⋅ε
+// of the Voigt stress and strain. Shear strains must be engineering strains.
+func StrainEnergyDensity(stress, strain [6]float64) float64 {
+	var w float64
+	for i := range stress {
+		w += stress[i] * strain[i]
+	}
+	return w / 2
+}
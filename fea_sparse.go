@@ -0,0 +1,371 @@
+package main
+
+import (
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+var (
+	_ mat.Matrix         = (*COO)(nil)
+	_ mat.NonZeroDoer    = (*COO)(nil)
+	_ mat.Matrix         = (*CSR)(nil)
+	_ mat.NonZeroDoer    = (*CSR)(nil)
+	_ mat.RowNonZeroDoer = (*CSR)(nil)
+)
+
+// COO is a sparse matrix in coordinate (triplet) format. It is meant
+// for finite element assembly: entries are appended with AddAt and duplicate
+// entries are summed when the matrix is converted to CSR with ToCSR.
+//
+// At on a COO is O(nnz), so convert to CSR before using it as a mat.Matrix
+// in anything but small problems.
+type COO struct {
+	r, c int
+	rows []int
+	cols []int
+	data []float64
+}
+
+// NewCOO returns an r×c COO matrix with capacity reserved for nnz entries.
+func NewCOO(r, c, nnz int) *COO {
+	if r < 0 || c < 0 {
+		panic(mat.ErrNegativeDimension)
+	}
+	return &COO{
+		r:    r,
+		c:    c,
+		rows: make([]int, 0, nnz),
+		cols: make([]int, 0, nnz),
+		data: make([]float64, 0, nnz),
+	}
+}
+
+// Dims returns the number of rows and columns of the matrix.
+func (m *COO) Dims() (r, c int) { return m.r, m.c }
+
+// T returns the transpose of the matrix.
+func (m *COO) T() mat.Matrix { return mat.Transpose{Matrix: m} }
+
+// At returns the sum of all entries stored at row i, column j.
+func (m *COO) At(i, j int) float64 {
+	if uint(i) >= uint(m.r) {
+		panic(mat.ErrRowAccess)
+	}
+	if uint(j) >= uint(m.c) {
+		panic(mat.ErrColAccess)
+	}
+	var v float64
+	for k := range m.data {
+		if m.rows[k] == i && m.cols[k] == j {
+			v += m.data[k]
+		}
+	}
+	return v
+}
+
+// NNZ returns the number of stored entries, duplicates included.
+func (m *COO) NNZ() int { return len(m.data) }
+
+// DoNonZero calls fn for every stored entry in insertion order.
+// Duplicate entries are passed to fn separately.
+func (m *COO) DoNonZero(fn func(i, j int, v float64)) {
+	for k, v := range m.data {
+		fn(m.rows[k], m.cols[k], v)
+	}
+}
+
+// AddAt adds v to the element at row i, column j.
+func (m *COO) AddAt(i, j int, v float64) {
+	if uint(i) >= uint(m.r) {
+		panic(mat.ErrRowAccess)
+	}
+	if uint(j) >= uint(m.c) {
+		panic(mat.ErrColAccess)
+	}
+	m.rows = append(m.rows, i)
+	m.cols = append(m.cols, j)
+	m.data = append(m.data, v)
+}
+
+// AddSub scatters the square matrix a into the receiver so that
+//  m[dofs[i], dofs[j]] += a[i, j]
+// which is the usual element stiffness assembly operation. Zero entries of a
+// are skipped.
+func (m *COO) AddSub(dofs []int, a mat.Matrix) {
+	r, c := a.Dims()
+	if r != len(dofs) || c != len(dofs) {
+		panic(mat.ErrShape)
+	}
+	for i := 0; i < r; i++ {
+		di := dofs[i]
+		for j := 0; j < c; j++ {
+			v := a.At(i, j)
+			if v != 0 {
+				m.AddAt(di, dofs[j], v)
+			}
+		}
+	}
+}
+
+// AddBlock adds a to the receiver with a's first element at row i0, column j0.
+// Sparse arguments (COO, CSR and their transposes) are added without
+// visiting their zero entries.
+func (m *COO) AddBlock(i0, j0 int, a mat.Matrix) {
+	r, c := a.Dims()
+	if i0 < 0 || j0 < 0 || i0+r > m.r || j0+c > m.c {
+		panic(mat.ErrShape)
+	}
+	switch a := a.(type) {
+	case mat.NonZeroDoer:
+		a.DoNonZero(func(i, j int, v float64) { m.AddAt(i0+i, j0+j, v) })
+		return
+	case mat.Transpose:
+		if nz, ok := a.Matrix.(mat.NonZeroDoer); ok {
+			nz.DoNonZero(func(i, j int, v float64) { m.AddAt(i0+j, j0+i, v) })
+			return
+		}
+	}
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			v := a.At(i, j)
+			if v != 0 {
+				m.AddAt(i0+i, j0+j, v)
+			}
+		}
+	}
+}
+
+// Resize changes the dimensions of the matrix. It panics if a stored
+// entry falls outside of the new dimensions.
+func (m *COO) Resize(r, c int) {
+	if r < 0 || c < 0 {
+		panic(mat.ErrNegativeDimension)
+	}
+	for k := range m.data {
+		if m.rows[k] >= r || m.cols[k] >= c {
+			panic(mat.ErrShape)
+		}
+	}
+	m.r, m.c = r, c
+}
+
+// ToCSR returns the matrix in compressed sparse row format.
+// Duplicate entries are summed in insertion order so the result
+// is deterministic for a fixed assembly order.
+func (m *COO) ToCSR() *CSR {
+	nnz := len(m.data)
+	// Two stable counting sort passes: first by column then by row.
+	// Result is sorted by row with ascending columns and duplicates
+	// kept in insertion order.
+	bycol := make([]int, nnz)
+	count := make([]int, max(m.r, m.c)+1)
+	for _, j := range m.cols {
+		count[j+1]++
+	}
+	for j := 0; j < m.c; j++ {
+		count[j+1] += count[j]
+	}
+	for k, j := range m.cols {
+		bycol[count[j]] = k
+		count[j]++
+	}
+	perm := make([]int, nnz)
+	indptr := make([]int, m.r+1)
+	for _, i := range m.rows {
+		indptr[i+1]++
+	}
+	for i := 0; i < m.r; i++ {
+		indptr[i+1] += indptr[i]
+	}
+	next := append([]int(nil), indptr[:m.r]...)
+	for _, k := range bycol {
+		i := m.rows[k]
+		perm[next[i]] = k
+		next[i]++
+	}
+	// Count the entries left after merging duplicates so that the result
+	// holds no more than its nonzero pattern.
+	merged := 0
+	for i := 0; i < m.r; i++ {
+		last := -1
+		for _, k := range perm[indptr[i]:indptr[i+1]] {
+			if j := m.cols[k]; j != last {
+				merged++
+				last = j
+			}
+		}
+	}
+	csr := &CSR{
+		r:      m.r,
+		c:      m.c,
+		indptr: make([]int, m.r+1),
+		ind:    make([]int, 0, merged),
+		data:   make([]float64, 0, merged),
+	}
+	for i := 0; i < m.r; i++ {
+		last := -1
+		for _, k := range perm[indptr[i]:indptr[i+1]] {
+			j := m.cols[k]
+			if j == last {
+				csr.data[len(csr.data)-1] += m.data[k]
+				continue
+			}
+			csr.ind = append(csr.ind, j)
+			csr.data = append(csr.data, m.data[k])
+			last = j
+		}
+		csr.indptr[i+1] = len(csr.ind)
+	}
+	return csr
+}
+
+// CSR is a sparse matrix in compressed sparse row format. Column indices
+// within a row are sorted and unique. CSR is the format used by the solvers;
+// build one by assembling a COO and calling ToCSR. Finite element matrices
+// are assembled directly into the sparsity pattern of the element
+// connectivity, which matrices of the same model share.
+type CSR struct {
+	r, c   int
+	indptr []int
+	ind    []int
+	data   []float64
+}
+
+// Dims returns the number of rows and columns of the matrix.
+func (m *CSR) Dims() (r, c int) { return m.r, m.c }
+
+// T returns the transpose of the matrix.
+func (m *CSR) T() mat.Matrix { return mat.Transpose{Matrix: m} }
+
+// At returns the element at row i, column j.
+func (m *CSR) At(i, j int) float64 {
+	if uint(i) >= uint(m.r) {
+		panic(mat.ErrRowAccess)
+	}
+	if uint(j) >= uint(m.c) {
+		panic(mat.ErrColAccess)
+	}
+	start, end := m.indptr[i], m.indptr[i+1]
+	k := start + sort.SearchInts(m.ind[start:end], j)
+	if k < end && m.ind[k] == j {
+		return m.data[k]
+	}
+	return 0
+}
+
+// NNZ returns the number of stored entries.
+func (m *CSR) NNZ() int { return len(m.data) }
+
+// clone returns a copy of m that shares its sparsity pattern.
+func (m *CSR) clone() *CSR {
+	c := *m
+	c.data = append([]float64(nil), m.data...)
+	return &c
+}
+
+// index returns the position of the entry at row i, column j in m.data.
+// It panics if the entry is not stored.
+func (m *CSR) index(i, j int) int {
+	start, end := m.indptr[i], m.indptr[i+1]
+	k := start + sort.SearchInts(m.ind[start:end], j)
+	if k == end || m.ind[k] != j {
+		panic("sparse: entry outside of sparsity pattern")
+	}
+	return k
+}
+
+// addSub scatters the square matrix a into the stored entries of the
+// receiver as COO.AddSub does. Zero entries of a are skipped.
+func (m *CSR) addSub(dofs []int, a mat.Matrix) {
+	r, c := a.Dims()
+	if r != len(dofs) || c != len(dofs) {
+		panic(mat.ErrShape)
+	}
+	for i, di := range dofs {
+		for j, dj := range dofs {
+			if v := a.At(i, j); v != 0 {
+				m.data[m.index(di, dj)] += v
+			}
+		}
+	}
+}
+
+// addDiag adds d[i] to the stored entry at row and column dofs[i].
+func (m *CSR) addDiag(dofs []int, d []float64) {
+	for i, dof := range dofs {
+		m.data[m.index(dof, dof)] += d[i]
+	}
+}
+
+// DoNonZero calls fn for every stored entry in row-major order.
+func (m *CSR) DoNonZero(fn func(i, j int, v float64)) {
+	for i := 0; i < m.r; i++ {
+		m.DoRowNonZero(i, fn)
+	}
+}
+
+// DoRowNonZero calls fn for every stored entry of row i.
+func (m *CSR) DoRowNonZero(i int, fn func(i, j int, v float64)) {
+	for k := m.indptr[i]; k < m.indptr[i+1]; k++ {
+		fn(i, m.ind[k], m.data[k])
+	}
+}
+
+// MulVecTo computes dst = A*x. dst and x must not overlap.
+func (m *CSR) MulVecTo(dst, x []float64) {
+	if len(dst) != m.r || len(x) != m.c {
+		panic(mat.ErrShape)
+	}
+	for i := 0; i < m.r; i++ {
+		var sum float64
+		for k := m.indptr[i]; k < m.indptr[i+1]; k++ {
+			sum += m.data[k] * x[m.ind[k]]
+		}
+		dst[i] = sum
+	}
+}
+
+// Diag returns the diagonal of the matrix.
+func (m *CSR) Diag() []float64 {
+	n := m.r
+	if m.c < n {
+		n = m.c
+	}
+	d := make([]float64, n)
+	for i := range d {
+		d[i] = m.At(i, i)
+	}
+	return d
+}
+
+// Sub returns the submatrix formed by the rows and columns where
+// keep is true. It is the sparse analogue of booleanIndexing.
+func (m *CSR) Sub(keep []bool) *CSR {
+	if len(keep) != m.r || len(keep) != m.c {
+		panic(mat.ErrShape)
+	}
+	newIdx := make([]int, len(keep))
+	n := 0
+	for i, k := range keep {
+		newIdx[i] = -1
+		if k {
+			newIdx[i] = n
+			n++
+		}
+	}
+	sub := &CSR{r: n, c: n, indptr: make([]int, n+1)}
+	for i := 0; i < m.r; i++ {
+		if !keep[i] {
+			continue
+		}
+		for k := m.indptr[i]; k < m.indptr[i+1]; k++ {
+			if j := newIdx[m.ind[k]]; j >= 0 {
+				sub.ind = append(sub.ind, j)
+				sub.data = append(sub.data, m.data[k])
+			}
+		}
+		sub.indptr[newIdx[i]+1] = len(sub.ind)
+	}
+	return sub
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// StaticLoads holds the supports and loads of a linear static analysis.
+type StaticLoads struct {
+	// Displacement holds prescribed displacements keyed by degree of freedom,
+	// node i owning degrees of freedom 3*i to 3*i+2 for the X, Y and Z displacement.
+	Displacement map[int]float64
+	// Constraints holds further supports and multi-point constraints and
+	// selects the enforcement method. If nil prescribed displacements are eliminated.
+	Constraints *Constraints
+	// Temperature holds the nodal temperatures that produce thermal strain loads.
+	// It may be a prescribed field or the solution of SolveThermal or
+	// SolveTransient. If nil there is no thermal strain.
+	Temperature []float64
+	// ReferenceTemperature is the stress free temperature.
+	ReferenceTemperature float64
+	// PointLoad holds concentrated forces applied to nodes.
+	PointLoad map[int]Vec
+	Traction  []Traction
+	Pressure  []PressureLoad
+	BodyForce []BodyForce
+	// Gravity is the acceleration of gravity. Elements are loaded with
+	// the weight of their material's Density.
+	Gravity Vec
+}
+
+// Traction is a distributed force per unit area on element faces.
+type Traction struct {
+	Faces    []ElemFace
+	Traction Vec
+}
+
+// PressureLoad is a distributed load normal to element faces. Positive
+// pressure acts against the outward normal, pushing on the faces.
+type PressureLoad struct {
+	Faces    []ElemFace
+	Pressure float64
+}
+
+// BodyForce is a force per unit volume acting on elements.
+type BodyForce struct {
+	// Elems holds the loaded elements. If nil all elements are loaded.
+	Elems []int
+	Force Vec
+}
+
+// SolveStatic solves the linear static problem
+//  K*u = f
+// of model and returns the nodal displacements u, node i owning indices 3*i
+// to 3*i+2. f holds the point loads, tractions, pressures, body forces and
+// thermal strain loads of loads. Use RecoverThermalStress to obtain the stresses of models with
+// thermal strain loads. An error is returned if the supports do not prevent
+// rigid body motion.
+func SolveStatic(model FEModel, materials []Material, loads StaticLoads) (u []float64, err error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		return nil, err
+	}
+	c, err := loads.constraints(len(model.Nodes))
+	if err != nil {
+		return nil, err
+	}
+	f := make([]float64, 3*len(model.Nodes))
+	if err := loads.assemble(model, materials, elemC, f); err != nil {
+		return nil, err
+	}
+	K := assembleStiffness(model, elemC)
+	if loads.Constraints == nil {
+		u, err := solvePrescribed(K, f, loads.Displacement)
+		var serr *singularError
+		if errors.As(err, &serr) {
+			return nil, fmt.Errorf("prescribed displacements do not prevent rigid body motion: %w", err)
+		}
+		return u, err
+	}
+	return c.solve(K, f)
+}
+
+// constraints returns the constraints of l including the prescribed
+// displacements in ascending degree of freedom order.
+func (l StaticLoads) constraints(nnodes int) (*Constraints, error) {
+	if len(l.Displacement) == 0 && (l.Constraints == nil || l.Constraints.Len() == 0) {
+		return nil, errors.New("model has no prescribed displacements to prevent rigid body motion")
+	}
+	c := NewConstraints(nnodes, 3)
+	if l.Constraints != nil {
+		if l.Constraints.nnodes != nnodes || l.Constraints.ndof != 3 {
+			return nil, fmt.Errorf("constraints for %d nodes with %d degrees of freedom on model with %d nodes: %w", l.Constraints.nnodes, l.Constraints.ndof, nnodes, mat.ErrShape)
+		}
+		*c = *l.Constraints
+		c.eqs = append([]Constraint(nil), c.eqs...)
+	}
+	dofs := make([]int, 0, len(l.Displacement))
+	for dof := range l.Displacement {
+		dofs = append(dofs, dof)
+	}
+	sort.Ints(dofs) // Deterministic constraint order.
+	for _, dof := range dofs {
+		c.Prescribe(dof, l.Displacement[dof])
+	}
+	return c, nil
+}
+
+// assemble adds the nodal forces of l to f.
+func (l StaticLoads) assemble(model FEModel, materials []Material, elemC []*mat.Dense, f []float64) error {
+	if l.Temperature != nil {
+		if len(l.Temperature) != len(model.Nodes) {
+			return fmt.Errorf("got %d temperatures for %d nodes: %w", len(l.Temperature), len(model.Nodes), mat.ErrShape)
+		}
+		elemCTE, err := model.elemCTE(materials)
+		if err != nil {
+			return err
+		}
+		assembleThermalLoad(model, elemC, elemCTE, l.Temperature, l.ReferenceTemperature, f)
+	}
+	for n, F := range l.PointLoad {
+		if n < 0 || n >= len(model.Nodes) {
+			return fmt.Errorf("point load at node %d out of range [0,%d)", n, len(model.Nodes))
+		}
+		f[3*n] += F.X
+		f[3*n+1] += F.Y
+		f[3*n+2] += F.Z
+	}
+	elem := model.element()
+	enod := make([]Vec, elem.NumNodes())
+	// addForce adds the force F distributed with the shape functions N to f.
+	addForce := func(enodes []int, N []float64, F Vec) {
+		for i, n := range enodes {
+			f[3*n] += N[i] * F.X
+			f[3*n+1] += N[i] * F.Y
+			f[3*n+2] += N[i] * F.Z
+		}
+	}
+	if len(l.Traction) > 0 || len(l.Pressure) > 0 {
+		finteg := newFaceIntegrator(elem)
+		for _, bc := range l.Traction {
+			if err := model.checkFaces(bc.Faces); err != nil {
+				return err
+			}
+			for _, face := range bc.Faces {
+				enodes := model.Elems[face.Elem]
+				storeElemNode(enod, model.Nodes, enodes)
+				for ipg := range finteg.wpg[face.Face] {
+					N, _, dA := finteg.point(enod, face.Face, ipg)
+					addForce(enodes, N, Scale(dA, bc.Traction))
+				}
+			}
+		}
+		for _, bc := range l.Pressure {
+			if err := model.checkFaces(bc.Faces); err != nil {
+				return err
+			}
+			for _, face := range bc.Faces {
+				enodes := model.Elems[face.Elem]
+				storeElemNode(enod, model.Nodes, enodes)
+				for ipg := range finteg.wpg[face.Face] {
+					// The normal is evaluated at each point to follow curved faces.
+					N, normal, dA := finteg.point(enod, face.Face, ipg)
+					addForce(enodes, N, Scale(-bc.Pressure*dA, normal))
+				}
+			}
+		}
+	}
+	// Body forces are gathered per element so each element is integrated once.
+	var b []Vec
+	for _, bf := range l.BodyForce {
+		if b == nil {
+			b = make([]Vec, len(model.Elems))
+		}
+		if bf.Elems == nil {
+			for iele := range b {
+				b[iele] = Add(b[iele], bf.Force)
+			}
+			continue
+		}
+		for _, iele := range bf.Elems {
+			if iele < 0 || iele >= len(model.Elems) {
+				return fmt.Errorf("body force on element %d out of range [0,%d)", iele, len(model.Elems))
+			}
+			b[iele] = Add(b[iele], bf.Force)
+		}
+	}
+	if l.Gravity != (Vec{}) {
+		density, err := model.elemProperty(materials, func(m Material) float64 { return m.Density })
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			b = make([]Vec, len(model.Elems))
+		}
+		for iele := range b {
+			b[iele] = Add(b[iele], Scale(density[iele], l.Gravity))
+		}
+	}
+	if b != nil {
+		integ := newElementIntegrator(elem)
+		for iele, enodes := range model.Elems {
+			if b[iele] == (Vec{}) {
+				continue
+			}
+			storeElemNode(enod, model.Nodes, enodes)
+			for ipg := range integ.upg {
+				dV := integ.gradient(enod, ipg)
+				addForce(enodes, integ.N[ipg], Scale(dV, b[iele]))
+			}
+		}
+	}
+	return nil
+}
+
+// assembleThermalLoad adds to f the nodal forces equivalent to the thermal
+// strain of the nodal temperatures T relative to Tref.
+func assembleThermalLoad(model FEModel, elemC []*mat.Dense, elemCTE [][6]float64, T []float64, Tref float64, f []float64) {
+	elem := model.element()
+	nn := elem.NumNodes()
+	integ := newElementIntegrator(elem)
+	enod := make([]Vec, nn)
+	dT := make([]float64, nn)
+	fe := make([]float64, 3*nn)
+	edofs := make([]int, 3*nn)
+	for iele, enodes := range model.Elems {
+		if elemCTE[iele] == ([6]float64{}) {
+			continue
+		}
+		storeElemNode(enod, model.Nodes, enodes)
+		for i, n := range enodes {
+			dT[i] = T[n] - Tref
+		}
+		integ.thermalLoad(fe, enod, elemC[iele], elemCTE[iele], dT)
+		storeElemDofs(edofs, enodes, 3)
+		for i, dof := range edofs {
+			f[dof] += fe[i]
+		}
+	}
+}
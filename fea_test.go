@@ -1,9 +1,19 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
 
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/spatial/r3"
 )
 
 func TestBooleanIndexing(t *testing.T) {
@@ -28,3 +38,2973 @@ func TestBooleanIndexing(t *testing.T) {
 		}
 	}
 }
+
+func TestCOOToCSR(t *testing.T) {
+	coo := NewCOO(4, 3, 0)
+	dense := mat.NewDense(4, 3, nil)
+	add := func(i, j int, v float64) {
+		coo.AddAt(i, j, v)
+		dense.Set(i, j, dense.At(i, j)+v)
+	}
+	add(3, 2, 1)
+	add(0, 1, 2)
+	add(0, 1, 3) // duplicate entry.
+	add(2, 0, -1)
+	add(0, 0, 4)
+	add(3, 0, 5)
+	add(2, 0, 1) // cancels out.
+	if !mat.Equal(coo, dense) {
+		t.Fatal("COO does not match dense reference")
+	}
+	csr := coo.ToCSR()
+	if !mat.Equal(csr, dense) {
+		t.Errorf("CSR does not match dense reference\n%v", mat.Formatted(csr))
+	}
+	if csr.NNZ() != 5 {
+		t.Errorf("expected duplicates to be merged, got nnz=%d", csr.NNZ())
+	}
+	if cap(csr.ind) != csr.NNZ() || cap(csr.data) != csr.NNZ() {
+		t.Errorf("CSR holds capacity for %d entries, want %d", cap(csr.data), csr.NNZ())
+	}
+	x := []float64{1, 2, 3}
+	got := make([]float64, 4)
+	csr.MulVecTo(got, x)
+	var want mat.VecDense
+	want.MulVec(dense, mat.NewVecDense(3, x))
+	if !mat.EqualApprox(mat.NewVecDense(4, got), &want, 1e-14) {
+		t.Errorf("MulVecTo mismatch: got %v want %v", got, want.RawVector().Data)
+	}
+
+	sq := NewCOO(3, 3, 0)
+	sq.AddBlock(0, 0, mat.NewDense(3, 3, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}))
+	sub := booleanIndexing(sq.ToCSR(), false, []bool{false, true, true}, []bool{false, true, true})
+	if !mat.Equal(sq.ToCSR().Sub([]bool{false, true, true}), sub) {
+		t.Error("CSR.Sub does not match booleanIndexing")
+	}
+}
+
+// laplacian3D returns the 7-point finite difference Laplacian on an n×n×n grid.
+func laplacian3D(n int) *CSR {
+	idx := func(i, j, k int) int { return (i*n+j)*n + k }
+	A := NewCOO(n*n*n, n*n*n, 7*n*n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			for k := 0; k < n; k++ {
+				row := idx(i, j, k)
+				A.AddAt(row, row, 6)
+				for _, nb := range [][3]int{{i - 1, j, k}, {i + 1, j, k}, {i, j - 1, k}, {i, j + 1, k}, {i, j, k - 1}, {i, j, k + 1}} {
+					if nb[0] >= 0 && nb[0] < n && nb[1] >= 0 && nb[1] < n && nb[2] >= 0 && nb[2] < n {
+						A.AddAt(row, idx(nb[0], nb[1], nb[2]), -1)
+					}
+				}
+			}
+		}
+	}
+	return A.ToCSR()
+}
+
+func TestPCG(t *testing.T) {
+	const n = 8
+	A := laplacian3D(n)
+	rnd := rand.New(rand.NewSource(1))
+	b := make([]float64, n*n*n)
+	for i := range b {
+		b[i] = rnd.Float64()
+	}
+	jac, err := NewJacobi(A.Diag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic, err := NewIC0(A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := NewSSOR(A, 1.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Matrix-free version of A.
+	matfree := OperatorFunc(func(dst, x []float64) { A.MulVecTo(dst, x) })
+	var unpreconditioned int
+	for _, test := range []struct {
+		name string
+		op   Operator
+		pc   Preconditioner
+	}{
+		{name: "none", op: A},
+		{name: "jacobi", op: A, pc: jac},
+		{name: "ic0", op: A, pc: ic},
+		{name: "ssor", op: A, pc: ss},
+		{name: "matrixfree", op: matfree, pc: jac},
+	} {
+		x := make([]float64, len(b))
+		res, err := PCG(test.op, x, b, PCGSettings{Tolerance: 1e-10, Preconditioner: test.pc})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(res.Residuals) != res.Iterations+1 {
+			t.Errorf("%s: residual history length %d for %d iterations", test.name, len(res.Residuals), res.Iterations)
+		}
+		Ax := make([]float64, len(b))
+		A.MulVecTo(Ax, x)
+		floats.Sub(Ax, b)
+		if rel := floats.Norm(Ax, 2) / floats.Norm(b, 2); rel > 1e-9 {
+			t.Errorf("%s: relative residual %g", test.name, rel)
+		}
+		switch test.name {
+		case "none":
+			unpreconditioned = res.Iterations
+		case "ic0", "ssor":
+			if res.Iterations >= unpreconditioned {
+				t.Errorf("%s: preconditioner did not reduce iterations: %d >= %d", test.name, res.Iterations, unpreconditioned)
+			}
+		}
+	}
+	x := make([]float64, len(b))
+	_, err = PCG(A, x, b, PCGSettings{MaxIterations: 2})
+	if !errors.Is(err, errNotConverged) {
+		t.Errorf("expected non-convergence error, got %v", err)
+	}
+}
+
+func TestLDL(t *testing.T) {
+	const n = 6
+	K := laplacian3D(n)
+	nK, _ := K.Dims()
+	// Add a few Lagrange multiplier constraints u[a]-u[b] = 0 and u[c] = 0 to form
+	// an indefinite saddle point system.
+	constraints := [][2]int{{0, nK - 1}, {3, 50}, {7, -1}}
+	N := len(constraints)
+	A := NewCOO(nK+N, nK+N, K.NNZ()+4*N)
+	A.AddBlock(0, 0, K)
+	delayed := make([]bool, nK+N)
+	for r, c := range constraints {
+		delayed[nK+r] = true
+		A.AddAt(nK+r, c[0], 1)
+		A.AddAt(c[0], nK+r, 1)
+		if c[1] >= 0 {
+			A.AddAt(nK+r, c[1], -1)
+			A.AddAt(c[1], nK+r, -1)
+		}
+	}
+	csr := A.ToCSR()
+	var f LDL
+	if err := f.Factorize(csr, delayed); err != nil {
+		t.Fatal(err)
+	}
+	if pos, neg, zero := f.Inertia(); pos != nK || neg != N || zero != 0 {
+		t.Errorf("bad inertia: got (%d,%d,%d), want (%d,%d,0)", pos, neg, zero, nK, N)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	b := mat.NewDense(nK+N, 3, nil)
+	for i := 0; i < nK+N; i++ {
+		for j := 0; j < 3; j++ {
+			b.Set(i, j, rnd.NormFloat64())
+		}
+	}
+	var got, want mat.Dense
+	if err := f.SolveTo(&got, b); err != nil {
+		t.Fatal(err)
+	}
+	err := want.Solve(mat.DenseCopyOf(csr), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mat.EqualApprox(&got, &want, 1e-10) {
+		t.Error("LDL solution does not match dense solution")
+	}
+	if f.NNZ() >= (nK+N)*(nK+N-1)/2 {
+		t.Errorf("ordering did not reduce fill: nnz(L)=%d", f.NNZ())
+	}
+
+	// A Laplacian with no Dirichlet condition is singular.
+	S := NewCOO(3, 3, 7)
+	for i := 0; i < 3; i++ {
+		S.AddAt(i, i, 2)
+		if i > 0 {
+			S.AddAt(i, i-1, -1)
+			S.AddAt(i-1, i, -1)
+		}
+	}
+	S.AddAt(0, 0, -1)
+	S.AddAt(2, 2, -1)
+	if err := f.Factorize(S.ToCSR(), nil); err == nil {
+		t.Error("expected singular matrix error")
+	}
+	// A Lagrange multiplier that does not remove the singularity fails
+	// iterative refinement for loads outside the range of the matrix.
+	A = NewCOO(4, 4, 9)
+	A.AddBlock(0, 0, S.ToCSR())
+	A.AddAt(3, 0, 1)
+	A.AddAt(0, 3, 1)
+	A.AddAt(3, 1, -1)
+	A.AddAt(1, 3, -1)
+	if err := f.Factorize(A.ToCSR(), []bool{false, false, false, true}); err != nil {
+		t.Fatal(err)
+	}
+	if pos, neg, zero := f.Inertia(); pos != 2 || neg != 1 || zero != 1 {
+		t.Errorf("bad inertia of singular matrix: got (%d,%d,%d), want (2,1,1)", pos, neg, zero)
+	}
+	if err := f.SolveVecTo(make([]float64, 4), []float64{1, 0, 0, 0}); !errors.Is(err, errNotConverged) {
+		t.Errorf("expected non-convergence error, got %v", err)
+	}
+}
+
+func TestHomogenizeIsotropic(t *testing.T) {
+	// A homogeneous RUC must return the constitutive matrix of its material.
+	nodes, h8 := feaModel()
+	Cm := isotropicCompliance(4.8e3, 0.34)
+	C, report, err := Homogenize(FEModel{Nodes: nodes, Elems: meshElems(h8)}, []Material{{C: Cm}}, HomogenizeSettings{
+		Box: Box{Max: Vec{X: 10, Y: 10, Z: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mat.EqualApprox(voigtDense(C), Cm, 1e-6) {
+		t.Errorf("homogenized stiffness does not match material:\n%.6g", mat.Formatted(voigtDense(C)))
+	}
+	if math.Abs(report.Volume-1000) > 1e-9 {
+		t.Errorf("bad mesh volume %g", report.Volume)
+	}
+	// Averaged strain of a full cell equals the imposed macroscopic strain.
+	if math.Abs(report.Strain[0][0]-0.1) > 1e-12 || math.Abs(report.Strain[3][3]-0.1) > 1e-12 {
+		t.Errorf("bad averaged strain %v", report.Strain)
+	}
+}
+
+func TestHomogenizeMaterials(t *testing.T) {
+	box := Box{Max: Vec{X: 2, Y: 2, Z: 2}}
+	nodes, elems := hexaGrid(box, [3]int{2, 2, 2})
+	Cf := orthotropicCompliance(235e3, 14e3, 0.2, 0.25, 28e3)
+	Cm := isotropicCompliance(4.8e3, 0.34)
+	settings := HomogenizeSettings{Box: box}
+
+	// A homogeneous orthotropic cell rotated 90° about Z swaps the X and Y axes.
+	model := FEModel{Nodes: nodes, Elems: elems}
+	all := findElems(nodes, elems, func(Vec) bool { return true })
+	model.SetOrientation(all, NewRotation(math.Pi/2, Vec{Z: 1}).Mat())
+	C, _, err := Homogenize(model, []Material{{C: Cf}}, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rotateStiffness(Cf, NewRotation(math.Pi/2, Vec{Z: 1}).Mat())
+	if !mat.EqualApprox(voigtDense(C), want, 1e-6*want.At(0, 0)) {
+		t.Errorf("rotated homogenized stiffness mismatch:\n%.6g", mat.Formatted(voigtDense(C)))
+	}
+	if math.Abs(C[1][1]-Cf.At(0, 0)) > 1e-6*Cf.At(0, 0) {
+		t.Errorf("expected fiber stiffness along Y, got C22=%g", C[1][1])
+	}
+
+	// Half fiber half matrix laminate must lie within the Voigt and Reuss bounds.
+	model = FEModel{Nodes: nodes, Elems: elems}
+	model.SetMaterial(findElems(nodes, elems, func(c Vec) bool { return c.Z < 1 }), 1)
+	C, _, err = Homogenize(model, []Material{{C: Cm}, {C: Cf}}, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var voigt, reuss, Sf, Sm mat.Dense
+	voigt.Add(Cf, Cm)
+	voigt.Scale(0.5, &voigt)
+	Sf.Inverse(Cf)
+	Sm.Inverse(Cm)
+	reuss.Add(&Sf, &Sm)
+	reuss.Scale(0.5, &reuss)
+	reuss.Inverse(&reuss)
+	for i := 0; i < 6; i++ {
+		if C[i][i] > voigt.At(i, i)*(1+1e-9) || C[i][i] < reuss.At(i, i)*(1-1e-9) {
+			t.Errorf("C[%d][%d]=%g outside bounds [%g, %g]", i, i, C[i][i], reuss.At(i, i), voigt.At(i, i))
+		}
+	}
+	// Fiber direction X lies in the laminate plane so it is stiffer than the stacking direction.
+	if C[0][0] < C[2][2] {
+		t.Errorf("expected in-plane fiber direction to be stiffest, got C11=%g C33=%g", C[0][0], C[2][2])
+	}
+	if _, _, err := Homogenize(model, []Material{{C: Cm}}, settings); err == nil {
+		t.Error("expected error for out of range material")
+	}
+}
+
+func TestHomogenizePeriodic(t *testing.T) {
+	Cm := isotropicCompliance(4.8e3, 0.34)
+	rng := rand.New(rand.NewSource(1))
+
+	// Mesher round-off must not break pairing.
+	nodes, h8 := feaModel()
+	elems := meshElems(h8)
+	for i := range nodes {
+		nodes[i] = Add(nodes[i], Vec{X: 1e-9 * rng.NormFloat64(), Y: 1e-9 * rng.NormFloat64(), Z: 1e-9 * rng.NormFloat64()})
+	}
+	C, _, err := Homogenize(FEModel{Nodes: nodes, Elems: elems}, []Material{{C: Cm}}, HomogenizeSettings{
+		Box: Box{Max: Vec{X: 10, Y: 10, Z: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mat.EqualApprox(voigtDense(C), Cm, 1e-4) {
+		t.Errorf("perturbed mesh stiffness mismatch:\n%.6g", mat.Formatted(voigtDense(C)))
+	}
+
+	// Shift a line of nodes on the X max face so the opposite faces no longer match.
+	box := Box{Max: Vec{X: 2, Y: 2, Z: 2}}
+	nodes, elems = hexaGrid(box, [3]int{4, 4, 4})
+	for _, n := range findNodes(nodes, func(n Vec) bool { return n.X == 2 && n.Y == 1 }) {
+		nodes[n].Y = 1.1
+	}
+	model := FEModel{Nodes: nodes, Elems: elems}
+	_, _, err = Homogenize(model, []Material{{C: Cm}}, HomogenizeSettings{Box: box})
+	var unpaired *UnpairedNodesError
+	if !errors.As(err, &unpaired) || len(unpaired.Nodes) != 5 {
+		t.Fatalf("expected 5 unpaired nodes, got %v", err)
+	}
+	C, _, err = Homogenize(model, []Material{{C: Cm}}, HomogenizeSettings{Box: box, NonMatching: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Node to face constraints do not transfer tractions exactly between
+	// non-matching faces so the result is only close to the homogeneous material.
+	if !mat.EqualApprox(voigtDense(C), Cm, 0.005*Cm.At(0, 0)) {
+		t.Errorf("non-matching mesh stiffness mismatch:\n%.6g", mat.Formatted(voigtDense(C)))
+	}
+}
+
+func TestElements(t *testing.T) {
+	tetNodes := []Vec{{}, {X: 1}, {Y: 1}, {Z: 1}}
+	for _, e := range tet10Edges {
+		tetNodes = append(tetNodes, Scale(0.5, Add(tetNodes[e[0]], tetNodes[e[1]])))
+	}
+	hexNodes := append([]Vec(nil), hexCorners[:]...)
+	for _, e := range hex20Edges {
+		hexNodes = append(hexNodes, Scale(0.5, Add(hexNodes[e[0]], hexNodes[e[1]])))
+	}
+	for _, test := range []struct {
+		elem    Element
+		nodes   []Vec // Reference coordinates of nodes.
+		volume  float64
+		inside  Vec
+		nfaceNN int
+	}{
+		{elem: Tet4{}, nodes: tetNodes[:4], volume: 1.0 / 6, inside: Vec{X: 0.2, Y: 0.3, Z: 0.1}, nfaceNN: 3},
+		{elem: Tet10{}, nodes: tetNodes, volume: 1.0 / 6, inside: Vec{X: 0.2, Y: 0.3, Z: 0.1}, nfaceNN: 6},
+		{elem: Hex8{}, nodes: hexNodes[:8], volume: 8, inside: Vec{X: 0.2, Y: -0.7, Z: 0.4}, nfaceNN: 4},
+		{elem: Hex20{}, nodes: hexNodes, volume: 8, inside: Vec{X: 0.2, Y: -0.7, Z: 0.4}, nfaceNN: 8},
+	} {
+		e := test.elem
+		nn := e.NumNodes()
+		if len(test.nodes) != nn {
+			t.Fatalf("%T: bad test node count", e)
+		}
+		N := make([]float64, nn)
+		for i, u := range test.nodes {
+			e.Basis(N, u)
+			for j := range N {
+				want := 0.0
+				if i == j {
+					want = 1
+				}
+				if math.Abs(N[j]-want) > 1e-14 {
+					t.Errorf("%T: N%d at node %d = %g, want %g", e, j, i, N[j], want)
+				}
+			}
+		}
+		// Partition of unity and derivatives against central differences.
+		e.Basis(N, test.inside)
+		if math.Abs(floats.Sum(N)-1) > 1e-14 {
+			t.Errorf("%T: shape functions do not sum to 1: %g", e, floats.Sum(N))
+		}
+		dN := mat.NewDense(3, nn, nil)
+		e.BasisDiff(dN, test.inside)
+		const h = 1e-6
+		Np := make([]float64, nn)
+		Nm := make([]float64, nn)
+		for d := 0; d < 3; d++ {
+			var dv Vec
+			dv.setComponent(d, h)
+			e.Basis(Np, Add(test.inside, dv))
+			e.Basis(Nm, Sub(test.inside, dv))
+			for j := 0; j < nn; j++ {
+				fd := (Np[j] - Nm[j]) / (2 * h)
+				if math.Abs(fd-dN.At(d, j)) > 1e-8 {
+					t.Errorf("%T: dN%d/du%d = %g, finite difference %g", e, j, d, dN.At(d, j), fd)
+				}
+			}
+		}
+		_, w := e.Quadrature()
+		if math.Abs(floats.Sum(w)-test.volume) > 1e-14 {
+			t.Errorf("%T: quadrature weights sum to %g, want %g", e, floats.Sum(w), test.volume)
+		}
+		// Faces are oriented with outward normals.
+		var centroid Vec
+		for _, n := range test.nodes {
+			centroid = Add(centroid, Scale(1/float64(nn), n))
+		}
+		for _, f := range e.Faces() {
+			if len(f) != test.nfaceNN {
+				t.Errorf("%T: face %v has %d nodes, want %d", e, f, len(f), test.nfaceNN)
+			}
+			a, b, c := test.nodes[f[0]], test.nodes[f[1]], test.nodes[f[2]]
+			normal := Cross(Sub(b, a), Sub(c, a))
+			if Dot(normal, Sub(a, centroid)) <= 0 {
+				t.Errorf("%T: face %v normal points inward", e, f)
+			}
+		}
+	}
+}
+
+// kuhnTetras splits every hexahedron into 6 tetrahedra sharing the diagonal
+// from local node 0 to 6. Meshes of equally oriented hexahedra stay conforming.
+func kuhnTetras(hexas [][]int) (tetras [][]int) {
+	for _, h := range hexas {
+		for _, t := range [6][4]int{{0, 1, 2, 6}, {0, 2, 3, 6}, {0, 3, 7, 6}, {0, 7, 4, 6}, {0, 4, 5, 6}, {0, 5, 1, 6}} {
+			tetras = append(tetras, []int{h[t[0]], h[t[1]], h[t[2]], h[t[3]]})
+		}
+	}
+	return tetras
+}
+
+func TestHomogenizeElements(t *testing.T) {
+	// Homogeneous cells of every element type must pass the patch test.
+	Cm := isotropicCompliance(4.8e3, 0.34)
+	box := Box{Max: Vec{X: 2, Y: 3, Z: 2}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 3, 2})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	tet4 := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}
+	hex20, err := hex8.Quadratic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tet10, err := tet4.Quadratic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []FEModel{hex8, hex20, tet4, tet10} {
+		C, report, err := Homogenize(model, []Material{{C: Cm}}, HomogenizeSettings{Box: box})
+		if err != nil {
+			t.Fatalf("%T: %v", model.Element, err)
+		}
+		if math.Abs(report.Volume-12) > 1e-12 {
+			t.Errorf("%T: bad mesh volume %g", model.Element, report.Volume)
+		}
+		if !mat.EqualApprox(voigtDense(C), Cm, 1e-6) {
+			t.Errorf("%T: homogenized stiffness does not match material:\n%.6g", model.Element, mat.Formatted(voigtDense(C)))
+		}
+	}
+
+	// BCC tetrahedra are usable without cleanup.
+	bcc := maketmesh(Box{Max: Vec{X: 1, Y: 1, Z: 1}}, 0.25)
+	model := tetraModel(bcc.meshTetraBCC(nil))
+	if err := model.validate(); err != nil {
+		t.Fatal(err)
+	}
+	integ := newElementIntegrator(model.element())
+	enod := make([]Vec, 4)
+	for i, elem := range model.Elems {
+		storeElemNode(enod, model.Nodes, elem)
+		if dV := integ.bmatrix(enod, 0); dV <= 0 {
+			t.Fatalf("degenerate tetrahedron %d: %v", i, elem)
+		}
+	}
+}
+
+func TestRecoverStress(t *testing.T) {
+	Cm := isotropicCompliance(4.8e3, 0.34)
+	box := Box{Max: Vec{X: 2, Y: 1, Z: 2}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 1, 2})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	tet4 := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}
+	hex20, _ := hex8.Quadratic()
+	tet10, _ := tet4.Quadratic()
+	// Uniform strain is recovered exactly by every element.
+	eps := [6]float64{1e-3, -2e-3, 5e-4, 1e-3, -4e-4, 2e-4}
+	for _, model := range []FEModel{hex8, hex20, tet4, tet10} {
+		u := make([]float64, 3*len(model.Nodes))
+		for i, n := range model.Nodes {
+			u[3*i] = eps[0]*n.X + eps[3]*n.Y + eps[5]*n.Z
+			u[3*i+1] = eps[1] * n.Y
+			u[3*i+2] = eps[2]*n.Z + eps[4]*n.Y
+		}
+		res, err := RecoverStress(model, []Material{{C: Cm}}, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want [6]float64
+		mat.NewVecDense(6, want[:]).MulVec(Cm, mat.NewVecDense(6, eps[:]))
+		for n := range model.Nodes {
+			if !floats.EqualApprox(res.NodalStrain[n][:], eps[:], 1e-15) || !floats.EqualApprox(res.NodalStress[n][:], want[:], 1e-10) {
+				t.Fatalf("%T: node %d strain %v stress %v, want %v %v", model.Element, n, res.NodalStrain[n], res.NodalStress[n], eps, want)
+			}
+		}
+	}
+	// Hex8 extrapolation recovers the linearly varying strain of ux = x*z.
+	u := make([]float64, 3*len(nodes))
+	for i, n := range nodes {
+		u[3*i] = 1e-3 * n.X * n.Z
+	}
+	res, err := RecoverStress(hex8, []Material{{C: Cm}}, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range nodes {
+		if math.Abs(res.NodalStrain[i][0]-1e-3*n.Z) > 1e-15 || math.Abs(res.NodalStrain[i][5]-1e-3*n.X) > 1e-15 {
+			t.Errorf("node %d at %v: εxx=%g γxz=%g", i, n, res.NodalStrain[i][0], res.NodalStrain[i][5])
+		}
+	}
+
+	// Derived quantities.
+	const tol = 1e-12
+	uniaxial := [6]float64{100}
+	if got := VonMises(uniaxial); math.Abs(got-100) > tol {
+		t.Errorf("uniaxial von Mises %g", got)
+	}
+	if got := VonMises([6]float64{3: 10}); math.Abs(got-10*math.Sqrt(3)) > tol {
+		t.Errorf("pure shear von Mises %g", got)
+	}
+	if got := VonMises([6]float64{-7, -7, -7}); got > tol {
+		t.Errorf("hydrostatic von Mises %g", got)
+	}
+	if got := Pressure([6]float64{-7, -7, -7}); math.Abs(got-7) > tol {
+		t.Errorf("pressure %g", got)
+	}
+	// Pure shear has principal stresses τ, 0, -τ.
+	if got := PrincipalStresses([6]float64{4: 10}); math.Abs(got[0]-10) > tol || math.Abs(got[1]) > tol || math.Abs(got[2]+10) > tol {
+		t.Errorf("pure shear principal stresses %v", got)
+	}
+	if got := StrainEnergyDensity(uniaxial, [6]float64{0.01, -0.003, -0.003}); math.Abs(got-0.5) > tol {
+		t.Errorf("strain energy density %g", got)
+	}
+}
+
+func TestModal(t *testing.T) {
+	// Cantilever beam clamped at X=0.
+	box := Box{Max: Vec{X: 10, Y: 1, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{10, 1, 1})
+	model := FEModel{Nodes: nodes, Elems: hexas}
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3), Density: 7.85e-9}}
+	K, err := AssembleStiffness(model, materials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := K.Dims()
+	fixed := make([]bool, n)
+	for _, node := range findNodes(nodes, func(n Vec) bool { return n.X == 0 }) {
+		fixed[3*node], fixed[3*node+1], fixed[3*node+2] = true, true, true
+	}
+	for _, lumped := range []bool{false, true} {
+		M, err := AssembleMass(model, materials, lumped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Total mass in each direction.
+		var total float64
+		M.DoNonZero(func(i, j int, v float64) {
+			if i%3 == 0 && j%3 == 0 {
+				total += v
+			}
+		})
+		if want := 10 * materials[0].Density; math.Abs(total-want) > 1e-12*want {
+			t.Errorf("lumped=%v: total mass %g, want %g", lumped, total, want)
+		}
+		const nmodes = 5
+		res, err := Modal(K, M, fixed, ModalSettings{Modes: nmodes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reference from the dense generalized eigenproblem reduced with the
+		// Cholesky factor of M: L⁻¹*K*L⁻ᵀ.
+		keep := make([]bool, n)
+		for i := range keep {
+			keep[i] = !fixed[i]
+		}
+		Kd, Md := mat.DenseCopyOf(K.Sub(keep)), mat.DenseCopyOf(M.Sub(keep))
+		nf, _ := Kd.Dims()
+		var chol mat.Cholesky
+		if !chol.Factorize(mat.NewSymDense(nf, Md.RawMatrix().Data)) {
+			t.Fatal("mass matrix not positive definite")
+		}
+		var L mat.TriDense
+		chol.LTo(&L)
+		var Linv, A mat.Dense
+		Linv.Inverse(&L)
+		A.Mul(&Linv, Kd)
+		A.Mul(&A, Linv.T())
+		var eig mat.EigenSym
+		sym := mat.NewSymDense(nf, nil)
+		for i := 0; i < nf; i++ {
+			for j := i; j < nf; j++ {
+				sym.SetSym(i, j, (A.At(i, j)+A.At(j, i))/2)
+			}
+		}
+		eig.Factorize(sym, false)
+		want := eig.Values(nil)
+		for k := 0; k < nmodes; k++ {
+			if math.Abs(res.Eigenvalues[k]-want[k]) > 1e-8*want[k] {
+				t.Errorf("lumped=%v: mode %d ω²=%g, want %g", lumped, k, res.Eigenvalues[k], want[k])
+			}
+			phi := res.Modes.ColView(k)
+			Mphi := make([]float64, n)
+			M.MulVecTo(Mphi, mat.Col(nil, k, res.Modes))
+			if got := mat.Dot(phi, mat.NewVecDense(n, Mphi)); math.Abs(got-1) > 1e-8 {
+				t.Errorf("lumped=%v: mode %d not mass normalized: %g", lumped, k, got)
+			}
+		}
+		// Square section so the first two bending modes coincide.
+		if math.Abs(res.Frequencies[0]-res.Frequencies[1]) > 1e-6*res.Frequencies[0] {
+			t.Errorf("lumped=%v: expected repeated bending frequency, got %v", lumped, res.Frequencies[:2])
+		}
+	}
+
+	// Unsupported structures have 6 rigid body modes.
+	M, _ := AssembleMass(model, materials, false)
+	res, err := Modal(K, M, nil, ModalSettings{Modes: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 6; k++ {
+		if math.Abs(res.Eigenvalues[k]) > 1e-6*res.Eigenvalues[6] {
+			t.Errorf("rigid body mode %d has ω²=%g", k, res.Eigenvalues[k])
+		}
+	}
+	if res.Frequencies[6] <= 0 {
+		t.Errorf("first elastic mode has frequency %g", res.Frequencies[6])
+	}
+
+	// Fully fixed structures have no modes.
+	allFixed := make([]bool, 3*len(model.Nodes))
+	for i := range allFixed {
+		allFixed[i] = true
+	}
+	if _, err := Modal(K, M, allFixed, ModalSettings{}); err == nil {
+		t.Error("expected error for structure without free degrees of freedom")
+	}
+}
+
+func TestThermal(t *testing.T) {
+	// One dimensional conduction along a bar with exact solutions.
+	const L, k = 4.0, 2.0
+	box := Box{Max: Vec{X: L, Y: 1, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{4, 1, 1})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	tet4 := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}
+	hex20, _ := hex8.Quadratic()
+	tet10, _ := tet4.Quadratic()
+	materials := []Material{{Conductivity: mat.NewDense(3, 3, []float64{k, 0, 0, 0, k, 0, 0, 0, k})}}
+	for _, model := range []FEModel{hex8, hex20, tet4, tet10} {
+		name := fmt.Sprintf("%T", model.Element)
+		all := model.BoundaryFaces(nil)
+		integ := newFaceIntegrator(model.element())
+		enod := make([]Vec, model.element().NumNodes())
+		var area float64
+		for _, f := range all {
+			storeElemNode(enod, model.Nodes, model.Elems[f.Elem])
+			for ipg := range integ.wpg[f.Face] {
+				_, normal, dA := integ.point(enod, f.Face, ipg)
+				area += dA
+				centroid, _ := model.faceGeometry(model.Elems[f.Elem], model.element().Faces()[f.Face])
+				// Outward normals of a box point away from its center.
+				if Dot(normal, Sub(centroid, box.Center())) <= 0 {
+					t.Fatalf("%s: face %+v normal %v points inward", name, f, normal)
+				}
+			}
+		}
+		if math.Abs(area-18) > 1e-12 {
+			t.Errorf("%s: boundary area %g, want 18", name, area)
+		}
+		left := model.BoundaryFaces(func(_, n Vec) bool { return n.X < -0.5 })
+		right := model.BoundaryFaces(func(_, n Vec) bool { return n.X > 0.5 })
+
+		// Heat enters at X=0 and is convected away at X=L.
+		const q, h, Tamb = 3.0, 5.0, 10.0
+		T, err := SolveThermal(model, materials, ThermalLoads{
+			Flux:       []HeatFlux{{Faces: left, Flux: q}},
+			Convection: []Convection{{Faces: right, Coefficient: h, Ambient: Tamb}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range model.Nodes {
+			want := Tamb + q/h + q*(L-n.X)/k
+			if math.Abs(T[i]-want) > 1e-9 {
+				t.Errorf("%s: flux and convection T(%v)=%g, want %g", name, n, T[i], want)
+			}
+		}
+		res, err := RecoverHeatFlux(model, materials, T)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.GaussFlux[0][0]; !EqualWithin(got, Vec{X: q}, 1e-9) {
+			t.Errorf("%s: heat flux %v, want %v", name, got, Vec{X: q})
+		}
+
+		// Uniform heat generation with ends held at zero temperature has a
+		// quadratic solution, exact for quadratic elements.
+		if model.element().NumNodes() == 4 || model.element().NumNodes() == 8 {
+			continue
+		}
+		const s = 1.0
+		fixed := make(map[int]float64)
+		for _, i := range findNodes(model.Nodes, func(n Vec) bool { return n.X == 0 || n.X == L }) {
+			fixed[i] = 0
+		}
+		source := make([]float64, len(model.Elems))
+		for i := range source {
+			source[i] = s
+		}
+		T, err = SolveThermal(model, materials, ThermalLoads{Temperature: fixed, Source: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range model.Nodes {
+			want := s * n.X * (L - n.X) / (2 * k)
+			if math.Abs(T[i]-want) > 1e-9 {
+				t.Errorf("%s: heat source T(%v)=%g, want %g", name, n, T[i], want)
+			}
+		}
+	}
+	if _, err := SolveThermal(hex8, materials, ThermalLoads{}); err == nil {
+		t.Error("expected error for undetermined temperature")
+	}
+}
+
+func TestHomogenizeConductivity(t *testing.T) {
+	// Rotated homogeneous anisotropic material.
+	box := Box{Max: Vec{X: 2, Y: 3, Z: 2}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 3, 2})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	tet4 := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}
+	kmat := mat.NewDense(3, 3, []float64{5, 0, 0, 0, 2, 0, 0, 0, 1})
+	R := NewRotation(0.7, Vec{X: 1, Y: 2, Z: 3}).Mat()
+	var want mat.Dense
+	want.Mul(R, kmat)
+	want.Mul(&want, R.T())
+	for _, model := range []FEModel{hex8, tet4} {
+		all := make([]int, len(model.Elems))
+		for i := range all {
+			all[i] = i
+		}
+		model.SetOrientation(all, R)
+		k, err := HomogenizeConductivity(model, []Material{{Conductivity: kmat}}, HomogenizeSettings{Box: box})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				if math.Abs(k[i][j]-want.At(i, j)) > 1e-9 {
+					t.Fatalf("%T: got %v, want\n%v", model.Element, k, mat.Formatted(&want))
+				}
+			}
+		}
+	}
+
+	// Laminate: series conduction across layers, parallel along them.
+	box = Box{Max: Vec{X: 4, Y: 1, Z: 1}}
+	nodes, hexas = hexaGrid(box, [3]int{4, 1, 1})
+	model := FEModel{Nodes: nodes, Elems: hexas}
+	model.SetMaterial(findElems(nodes, hexas, func(c Vec) bool { return c.X > 2 }), 1)
+	iso := func(k float64) *mat.Dense { return mat.NewDense(3, 3, []float64{k, 0, 0, 0, k, 0, 0, 0, k}) }
+	k, err := HomogenizeConductivity(model, []Material{{Conductivity: iso(1)}, {Conductivity: iso(3)}}, HomogenizeSettings{Box: box})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(k[0][0]-1.5) > 1e-9 || math.Abs(k[1][1]-2) > 1e-9 || math.Abs(k[2][2]-2) > 1e-9 {
+		t.Errorf("laminate conductivity %v, want diagonal 1.5, 2, 2", k)
+	}
+
+	// Axial conductivity of the fiber RUC is the rule of mixtures.
+	cnodes, h8 := feaModel()
+	cretton := FEModel{Nodes: cnodes, Elems: meshElems(h8)}
+	fiberRadius := math.Sqrt(0.7 * 10 * 10 / math.Pi)
+	fiber := findElems(cnodes, cretton.Elems, func(c Vec) bool { return math.Hypot(c.Y-5, c.Z-5) < fiberRadius })
+	cretton.SetMaterial(fiber, 1)
+	var fiberVolume float64
+	integ := newElementIntegrator(Hex8{})
+	enod := make([]Vec, 8)
+	for _, iele := range fiber {
+		storeElemNode(enod, cnodes, cretton.Elems[iele])
+		for ipg := range integ.upg {
+			fiberVolume += integ.gradient(enod, ipg)
+		}
+	}
+	vf := fiberVolume / 1000
+	const km, kf = 0.2, 10.0
+	k, err = HomogenizeConductivity(cretton, []Material{{Conductivity: iso(km)}, {Conductivity: iso(kf)}}, HomogenizeSettings{Box: Box{Max: Vec{X: 10, Y: 10, Z: 10}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := vf*kf + (1-vf)*km; math.Abs(k[0][0]-want) > 1e-9*want {
+		t.Errorf("axial conductivity %g, want %g", k[0][0], want)
+	}
+	if !(k[1][1] > km && k[1][1] < k[0][0]) || math.Abs(k[1][1]-k[2][2]) > 1e-6*k[1][1] {
+		t.Errorf("bad transverse conductivity %v", k)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	// A highly conductive part cooled by convection keeps a uniform temperature
+	// that decays as in the lumped capacitance model:
+	//  ρ*c*V*dT/dt = -h*A*(T - Tamb)
+	bcc := maketmesh(Box{Max: Vec{X: 1, Y: 1, Z: 1}}, 0.25)
+	model := tetraModel(bcc.meshTetraBCC(nil))
+	const rho, c, h, Tamb, T0 = 2.0, 3.0, 1.0, 20.0, 200.0
+	materials := []Material{{
+		Density:      rho,
+		SpecificHeat: c,
+		Conductivity: mat.NewDense(3, 3, []float64{1e4, 0, 0, 0, 1e4, 0, 0, 0, 1e4}),
+	}}
+	faces := model.BoundaryFaces(nil)
+	var volume, area float64
+	integ := newElementIntegrator(Tet4{})
+	finteg := newFaceIntegrator(Tet4{})
+	enod := make([]Vec, 4)
+	for _, elem := range model.Elems {
+		storeElemNode(enod, model.Nodes, elem)
+		volume += integ.gradient(enod, 0)
+	}
+	for _, f := range faces {
+		storeElemNode(enod, model.Nodes, model.Elems[f.Elem])
+		for ipg := range finteg.wpg[f.Face] {
+			_, _, dA := finteg.point(enod, f.Face, ipg)
+			area += dA
+		}
+	}
+	initial := make([]float64, len(model.Nodes))
+	for i := range initial {
+		initial[i] = T0
+	}
+	// The BCC mesh has nodes not referenced by any tetrahedron. Their
+	// temperature is prescribed since it is otherwise undetermined.
+	used := make([]bool, len(model.Nodes))
+	for _, elem := range model.Elems {
+		for _, n := range elem {
+			used[n] = true
+		}
+	}
+	unused := make(map[int]float64)
+	for i := range used {
+		if !used[i] {
+			unused[i] = T0
+		}
+	}
+	const dt = 0.1
+	a := dt * h * area / (rho * c * volume)
+	for _, theta := range []float64{1, 0.5} {
+		for _, lumped := range []bool{false, true} {
+			res, err := SolveTransient(model, materials, TransientSettings{
+				Initial:  initial,
+				TimeStep: dt,
+				Duration: 1,
+				Theta:    theta,
+				Lumped:   lumped,
+				Loads: func(float64) ThermalLoads {
+					return ThermalLoads{
+						Temperature: unused,
+						Convection:  []Convection{{Faces: faces, Coefficient: h, Ambient: Tamb}},
+					}
+				},
+				Snapshots: []float64{1, 0, 0.25},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Times) != 3 || res.Times[0] != 0 || res.Times[1] != 0.25 || res.Times[2] != 1 {
+				t.Fatalf("bad snapshot times %v", res.Times)
+			}
+			// Amplification factor of the θ-method per step.
+			r := (1 - (1-theta)*a) / (1 + theta*a)
+			excess := func(steps float64) float64 { return (T0 - Tamb) * math.Pow(r, steps) }
+			want := []float64{
+				excess(0),
+				(excess(2) + excess(3)) / 2, // Interpolated between steps.
+				excess(10),
+			}
+			for k, temps := range res.Temperatures {
+				for i, T := range temps {
+					if used[i] && math.Abs(T-Tamb-want[k]) > 1e-3*want[k] {
+						t.Fatalf("theta=%g lumped=%v: t=%g node %d T=%g, want %g", theta, lumped, res.Times[k], i, T, Tamb+want[k])
+					}
+				}
+			}
+		}
+	}
+
+	// A bar heated at one end by a ramped temperature reaches the linear steady state.
+	const L = 4.0
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{4, 1, 1})
+	bar := FEModel{Nodes: nodes, Elems: hexas}
+	materials[0].Conductivity = mat.NewDense(3, 3, []float64{6, 0, 0, 0, 6, 0, 0, 0, 6})
+	cold := findNodes(nodes, func(n Vec) bool { return n.X == 0 })
+	hot := findNodes(nodes, func(n Vec) bool { return n.X == L })
+	res, err := SolveTransient(bar, materials, TransientSettings{
+		TimeStep: 1,
+		Duration: 60,
+		Loads: func(t float64) ThermalLoads {
+			prescribed := make(map[int]float64)
+			for _, i := range cold {
+				prescribed[i] = 0
+			}
+			for _, i := range hot {
+				prescribed[i] = math.Min(t, 1)
+			}
+			return ThermalLoads{Temperature: prescribed}
+		},
+		Snapshots: []float64{60},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range nodes {
+		if want := n.X / L; math.Abs(res.Temperatures[0][i]-want) > 1e-9 {
+			t.Errorf("steady state T(%v)=%g, want %g", n, res.Temperatures[0][i], want)
+		}
+	}
+}
+
+func TestThermoElastic(t *testing.T) {
+	const Tref, T0, b = 20.0, 70.0, 10.0
+	box := Box{Max: Vec{X: 2, Y: 3, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 3, 1})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	hex20, _ := hex8.Quadratic()
+	tet10, _ := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}.Quadratic()
+
+	// A linear temperature field in an unconstrained isotropic body
+	// produces compatible thermal strains and no stress.
+	const alpha = 1e-5
+	iso := []Material{{C: isotropicCompliance(200e3, 0.3), CTE: [6]float64{alpha, alpha, alpha}}}
+	for _, model := range []FEModel{hex20, tet10} {
+		T := make([]float64, len(model.Nodes))
+		for i, n := range model.Nodes {
+			T[i] = T0 + b*n.X
+		}
+		// Statically determinate supports.
+		origin := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{} })[0]
+		xaxis := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{X: box.Max.X} })[0]
+		yaxis := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{Y: box.Max.Y} })[0]
+		supports := map[int]float64{
+			3 * origin: 0, 3*origin + 1: 0, 3*origin + 2: 0,
+			3*xaxis + 1: 0, 3*xaxis + 2: 0,
+			3*yaxis + 2: 0,
+		}
+		u, err := SolveStatic(model, iso, StaticLoads{Displacement: supports, Temperature: T, ReferenceTemperature: Tref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range model.Nodes {
+			dT := T0 - Tref + b*n.X
+			want := Vec{
+				X: alpha * ((T0-Tref)*n.X + b*(n.X*n.X-n.Y*n.Y-n.Z*n.Z)/2),
+				Y: alpha * dT * n.Y,
+				Z: alpha * dT * n.Z,
+			}
+			if got := (Vec{X: u[3*i], Y: u[3*i+1], Z: u[3*i+2]}); !EqualWithin(got, want, 1e-12) {
+				t.Fatalf("%T: displacement at %v is %v, want %v", model.Element, n, got, want)
+			}
+		}
+		res, err := RecoverThermalStress(model, iso, u, T, Tref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for iele := range res.GaussStress {
+			for _, s := range res.GaussStress[iele] {
+				if VonMises(s) > 1e-6 {
+					t.Fatalf("%T: stress %v in free thermal expansion", model.Element, s)
+				}
+			}
+		}
+	}
+
+	// Restrained expansion of a rotated orthotropic material. With a clamped
+	// boundary the interior nodes do not move and the stress is -C*α*ΔT in
+	// material axes.
+	Cf := orthotropicCompliance(235e3, 14e3, 0.2, 0.25, 28e3)
+	cte := [6]float64{-0.5e-6, 10e-6, 10e-6}
+	R := NewRotation(0.5, Vec{X: 1, Y: 1, Z: 1}).Mat()
+	nodes, hexas = hexaGrid(box, [3]int{2, 3, 2})
+	model := FEModel{Nodes: nodes, Elems: hexas}
+	all := make([]int, len(hexas))
+	for i := range all {
+		all[i] = i
+	}
+	model.SetOrientation(all, R)
+	supports := make(map[int]float64)
+	for i, n := range nodes {
+		if n.X == 0 || n.Y == 0 || n.Z == 0 || n.X == box.Max.X || n.Y == box.Max.Y || n.Z == box.Max.Z {
+			supports[3*i], supports[3*i+1], supports[3*i+2] = 0, 0, 0
+		}
+	}
+	T := make([]float64, len(nodes))
+	for i := range T {
+		T[i] = T0
+	}
+	materials := []Material{{C: Cf, CTE: cte}}
+	u, err := SolveStatic(model, materials, StaticLoads{Displacement: supports, Temperature: T, ReferenceTemperature: Tref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := RecoverThermalStress(model, materials, u, T, Tref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sigma mat.VecDense
+	sigma.MulVec(Cf, mat.NewVecDense(6, cte[:]))
+	sigma.ScaleVec(-(T0 - Tref), &sigma)
+	var rot mat.Dense
+	rot.Mul(R, voigtTensor([6]float64{sigma.AtVec(0), sigma.AtVec(1), sigma.AtVec(2), sigma.AtVec(3), sigma.AtVec(4), sigma.AtVec(5)}))
+	rot.Mul(&rot, R.T())
+	for d, p := range voigtPairs {
+		if got, want := res.GaussStress[3][0][d], rot.At(p[0], p[1]); math.Abs(got-want) > 1e-9*math.Abs(sigma.AtVec(0)) {
+			t.Errorf("restrained stress component %d: got %g, want %g", d, got, want)
+		}
+	}
+}
+
+func TestNeumannLoads(t *testing.T) {
+	box := Box{Max: Vec{X: 2, Y: 3, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 3, 1})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	hex20, _ := hex8.Quadratic()
+	tet10, _ := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}.Quadratic()
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3), Density: 2}}
+	on := func(normal Vec) func(centroid, n Vec) bool {
+		return func(centroid, n Vec) bool { return EqualWithin(n, normal, 1e-12) }
+	}
+	sum := func(f []float64) (s Vec) {
+		for i := 0; i < len(f); i += 3 {
+			s = Add(s, Vec{X: f[i], Y: f[i+1], Z: f[i+2]})
+		}
+		return s
+	}
+	for _, model := range []FEModel{hex8, hex20, tet10} {
+		// Resultants of the load vectors.
+		traction := Vec{X: 1, Y: -2, Z: 3}
+		g := Vec{Z: -10}
+		for _, test := range []struct {
+			loads StaticLoads
+			want  Vec
+		}{
+			{loads: StaticLoads{Traction: []Traction{{Faces: model.BoundaryFaces(on(Vec{X: 1})), Traction: traction}}}, want: Scale(3, traction)},
+			{loads: StaticLoads{Pressure: []PressureLoad{{Faces: model.BoundaryFaces(nil), Pressure: 5}}}},
+			{loads: StaticLoads{Pressure: []PressureLoad{{Faces: model.BoundaryFaces(on(Vec{Z: 1})), Pressure: 5}}}, want: Vec{Z: -30}},
+			{loads: StaticLoads{Gravity: g}, want: Scale(2*6, g)},
+			{loads: StaticLoads{BodyForce: []BodyForce{{Elems: []int{0}, Force: traction}}}, want: Scale(box.Size().X*box.Size().Y*box.Size().Z/float64(len(model.Elems)), traction)},
+			{loads: StaticLoads{PointLoad: map[int]Vec{0: traction, 1: g}}, want: Add(traction, g)},
+		} {
+			f := make([]float64, 3*len(model.Nodes))
+			err := test.loads.assemble(model, materials, nil, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sum(f); !EqualWithin(got, test.want, 1e-12) {
+				t.Errorf("%T: resultant of %+v is %v, want %v", model.Element, test.loads, got, test.want)
+			}
+		}
+
+		// Self-equilibrated tractions and pressures on opposite faces
+		// produce a uniform stress state.
+		const sx, p = 10.0, 4.0
+		origin := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{} })[0]
+		xaxis := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{X: box.Max.X} })[0]
+		yaxis := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{Y: box.Max.Y} })[0]
+		supports := map[int]float64{
+			3 * origin: 0, 3*origin + 1: 0, 3*origin + 2: 0,
+			3*xaxis + 1: 0, 3*xaxis + 2: 0,
+			3*yaxis + 2: 0,
+		}
+		loads := StaticLoads{
+			Displacement: supports,
+			Traction: []Traction{
+				{Faces: model.BoundaryFaces(on(Vec{X: 1})), Traction: Vec{X: sx}},
+				{Faces: model.BoundaryFaces(on(Vec{X: -1})), Traction: Vec{X: -sx}},
+			},
+			Pressure: []PressureLoad{{Faces: model.BoundaryFaces(func(c, n Vec) bool { return math.Abs(n.Y) > 0.5 }), Pressure: p}},
+		}
+		u, err := SolveStatic(model, materials, loads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := RecoverStress(model, materials, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [6]float64{sx, -p}
+		for iele := range res.GaussStress {
+			for _, s := range res.GaussStress[iele] {
+				for i := range s {
+					if math.Abs(s[i]-want[i]) > 1e-9 {
+						t.Fatalf("%T: got stress %v, want %v", model.Element, s, want)
+					}
+				}
+			}
+		}
+	}
+
+	// Faces on the surface of an SDF: the whole box and its X = 0 side. The
+	// resultant of a unit traction on them is their area.
+	for _, model := range []FEModel{hex8, tet10} {
+		for _, test := range []struct {
+			sdf   boxSDF
+			faces int
+			area  float64
+		}{
+			{sdf: boxSDF(box), faces: 22, area: 22},
+			{sdf: boxSDF{Min: Vec{X: -1}, Max: Vec{Y: 3, Z: 1}}, faces: 3, area: 3},
+		} {
+			faces := model.BoundaryFaces(SDFFaces(test.sdf, 1e-9))
+			if _, ok := model.Element.(Tet10); ok {
+				test.faces *= 2
+			}
+			if len(faces) != test.faces {
+				t.Errorf("%T: selected %d faces of %+v, want %d", model.Element, len(faces), test.sdf, test.faces)
+			}
+			f := make([]float64, 3*len(model.Nodes))
+			loads := StaticLoads{Traction: []Traction{{Faces: faces, Traction: Vec{X: 1}}}}
+			if err := loads.assemble(model, materials, nil, f); err != nil {
+				t.Fatal(err)
+			}
+			if got := sum(f).X; math.Abs(got-test.area) > 1e-12 {
+				t.Errorf("%T: area of faces on %+v is %g, want %g", model.Element, test.sdf, got, test.area)
+			}
+		}
+	}
+
+	// A column hanging from a traction on its top face under its own weight
+	// has axial stress ρ*g*z, which quadratic elements represent exactly.
+	const rho, g, L = 2.0, 10.0, 4.0
+	col := Box{Max: Vec{X: 1, Y: 1, Z: L}}
+	nodes, hexas = hexaGrid(col, [3]int{1, 1, 4})
+	hex20, _ = FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	tet10, _ = FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}.Quadratic()
+	materials[0].Density = rho
+	for _, model := range []FEModel{hex20, tet10} {
+		origin := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{} })[0]
+		xaxis := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{X: 1} })[0]
+		yaxis := findNodes(model.Nodes, func(n Vec) bool { return n == Vec{Y: 1} })[0]
+		loads := StaticLoads{
+			Displacement: map[int]float64{
+				3 * origin: 0, 3*origin + 1: 0, 3*origin + 2: 0,
+				3*xaxis + 1: 0, 3*xaxis + 2: 0,
+				3*yaxis + 2: 0,
+			},
+			Traction: []Traction{{Faces: model.BoundaryFaces(on(Vec{Z: 1})), Traction: Vec{Z: rho * g * L}}},
+			Gravity:  Vec{Z: -g},
+		}
+		u, err := SolveStatic(model, materials, loads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := RecoverStress(model, materials, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for iele := range res.GaussStress {
+			for ipg, s := range res.GaussStress[iele] {
+				want := [6]float64{2: rho * g * res.GaussPoints[iele][ipg].Z}
+				for i := range s {
+					if math.Abs(s[i]-want[i]) > 1e-9 {
+						t.Fatalf("%T: got stress %v at %v, want %v", model.Element, s, res.GaussPoints[iele][ipg], want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// boxSDF is the signed distance function of a box.
+type boxSDF Box
+
+func (b boxSDF) Evaluate(p r3.Vec) float64 {
+	// Distances outside each pair of faces, negative inside.
+	d := [3]float64{
+		math.Max(b.Min.X-p.X, p.X-b.Max.X),
+		math.Max(b.Min.Y-p.Y, p.Y-b.Max.Y),
+		math.Max(b.Min.Z-p.Z, p.Z-b.Max.Z),
+	}
+	var outside float64
+	for _, di := range d {
+		outside += math.Max(di, 0) * math.Max(di, 0)
+	}
+	return math.Sqrt(outside) + math.Min(math.Max(d[0], math.Max(d[1], d[2])), 0)
+}
+
+func TestConstraints(t *testing.T) {
+	c := NewConstraints(2, 1)
+	c.Prescribe(0, 1)
+	c.Prescribe(1, 2)
+	c.Add(Constraint{Dofs: []int{0, 1}, Coefs: []float64{1, -1}, Value: -1})
+	c.Add(Constraint{Dofs: []int{0, 1}, Coefs: []float64{1, 1}, Value: 4})
+	c.Add(Constraint{Dofs: []int{1, 0}, Coefs: []float64{2, 2}, Value: 6})
+	var cerr *ConstraintError
+	if err := c.Validate(); !errors.As(err, &cerr) {
+		t.Fatalf("expected constraint error, got %v", err)
+	}
+	if fmt.Sprint(cerr.Redundant, cerr.Conflicting) != "[2 4] [3]" {
+		t.Errorf("got redundant %v and conflicting %v constraints, want [2 4] and [3]", cerr.Redundant, cerr.Conflicting)
+	}
+
+	// Uniaxial stress of a rotated bar held by symmetry planes
+	// oblique to the axes.
+	const s = 10.0
+	R := NewRotation(0.7, Vec{X: 1, Y: 2, Z: 3}).Mat()
+	box := Box{Max: Vec{X: 2, Y: 1, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 1, 1})
+	axes := [3]Vec{R.MulVec(Vec{X: 1}), R.MulVec(Vec{Y: 1}), R.MulVec(Vec{Z: 1})}
+	var planes [3][]int
+	for i, n := range nodes {
+		for d := range planes {
+			if n.component(d) == 0 {
+				planes[d] = append(planes[d], i)
+			}
+		}
+		nodes[i] = R.MulVec(n)
+	}
+	model := FEModel{Nodes: nodes, Elems: hexas}
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3)}}
+	end := model.BoundaryFaces(func(_, n Vec) bool { return EqualWithin(n, axes[0], 1e-12) })
+	for _, method := range []ConstraintMethod{Elimination, Penalty, Lagrange} {
+		c := NewConstraints(len(nodes), 3)
+		c.Method = method
+		for d, plane := range planes {
+			c.Symmetry(plane, axes[d])
+		}
+		u, err := SolveStatic(model, materials, StaticLoads{
+			Constraints: c,
+			Traction:    []Traction{{Faces: end, Traction: Scale(s, axes[0])}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := RecoverStress(model, materials, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for iele := range res.GaussStress {
+			for _, stress := range res.GaussStress[iele] {
+				got := voigtTensor(stress)
+				for i := 0; i < 3; i++ {
+					for j := 0; j < 3; j++ {
+						w := s * axes[0].component(i) * axes[0].component(j)
+						if math.Abs(got.At(i, j)-w) > 1e-6*s {
+							t.Fatalf("method %d: got stress %v, want uniaxial %g along %v", method, stress, s, axes[0])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// A block clamped at one end and loaded through a rigid link
+	// on the other gives the same solution with every method.
+	nodes, hexas = hexaGrid(box, [3]int{4, 2, 2})
+	model = FEModel{Nodes: nodes, Elems: hexas}
+	clamped := findNodes(nodes, func(n Vec) bool { return n.X == 0 })
+	tip := findNodes(nodes, func(n Vec) bool { return n.X == box.Max.X })
+	master := findNodes(nodes, func(n Vec) bool { return n == Vec{X: 2, Y: 0.5, Z: 0.5} })[0]
+	var slaves []int
+	for _, n := range tip {
+		if n != master {
+			slaves = append(slaves, n)
+		}
+	}
+	var reference []float64
+	for _, method := range []ConstraintMethod{Elimination, Lagrange, Penalty} {
+		c := NewConstraints(len(nodes), 3)
+		c.Method = method
+		c.Fix(clamped)
+		c.RigidLink(nodes, master, slaves)
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		u, err := SolveStatic(model, materials, StaticLoads{
+			Constraints: c,
+			PointLoad:   map[int]Vec{master: {Y: 1000, Z: -500}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		disp := func(n int) Vec { return Vec{X: u[3*n], Y: u[3*n+1], Z: u[3*n+2]} }
+		tol := 1e-9 * Norm(disp(master))
+		if method == Penalty {
+			tol = 1e-5 * Norm(disp(master))
+		}
+		for _, n := range clamped {
+			if Norm(disp(n)) > tol {
+				t.Errorf("method %d: clamped node %d moved %v", method, n, disp(n))
+			}
+		}
+		// Linearized distances between linked nodes are preserved.
+		for _, a := range tip {
+			for _, b := range tip {
+				dx := Sub(nodes[a], nodes[b])
+				if d := Dot(Sub(disp(a), disp(b)), dx); math.Abs(d) > tol {
+					t.Fatalf("method %d: rigid link stretched by %g between nodes %d and %d", method, d, a, b)
+				}
+			}
+		}
+		if reference == nil {
+			reference = u
+			continue
+		}
+		for i := range u {
+			if math.Abs(u[i]-reference[i]) > tol {
+				t.Fatalf("method %d: displacement %d is %g, want %g", method, i, u[i], reference[i])
+			}
+		}
+	}
+
+	// A beam with only its X displacement fixed at one end is a mechanism.
+	nodes, hexas = hexaGrid(box, [3]int{2, 1, 1})
+	model = FEModel{Nodes: nodes, Elems: hexas}
+	clamped = findNodes(nodes, func(n Vec) bool { return n.X == 0 })
+	tip = findNodes(nodes, func(n Vec) bool { return n.X == box.Max.X })
+	fixed := make(map[int]float64)
+	for _, n := range clamped {
+		fixed[3*n] = 0
+	}
+	loads := StaticLoads{Displacement: fixed, PointLoad: map[int]Vec{tip[0]: {Y: 1}}}
+	if _, err := SolveStatic(model, materials, loads); err == nil {
+		t.Error("prescribed displacements: expected rigid body motion error")
+	}
+	for _, method := range []ConstraintMethod{Elimination, Penalty, Lagrange} {
+		loads.Constraints = NewConstraints(len(nodes), 3)
+		loads.Constraints.Method = method
+		if _, err := SolveStatic(model, materials, loads); err == nil {
+			t.Errorf("method %d: expected rigid body motion error", method)
+		}
+	}
+}
+
+func TestHomogenizeCTE(t *testing.T) {
+	// Homogeneous rotated cell.
+	Cf := orthotropicCompliance(235e3, 14e3, 0.2, 0.25, 28e3)
+	cte := [6]float64{-0.5e-6, 10e-6, 10e-6}
+	R := NewRotation(0.5, Vec{X: 1, Y: 1, Z: 1}).Mat()
+	box := Box{Max: Vec{X: 2, Y: 3, Z: 2}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 3, 2})
+	model := FEModel{Nodes: nodes, Elems: hexas}
+	all := make([]int, len(hexas))
+	for i := range all {
+		all[i] = i
+	}
+	model.SetOrientation(all, R)
+	_, report, err := Homogenize(model, []Material{{C: Cf, CTE: cte}}, HomogenizeSettings{Box: box})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CTE != [6]float64{} {
+		t.Errorf("got CTE %v without enabling thermal expansion", report.CTE)
+	}
+	_, report, err = Homogenize(model, []Material{{C: Cf, CTE: cte}}, HomogenizeSettings{Box: box, ThermalExpansion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rotateStrain(cte, R)
+	for i := range want {
+		if math.Abs(report.CTE[i]-want[i]) > 1e-12 {
+			t.Fatalf("rotated CTE %v, want %v", report.CTE, want)
+		}
+	}
+
+	// Levin's formula is exact for two phase composites:
+	//  α* = ᾱ + (S* - S̄)*(S₁ - S₂)⁻¹*(α₁ - α₂)
+	// where S are compliances and bars denote volume averages.
+	cnodes, h8 := feaModel()
+	cretton := FEModel{Nodes: cnodes, Elems: meshElems(h8)}
+	fiberRadius := math.Sqrt(0.7 * 10 * 10 / math.Pi)
+	fiber := findElems(cnodes, cretton.Elems, func(c Vec) bool { return math.Hypot(c.Y-5, c.Z-5) < fiberRadius })
+	cretton.SetMaterial(fiber, 1)
+	var vf float64
+	integ := newElementIntegrator(Hex8{})
+	enod := make([]Vec, 8)
+	for _, iele := range fiber {
+		storeElemNode(enod, cnodes, cretton.Elems[iele])
+		for ipg := range integ.upg {
+			vf += integ.gradient(enod, ipg) / 1000
+		}
+	}
+	am, af := 60e-6, 5e-6
+	materials := []Material{
+		{C: isotropicCompliance(4.8e3, 0.34), CTE: [6]float64{am, am, am}},
+		{C: isotropicCompliance(72e3, 0.22), CTE: [6]float64{af, af, af}},
+	}
+	C, report, err := Homogenize(cretton, materials, HomogenizeSettings{Box: Box{Max: Vec{X: 10, Y: 10, Z: 10}}, ThermalExpansion: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var Seff, Sm, Sf, Savg, dS mat.Dense
+	Seff.Inverse(voigtDense(C))
+	Sm.Inverse(materials[0].C)
+	Sf.Inverse(materials[1].C)
+	Savg.Scale(1-vf, &Sm)
+	dS.Scale(vf, &Sf)
+	Savg.Add(&Savg, &dS)
+	dS.Sub(&Sm, &Sf)
+	dalpha := mat.NewVecDense(6, []float64{am - af, am - af, am - af, 0, 0, 0})
+	var levin, tmp mat.VecDense
+	if err := tmp.SolveVec(&dS, dalpha); err != nil {
+		t.Fatal(err)
+	}
+	var Sdiff mat.Dense
+	Sdiff.Sub(&Seff, &Savg)
+	levin.MulVec(&Sdiff, &tmp)
+	for i := 0; i < 3; i++ {
+		levin.SetVec(i, levin.AtVec(i)+(1-vf)*am+vf*af)
+	}
+	for i := range report.CTE {
+		if math.Abs(report.CTE[i]-levin.AtVec(i)) > 1e-6*am {
+			t.Errorf("effective CTE %v, Levin's formula gives %v", report.CTE, mat.Formatted(levin.T()))
+			break
+		}
+	}
+	if !(report.CTE[0] > af && report.CTE[0] < report.CTE[1]) {
+		t.Errorf("axial CTE %g should be between fiber %g and transverse CTE %g", report.CTE[0], af, report.CTE[1])
+	}
+}
+
+func TestNonlinear(t *testing.T) {
+	const E = 1000.0
+	materials := []Material{{C: isotropicCompliance(E, 0)}}
+	box := Box{Max: Vec{X: 2, Y: 1, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 1, 1})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	tet10, _ := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}.Quadratic()
+	for _, model := range []FEModel{hex8, tet10} {
+		// Uniaxial stretch of a St. Venant-Kirchhoff bar without lateral
+		// contraction. The nominal stress is E*λ*(λ²-1)/2 for a stretch λ.
+		const stretch = 1.5
+		supports := make(map[int]float64)
+		var end []int
+		for i, n := range model.Nodes {
+			if n.X == 0 {
+				supports[3*i] = 0
+			}
+			if n.X == box.Max.X {
+				supports[3*i] = (stretch - 1) * box.Max.X
+				end = append(end, 3*i)
+			}
+			if n.Y == 0 {
+				supports[3*i+1] = 0
+			}
+			if n.Z == 0 {
+				supports[3*i+2] = 0
+			}
+		}
+		res, err := SolveNonlinear(model, materials, StaticLoads{Displacement: supports}, NonlinearSettings{Steps: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		force, disp := res.ForceDisplacement(end)
+		if len(force) != 6 {
+			t.Fatalf("%T: got %d points on force-displacement curve, want 6", model.Element, len(force))
+		}
+		for i := range force {
+			l := 1 + disp[i]/box.Max.X
+			if want := E * l * (l*l - 1) / 2; math.Abs(force[i]-want) > 1e-8*E {
+				t.Errorf("%T: force at stretch %g is %g, want %g", model.Element, l, force[i], want)
+			}
+		}
+		for _, step := range res.Steps {
+			if n := len(step.Residuals); n > 6 {
+				t.Errorf("%T: %d iterations at load factor %g, want quadratic convergence: %v", model.Element, n, step.LoadFactor, step.Residuals)
+			}
+		}
+
+		// A large rigid rotation prescribed on one end is followed by the rest
+		// of the body without strain.
+		R := NewRotation(math.Pi/2, Vec{X: 1, Y: 1}).Mat()
+		supports = make(map[int]float64)
+		for i, n := range model.Nodes {
+			if n.X == 0 {
+				u := Sub(R.MulVec(n), n)
+				supports[3*i], supports[3*i+1], supports[3*i+2] = u.X, u.Y, u.Z
+			}
+		}
+		res, err = SolveNonlinear(model, materials, StaticLoads{Displacement: supports}, NonlinearSettings{LineSearch: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := res.Steps[len(res.Steps)-1]
+		for i, n := range model.Nodes {
+			u := Vec{X: last.Displacement[3*i], Y: last.Displacement[3*i+1], Z: last.Displacement[3*i+2]}
+			if want := Sub(R.MulVec(n), n); !EqualWithin(u, want, 1e-8) {
+				t.Fatalf("%T: node %v displaced %v under rigid rotation, want %v", model.Element, n, u, want)
+			}
+		}
+		if f := floats.Norm(last.Force, 2); f > 1e-6 {
+			t.Errorf("%T: internal force %g under rigid rotation", model.Element, f)
+		}
+	}
+
+	// Small loads give the linear solution.
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: 4, Y: 1, Z: 1}}, [3]int{4, 1, 1})
+	model, _ := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	materials = []Material{{C: isotropicCompliance(E, 0.3)}}
+	clamped := NewConstraints(len(model.Nodes), 3)
+	clamped.Fix(findNodes(model.Nodes, func(n Vec) bool { return n.X == 0 }))
+	tip := model.BoundaryFaces(func(_, n Vec) bool { return n.X == 1 })
+	loads := StaticLoads{Constraints: clamped, Traction: []Traction{{Faces: tip, Traction: Vec{Z: 1e-6 * E}}}}
+	ulin, err := SolveStatic(model, materials, loads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := SolveNonlinear(model, materials, loads, NonlinearSettings{Steps: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unl := res.Steps[0].Displacement
+	if d := floats.Distance(ulin, unl, math.Inf(1)); d > 1e-4*floats.Norm(ulin, math.Inf(1)) {
+		t.Errorf("nonlinear solution differs from linear by %g for small loads", d)
+	}
+
+	// Large deflection of a slender cantilever under a transverse tip load
+	// P = E*I/L². The elastica gives tip deflections of 0.3017*L transverse
+	// and 0.0566*L axial.
+	const L = 10.0
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{10, 1, 1})
+	model, _ = FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	materials = []Material{{C: isotropicCompliance(E, 0)}}
+	clamped = NewConstraints(len(model.Nodes), 3)
+	clamped.Fix(findNodes(model.Nodes, func(n Vec) bool { return n.X == 0 }))
+	tip = model.BoundaryFaces(func(_, n Vec) bool { return n.X == 1 })
+	P := E * (1.0 / 12) / (L * L)
+	res, err = SolveNonlinear(model, materials, StaticLoads{
+		Constraints: clamped,
+		Traction:    []Traction{{Faces: tip, Traction: Vec{Z: P}}},
+	}, NonlinearSettings{LineSearch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ux, uz []int
+	for _, n := range findNodes(model.Nodes, func(n Vec) bool { return n.X == L }) {
+		ux, uz = append(ux, 3*n), append(uz, 3*n+2)
+	}
+	_, deflection := res.ForceDisplacement(uz)
+	_, shortening := res.ForceDisplacement(ux)
+	if got := deflection[len(deflection)-1] / L; math.Abs(got-0.3017) > 0.005 {
+		t.Errorf("transverse tip deflection is %.4f*L, want 0.3017*L", got)
+	}
+	if got := -shortening[len(shortening)-1] / L; math.Abs(got-0.0566) > 0.003 {
+		t.Errorf("axial tip deflection is %.4f*L, want 0.0566*L", got)
+	}
+
+	// Cutbacks are counted per increment: two increments that each converge
+	// after one halving do not exhaust a limit of one cutback.
+	sys := &hardSpring{hard: [][2]float64{{0.18, 0.22}, {0.53, 0.57}}}
+	c := NewConstraints(1, 3)
+	c.Method = Elimination
+	res, err = solveNewton(sys, c, []float64{1, 0, 0}, NonlinearSettings{MaxCutbacks: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Increments of 0.1 except for the halved ones ending at 0.25 and 0.6.
+	if len(res.Steps) != 11 || res.Steps[len(res.Steps)-1].LoadFactor != 1 {
+		t.Errorf("got %d steps to load factor %g, want 11 to 1", len(res.Steps), res.Steps[len(res.Steps)-1].LoadFactor)
+	}
+
+	// A singular tangent stiffness fails before any cutback.
+	res, err = solveNewton(looseSpring{}, c, []float64{1, 0, 0}, NonlinearSettings{})
+	var serr *singularError
+	if !errors.As(err, &serr) {
+		t.Fatalf("got error %v for singular tangent stiffness, want singular pivot", err)
+	}
+	if len(res.Steps) != 0 {
+		t.Errorf("got %d steps for singular tangent stiffness, want 0", len(res.Steps))
+	}
+}
+
+// looseSpring is a nonlinearSystem of three unit springs of which the last
+// is not attached.
+type looseSpring struct{}
+
+func (looseSpring) assemble(u []float64, withK bool) (*CSR, []float64) {
+	fint := append([]float64(nil), u...)
+	fint[2] = 0
+	var K *CSR
+	if withK {
+		coo := NewCOO(3, 3, 2)
+		coo.AddAt(0, 0, 1)
+		coo.AddAt(1, 1, 1)
+		K = coo.ToCSR()
+	}
+	return K, fint
+}
+
+func (looseSpring) commit(*NonlinearStep) {}
+
+// hardSpring is a nonlinearSystem of three unit springs. The first only
+// converges within 0.06 of its committed displacement when that lies in one
+// of the hard ranges: beyond it the force jumps and Newton-Raphson cycles.
+type hardSpring struct {
+	hard      [][2]float64
+	committed float64
+}
+
+func (s *hardSpring) assemble(u []float64, withK bool) (*CSR, []float64) {
+	fint := append([]float64(nil), u...)
+	for _, r := range s.hard {
+		if s.committed >= r[0] && s.committed <= r[1] && u[0] > s.committed+0.06 {
+			fint[0]++
+		}
+	}
+	var K *CSR
+	if withK {
+		coo := NewCOO(3, 3, 3)
+		for i := 0; i < 3; i++ {
+			coo.AddAt(i, i, 1)
+		}
+		K = coo.ToCSR()
+	}
+	return K, fint
+}
+
+func (s *hardSpring) commit(step *NonlinearStep) { s.committed = step.Displacement[0] }
+
+func TestHyperelastic(t *testing.T) {
+	const E, nu = 1000.0, 0.3
+	mu, lambda := E/(2*(1+nu)), E*nu/((1+nu)*(1-2*nu))
+	laws := []Hyperelastic{
+		StVenantKirchhoff{C: isotropicCompliance(E, nu)},
+		NeoHookean{Mu: mu, Lambda: lambda},
+		MooneyRivlin{C10: 0.3 * mu, C01: 0.2 * mu, Bulk: lambda + 2*mu/3},
+	}
+	// deformation returns a deformation gradient with the Green-Lagrange
+	// strain E in Voigt notation from the Cholesky factor of C = I + 2*E.
+	deformation := func(E []float64) *Mat {
+		C := mat.NewSymDense(3, nil)
+		for I, p := range voigtPairs {
+			v := E[I]
+			if p[0] == p[1] {
+				v = 1 + 2*v
+			}
+			C.SetSym(p[0], p[1], v)
+		}
+		var chol mat.Cholesky
+		if !chol.Factorize(C) {
+			t.Fatalf("strain %v is not admissible", E)
+		}
+		var L mat.TriDense
+		chol.LTo(&L)
+		F := NewMat(nil)
+		F.CloneFrom(L.T())
+		return F
+	}
+	rng := rand.New(rand.NewSource(1))
+	Q := NewRotation(1, Vec{X: 1, Y: 2, Z: 3}).Mat()
+	for _, law := range laws {
+		// The linear material at small strains.
+		var S [6]float64
+		D := mat.NewDense(6, 6, nil)
+		law.Stress(Eye(), &S, D)
+		if !mat.EqualApprox(D, isotropicCompliance(E, nu), 1e-10*E) {
+			t.Errorf("%T: small strain tangent\n%v\nwant\n%v", law, mat.Formatted(D), mat.Formatted(isotropicCompliance(E, nu)))
+		}
+		if floats.Norm(S[:], math.Inf(1)) > 1e-10*E {
+			t.Errorf("%T: stress %v in undeformed state", law, S)
+		}
+		for trial := 0; trial < 5; trial++ {
+			strain := make([]float64, 6)
+			for i := range strain {
+				strain[i] = 0.2 * (rng.Float64() - 0.5)
+			}
+			F := deformation(strain)
+			law.Stress(F, &S, D)
+			// Stress and tangent are the derivatives of the energy with
+			// respect to the strain.
+			dW := fd.Gradient(nil, func(E []float64) float64 {
+				return law.Energy(deformation(E))
+			}, strain, &fd.Settings{Formula: fd.Central})
+			if !floats.EqualApprox(S[:], dW, 1e-6*E) {
+				t.Errorf("%T: stress %v, want energy gradient %v", law, S, dW)
+			}
+			dS := mat.NewDense(6, 6, nil)
+			fd.Jacobian(dS, func(S, E []float64) {
+				law.Stress(deformation(E), (*[6]float64)(S), nil)
+			}, strain, &fd.JacobianSettings{Formula: fd.Central})
+			if !mat.EqualApprox(D, dS, 1e-5*E) {
+				t.Errorf("%T: tangent\n%v\nwant stress jacobian\n%v", law, mat.Formatted(D), mat.Formatted(dS))
+			}
+			// Rotations after deformation change neither energy nor stress.
+			var QF Mat
+			QF.Mul(Q, F)
+			if w, wq := law.Energy(F), law.Energy(&QF); math.Abs(w-wq) > 1e-10*E {
+				t.Errorf("%T: energy %g changes to %g under rotation", law, w, wq)
+			}
+			var SQ [6]float64
+			law.Stress(&QF, &SQ, nil)
+			if !floats.EqualApprox(S[:], SQ[:], 1e-10*E) {
+				t.Errorf("%T: stress %v changes to %v under rotation", law, S, SQ)
+			}
+		}
+	}
+
+	// Uniaxial stretch of a Neo-Hookean bar with λ = 0, which does not
+	// contract laterally. The nominal stress is μ*(l - 1/l) for a stretch l.
+	box := Box{Max: Vec{X: 2, Y: 1, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 1, 1})
+	model := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	materials := []Material{{Hyperelastic: NeoHookean{Mu: mu}}}
+	supports := make(map[int]float64)
+	var end []int
+	for i, n := range model.Nodes {
+		if n.X == 0 {
+			supports[3*i] = 0
+		}
+		if n.X == box.Max.X {
+			supports[3*i] = box.Max.X
+			end = append(end, 3*i)
+		}
+		if n.Y == 0 && n.Z == 0 {
+			supports[3*i+1] = 0
+		}
+		if n.Z == 0 {
+			supports[3*i+2] = 0
+		}
+	}
+	res, err := SolveNonlinear(model, materials, StaticLoads{Displacement: supports}, NonlinearSettings{Steps: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	force, disp := res.ForceDisplacement(end)
+	for i := range force {
+		l := 1 + disp[i]/box.Max.X
+		if want := mu * (l - 1/l); math.Abs(force[i]-want) > 1e-8*mu {
+			t.Errorf("force at stretch %g is %g, want %g", l, force[i], want)
+		}
+	}
+	last := res.Steps[len(res.Steps)-1]
+	for i, n := range model.Nodes {
+		if u := last.Displacement[3*i+1]; math.Abs(u) > 1e-8 && n.Y != 0 {
+			t.Errorf("lateral displacement %g of node %v", u, n)
+		}
+	}
+}
+
+func TestPlasticity(t *testing.T) {
+	const E, nu, yield = 200e3, 0.3, 250.0
+	C := isotropicCompliance(E, nu)
+	G, K, ok := isotropicModuli(C)
+	if !ok || math.Abs(G-E/(2*(1+nu))) > 1e-9*E || math.Abs(K-E/(3*(1-2*nu))) > 1e-9*E {
+		t.Fatalf("moduli G=%g K=%g of isotropic material", G, K)
+	}
+	aniso := mat.DenseCopyOf(C)
+	aniso.Set(0, 0, 1.1*C.At(0, 0))
+	if _, _, ok := isotropicModuli(aniso); ok {
+		t.Error("anisotropic matrix is isotropic")
+	}
+	law := J2Plasticity{Yield: yield, IsotropicHardening: 5000, KinematicHardening: 3000}
+	old := PlasticState{Strain: [6]float64{1e-3, -5e-4, -5e-4}, BackStress: [6]float64{20, -10, -10}, Equivalent: 1e-3}
+	rng := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 5; trial++ {
+		strain := make([]float64, 6)
+		for i := range strain {
+			strain[i] = 0.01 * (rng.Float64() - 0.5)
+		}
+		state := old
+		var S [6]float64
+		D := mat.NewDense(6, 6, nil)
+		law.returnMap(G, K, (*[6]float64)(strain), &state, &S, D)
+		if state.Equivalent == old.Equivalent {
+			t.Fatalf("strain %v does not yield", strain)
+		}
+		// The stress returns to the hardened yield surface.
+		var dev [6]float64
+		p := (S[0] + S[1] + S[2]) / 3
+		var q float64
+		for I := range dev {
+			dev[I] = S[I] - state.BackStress[I]
+			if I < 3 {
+				dev[I] -= p
+				q += dev[I] * dev[I]
+			} else {
+				q += 2 * dev[I] * dev[I]
+			}
+		}
+		if q, want := math.Sqrt(1.5*q), yield+law.IsotropicHardening*state.Equivalent; math.Abs(q-want) > 1e-9*want {
+			t.Errorf("equivalent stress %g after return, want %g", q, want)
+		}
+		// Plastic flow is isochoric.
+		if dv := state.Strain[0] + state.Strain[1] + state.Strain[2]; math.Abs(dv) > 1e-15 {
+			t.Errorf("plastic volume change %g", dv)
+		}
+		// The algorithmic tangent is the derivative of the returned stress.
+		dS := mat.NewDense(6, 6, nil)
+		fd.Jacobian(dS, func(S, strain []float64) {
+			state := old
+			law.returnMap(G, K, (*[6]float64)(strain), &state, (*[6]float64)(S), nil)
+		}, strain, &fd.JacobianSettings{Formula: fd.Central, Step: 1e-8})
+		if !mat.EqualApprox(D, dS, 1e-5*E) {
+			t.Errorf("tangent\n%v\nwant stress jacobian\n%v", mat.Formatted(D), mat.Formatted(dS))
+		}
+	}
+
+	// A bar loaded in tension beyond yield, unloaded and loaded in compression
+	// to the same stress. The bar yields again in compression at -300 MPa
+	// with isotropic hardening and at 300 - 2*250 = -200 MPa with kinematic
+	// hardening.
+	const L, peak, H = 2.0, 300.0, 15000.0
+	box := Box{Max: Vec{X: L, Y: 1, Z: 1}}
+	nodes, hexas := hexaGrid(box, [3]int{2, 1, 1})
+	model := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	supports := make(map[int]float64)
+	var end []int
+	for i, n := range model.Nodes {
+		if n.X == 0 {
+			supports[3*i] = 0
+		}
+		if n.X == L {
+			end = append(end, 3*i)
+		}
+		if n.Y == 0 {
+			supports[3*i+1] = 0
+		}
+		if n.Z == 0 {
+			supports[3*i+2] = 0
+		}
+	}
+	loads := StaticLoads{
+		Displacement: supports,
+		Traction:     []Traction{{Faces: model.BoundaryFaces(func(_, n Vec) bool { return n.X == 1 }), Traction: Vec{X: peak}}},
+	}
+	settings := NonlinearSettings{Steps: 4, LoadPath: []float64{1, -1}}
+	first := (peak - yield) / H
+	for _, test := range []struct {
+		hardening J2Plasticity
+		second    float64 // Plastic strain in compression.
+	}{
+		{hardening: J2Plasticity{Yield: yield, IsotropicHardening: H}},
+		{hardening: J2Plasticity{Yield: yield, KinematicHardening: H}, second: (-peak + 2*yield - peak) / H},
+	} {
+		materials := []Material{{C: C, Plasticity: &test.hardening}}
+		res, err := SolvePlastic(model, materials, loads, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Steps) != 8 {
+			t.Fatalf("got %d steps, want 8", len(res.Steps))
+		}
+		_, disp := res.ForceDisplacement(end)
+		for i, want := range map[int]float64{
+			3: 0.75 * peak / E,     // Elastic.
+			4: peak/E + first,      // Yielded.
+			6: first,               // Unloaded.
+			7: -0.5*peak/E + first, // Elastic in compression.
+			8: -peak/E + first + test.second,
+		} {
+			if got := disp[i] / L; math.Abs(got-want) > 1e-9 {
+				t.Errorf("%+v: strain %g at load factor %g, want %g", test.hardening, got, res.Steps[i-1].LoadFactor, want)
+			}
+		}
+		want := first + math.Abs(test.second)
+		for _, states := range res.Steps[7].Plastic {
+			for _, state := range states {
+				if math.Abs(state.Equivalent-want) > 1e-9 || math.Abs(state.Strain[0]-first-test.second) > 1e-9 {
+					t.Fatalf("%+v: plastic state %+v, want equivalent plastic strain %g", test.hardening, state, want)
+				}
+			}
+		}
+	}
+
+	// Plasticity needs the elastic moduli of C.
+	materials := []Material{{Plasticity: &J2Plasticity{Yield: yield}}}
+	if _, err := SolvePlastic(model, materials, loads, settings); err == nil || !strings.Contains(err.Error(), "material 0") {
+		t.Errorf("expected error naming plastic material without constitutive matrix, got %v", err)
+	}
+}
+
+func TestExplicit(t *testing.T) {
+	// Time steps below the critical time step are stable and larger ones are
+	// not: an initial displacement exciting all modes is integrated and its
+	// energy must be conserved.
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: 4, Y: 3, Z: 2}}, [3]int{4, 3, 2})
+	hex8 := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	hex20, _ := hex8.Quadratic()
+	tet4 := FEModel{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)}
+	tet10, _ := tet4.Quadratic()
+	rng := rand.New(rand.NewSource(1))
+	for _, nu := range []float64{0, 0.3, 0.45} {
+		materials := []Material{{C: isotropicCompliance(200e3, nu), Density: 7.85e-9}}
+		for _, model := range []FEModel{hex8, hex20, tet4, tet10} {
+			dtc, err := CriticalTimeStep(model, materials)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u0 := make([]float64, 3*len(model.Nodes))
+			for i := range u0 {
+				u0[i] = 1e-3 * rng.NormFloat64()
+			}
+			for _, safety := range []float64{0, 3} {
+				dt := safety * dtc
+				if safety == 0 {
+					dt = 0.8 * dtc
+				}
+				res, err := SolveExplicit(model, materials, ExplicitSettings{
+					TimeStep:            safety * dtc,
+					Duration:            300 * dt,
+					InitialDisplacement: u0,
+					Snapshots:           []float64{0, 300 * dt},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				e0, e1 := res.Energies[0].Total(), res.Energies[1].Total()
+				stable := math.Abs(e1-e0) < 1e-8*e0
+				if stable != (safety == 0) {
+					t.Errorf("%T ν=%g: energy %g changes to %g with time step %g of critical %g", model.Element, nu, e0, e1, res.TimeStep, dtc)
+				}
+			}
+		}
+	}
+
+	// Free vibration of a clamped bar in its first axial mode of period 4*L/c
+	// without lateral contraction.
+	const L, E, rho = 10.0, 1.0, 1.0
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{10, 1, 1})
+	model := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	materials := []Material{{C: isotropicCompliance(E, 0), Density: rho}}
+	supports := make(map[int]float64)
+	u0 := make([]float64, 3*len(model.Nodes))
+	var tip []int
+	for i, n := range model.Nodes {
+		supports[3*i+1], supports[3*i+2] = 0, 0
+		if n.X == 0 {
+			supports[3*i] = 0
+		}
+		if n.X == L {
+			tip = append(tip, 3*i)
+		}
+		u0[3*i] = 0.01 * math.Sin(math.Pi*n.X/(2*L))
+	}
+	omega := math.Pi / 2 * math.Sqrt(E/rho) / L
+	period := 2 * math.Pi / omega
+	for _, alpha := range []float64{0, 0.05} {
+		// Mass damping damps the mode with ratio ζ = α/(2*ω).
+		zeta := alpha / (2 * omega)
+		wd := omega * math.Sqrt(1-zeta*zeta)
+		mode := func(t float64) float64 {
+			return 0.01 * math.Exp(-zeta*omega*t) * (math.Cos(wd*t) + zeta*omega/wd*math.Sin(wd*t))
+		}
+		res, err := SolveExplicit(model, materials, ExplicitSettings{
+			Duration:            period,
+			MassDamping:         alpha,
+			InitialDisplacement: u0,
+			Loads:               func(float64) StaticLoads { return StaticLoads{Displacement: supports} },
+			Snapshots:           []float64{0, period / 2, period},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, tk := range res.Times {
+			want := mode(tk)
+			var got float64
+			for _, dof := range tip {
+				got += res.Displacements[k][dof] / float64(len(tip))
+			}
+			if math.Abs(got-want) > 0.01*math.Abs(want) {
+				t.Errorf("α=%g: tip displacement %g at time %g, want %g", alpha, got, tk, want)
+			}
+			if e, e0 := res.Energies[k].Total(), res.Energies[0].Total(); math.Abs(e-e0) > 1e-3*e0 {
+				t.Errorf("α=%g: total energy %g at time %g, want %g", alpha, e, tk, e0)
+			}
+		}
+		if d := res.Energies[2].Damping; alpha > 0 && d < 0.5*res.Energies[0].Strain {
+			t.Errorf("α=%g: %g energy dissipated by damping", alpha, d)
+		}
+	}
+
+	// An end of the bar moved at speed V sends a wave of stress ρ*c*V. Until
+	// the wave reaches the other end the support does work ρ*c*V²*t, split
+	// evenly between kinetic and strain energy. The lumped mass of the moving
+	// end is excluded from the balance.
+	const V = 1e-3
+	res, err := SolveExplicit(model, materials, ExplicitSettings{
+		Duration: 0.8 * L,
+		Loads: func(t float64) StaticLoads {
+			moving := make(map[int]float64, len(supports))
+			for dof, v := range supports {
+				moving[dof] = v
+				if dof%3 == 0 {
+					moving[dof] = V * t
+				}
+			}
+			return StaticLoads{Displacement: moving}
+		},
+		Snapshots: []float64{0.8 * L},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := res.Energies[0]
+	if want := rho * math.Sqrt(E/rho) * V * V * 0.8 * L; math.Abs(e.External-want) > 0.1*want {
+		t.Errorf("work %g of moving support, want %g", e.External, want)
+	}
+	if math.Abs(e.Total()) > 1e-3*e.External || math.Abs(e.Kinetic-e.Strain) > 0.1*e.External {
+		t.Errorf("unbalanced energies %+v", e)
+	}
+}
+
+func TestDynamic(t *testing.T) {
+	// Axial vibration of a clamped bar without lateral contraction.
+	const L = 10.0
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{10, 1, 1})
+	model := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	materials := []Material{{C: isotropicCompliance(1, 0), Density: 1}}
+	n := 3 * len(nodes)
+	supports := make(map[int]float64)
+	fixed := make([]bool, n)
+	var tip []int
+	for i, node := range nodes {
+		supports[3*i+1], supports[3*i+2] = 0, 0
+		if node.X == 0 {
+			supports[3*i] = 0
+		}
+		if node.X == L {
+			tip = append(tip, 3*i)
+		}
+	}
+	for dof := range supports {
+		fixed[dof] = true
+	}
+	loads := func(float64) StaticLoads { return StaticLoads{Displacement: supports} }
+	K, err := AssembleStiffness(model, materials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	M, err := AssembleMass(model, materials, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes, err := Modal(K, M, fixed, ModalSettings{Modes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	omega := math.Sqrt(modes.Eigenvalues[0])
+	phi := mat.Col(nil, 0, modes.Modes)
+	// energy returns the kinetic and strain energy of the first mode and of
+	// all modes at snapshot k.
+	energy := func(res DynamicResult, k int) (mode, total float64) {
+		u, v := res.Displacements[k], res.Velocities[k]
+		Mu, Mv, Ku := make([]float64, n), make([]float64, n), make([]float64, n)
+		M.MulVecTo(Mu, u)
+		M.MulVecTo(Mv, v)
+		K.MulVecTo(Ku, u)
+		q, qdot := floats.Dot(phi, Mu), floats.Dot(phi, Mv)
+		return (qdot*qdot + omega*omega*q*q) / 2, (floats.Dot(v, Mv) + floats.Dot(u, Ku)) / 2
+	}
+
+	// The average acceleration method integrates a mode exactly with the
+	// frequency Ω given by tan(Ω*Δt/2) = ω*Δt/2.
+	period := 2 * math.Pi / omega
+	dt := period / 40
+	wd := 2 / dt * math.Atan(omega*dt/2)
+	res, err := SolveDynamic(model, materials, DynamicSettings{
+		TimeStep:            dt,
+		Duration:            2 * period,
+		InitialDisplacement: phi,
+		Loads:               loads,
+		Snapshots:           []float64{0, 10 * dt, 2 * period},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, tk := range res.Times {
+		for _, dof := range tip {
+			want := phi[dof] * math.Cos(wd*tk)
+			if got := res.Displacements[k][dof]; math.Abs(got-want) > 1e-9*math.Abs(phi[dof]) {
+				t.Errorf("displacement %g at time %g, want %g", got, tk, want)
+			}
+			want = -omega * omega * phi[dof] * math.Cos(wd*tk)
+			if got := res.Accelerations[k][dof]; math.Abs(got-want) > 1e-9*omega*omega*math.Abs(phi[dof]) {
+				t.Errorf("acceleration %g at time %g, want %g", got, tk, want)
+			}
+		}
+	}
+
+	// Starting from all modes at a time step too large for the high ones, the
+	// average acceleration method conserves energy and HHT-α dissipates the
+	// high modes while hardly damping the resolved first mode.
+	rng := rand.New(rand.NewSource(1))
+	u0 := make([]float64, n)
+	for i := range u0 {
+		if !fixed[i] {
+			u0[i] = 1e-3 * rng.NormFloat64()
+		}
+	}
+	dt = period / 20
+	for _, alpha := range []float64{0, -0.1} {
+		res, err := SolveDynamic(model, materials, DynamicSettings{
+			TimeStep:            dt,
+			Duration:            100 * dt,
+			Alpha:               alpha,
+			InitialDisplacement: u0,
+			Loads:               loads,
+			Snapshots:           []float64{0, 100 * dt},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mode0, total0 := energy(res, 0)
+		mode1, total1 := energy(res, 1)
+		high0, high1 := total0-mode0, total1-mode1
+		if alpha == 0 {
+			if math.Abs(total1-total0) > 1e-10*total0 || math.Abs(mode1-mode0) > 1e-10*total0 {
+				t.Errorf("α=0: energy %g and first mode energy %g change to %g and %g", total0, mode0, total1, mode1)
+			}
+			continue
+		}
+		if high1 > 0.01*high0 || mode1 < 0.95*mode0 {
+			t.Errorf("α=%g: high mode energy %g changes to %g, first mode energy %g to %g", alpha, high0, high1, mode0, mode1)
+		}
+	}
+
+	// A suddenly applied load on a damped bar settles to the static solution.
+	static := StaticLoads{Displacement: supports, PointLoad: make(map[int]Vec)}
+	for _, dof := range tip {
+		static.PointLoad[dof/3] = Vec{X: 0.25}
+	}
+	want, err := SolveStatic(model, materials, static)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lumped := range []bool{false, true} {
+		res, err := SolveDynamic(model, materials, DynamicSettings{
+			TimeStep:    period / 20,
+			Duration:    10 * period,
+			Alpha:       -0.05,
+			MassDamping: 2 * omega,
+			Lumped:      lumped,
+			Loads:       func(float64) StaticLoads { return static },
+			Snapshots:   []float64{10 * period},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !floats.EqualApprox(res.Displacements[0], want, 1e-6*floats.Norm(want, math.Inf(1))) {
+			t.Errorf("lumped=%v: final displacement %v, want %v", lumped, res.Displacements[0][3*len(nodes)-3:], want[3*len(nodes)-3:])
+		}
+	}
+
+	// Prescribed motion is followed exactly and changing supports are rejected.
+	moving := func(t float64) StaticLoads {
+		d := make(map[int]float64, len(supports))
+		for dof, v := range supports {
+			d[dof] = v
+			if dof%3 == 0 {
+				d[dof] = 1e-3 * math.Sin(omega*t)
+			}
+		}
+		return StaticLoads{Displacement: d}
+	}
+	res, err = SolveDynamic(model, materials, DynamicSettings{
+		TimeStep:  dt,
+		Duration:  period,
+		Loads:     moving,
+		Snapshots: []float64{period / 2, period},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, tk := range res.Times {
+		for dof, v := range moving(tk).Displacement {
+			if got := res.Displacements[k][dof]; math.Abs(got-v) > 1e-12 {
+				t.Errorf("prescribed displacement %g at time %g, want %g", got, tk, v)
+			}
+		}
+	}
+	_, err = SolveDynamic(model, materials, DynamicSettings{
+		TimeStep: dt,
+		Duration: period,
+		Loads: func(t float64) StaticLoads {
+			if t > period/2 {
+				return StaticLoads{PointLoad: map[int]Vec{0: {X: 1}}}
+			}
+			return StaticLoads{Displacement: supports}
+		},
+	})
+	if err == nil {
+		t.Error("expected error for changing supports")
+	}
+}
+
+func TestFrequencyResponse(t *testing.T) {
+	// Clamped bar loaded axially at its tip, free to contract laterally.
+	const L = 10.0
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{10, 1, 1})
+	model := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3), Density: 7.85e-9}}
+	n := 3 * len(nodes)
+	loads := StaticLoads{Displacement: make(map[int]float64), PointLoad: make(map[int]Vec)}
+	fixed := make([]bool, n)
+	var tip []int
+	for i, node := range nodes {
+		if node.X == 0 {
+			for d := 0; d < 3; d++ {
+				loads.Displacement[3*i+d] = 0
+				fixed[3*i+d] = true
+			}
+		}
+		if node.X == L {
+			tip = append(tip, i)
+			loads.PointLoad[i] = Vec{X: 1, Y: 0.5}
+		}
+	}
+
+	// The static limit, with structural damping delaying the response by
+	// the phase of 1 + i*η.
+	static, err := SolveStatic(model, materials, loads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const eta = 0.02
+	for _, lossFactor := range []float64{0, eta} {
+		res, err := FrequencyResponse(model, materials, loads, FrequencySettings{Frequencies: []float64{0}, LossFactor: lossFactor})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, got := range res.Amplitudes[0] {
+			want := complex(static[i], 0) / complex(1, lossFactor)
+			if cmplx.Abs(got-want) > 1e-9*floats.Norm(static, math.Inf(1)) {
+				t.Errorf("η=%g: static amplitude %d is %g, want %g", lossFactor, i, got, want)
+			}
+		}
+	}
+
+	// Modal superposition over all modes:
+	//  U = Σ φₖ*φₖᵀ*F/(ωₖ² - ω² + i*ω*(a + b*ωₖ²) + i*η*ωₖ²)
+	K, err := AssembleStiffness(model, materials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	M, err := AssembleMass(model, materials, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nfree := 0
+	for _, fix := range fixed {
+		if !fix {
+			nfree++
+		}
+	}
+	modes, err := Modal(K, M, fixed, ModalSettings{Modes: nfree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	F := make([]float64, n)
+	for i, load := range loads.PointLoad {
+		F[3*i], F[3*i+1] = load.X, load.Y
+	}
+	f1 := modes.Frequencies[0]
+	settings := FrequencySettings{
+		Frequencies:      []float64{0.5 * f1, f1, 1.01 * f1, 3 * f1},
+		MassDamping:      1e-3 * 2 * math.Pi * f1,
+		StiffnessDamping: 1e-3 / (2 * math.Pi * f1),
+		LossFactor:       eta,
+		Lumped:           true,
+		Probes:           tip,
+	}
+	res, err := FrequencyResponse(model, materials, loads, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, freq := range res.Frequencies {
+		omega := 2 * math.Pi * freq
+		want := make([]complex128, 3*len(tip))
+		for m, w2 := range modes.Eigenvalues {
+			phi := mat.Col(nil, m, modes.Modes)
+			q := complex(floats.Dot(phi, F), 0) / complex(w2-omega*omega, omega*(settings.MassDamping+settings.StiffnessDamping*w2)+eta*w2)
+			for i, node := range tip {
+				for d := 0; d < 3; d++ {
+					want[3*i+d] += complex(phi[3*node+d], 0) * q
+				}
+			}
+		}
+		var scale float64
+		for _, w := range want {
+			scale = math.Max(scale, cmplx.Abs(w))
+		}
+		for i, got := range res.Amplitudes[k] {
+			if cmplx.Abs(got-want[i]) > 1e-6*scale {
+				t.Errorf("frequency %g: amplitude %d is %g, want %g", freq, i, got, want[i])
+			}
+		}
+	}
+	// Close to resonance the response lags the load by a quarter period.
+	if U := res.Amplitudes[1][0]; math.Abs(real(U)) > 0.1*math.Abs(imag(U)) || imag(U) > 0 {
+		t.Errorf("resonant amplitude %g is not a quarter period behind", U)
+	}
+
+	// Harmonic support motion transmitted through a rigid link at the tip.
+	base := StaticLoads{Displacement: make(map[int]float64), Constraints: NewConstraints(len(nodes), 3)}
+	for dof, fix := range fixed {
+		if fix {
+			base.Displacement[dof] = 0
+			if dof%3 == 0 {
+				base.Displacement[dof] = 1e-3
+			}
+		}
+	}
+	base.Constraints.RigidLink(nodes, tip[0], tip[1:])
+	static, err = SolveStatic(model, materials, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = FrequencyResponse(model, materials, base, FrequencySettings{Frequencies: []float64{0, 2 * f1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, got := range res.Amplitudes[0] {
+		if cmplx.Abs(got-complex(static[i], 0)) > 1e-12 {
+			t.Errorf("static amplitude %d of support motion is %g, want %g", i, got, static[i])
+		}
+	}
+	// Uniform support motion keeps the linked tip nodes together.
+	for _, node := range tip[1:] {
+		if got, want := res.Amplitudes[1][3*node], res.Amplitudes[1][3*tip[0]]; cmplx.Abs(got-want) > 1e-9*cmplx.Abs(want) {
+			t.Errorf("linked axial amplitudes %g and %g differ", got, want)
+		}
+	}
+}
+
+func TestBuckling(t *testing.T) {
+	// Under a uniform stress the geometric stiffness does the work of the
+	// stress on the rotation θ about Z: uᵀ*Kg*u = (σxx + σyy)*θ²*V.
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: 3, Y: 2, Z: 1}}, [3]int{3, 2, 1})
+	materials := []Material{{C: isotropicCompliance(1000, 0.3)}}
+	for _, model := range []FEModel{
+		{Nodes: nodes, Element: Hex8{}, Elems: hexas},
+		{Nodes: nodes, Element: Tet4{}, Elems: kuhnTetras(hexas)},
+	} {
+		const strain, theta = 1e-3, 0.1
+		u := make([]float64, 3*len(nodes))
+		rot := make([]float64, 3*len(nodes))
+		for i, n := range nodes {
+			u[3*i] = strain * n.X
+			rot[3*i], rot[3*i+1] = -theta*n.Y, theta*n.X
+		}
+		stress, err := RecoverStress(model, materials, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Kg, err := AssembleGeometricStiffness(model, stress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Kgu := make([]float64, len(rot))
+		Kg.MulVecTo(Kgu, rot)
+		C := materials[0].C
+		want := (C.At(0, 0) + C.At(1, 0)) * strain * theta * theta * 6
+		if got := floats.Dot(rot, Kgu); math.Abs(got-want) > 1e-10*want {
+			t.Errorf("%T: rotation work %g, want %g", model.Element, got, want)
+		}
+	}
+
+	// Euler buckling load π²*E*I/(4*L²) of a column clamped at its base,
+	// without lateral contraction so the clamp does not stiffen it.
+	const L, E, p = 20.0, 1000.0, 1e-3
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{10, 1, 1})
+	model, _ := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	materials = []Material{{C: isotropicCompliance(E, 0)}}
+	clamped := NewConstraints(len(model.Nodes), 3)
+	clamped.Fix(findNodes(model.Nodes, func(n Vec) bool { return n.X == 0 }))
+	top := model.BoundaryFaces(func(_, n Vec) bool { return n.X == 1 })
+	euler := math.Pi * math.Pi * E / 12 / (4 * L * L) / p
+	var factors []float64
+	for _, sign := range []float64{1, -1} {
+		loads := StaticLoads{Constraints: clamped, Traction: []Traction{{Faces: top, Traction: Vec{X: -sign * p}}}}
+		res, err := Buckling(model, materials, loads, BucklingSettings{Modes: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sign < 0 {
+			// Reversed loads reverse the load factors.
+			for k, lambda := range res.LoadFactors {
+				if math.Abs(lambda+factors[k]) > 1e-8*factors[k] {
+					t.Errorf("reversed load factor %d is %g, want %g", k, lambda, -factors[k])
+				}
+			}
+			continue
+		}
+		factors = res.LoadFactors
+		// The square section buckles in both lateral directions alike.
+		for k, lambda := range factors {
+			if math.Abs(lambda-euler) > 0.005*euler {
+				t.Errorf("load factor %d is %g, want %g", k, lambda, euler)
+			}
+		}
+		if math.Abs(factors[0]-factors[1]) > 1e-6*factors[0] {
+			t.Errorf("expected repeated load factors, got %v", factors)
+		}
+		// Deflection 1 - cos(π*x/(2*L)) relative to the top.
+		for k := range factors {
+			phi := mat.Col(nil, k, res.Modes)
+			var tip, mid Vec
+			for i, n := range model.Nodes {
+				w := Vec{Y: phi[3*i+1], Z: phi[3*i+2]}
+				switch n.X {
+				case L:
+					tip = w
+				case L / 2:
+					mid = w
+				}
+			}
+			want := 1 - math.Cos(math.Pi/4)
+			if r := Norm(mid) / Norm(tip); math.Abs(r-want) > 0.01 {
+				t.Errorf("mode %d: midheight deflection %g of top, want %g", k, r, want)
+			}
+		}
+	}
+}
+
+func TestHex8Formulations(t *testing.T) {
+	formulations := []Hex8Formulation{FullIntegration, BBar, IncompatibleModes, ReducedIntegration}
+	// Patch test: a linear displacement field prescribed on the boundary of a
+	// distorted patch is reproduced inside with constant stress.
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: 1, Y: 1, Z: 1}}, [3]int{2, 2, 2})
+	center := findNodes(nodes, func(n Vec) bool { return n == Vec{X: 0.5, Y: 0.5, Z: 0.5} })[0]
+	nodes[center] = Vec{X: 0.62, Y: 0.41, Z: 0.57}
+	grad := [3][3]float64{{1e-3, 2e-4, -3e-4}, {5e-4, -2e-3, 1e-4}, {-4e-4, 3e-4, 1.5e-3}}
+	linear := func(n Vec) (u [3]float64) {
+		for i := range u {
+			u[i] = grad[i][0]*n.X + grad[i][1]*n.Y + grad[i][2]*n.Z
+		}
+		return u
+	}
+	materials := []Material{{C: isotropicCompliance(1000, 0.3)}}
+	var wantStress [6]float64
+	strain := [6]float64{grad[0][0], grad[1][1], grad[2][2], grad[0][1] + grad[1][0], grad[1][2] + grad[2][1], grad[0][2] + grad[2][0]}
+	for i := range wantStress {
+		for j := range strain {
+			wantStress[i] += materials[0].C.At(i, j) * strain[j]
+		}
+	}
+	for _, f := range formulations {
+		model := FEModel{Nodes: nodes, Element: Hex8{Formulation: f}, Elems: hexas}
+		disp := make(map[int]float64)
+		for i, n := range nodes {
+			if i == center {
+				continue
+			}
+			u := linear(n)
+			for d := range u {
+				disp[3*i+d] = u[d]
+			}
+		}
+		u, err := SolveStatic(model, materials, StaticLoads{Displacement: disp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := linear(nodes[center])
+		for d := range want {
+			if math.Abs(u[3*center+d]-want[d]) > 1e-12 {
+				t.Errorf("%v: center displacement %d is %g, want %g", f, d, u[3*center+d], want[d])
+			}
+		}
+		stress, err := RecoverStress(model, materials, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for iele, gauss := range stress.GaussStress {
+			for _, s := range gauss {
+				for k := range s {
+					if math.Abs(s[k]-wantStress[k]) > 1e-9 {
+						t.Errorf("%v: element %d stress %v, want %v", f, iele, s, wantStress)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	// Tip deflection of a cantilever under an end shear load relative to
+	// Timoshenko beam theory. Fully integrated elements are too stiff in
+	// bending and incompatible modes bend exactly.
+	const L, E, p = 10.0, 1000.0, 1e-3
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: L, Y: 1, Z: 1}}, [3]int{10, 2, 2})
+	materials = []Material{{C: isotropicCompliance(E, 0)}}
+	clamped := NewConstraints(len(nodes), 3)
+	clamped.Fix(findNodes(nodes, func(n Vec) bool { return n.X == 0 }))
+	beam := p*L*L*L/(3*E/12) + p*L/(5./6*E/2)
+	for _, test := range []struct {
+		f        Hex8Formulation
+		min, max float64
+	}{
+		{f: FullIntegration, min: 0.6, max: 0.7},
+		{f: IncompatibleModes, min: 0.99, max: 1.01},
+		{f: ReducedIntegration, min: 0.9, max: 1.02},
+	} {
+		model := FEModel{Nodes: nodes, Element: Hex8{Formulation: test.f}, Elems: hexas}
+		tip := model.BoundaryFaces(func(_, n Vec) bool { return n.X == 1 })
+		loads := StaticLoads{Constraints: clamped, Traction: []Traction{{Faces: tip, Traction: Vec{Z: p}}}}
+		u, err := SolveStatic(model, materials, loads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var w float64
+		ends := findNodes(nodes, func(n Vec) bool { return n.X == L })
+		for _, i := range ends {
+			w += u[3*i+2]
+		}
+		if r := w / float64(len(ends)) / beam; r < test.min || r > test.max {
+			t.Errorf("%v: tip deflection %g of beam theory, want in [%g,%g]", test.f, r, test.min, test.max)
+		}
+	}
+
+	// A bar free to expand along X under a temperature linear in X with only
+	// axial thermal strain is stress free. Its displacement is quadratic, which
+	// incompatible modes reproduce including the load of the thermal strain.
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: 4, Y: 1, Z: 1}}, [3]int{4, 1, 1})
+	const cte = 1e-3
+	materials = []Material{{C: isotropicCompliance(E, 0), CTE: [6]float64{cte}}}
+	T := make([]float64, len(nodes))
+	disp := make(map[int]float64)
+	for i, n := range nodes {
+		T[i] = 100 * n.X
+		disp[3*i+1], disp[3*i+2] = 0, 0
+		if n.X == 0 {
+			disp[3*i] = 0
+		}
+	}
+	for _, f := range []Hex8Formulation{FullIntegration, IncompatibleModes} {
+		model := FEModel{Nodes: nodes, Element: Hex8{Formulation: f}, Elems: hexas}
+		u, err := SolveStatic(model, materials, StaticLoads{Displacement: disp, Temperature: T})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stress, err := RecoverThermalStress(model, materials, u, T, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var maxStress float64
+		for _, gauss := range stress.GaussStress {
+			for _, s := range gauss {
+				maxStress = math.Max(maxStress, math.Abs(s[0]))
+			}
+		}
+		// Reference stress of the restrained thermal strain across an element.
+		ref := E * cte * 100
+		if f == FullIntegration {
+			if maxStress < 0.1*ref {
+				t.Errorf("fully integrated thermal stress %g, expected spurious stress", maxStress)
+			}
+		} else if maxStress > 1e-9*ref {
+			t.Errorf("%v: thermal stress %g, want 0", f, maxStress)
+		}
+	}
+
+	// Cook's membrane in plane strain with a nearly incompressible material.
+	// The fully integrated element locks while the others approach the
+	// converged corner deflection of about 7.7.
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: 1, Y: 1, Z: 1}}, [3]int{16, 16, 1})
+	corner := -1
+	disp = make(map[int]float64)
+	for i, n := range nodes {
+		bottom, top := 44*n.X, 44+16*n.X
+		nodes[i] = Vec{X: 48 * n.X, Y: bottom + n.Y*(top-bottom), Z: n.Z}
+		disp[3*i+2] = 0
+		if n.X == 0 {
+			disp[3*i], disp[3*i+1] = 0, 0
+		}
+		if n.X == 1 && n.Y == 1 && n.Z == 0 {
+			corner = i
+		}
+	}
+	materials = []Material{{C: isotropicCompliance(250, 0.4999)}}
+	for _, f := range formulations {
+		model := FEModel{Nodes: nodes, Element: Hex8{Formulation: f}, Elems: hexas}
+		right := model.BoundaryFaces(func(_, n Vec) bool { return n.X == 1 })
+		loads := StaticLoads{Displacement: disp, Traction: []Traction{{Faces: right, Traction: Vec{Y: 100. / 16}}}}
+		u, err := SolveStatic(model, materials, loads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := u[3*corner+1]
+		if f == FullIntegration {
+			if got > 4 {
+				t.Errorf("fully integrated corner deflection %g, expected locking", got)
+			}
+		} else if math.Abs(got-7.7) > 0.02*7.7 {
+			t.Errorf("%v: corner deflection %g, want 7.7", f, got)
+		}
+	}
+
+	// Formulations are rejected by analyses that do not support them.
+	model := FEModel{Nodes: nodes, Element: Hex8{Formulation: IncompatibleModes}, Elems: hexas}
+	materials[0].Density = 1
+	if _, err := SolveNonlinear(model, materials, StaticLoads{Displacement: disp}, NonlinearSettings{}); err == nil || !strings.Contains(err.Error(), "IncompatibleModes") {
+		t.Errorf("expected nonlinear analysis to reject incompatible modes by name, got %v", err)
+	}
+	if _, err := SolveExplicit(model, materials, ExplicitSettings{Duration: 1}); err == nil {
+		t.Error("expected explicit analysis to reject incompatible modes")
+	}
+
+	// A void element has no incompatible mode stiffness to condense: it
+	// contributes nothing and has no stress.
+	nodes, hexas = hexaGrid(Box{Max: Vec{X: 2, Y: 1, Z: 1}}, [3]int{2, 1, 1})
+	model = FEModel{Nodes: nodes, Element: Hex8{Formulation: IncompatibleModes}, Elems: hexas, ElemMaterial: []int{0, 1}}
+	materials = []Material{{C: isotropicCompliance(1000, 0.3)}, {C: mat.NewDense(6, 6, nil)}}
+	K, err := AssembleStiffness(model, materials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := K.Dims()
+	for _, i := range findNodes(nodes, func(n Vec) bool { return n.X == 2 }) {
+		for d := 0; d < 3; d++ {
+			for j := 0; j < n; j++ {
+				if v := K.At(3*i+d, j); v != 0 {
+					t.Fatalf("void node %d stiffness %d,%d is %g, want 0", i, 3*i+d, j, v)
+				}
+			}
+		}
+	}
+	u := make([]float64, 3*len(nodes))
+	for i, n := range nodes {
+		v := linear(n)
+		copy(u[3*i:], v[:])
+	}
+	stress, err := RecoverStress(model, materials, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for iele, gauss := range stress.GaussStress {
+		want := wantStress
+		if iele == 1 {
+			want = [6]float64{}
+		}
+		for _, s := range gauss {
+			for k := range s {
+				if math.Abs(s[k]-want[k]) > 1e-9 {
+					t.Fatalf("element %d stress %v, want %v", iele, s, want)
+				}
+			}
+		}
+	}
+}
+
+func TestEngineeringConstants(t *testing.T) {
+	// General orthotropic material from its compliance.
+	want := ElasticConstants{E1: 200, E2: 50, E3: 20, Nu12: 0.3, Nu13: 0.25, Nu23: 0.4, G12: 30, G13: 15, G23: 8}
+	want.Nu21 = want.Nu12 * want.E2 / want.E1
+	want.Nu31 = want.Nu13 * want.E3 / want.E1
+	want.Nu32 = want.Nu23 * want.E3 / want.E2
+	S := mat.NewDense(6, 6, []float64{
+		1 / want.E1, -want.Nu21 / want.E2, -want.Nu31 / want.E3, 0, 0, 0,
+		-want.Nu12 / want.E1, 1 / want.E2, -want.Nu32 / want.E3, 0, 0, 0,
+		-want.Nu13 / want.E1, -want.Nu23 / want.E2, 1 / want.E3, 0, 0, 0,
+		0, 0, 0, 1 / want.G12, 0, 0,
+		0, 0, 0, 0, 1 / want.G23, 0,
+		0, 0, 0, 0, 0, 1 / want.G13,
+	})
+	var C mat.Dense
+	if err := C.Inverse(S); err != nil {
+		t.Fatal(err)
+	}
+	// Fiber of gen_shape.go, transversely isotropic about x.
+	fiber := ElasticConstants{E1: 235e3, E2: 14e3, E3: 14e3, Nu12: 0.2, Nu13: 0.2, Nu23: 0.25, G12: 28e3, G13: 28e3, G23: 14e3 / 2.5}
+	fiber.Nu21 = fiber.Nu12 * fiber.E2 / fiber.E1
+	fiber.Nu31 = fiber.Nu21
+	fiber.Nu32 = fiber.Nu23
+	iso := ElasticConstants{E1: 4.8e3, E2: 4.8e3, E3: 4.8e3, G12: 4.8e3 / 2.68, G13: 4.8e3 / 2.68, G23: 4.8e3 / 2.68}
+	iso.Nu12, iso.Nu13, iso.Nu23, iso.Nu21, iso.Nu31, iso.Nu32 = 0.34, 0.34, 0.34, 0.34, 0.34, 0.34
+	Cf := orthotropicCompliance(235e3, 14e3, 0.2, 0.25, 28e3)
+	for _, test := range []struct {
+		C         mat.Matrix
+		want      ElasticConstants
+		ortho, ti bool
+		axis      int
+		isotropic bool
+	}{
+		{C: &C, want: want, ortho: true},
+		{C: Cf, want: fiber, ortho: true, ti: true, axis: 0},
+		{C: isotropicCompliance(4.8e3, 0.34), want: iso, ortho: true, ti: true, isotropic: true},
+		// Fiber along z.
+		{C: rotateStiffness(Cf, NewRotation(math.Pi/2, Vec{Y: 1}).Mat()), ortho: true, ti: true, axis: 2},
+		// Off axis fiber.
+		{C: rotateStiffness(Cf, NewRotation(math.Pi/6, Vec{Z: 1}).Mat())},
+	} {
+		got, err := EngineeringConstants(test.C)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.want.E1 != 0 {
+			fields := func(c ElasticConstants) []float64 {
+				return []float64{c.E1, c.E2, c.E3, c.Nu12, c.Nu13, c.Nu23, c.Nu21, c.Nu31, c.Nu32, c.G12, c.G13, c.G23}
+			}
+			if !floats.EqualApprox(fields(got), fields(test.want), 1e-10) {
+				t.Errorf("got constants %+v, want %+v", got, test.want)
+			}
+		}
+		// Reciprocity νᵢⱼ/Eᵢ = νⱼᵢ/Eⱼ holds for any symmetric stiffness.
+		if math.Abs(got.Nu12/got.E1-got.Nu21/got.E2) > 1e-10*math.Abs(got.Nu12/got.E1) {
+			t.Errorf("ν12/E1 = %g and ν21/E2 = %g differ", got.Nu12/got.E1, got.Nu21/got.E2)
+		}
+		d := MaterialSymmetry(test.C)
+		if d.Asymmetry > 1e-14 {
+			t.Errorf("asymmetry %g of symmetric stiffness", d.Asymmetry)
+		}
+		for _, class := range []struct {
+			name string
+			dist float64
+			in   bool
+		}{
+			{"orthotropic", d.Orthotropic, test.ortho},
+			{"transversely isotropic", d.TransverselyIsotropic, test.ti},
+			{"isotropic", d.Isotropic, test.isotropic},
+		} {
+			if in := class.dist < 1e-12; in != class.in {
+				t.Errorf("distance %g to %s class, want in class %t", class.dist, class.name, class.in)
+			}
+			if class.dist < 0 || class.dist > 1 {
+				t.Errorf("distance %g to %s class out of [0,1]", class.dist, class.name)
+			}
+		}
+		if test.ti && !test.isotropic && d.Axis != test.axis {
+			t.Errorf("transverse isotropy about axis %d, want %d", d.Axis, test.axis)
+		}
+	}
+	// Classes are nested so distances do not decrease.
+	d := MaterialSymmetry(&C)
+	if !(d.Orthotropic <= d.TransverselyIsotropic && d.TransverselyIsotropic <= d.Isotropic) {
+		t.Errorf("distances %+v not ordered by class", d)
+	}
+
+	// Asymmetric and indefinite stiffnesses are rejected.
+	asym := mat.DenseCopyOf(Cf)
+	asym.Set(0, 1, 1.01*asym.At(0, 1))
+	if d := MaterialSymmetry(asym); !(d.Asymmetry > 1e-4) {
+		t.Errorf("asymmetry %g, want positive", d.Asymmetry)
+	}
+	if _, err := EngineeringConstants(asym); err == nil {
+		t.Error("expected error for asymmetric stiffness")
+	}
+	if _, err := EngineeringConstants(isotropicCompliance(1, 0.6)); err == nil {
+		t.Error("expected error for indefinite stiffness")
+	}
+}
+
+func TestMicromechanics(t *testing.T) {
+	// Closed forms of the Mori-Tanaka estimate for isotropic phases: the plane
+	// strain bulk modulus k23 and shear moduli G12 and G23 of Hill and Hashin.
+	Ef, nuf, Em, num, vf := 70e3, 0.2, 3e3, 0.35, 0.4
+	m, err := FiberComposite(isotropicCompliance(Ef, nuf), isotropicCompliance(Em, num), vf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Gf, Gm := Ef/(2*(1+nuf)), Em/(2*(1+num))
+	kf, km := Gf/(1-2*nuf), Gm/(1-2*num)
+	C := m.MoriTanaka
+	for _, test := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"k23", (C.At(1, 1) + C.At(1, 2)) / 2, km + vf/(1/(kf-km)+(1-vf)/(km+Gm))},
+		{"G12", C.At(3, 3), Gm * (Gf + Gm + vf*(Gf-Gm)) / (Gf + Gm - vf*(Gf-Gm))},
+		{"G23", C.At(4, 4), Gm + vf/(1/(Gf-Gm)+(km+2*Gm)*(1-vf)/(2*Gm*(km+Gm)))},
+		{"isotropic G23", (C.At(1, 1) - C.At(1, 2)) / 2, C.At(4, 4)},
+		// Halpin-Tsai with ξ = 1 is exact for G12.
+		{"Halpin-Tsai G12", m.HalpinTsai.At(3, 3), C.At(3, 3)},
+	} {
+		if math.Abs(test.got-test.want) > 1e-10*test.want {
+			t.Errorf("Mori-Tanaka %s is %g, want %g", test.name, test.got, test.want)
+		}
+	}
+
+	Cf := orthotropicCompliance(235e3, 14e3, 0.2, 0.25, 28e3)
+	Cm := isotropicCompliance(4.8e3, 0.34)
+	for _, vf := range []float64{0, 1} {
+		m, err := FiberComposite(Cf, Cm, vf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Cm
+		if vf == 1 {
+			want = Cf
+		}
+		for _, C := range []*mat.Dense{m.Voigt, m.Reuss, m.HalpinTsai, m.MoriTanaka, m.HashinShtrikmanLower, m.HashinShtrikmanUpper} {
+			if !mat.EqualApprox(C, want, 1e-8*mat.Norm(want, 2)) {
+				t.Errorf("volume fraction %g: estimate\n%v\nwant phase stiffness\n%v", vf, mat.Formatted(C), mat.Formatted(want))
+			}
+		}
+	}
+	m, err = FiberComposite(Cf, Cm, 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fiber is stiffer than the matrix, which makes Mori-Tanaka the lower
+	// Hashin-Shtrikman bound.
+	if !mat.EqualApprox(m.MoriTanaka, m.HashinShtrikmanLower, 1e-10*mat.Norm(Cf, 2)) {
+		t.Error("Mori-Tanaka differs from the lower Hashin-Shtrikman bound")
+	}
+	// Bounds are nested: Reuss ⪯ HS lower ⪯ HS upper ⪯ Voigt.
+	chain := []*mat.Dense{m.Reuss, m.HashinShtrikmanLower, m.HashinShtrikmanUpper, m.Voigt}
+	for i := 1; i < len(chain); i++ {
+		var D mat.Dense
+		D.Sub(mandel(chain[i]), mandel(chain[i-1]))
+		if e := minEigenvalue(&D); e < -1e-9*mat.Norm(Cf, 2) {
+			t.Errorf("bound %d not above bound %d: smallest eigenvalue of difference %g", i, i-1, e)
+		}
+	}
+
+	// An estimate compared to itself has no deviation and lies within the bounds.
+	report, err := CompareMicromechanics(m.MoriTanaka, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Estimates) != 6 || report.Estimates[3].Model != "Mori-Tanaka" || report.Estimates[3].Deviation > 1e-14 {
+		t.Errorf("unexpected Mori-Tanaka comparison %+v", report.Estimates)
+	}
+	if !report.WithinVoigtReuss || !report.WithinHashinShtrikman {
+		t.Error("Mori-Tanaka estimate reported out of bounds")
+	}
+	if report.FEA != report.Estimates[3].Constants {
+		t.Errorf("FEA constants %+v differ from estimate %+v", report.FEA, report.Estimates[3].Constants)
+	}
+	stiff := mat.DenseCopyOf(m.Voigt)
+	stiff.Scale(1.1, stiff)
+	if report, err = CompareMicromechanics(stiff, m); err != nil {
+		t.Fatal(err)
+	}
+	if report.WithinVoigtReuss || report.WithinHashinShtrikman {
+		t.Error("stiffness above the Voigt bound reported within bounds")
+	}
+	if !strings.Contains(report.String(), "Hashin-Shtrikman upper") {
+		t.Errorf("report missing estimates:\n%v", report)
+	}
+
+	if _, err := FiberComposite(Cf, Cm, 1.5); err == nil {
+		t.Error("expected error for volume fraction above one")
+	}
+	if _, err := FiberComposite(Cm, Cf, 0.5); err == nil {
+		t.Error("expected error for anisotropic matrix")
+	}
+}
+
+func TestParallelAssembly(t *testing.T) {
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: 3, Y: 2, Z: 2}}, [3]int{6, 4, 4})
+	model, _ := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3), Density: 1}}
+	u := make([]float64, 3*len(model.Nodes))
+	for i := range u {
+		u[i] = math.Sin(float64(i))
+	}
+	// run returns the stiffness and mass matrices and the stresses of model
+	// computed with the given number of workers.
+	run := func(workers int) (K, M *CSR, res *StressResult) {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(workers))
+		K, err := AssembleStiffness(model, materials)
+		if err != nil {
+			t.Fatal(err)
+		}
+		M, err = AssembleMass(model, materials, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = RecoverStress(model, materials, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return K, M, res
+	}
+	K1, M1, res1 := run(1)
+	// Assembly into the sparsity pattern matches assembly of a COO.
+	elemC, err := model.elemConstitutive(materials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nn := model.element().NumNodes()
+	ne := 3 * nn
+	ref := NewCOO(len(u), len(u), len(model.Elems)*ne*ne)
+	integ := newElementIntegrator(model.element())
+	Ke := mat.NewDense(ne, ne, nil)
+	enod := make([]Vec, nn)
+	edofs := make([]int, ne)
+	for iele, enodes := range model.Elems {
+		storeElemNode(enod, model.Nodes, enodes)
+		integ.stiffness(Ke, enod, elemC[iele])
+		storeElemDofs(edofs, enodes, 3)
+		ref.AddSub(edofs, Ke)
+	}
+	if !mat.EqualApprox(K1, ref.ToCSR(), 1e-9*mat.Norm(K1, math.Inf(1))) {
+		t.Error("stiffness matrix differs from COO assembly")
+	}
+	for _, workers := range []int{2, 3, 8} {
+		K, M, res := run(workers)
+		// Results must be bit for bit identical.
+		if !equalCSR(K, K1) || !equalCSR(M, M1) {
+			t.Errorf("%d workers: assembly differs from serial assembly", workers)
+		}
+		for iele := range res.GaussStress {
+			for ipg := range res.GaussStress[iele] {
+				if res.GaussStress[iele][ipg] != res1.GaussStress[iele][ipg] {
+					t.Fatalf("%d workers: stress differs from serial recovery", workers)
+				}
+			}
+		}
+		for n := range res.NodalStress {
+			if res.NodalStress[n] != res1.NodalStress[n] {
+				t.Fatalf("%d workers: nodal stress differs from serial recovery", workers)
+			}
+		}
+	}
+}
+
+func equalCSR(a, b *CSR) bool {
+	if a.r != b.r || a.c != b.c || len(a.data) != len(b.data) {
+		return false
+	}
+	for i := range a.indptr {
+		if a.indptr[i] != b.indptr[i] {
+			return false
+		}
+	}
+	for k := range a.data {
+		if a.ind[k] != b.ind[k] || a.data[k] != b.data[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkAssembleStiffness(b *testing.B) {
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: 1, Y: 1, Z: 1}}, [3]int{8, 8, 8})
+	model, _ := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3)}}
+	benchmarkWorkers(b, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := AssembleStiffness(model, materials)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkRecoverStress(b *testing.B) {
+	nodes, hexas := hexaGrid(Box{Max: Vec{X: 1, Y: 1, Z: 1}}, [3]int{8, 8, 8})
+	model, _ := FEModel{Nodes: nodes, Element: Hex8{}, Elems: hexas}.Quadratic()
+	materials := []Material{{C: isotropicCompliance(200e3, 0.3)}}
+	u := make([]float64, 3*len(model.Nodes))
+	for i := range u {
+		u[i] = math.Sin(float64(i))
+	}
+	benchmarkWorkers(b, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := RecoverStress(model, materials, u)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// benchmarkWorkers runs bench with 1, 2, 4, ... workers up to the number of CPUs.
+func benchmarkWorkers(b *testing.B, bench func(b *testing.B)) {
+	for workers := 1; ; workers *= 2 {
+		if workers > runtime.NumCPU() {
+			workers = runtime.NumCPU()
+		}
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(workers))
+			bench(b)
+		})
+		if workers == runtime.NumCPU() {
+			return
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// HeatFlux is a prescribed heat flux on element faces.
+type HeatFlux struct {
+	Faces []ElemFace
+	// Flux is the heat flow per unit area entering the model through Faces.
+	Flux float64
+}
+
+// Convection is a convection boundary condition on element faces. Heat leaves
+// the model at a rate Coefficient*(T - Ambient) per unit area.
+type Convection struct {
+	Faces []ElemFace
+	// Coefficient is the film coefficient.
+	Coefficient float64
+	// Ambient is the temperature of the surrounding fluid.
+	Ambient float64
+}
+
+// ThermalLoads holds the boundary conditions and heat sources of a scalar
+// field problem such as heat conduction. The same problems describe
+// electrostatics and diffusion with the appropriate interpretation of the fields.
+type ThermalLoads struct {
+	// Temperature holds the prescribed temperature of nodes.
+	Temperature map[int]float64
+	Flux        []HeatFlux
+	Convection  []Convection
+	// Source holds the heat generated per unit volume in each element. It may be nil.
+	Source []float64
+}
+
+// AssembleConductivity returns the global conductivity matrix of model. There is
+// a single degree of freedom per node, the temperature. The conductivity of
+// each element is taken from its material and rotated to its orientation.
+func AssembleConductivity(model FEModel, materials []Material) (*CSR, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	elemK, err := model.elemConductivity(materials)
+	if err != nil {
+		return nil, err
+	}
+	return assembleConductivity(model, elemK), nil
+}
+
+func assembleConductivity(model FEModel, elemK []*mat.Dense) *CSR {
+	elem := model.element()
+	nn := elem.NumNodes()
+	a := newElemAssembly(model, 1, false)
+	K := a.matrix()
+	parallelColors(a.colors, func() func(int) {
+		integ := newElementIntegrator(elem)
+		Ke := mat.NewDense(nn, nn, nil)
+		enod := make([]Vec, nn)
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			integ.conduction(Ke, enod, elemK[iele])
+			K.addSub(enodes, Ke)
+		}
+	})
+	return K
+}
+
+// assemble adds the convection terms of l to the conductivity matrix K and the
+// heat flux, convection and source terms to the load vector f.
+func (l ThermalLoads) assemble(model FEModel, K *CSR, f []float64) error {
+	if l.Source != nil && len(l.Source) != len(model.Elems) {
+		return fmt.Errorf("%d heat sources for %d elements: %w", len(l.Source), len(model.Elems), mat.ErrShape)
+	}
+	elem := model.element()
+	nn := elem.NumNodes()
+	enod := make([]Vec, nn)
+	if len(l.Flux) > 0 || len(l.Convection) > 0 {
+		finteg := newFaceIntegrator(elem)
+		for _, bc := range l.Flux {
+			if err := model.checkFaces(bc.Faces); err != nil {
+				return err
+			}
+			for _, face := range bc.Faces {
+				enodes := model.Elems[face.Elem]
+				storeElemNode(enod, model.Nodes, enodes)
+				for ipg := range finteg.wpg[face.Face] {
+					N, _, dA := finteg.point(enod, face.Face, ipg)
+					for i, n := range enodes {
+						f[n] += bc.Flux * N[i] * dA
+					}
+				}
+			}
+		}
+		He := mat.NewDense(nn, nn, nil)
+		for _, bc := range l.Convection {
+			if err := model.checkFaces(bc.Faces); err != nil {
+				return err
+			}
+			for _, face := range bc.Faces {
+				enodes := model.Elems[face.Elem]
+				storeElemNode(enod, model.Nodes, enodes)
+				He.Zero()
+				for ipg := range finteg.wpg[face.Face] {
+					N, _, dA := finteg.point(enod, face.Face, ipg)
+					for i, n := range enodes {
+						f[n] += bc.Coefficient * bc.Ambient * N[i] * dA
+						for j := range enodes {
+							He.Set(i, j, He.At(i, j)+bc.Coefficient*N[i]*N[j]*dA)
+						}
+					}
+				}
+				K.addSub(enodes, He)
+			}
+		}
+	}
+	if l.Source != nil {
+		integ := newElementIntegrator(elem)
+		for iele, enodes := range model.Elems {
+			if l.Source[iele] == 0 {
+				continue
+			}
+			storeElemNode(enod, model.Nodes, enodes)
+			for ipg := range integ.upg {
+				dV := integ.gradient(enod, ipg)
+				for i, n := range enodes {
+					f[n] += l.Source[iele] * integ.N[ipg][i] * dV
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SolveThermal solves the steady-state heat conduction problem of model
+// and returns the temperature of each node.
+func SolveThermal(model FEModel, materials []Material, loads ThermalLoads) (T []float64, err error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	elemK, err := model.elemConductivity(materials)
+	if err != nil {
+		return nil, err
+	}
+	hasConvection := false
+	for _, bc := range loads.Convection {
+		hasConvection = hasConvection || (bc.Coefficient > 0 && len(bc.Faces) > 0)
+	}
+	if len(loads.Temperature) == 0 && !hasConvection {
+		return nil, errors.New("temperature is undetermined without prescribed temperatures or convection")
+	}
+	K := assembleConductivity(model, elemK)
+	f := make([]float64, len(model.Nodes))
+	if err := loads.assemble(model, K, f); err != nil {
+		return nil, err
+	}
+	return solvePrescribed(K, f, loads.Temperature)
+}
+
+// solvePrescribed solves the symmetric system A*x = b for x with the
+// prescribed values of x eliminated from the system.
+func solvePrescribed(A *CSR, b []float64, prescribed map[int]float64) ([]float64, error) {
+	if r, _ := A.Dims(); len(b) != r {
+		return nil, fmt.Errorf("system has %d rows and %d right hand side entries: %w", r, len(b), mat.ErrShape)
+	}
+	s, err := newPrescribedSolver(A, prescribed)
+	if err != nil {
+		return nil, err
+	}
+	return s.solve(b, prescribed)
+}
+
+// prescribedSolver solves symmetric systems A*x = b where some entries of x
+// are prescribed. The free block of A is factorized once so only the right hand
+// side and the prescribed values may change between solves.
+type prescribedSolver struct {
+	A    *CSR
+	free []bool
+	ldl  LDL
+}
+
+// newPrescribedSolver factorizes A with the degrees of freedom in prescribed
+// eliminated. Only the keys of prescribed are used.
+func newPrescribedSolver(A *CSR, prescribed map[int]float64) (*prescribedSolver, error) {
+	n, c := A.Dims()
+	if n != c {
+		return nil, fmt.Errorf("system is %d×%d: %w", n, c, mat.ErrShape)
+	}
+	s := &prescribedSolver{A: A, free: make([]bool, n)}
+	for i := range s.free {
+		s.free[i] = true
+	}
+	for i := range prescribed {
+		if i < 0 || i >= n {
+			return nil, fmt.Errorf("prescribed degree of freedom %d out of range [0,%d)", i, n)
+		}
+		s.free[i] = false
+	}
+	if len(prescribed) < n {
+		if err := s.ldl.Factorize(A.Sub(s.free), nil); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// solve returns the solution of A*x = b for the prescribed values, which must
+// be prescribed on the same degrees of freedom as when s was created.
+func (s *prescribedSolver) solve(b []float64, prescribed map[int]float64) ([]float64, error) {
+	x := make([]float64, len(b))
+	for i, v := range prescribed {
+		x[i] = v
+	}
+	rhs := append([]float64(nil), b...)
+	s.A.DoNonZero(func(i, j int, v float64) {
+		if s.free[i] && !s.free[j] {
+			rhs[i] -= v * x[j]
+		}
+	})
+	freeRHS := rhs[:0]
+	for i, f := range s.free {
+		if f {
+			freeRHS = append(freeRHS, rhs[i])
+		}
+	}
+	if len(freeRHS) == 0 {
+		return x, nil
+	}
+	sol := make([]float64, len(freeRHS))
+	if err := s.ldl.SolveVecTo(sol, freeRHS); err != nil {
+		return nil, err
+	}
+	j := 0
+	for i, f := range s.free {
+		if f {
+			x[i] = sol[j]
+			j++
+		}
+	}
+	return x, nil
+}
+
+// FluxResult holds the temperature gradient and heat flux recovered from a
+// temperature solution at the quadrature points of each element.
+type FluxResult struct {
+	// GaussPoints holds the global position of the quadrature points of
+	// each element: GaussPoints[iele][ipg].
+	GaussPoints [][]Vec
+	// GaussVolume holds the volume represented by each quadrature point.
+	GaussVolume [][]float64
+	// GaussGradient holds the temperature gradient ∇T.
+	GaussGradient [][]Vec
+	// GaussFlux holds the heat flux q = -k*∇T.
+	GaussFlux [][]Vec
+}
+
+// RecoverHeatFlux computes the temperature gradient and heat flux of model
+// for the nodal temperatures T.
+func RecoverHeatFlux(model FEModel, materials []Material, T []float64) (*FluxResult, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	if len(T) != len(model.Nodes) {
+		return nil, fmt.Errorf("got %d temperatures for %d nodes: %w", len(T), len(model.Nodes), mat.ErrShape)
+	}
+	elemK, err := model.elemConductivity(materials)
+	if err != nil {
+		return nil, err
+	}
+	elem := model.element()
+	npg := len(newElementIntegrator(elem).upg)
+	nel := len(model.Elems)
+	res := &FluxResult{
+		GaussPoints:   make([][]Vec, nel),
+		GaussVolume:   make([][]float64, nel),
+		GaussGradient: make([][]Vec, nel),
+		GaussFlux:     make([][]Vec, nel),
+	}
+	parallelElems(nel, func() func(int) {
+		integ := newElementIntegrator(elem)
+		enod := make([]Vec, elem.NumNodes())
+		return func(iele int) {
+			enodes := model.Elems[iele]
+			storeElemNode(enod, model.Nodes, enodes)
+			res.GaussPoints[iele] = make([]Vec, npg)
+			res.GaussVolume[iele] = make([]float64, npg)
+			res.GaussGradient[iele] = make([]Vec, npg)
+			res.GaussFlux[iele] = make([]Vec, npg)
+			k := elemK[iele]
+			for ipg := 0; ipg < npg; ipg++ {
+				res.GaussVolume[iele][ipg] = integ.gradient(enod, ipg)
+				var x, grad Vec
+				for i, n := range enodes {
+					x = Add(x, Scale(integ.N[ipg][i], enod[i]))
+					grad = Add(grad, Scale(T[n], Vec{X: integ.dNxyz.At(0, i), Y: integ.dNxyz.At(1, i), Z: integ.dNxyz.At(2, i)}))
+				}
+				res.GaussPoints[iele][ipg] = x
+				res.GaussGradient[iele][ipg] = grad
+				res.GaussFlux[iele][ipg] = Vec{
+					X: -(k.At(0, 0)*grad.X + k.At(0, 1)*grad.Y + k.At(0, 2)*grad.Z),
+					Y: -(k.At(1, 0)*grad.X + k.At(1, 1)*grad.Y + k.At(1, 2)*grad.Z),
+					Z: -(k.At(2, 0)*grad.X + k.At(2, 1)*grad.Y + k.At(2, 2)*grad.Z),
+				}
+			}
+		}
+	})
+	return res, nil
+}
+
+// HomogenizeConductivity computes the effective conductivity tensor k of a
+// periodic representative unit cell. A unit macroscopic temperature gradient
+// is imposed along each axis through periodic boundary conditions and k is
+// obtained from the volume averaged heat flux. The Box, Tolerance and
+// NonMatching fields of settings are used.
+func HomogenizeConductivity(model FEModel, materials []Material, settings HomogenizeSettings) (k [3][3]float64, err error) {
+	if err := model.validate(); err != nil {
+		return k, err
+	}
+	elemK, err := model.elemConductivity(materials)
+	if err != nil {
+		return k, err
+	}
+	size := settings.Box.Size()
+	boxVolume := size.X * size.Y * size.Z
+	if !(boxVolume > 0) {
+		return k, fmt.Errorf("invalid RUC box %+v", settings.Box)
+	}
+	tol := settings.Tolerance
+	if tol == 0 {
+		tol = 1e-6 * Norm(size)
+	}
+	constraints, err := rucPeriodicConstraints(model.Nodes, model.Elems, model.element(), settings.Box, tol, settings.NonMatching)
+	if err != nil {
+		return k, err
+	}
+	if len(constraints) == 0 {
+		return k, errors.New("no periodic node pairs found on RUC faces")
+	}
+	system, err := newPeriodicSystem(assembleConductivity(model, elemK), model.Nodes, constraints, 1, settings.Box)
+	if err != nil {
+		return k, err
+	}
+	for j := 0; j < 3; j++ {
+		// Temperature jump between periodic images for a unit gradient along j.
+		T, err := system.solve(func(dx Vec, _ int) float64 { return dx.component(j) }, nil)
+		if err != nil {
+			return k, err
+		}
+		res, err := RecoverHeatFlux(model, materials, T)
+		if err != nil {
+			return k, err
+		}
+		var sum Vec
+		for iele := range res.GaussVolume {
+			for ipg, dV := range res.GaussVolume[iele] {
+				sum = Add(sum, Scale(dV, res.GaussFlux[iele][ipg]))
+			}
+		}
+		// Average flux is -k*∇T with ∇T the unit vector along j.
+		for i := 0; i < 3; i++ {
+			k[i][j] = -sum.component(i) / boxVolume
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// TransientSettings configures SolveTransient.
+type TransientSettings struct {
+	// Initial holds the temperature of each node at time zero.
+	// If nil all nodes start at zero temperature.
+	Initial []float64
+	// TimeStep is the time step Δt. The last step is shortened to end at Duration.
+	TimeStep float64
+	// Duration is the simulated time.
+	Duration float64
+	// Theta is the implicitness θ of the time integration: 1 is backward Euler
+	// and 0.5 is Crank-Nicolson. Values from 0.5 to 1 are unconditionally stable.
+	// If zero backward Euler is used, the explicit scheme is not supported.
+	Theta float64
+	// Lumped selects a lumped capacity matrix, which prevents the temperature
+	// undershoot consistent capacity matrices show with small time steps.
+	Lumped bool
+	// Loads returns the thermal loads at time t. Changing the prescribed
+	// temperature nodes or the convection coefficients between steps requires a
+	// new factorization. If nil there are no loads.
+	Loads func(t float64) ThermalLoads
+	// Snapshots holds the times at which the temperature is recorded. Times
+	// that fall between steps are interpolated linearly.
+	Snapshots []float64
+}
+
+// TransientResult holds the temperatures recorded by SolveTransient.
+type TransientResult struct {
+	// Times holds the snapshot times in ascending order.
+	Times []float64
+	// Temperatures holds the nodal temperatures at each snapshot time.
+	Temperatures [][]float64
+}
+
+// AssembleCapacity returns the global heat capacity matrix of model with the
+// degrees of freedom of AssembleConductivity. The heat capacity per unit volume
+// of each element is the product of its material's density and specific heat.
+// Lumping is done as in AssembleMass.
+func AssembleCapacity(model FEModel, materials []Material, lumped bool) (*CSR, error) {
+	if err := model.validate(); err != nil {
+		return nil, err
+	}
+	rhoc, err := model.elemProperty(materials, func(m Material) float64 { return m.Density * m.SpecificHeat })
+	if err != nil {
+		return nil, err
+	}
+	return assembleMass(model, rhoc, 1, lumped), nil
+}
+
+// SolveTransient integrates the transient heat conduction equation
+//  C*dT/dt + K*T = f
+// of model in time with the θ-method:
+//  (C/Δt + θ*K)*Tₙ₊₁ = (C/Δt - (1-θ)*K)*Tₙ + θ*fₙ₊₁ + (1-θ)*fₙ
+// where K includes convection and f the heat flux, convection and source terms
+// of the loads at each time.
+func SolveTransient(model FEModel, materials []Material, settings TransientSettings) (TransientResult, error) {
+	var result TransientResult
+	if err := model.validate(); err != nil {
+		return result, err
+	}
+	elemK, err := model.elemConductivity(materials)
+	if err != nil {
+		return result, err
+	}
+	rhoc, err := model.elemProperty(materials, func(m Material) float64 { return m.Density * m.SpecificHeat })
+	if err != nil {
+		return result, err
+	}
+	if !(settings.TimeStep > 0) || !(settings.Duration >= 0) {
+		return result, fmt.Errorf("invalid time step %g or duration %g", settings.TimeStep, settings.Duration)
+	}
+	theta := settings.Theta
+	if theta == 0 {
+		theta = 1
+	}
+	if theta < 0 || theta > 1 {
+		return result, fmt.Errorf("theta %g out of range (0,1]", theta)
+	}
+	snapshots := append([]float64(nil), settings.Snapshots...)
+	sort.Float64s(snapshots)
+	if len(snapshots) > 0 && (snapshots[0] < 0 || snapshots[len(snapshots)-1] > settings.Duration) {
+		return result, errors.New("snapshot times must be within the simulated time")
+	}
+	n := len(model.Nodes)
+	T := make([]float64, n)
+	if settings.Initial != nil {
+		if len(settings.Initial) != n {
+			return result, fmt.Errorf("got %d initial temperatures for %d nodes: %w", len(settings.Initial), n, mat.ErrShape)
+		}
+		copy(T, settings.Initial)
+	}
+	loadsAt := func(t float64) ThermalLoads {
+		if settings.Loads == nil {
+			return ThermalLoads{}
+		}
+		return settings.Loads(t)
+	}
+	Kcond := assembleConductivity(model, elemK)
+	C := assembleMass(model, rhoc, 1, settings.Lumped)
+	// system returns the conductivity matrix and load vector of loads.
+	system := func(loads ThermalLoads) (*CSR, []float64, error) {
+		K := Kcond.clone()
+		f := make([]float64, n)
+		if err := loads.assemble(model, K, f); err != nil {
+			return nil, nil, err
+		}
+		return K, f, nil
+	}
+
+	loads := loadsAt(0)
+	for i, v := range loads.Temperature {
+		if i < 0 || i >= n {
+			return result, fmt.Errorf("prescribed temperature at node %d out of range [0,%d)", i, n)
+		}
+		T[i] = v
+	}
+	K, f, err := system(loads)
+	if err != nil {
+		return result, err
+	}
+	record := func(t float64, T []float64) {
+		result.Times = append(result.Times, t)
+		result.Temperatures = append(result.Temperatures, append([]float64(nil), T...))
+	}
+	for len(snapshots) > 0 && snapshots[0] == 0 {
+		record(0, T)
+		snapshots = snapshots[1:]
+	}
+
+	var (
+		solver       *prescribedSolver
+		solverDt     float64
+		solverLoads  ThermalLoads
+		CT           = make([]float64, n)
+		KT           = make([]float64, n)
+		b            = make([]float64, n)
+		interpolated = make([]float64, n)
+	)
+	t := 0.0
+	for step := 1; t < settings.Duration; step++ {
+		// Step times are computed from the step count to avoid accumulating round-off.
+		t1 := math.Min(float64(step)*settings.TimeStep, settings.Duration)
+		dt := t1 - t
+		loads1 := loadsAt(t1)
+		K1, f1, err := system(loads1)
+		if err != nil {
+			return result, err
+		}
+		if solver == nil || dt != solverDt || !sameThermalSystem(loads1, solverLoads) {
+			A := NewCOO(n, n, C.NNZ()+K1.NNZ())
+			C.DoNonZero(func(i, j int, v float64) { A.AddAt(i, j, v/dt) })
+			K1.DoNonZero(func(i, j int, v float64) { A.AddAt(i, j, theta*v) })
+			solver, err = newPrescribedSolver(A.ToCSR(), loads1.Temperature)
+			if err != nil {
+				return result, err
+			}
+			solverDt, solverLoads = dt, loads1
+		}
+		C.MulVecTo(CT, T)
+		K.MulVecTo(KT, T)
+		for i := range b {
+			b[i] = CT[i]/dt - (1-theta)*KT[i] + theta*f1[i] + (1-theta)*f[i]
+		}
+		T1, err := solver.solve(b, loads1.Temperature)
+		if err != nil {
+			return result, fmt.Errorf("time %g: %w", t1, err)
+		}
+		for len(snapshots) > 0 && snapshots[0] <= t1 {
+			w := (snapshots[0] - t) / dt
+			for i := range interpolated {
+				interpolated[i] = (1-w)*T[i] + w*T1[i]
+			}
+			record(snapshots[0], interpolated)
+			snapshots = snapshots[1:]
+		}
+		T, K, f, t = T1, K1, f1, t1
+	}
+	return result, nil
+}
+
+// sameThermalSystem reports whether the loads a and b prescribe temperatures
+// on the same nodes and have the same convection coefficients, in which case
+// their system matrices are equal.
+func sameThermalSystem(a, b ThermalLoads) bool {
+	if len(a.Temperature) != len(b.Temperature) || len(a.Convection) != len(b.Convection) {
+		return false
+	}
+	for i := range a.Temperature {
+		if _, ok := b.Temperature[i]; !ok {
+			return false
+		}
+	}
+	for i, ca := range a.Convection {
+		cb := b.Convection[i]
+		if ca.Coefficient != cb.Coefficient || len(ca.Faces) != len(cb.Faces) {
+			return false
+		}
+		for j := range ca.Faces {
+			if ca.Faces[j] != cb.Faces[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
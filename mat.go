@@ -203,6 +203,8 @@ func (m *Mat) Det() float64 {
 	return a*deta - b*detb + c*detc
 }
 
+// Eigs returns the eigenvalues of the symmetric matrix m in r. Eigenvectors
+// are not computed so c is always nil. Eigs panics if m is not symmetric.
 func (m *Mat) Eigs() (r, c []float64) {
 	const tol = 1e-12
 	if !scalar.EqualWithinAbs(m.At(0, 1), m.At(1, 0), tol) ||
@@ -231,8 +233,9 @@ func (m *Mat) Eigs() (r, c []float64) {
 	}
 	// sqrt(3)
 	const sqrt3 = 1.7320508075688772935274463415058723669428052538103806280558069794
-	// phi = 1/3 atan( sqrt(p^3 - q^2)/q ), 0<=phi<=pi
-	phi := math.Atan(math.Sqrt(p*p*p-q*q)/q) / 3
+	// phi = 1/3 atan( sqrt(p^3 - q^2)/q ), 0<=phi<=pi/3. Atan2 picks the
+	// correct branch for negative q and round-off may make p^3-q^2 negative.
+	phi := math.Atan2(math.Sqrt(math.Max(0, p*p*p-q*q)), q) / 3
 	sp, cp := math.Sincos(phi)
 	sqrtp := math.Sqrt(p)
 	return []float64{
@@ -1,12 +1,44 @@
 package main
 
-import "testing"
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"gonum.org/v1/gonum/mat"
+)
 
 func TestMatEigs(t *testing.T) {
-	m := NewMat([]float64{
-		1, 2, 3,
-		2, 4, 5,
-		3, 5, 6,
-	})
-	t.Fatal(m.Eigs())
+	for _, test := range [][]float64{
+		{
+			1, 2, 3,
+			2, 4, 5,
+			3, 5, 6,
+		},
+		{
+			-1, 2, 3,
+			2, -4, 5,
+			3, 5, -6,
+		},
+		{ // det(A-m*I) < 0.
+			2, 0, 0,
+			0, 2, 0,
+			0, 0, -1,
+		},
+	} {
+		m := NewMat(test)
+		got, _ := m.Eigs()
+		var eig mat.EigenSym
+		if !eig.Factorize(mat.NewSymDense(3, test), false) {
+			t.Fatal("reference factorization failed")
+		}
+		want := eig.Values(nil)
+		sort.Float64s(got)
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-12*math.Abs(want[2]) {
+				t.Errorf("eigenvalues of %v: got %v, want %v", test, got, want)
+				break
+			}
+		}
+	}
 }
@@ -0,0 +1,143 @@
+// Package quadrature provides numerical integration rules for the reference
+// domains of finite elements: Gauss-Legendre rules on [-1, 1] of any order and
+// Grundmann-Möller rules on simplices of any degree.
+package quadrature
+
+import (
+	"fmt"
+	"math"
+)
+
+// Legendre returns the nodes and weights of the n point Gauss-Legendre rule
+// on [-1, 1]. Nodes are sorted in ascending order. The rule integrates
+// polynomials of degree 2n-1 exactly. Legendre panics if n < 1.
+func Legendre(n int) (x, w []float64) {
+	if n < 1 {
+		panic(fmt.Sprintf("quadrature: invalid number of Gauss-Legendre points %d", n))
+	}
+	x = make([]float64, n)
+	w = make([]float64, n)
+	// Roots are symmetric so only half are found with Newton iteration.
+	for i := 0; i < (n+1)/2; i++ {
+		// Initial guess from the asymptotic approximation of the ith largest root.
+		z := math.Cos(math.Pi * (float64(i) + 0.75) / (float64(n) + 0.5))
+		var dp float64
+		for iter := 0; iter < 100; iter++ {
+			var p float64
+			p, dp = legendre(n, z)
+			dz := p / dp
+			z -= dz
+			if math.Abs(dz) <= 1e-16 {
+				break
+			}
+		}
+		_, dp = legendre(n, z)
+		x[i], x[n-1-i] = -z, z
+		w[i] = 2 / ((1 - z*z) * dp * dp)
+		w[n-1-i] = w[i]
+	}
+	if n%2 == 1 {
+		x[n/2] = 0 // Remove round-off of the middle root.
+	}
+	return x, w
+}
+
+// legendre returns the value and derivative of the Legendre polynomial
+// of degree n at x, computed with Bonnet's recursion.
+func legendre(n int, x float64) (p, dp float64) {
+	p0, p1 := 1.0, x
+	if n == 0 {
+		return 1, 0
+	}
+	for k := 2; k <= n; k++ {
+		p0, p1 = p1, (float64(2*k-1)*x*p1-float64(k-1)*p0)/float64(k)
+	}
+	p = p1
+	dp = float64(n) * (x*p1 - p0) / (x*x - 1)
+	return p, dp
+}
+
+// Simplex returns a Grundmann-Möller rule on the dim-dimensional unit simplex
+// with vertices at the origin and on each coordinate axis. The rule integrates
+// polynomials up to degree exactly. Grundmann-Möller rules have odd degree so
+// even degrees are rounded up. Points are given in Cartesian coordinates and
+// weights sum to the simplex volume 1/dim!.
+//
+// Rules of degree greater than 1 have negative weights.
+func Simplex(dim, degree int) (points [][]float64, w []float64) {
+	if dim < 1 || degree < 0 {
+		panic(fmt.Sprintf("quadrature: invalid simplex rule of dimension %d and degree %d", dim, degree))
+	}
+	s := degree / 2 // Degree is d = 2s+1.
+	d := 2*s + 1
+	beta := make([]int, dim+1)
+	for i := 0; i <= s; i++ {
+		denom := float64(d + dim - 2*i)
+		// Weight is (-1)ⁱ 2⁻²ˢ (d+n-2i)ᵈ / (i! (d+n-i)!).
+		wi := math.Pow(denom, float64(d)) / math.Pow(2, float64(2*s))
+		wi /= factorial(i) * factorial(d+dim-i)
+		if i%2 == 1 {
+			wi = -wi
+		}
+		compositions(beta, s-i, func(beta []int) {
+			// Barycentric coordinates λⱼ = (2βⱼ+1)/(d+n-2i) of which the
+			// last dim are the Cartesian coordinates.
+			p := make([]float64, dim)
+			for j := range p {
+				p[j] = float64(2*beta[j+1]+1) / denom
+			}
+			points = append(points, p)
+			w = append(w, wi)
+		})
+	}
+	return points, w
+}
+
+// Triangle returns a Grundmann-Möller rule on the triangle with vertices
+// (0,0), (1,0) and (0,1) that integrates polynomials up to degree exactly.
+func Triangle(degree int) (points [][2]float64, w []float64) {
+	p, w := Simplex(2, degree)
+	points = make([][2]float64, len(p))
+	for i := range p {
+		copy(points[i][:], p[i])
+	}
+	return points, w
+}
+
+// Tetrahedron returns a Grundmann-Möller rule on the tetrahedron with vertices
+// at the origin and (1,0,0), (0,1,0) and (0,0,1) that integrates polynomials up
+// to degree exactly.
+func Tetrahedron(degree int) (points [][3]float64, w []float64) {
+	p, w := Simplex(3, degree)
+	points = make([][3]float64, len(p))
+	for i := range p {
+		copy(points[i][:], p[i])
+	}
+	return points, w
+}
+
+// compositions calls fn with every way of writing sum as an ordered
+// sum of len(beta) non-negative integers. beta is used as scratch space.
+func compositions(beta []int, sum int, fn func(beta []int)) {
+	var rec func(k, rem int)
+	rec = func(k, rem int) {
+		if k == len(beta)-1 {
+			beta[k] = rem
+			fn(beta)
+			return
+		}
+		for v := rem; v >= 0; v-- {
+			beta[k] = v
+			rec(k+1, rem-v)
+		}
+	}
+	rec(0, sum)
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+	return f
+}
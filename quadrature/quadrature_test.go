@@ -0,0 +1,85 @@
+package quadrature
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLegendre(t *testing.T) {
+	for n := 1; n <= 30; n++ {
+		x, w := Legendre(n)
+		for i := 1; i < n; i++ {
+			if x[i] <= x[i-1] {
+				t.Fatalf("n=%d: nodes not ascending: %v", n, x)
+			}
+		}
+		// ∫xᵏ dx over [-1,1] is 2/(k+1) for even k and 0 for odd k.
+		for k := 0; k <= 2*n-1; k++ {
+			var got float64
+			for i := range x {
+				got += w[i] * math.Pow(x[i], float64(k))
+			}
+			want := 0.0
+			if k%2 == 0 {
+				want = 2 / float64(k+1)
+			}
+			if math.Abs(got-want) > 1e-13 {
+				t.Errorf("n=%d: ∫x^%d = %g, want %g", n, k, got, want)
+			}
+		}
+	}
+	// Known 3 point rule.
+	x, w := Legendre(3)
+	if math.Abs(x[2]-math.Sqrt(0.6)) > 1e-15 || math.Abs(w[0]-5.0/9) > 1e-15 || math.Abs(w[1]-8.0/9) > 1e-15 {
+		t.Errorf("bad 3 point rule: %v %v", x, w)
+	}
+}
+
+func TestSimplex(t *testing.T) {
+	for degree := 0; degree <= 9; degree++ {
+		// ∫ xᵃ yᵇ over the unit triangle is a! b! / (a+b+2)!.
+		p2, w2 := Triangle(degree)
+		for a := 0; a <= degree; a++ {
+			for b := 0; a+b <= degree; b++ {
+				var got float64
+				for i, p := range p2 {
+					got += w2[i] * math.Pow(p[0], float64(a)) * math.Pow(p[1], float64(b))
+				}
+				want := factorial(a) * factorial(b) / factorial(a+b+2)
+				if math.Abs(got-want) > 1e-12*want {
+					t.Errorf("triangle degree %d: ∫x^%d y^%d = %g, want %g", degree, a, b, got, want)
+				}
+			}
+		}
+		// ∫ xᵃ yᵇ zᶜ over the unit tetrahedron is a! b! c! / (a+b+c+3)!.
+		p3, w3 := Tetrahedron(degree)
+		for a := 0; a <= degree; a++ {
+			for b := 0; a+b <= degree; b++ {
+				for c := 0; a+b+c <= degree; c++ {
+					var got float64
+					for i, p := range p3 {
+						got += w3[i] * math.Pow(p[0], float64(a)) * math.Pow(p[1], float64(b)) * math.Pow(p[2], float64(c))
+					}
+					want := factorial(a) * factorial(b) * factorial(c) / factorial(a+b+c+3)
+					if math.Abs(got-want) > 1e-12*want {
+						t.Errorf("tetrahedron degree %d: ∫x^%d y^%d z^%d = %g, want %g", degree, a, b, c, got, want)
+					}
+				}
+			}
+		}
+	}
+	// All points of a rule lie inside the simplex.
+	p, _ := Simplex(4, 7)
+	for _, x := range p {
+		var sum float64
+		for _, v := range x {
+			if v <= 0 {
+				t.Fatalf("point %v outside simplex", x)
+			}
+			sum += v
+		}
+		if sum >= 1 {
+			t.Fatalf("point %v outside simplex", x)
+		}
+	}
+}
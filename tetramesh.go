@@ -131,7 +131,7 @@ func maketmesh(b Box, resolution float64) *tmesh {
 
 func (t *tmesh) meshTetraBCC(evaluator func(Vec) float64) (nodes []Vec, tetras [][4]int) {
 	n := 0
-	tetras = make([][4]int, len(t.matrix.nodes))
+	tetras = make([][4]int, 0, len(t.matrix.nodes))
 	t.matrix.foreach(func(_, _, _ int, node *tnode) {
 		bb := node.box()
 		vert := bb.Vertices()
@@ -18,6 +18,33 @@ type Vec struct {
 
 func (v Vec) lower() r2.Vec { return r2.Vec{X: v.X, Y: v.Y} }
 
+// component returns the X, Y or Z component of v for d equal to 0, 1 or 2.
+func (v Vec) component(d int) float64 {
+	switch d {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	case 2:
+		return v.Z
+	}
+	panic("bad dimension")
+}
+
+// setComponent sets the X, Y or Z component of v for d equal to 0, 1 or 2.
+func (v *Vec) setComponent(d int, f float64) {
+	switch d {
+	case 0:
+		v.X = f
+	case 1:
+		v.Y = f
+	case 2:
+		v.Z = f
+	default:
+		panic("bad dimension")
+	}
+}
+
 // Add returns the vector sum of p and q.
 func Add(p, q Vec) Vec {
 	return Vec{